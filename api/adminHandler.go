@@ -0,0 +1,225 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+type AdminHandler interface {
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type AdminHandlerOpts struct {
+	Core        repository.CoreRepository
+	Role        repository.RoleRepository
+	Log         repository.LogRepository
+	Firebase    service.FirebaseService
+	Permissions service.PermissionResolver
+}
+
+// Support tasks for platform operators, registered only with ADMIN_API_ENABLED=true. Group roles don't apply here:
+// an operator's uid must be listed in ADMIN_UIDS and flagged platformAdmin in the user table.
+type AdminHandlerImpl struct {
+	core        repository.CoreRepository
+	role        repository.RoleRepository
+	log         repository.LogRepository
+	firebase    service.FirebaseService
+	permissions service.PermissionResolver
+
+	admins map[string]bool
+}
+
+// Most users a search returns.
+const adminSearchLimit = 50
+
+func NewAdminHandler(opts *AdminHandlerOpts) *AdminHandlerImpl {
+	admins := make(map[string]bool)
+	for _, uid := range strings.Split(os.Getenv("ADMIN_UIDS"), ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			admins[uid] = true
+		}
+	}
+	return &AdminHandlerImpl{
+		core:        opts.Core,
+		role:        opts.Role,
+		log:         opts.Log,
+		firebase:    opts.Firebase,
+		permissions: opts.Permissions,
+		admins:      admins,
+	}
+}
+
+func (handler *AdminHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/api/admin", handler.requireAdmin)
+	admin.GET("/users", handler.audited("AdminSearchUsers", handler.searchUsers))
+	admin.GET("/user/:userId/groups", handler.audited("AdminListUserGroups", handler.userGroups))
+	admin.POST("/user/:userId/verify", handler.audited("AdminVerifyUser", handler.verifyUser))
+	admin.POST("/group/:id/owner", handler.audited("AdminReassignOwner", handler.reassignOwner))
+	admin.GET("/group/:id/logs", handler.audited("AdminViewLogs", handler.groupLogs))
+}
+
+// Lets only operators through. The token is verified with firebase again, bypassing the token cache and session
+// tokens, so a revoked operator is locked out right away. Internal services have no business here either.
+func (handler *AdminHandlerImpl) requireAdmin(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if c.GetBool("internal-service") || token == "" {
+		AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "operators only")
+		return
+	}
+	decodedToken, err := handler.firebase.VerifyTokenStrict(token)
+	if err != nil {
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_TOKEN_INVALID, "operators must sign in through firebase")
+		return
+	}
+	if !handler.admins[decodedToken.UID] {
+		log.Printf("admin API refused to %s, not in ADMIN_UIDS\n", decodedToken.UID)
+		AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "operators only")
+		return
+	}
+	isAdmin, err := handler.core.IsPlatformAdmin(c.Request.Context(), decodedToken.UID)
+	if err != nil {
+		abortInternal(c, "error checking platform admin", err)
+		return
+	}
+	if !isAdmin {
+		log.Printf("admin API refused to %s, not flagged platformAdmin\n", decodedToken.UID)
+		AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "operators only")
+		return
+	}
+	c.Set("userId", decodedToken.UID)
+	c.Next()
+}
+
+// Writes every admin request to the platform log once it's answered, and to the log of the group it concerns,
+// so the group can see what an operator did.
+func (handler *AdminHandlerImpl) audited(action string, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		next(c)
+		userId := c.GetString("userId")
+		entry := types.LogEntry{
+			Action:    action,
+			Status:    auditStatus(c),
+			UserId:    userId,
+			Email:     handler.permissions.UserEmail(userId),
+			Timestamp: time.Now().Format(time.RFC3339),
+			Detail:    auditDetail(c),
+		}
+		platform := entry
+		platform.GroupId = types.PLATFORM_LOG_ID
+		handler.log.NewEntry(&platform)
+		if groupId := c.Param("id"); groupId != "" && groupId != types.PLATFORM_LOG_ID {
+			group := entry
+			group.GroupId = groupId
+			handler.log.NewEntry(&group)
+		}
+	}
+}
+
+// Finds users by the start of their email, ?email= is required.
+func (handler *AdminHandlerImpl) searchUsers(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("email"))
+	if query == "" {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "email is required")
+		return
+	}
+	SetAuditDetail(c, map[string]any{"email": query})
+	users, err := handler.core.SearchUsersByEmail(c.Request.Context(), query, adminSearchLimit)
+	if err != nil {
+		abortInternal(c, "error searching users", err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// Lists the groups a user is a member of.
+func (handler *AdminHandlerImpl) userGroups(c *gin.Context) {
+	userId := c.Param("userId")
+	SetAuditDetail(c, map[string]any{"userId": userId})
+	if !handler.userExists(c, userId) {
+		return
+	}
+	groups, err := handler.core.OrganisationList(userId)
+	if err != nil {
+		abortInternal(c, "error reading user's groups", err)
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// Marks a user verified, e.g. when the verification mail never arrived.
+func (handler *AdminHandlerImpl) verifyUser(c *gin.Context) {
+	userId := c.Param("userId")
+	SetAuditDetail(c, map[string]any{"userId": userId})
+	if !handler.userExists(c, userId) {
+		return
+	}
+	if err := handler.core.VerifyUser(userId); err != nil {
+		abortInternal(c, "error verifying user", err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// Makes a member the group's only owner, e.g. when the owner left the company.
+func (handler *AdminHandlerImpl) reassignOwner(c *gin.Context) {
+	var body types.ReassignOwnerBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	groupId := c.Param("id")
+	var previous []string
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		var err error
+		previous, err = handler.role.ReassignGroupOwnerWithTx(tx, groupId, body.UserId)
+		return err
+	})
+	SetAuditDetail(c, map[string]any{"userId": body.UserId, "previousOwners": previous})
+	if err != nil {
+		log.Printf("error reassigning owner of group %s: %+v\n", groupId, err)
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		case errors.Is(err, types.ErrForbiddenOperation):
+			AbortWithError(c, http.StatusForbidden, types.CODE_NOT_A_MEMBER, "user is not a member of the group")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
+		return
+	}
+	handler.permissions.InvalidateGroup(groupId)
+	c.JSON(http.StatusOK, gin.H{"previousOwners": previous})
+}
+
+// Reads any group's log, or the platform log with the id "platform".
+func (handler *AdminHandlerImpl) groupLogs(c *gin.Context) {
+	logs, err := handler.log.ReadByGroupId(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortInternal(c, "error reading group logs", err)
+		return
+	}
+	c.JSON(http.StatusOK, logs)
+}
+
+// Responds 404 USER_NOT_FOUND if there is no such user, returns whether the request may go on.
+func (handler *AdminHandlerImpl) userExists(c *gin.Context, userId string) bool {
+	if _, err := handler.core.ReadUserById(userId); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_USER_NOT_FOUND, "user not found")
+			return false
+		}
+		abortInternal(c, "error reading user", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/types"
+)
+
+// A fakeCore knowing which users are flagged platformAdmin.
+type fakeAdminCore struct {
+	*fakeCore
+	admins   map[string]bool
+	verified []string
+}
+
+func (fake *fakeAdminCore) IsPlatformAdmin(ctx context.Context, userId string) (bool, error) {
+	return fake.admins[userId], nil
+}
+
+func (fake *fakeAdminCore) VerifyUser(userId string) error {
+	fake.verified = append(fake.verified, userId)
+	return nil
+}
+
+// Only operators both listed in ADMIN_UIDS and flagged platformAdmin get in, and what they do is logged to the
+// platform log.
+func TestAdminAPIRequiresAnOperator(t *testing.T) {
+	t.Setenv("ADMIN_UIDS", "operator, unflagged")
+	store := newFakeMemberships()
+	core := &fakeAdminCore{fakeCore: &fakeCore{store: store}, admins: map[string]bool{"operator": true, "unlisted": true}}
+	core.addUser("user", "user@example.com")
+	entries := &fakeLog{}
+	handler := NewAdminHandler(&AdminHandlerOpts{Core: core, Log: entries, Firebase: firebasetest.NewFakeFirebaseService(&service.FirebaseServiceOpts{}),
+		Permissions: service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})})
+	router := gin.New()
+	handler.RegisterRoutes(&router.RouterGroup)
+
+	for _, tc := range []struct {
+		operator string
+		want     int
+	}{
+		{"", http.StatusForbidden},
+		{"unflagged", http.StatusForbidden},
+		{"unlisted", http.StatusForbidden},
+		{"operator", http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/api/admin/user/user/verify", nil)
+		if tc.operator != "" {
+			request.Header.Set("Authorization", "Bearer "+tc.operator)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != tc.want {
+			t.Errorf("%q got %d, want %d", tc.operator, recorder.Code, tc.want)
+		}
+	}
+	if len(core.verified) != 1 {
+		t.Errorf("verified %v, want the user verified once", core.verified)
+	}
+	if len(entries.entries) != 1 || entries.entries[0].GroupId != types.PLATFORM_LOG_ID || entries.entries[0].UserId != "operator" {
+		t.Errorf("logged %+v, want the operator's request in the platform log", entries.entries)
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+const (
+	// How often new log entries are checked against the alert rules.
+	alertScanInterval = time.Minute * 5
+	// Entries are queued before they're written, so the latest of them are left for the next scan.
+	alertScanDelay = time.Minute
+	// A scan catching up after every instance was down looks at most this far back.
+	maxAlertScanCatchUp = time.Hour * 24
+)
+
+// Checks the log against the alert rules periodically. Every instance runs this, the stretch of the log
+// a scan covers is claimed first so only one of them scans it.
+func (handler *LogHandlerImpl) alertWorker() {
+	ticker := time.NewTicker(alertScanInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		handler.scanAlerts(context.Background())
+	}
+}
+
+// Writes an alert entry for everything the rules find in the entries written since the last scan,
+// mailing group owners too with ALERT_EMAILS=true.
+func (handler *LogHandlerImpl) scanAlerts(ctx context.Context) {
+	until := time.Now().Add(-alertScanDelay).Truncate(time.Second)
+	from, claimed, err := handler.log.ClaimScan(ctx, "alerts", until)
+	if err != nil {
+		log.Printf("error claiming alert scan: %+v\n", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	if until.Sub(from) > maxAlertScanCatchUp {
+		from = until.Add(-maxAlertScanCatchUp)
+	}
+	// from further back, so entries just before from count towards alerts raised after it
+	entries, err := handler.log.ReadEntriesBetween(ctx, from.Add(-service.AlertLookback(handler.alertRules)), until)
+	if err != nil {
+		// the stretch is claimed, so it goes unscanned rather than being scanned twice
+		log.Printf("error reading log entries to scan for alerts: %+v\n", err)
+		return
+	}
+	for _, alert := range service.EvaluateAlertRules(handler.alertRules, entries, from) {
+		log.Printf("alert %s in group %s\n", alert.Rule, alert.GroupId)
+		handler.log.NewEntry(alertEntry(alert))
+		if !handler.alertEmails {
+			continue
+		}
+		// a group failing to be mailed doesn't keep the others' owners from being mailed
+		if err := handler.mailAlert(ctx, alert); err != nil {
+			log.Printf("error mailing alert %s of group %s: %+v\n", alert.Rule, alert.GroupId, err)
+		}
+	}
+}
+
+// The log entry an alert is written as, the rule being its action.
+func alertEntry(alert *types.Alert) *types.LogEntry {
+	detail := map[string]any{"at": alert.At.Format(time.RFC3339)}
+	if alert.Count > 0 {
+		detail["count"] = alert.Count
+		detail["window"] = alert.Window.String()
+	}
+	raw, _ := json.Marshal(detail)
+	return &types.LogEntry{
+		GroupId:   alert.GroupId,
+		Action:    alert.Rule,
+		Status:    types.LOG_STATUS_ALERT,
+		UserId:    alert.UserId,
+		Email:     alert.Email,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Detail:    raw,
+	}
+}
+
+// Mails the alert to the group's owners.
+func (handler *LogHandlerImpl) mailAlert(ctx context.Context, alert *types.Alert) error {
+	group, err := handler.core.ReadGroup(ctx, alert.GroupId)
+	if err != nil {
+		return err
+	}
+	members, err := handler.core.ReadOrganisationMembers(alert.GroupId)
+	if err != nil {
+		return err
+	}
+	data := &types.AlertMailData{
+		Group:  group.Name,
+		Rule:   alert.Rule,
+		Email:  alert.Email,
+		At:     alert.At.UTC().Format("2006-01-02 15:04 MST"),
+		Count:  alert.Count,
+		Window: alert.Window.String(),
+		Link:   handler.portal_domain,
+	}
+	for _, member := range members {
+		if member.Disabled || !hasRole(member, "Group Owner") {
+			continue
+		}
+		user, err := handler.permissions.User(member.Id)
+		if err != nil {
+			log.Printf("error reading user %s: %+v\n", member.Id, err)
+			continue
+		}
+		message, err := handler.email.CreateSecurityAlert(user.Email, user.Locale, data)
+		if err != nil {
+			return err
+		}
+		handler.email.Enqueue(message)
+	}
+	return nil
+}
+
+func hasRole(member *types.OrganisationMember, name string) bool {
+	for _, role := range member.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,15 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/types"
@@ -12,46 +18,145 @@ import (
 )
 
 type API interface {
-	Run()
+	// Configures the router with every middleware and route, without binding a port, e.g. for httptest.
+	// Only the first call configures it, later ones return the same engine.
+	Build() *gin.Engine
+	// Builds the router and serves it on addr, e.g. ":8080", blocking until the server fails.
+	Serve(addr string) error
 }
 
 type API_opts struct {
 	Handlers []types.Handler
+	// Optional, recovered panics are only logged without it.
+	Reporter ErrorReporter
+	// Optional, dependencies checked by /readyz keyed by name, e.g. "email".
+	ReadinessChecks map[string]func(ctx context.Context) error
 }
 
 type API_impl struct {
 	router   *gin.Engine
 	handlers []types.Handler
+	reporter ErrorReporter
+	build    sync.Once
+
+	maintenance           atomic.Bool
+	maintenanceRetryAfter int
+
+	readiness *readiness
 }
 
 func NewAPI(opts *API_opts) *API_impl {
 	//gin.SetMode(gin.ReleaseMode) or GIN_MODE=release
-	return &API_impl{
-		router:   gin.Default(),
+	h := &API_impl{
+		router:   gin.New(),
 		handlers: opts.Handlers,
+		reporter: opts.Reporter,
+		readiness: &readiness{
+			checks: opts.ReadinessChecks,
+		},
 	}
+	h.trustProxies()
+	h.router.Use(requestId, clientIP, gin.Logger(), h.recovery)
+	h.initMaintenance()
+	return h
 }
 
+// Prefix of the current API version, routes are registered as e.g. /v1/api/user/login.
+const apiVersionPrefix = "/v1"
+
+// Registers every route under the version prefix, and once more without it as a deprecated alias,
+// so clients can move over before the unprefixed paths are removed.
 func (h *API_impl) registerRoutes() {
+	versioned := h.router.Group(apiVersionPrefix)
+	unversioned := h.router.Group("", deprecatedAlias)
 	for _, handler := range h.handlers {
-		handler.RegisterRoutes(h.router)
+		handler.RegisterRoutes(versioned)
+		handler.RegisterRoutes(unversioned)
+	}
+	// after the handlers, so the authentication middleware applies
+	versioned.POST("/api/internal/maintenance", requireInternalService, h.setMaintenance)
+	unversioned.POST("/api/internal/maintenance", requireInternalService, h.setMaintenance)
+	// unversioned only, these are for the load balancer rather than clients
+	h.router.GET("/healthz", h.healthz)
+	h.router.GET("/readyz", h.readyz)
+
+	// unknown paths and methods answer with the error envelope rather than gin's plain text
+	h.router.HandleMethodNotAllowed = true
+	h.router.NoRoute(noRoute)
+	h.router.NoMethod(noMethod(h.router.Routes()))
+}
+
+func noRoute(c *gin.Context) {
+	AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "no such route")
+}
+
+// Answers 405 for a path registered with other methods, listing them in Allow and in the error details.
+func noMethod(routes gin.RoutesInfo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := make([]string, 0)
+		for _, route := range routes {
+			if matchesRoute(route.Path, c.Request.URL.Path) && !slices.Contains(allowed, route.Method) {
+				allowed = append(allowed, route.Method)
+			}
+		}
+		sort.Strings(allowed)
+		c.Header("Allow", strings.Join(allowed, ", "))
+		AbortWithErrorDetails(c, http.StatusMethodNotAllowed, types.CODE_METHOD_NOT_ALLOWED, "method not allowed", gin.H{"allowed": allowed})
+	}
+}
+
+// Whether a path matches a gin route template, e.g. /api/group/abc and /api/group/:id.
+func matchesRoute(template string, path string) bool {
+	templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+		if i >= len(pathSegments) || (!strings.HasPrefix(segment, ":") && segment != pathSegments[i]) {
+			return false
+		}
+	}
+	return len(templateSegments) == len(pathSegments)
+}
+
+// Marks responses to unprefixed paths as deprecated, pointing at the versioned path.
+func deprecatedAlias(c *gin.Context) {
+	c.Header("Deprecation", "true")
+	c.Header("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", apiVersionPrefix, c.Request.URL.Path))
+	c.Header("Warning", fmt.Sprintf("299 - \"unversioned paths are deprecated, use %s%s\"", apiVersionPrefix, c.Request.URL.Path))
+}
+
+// Strips the version prefix from a path or route template, so both spellings of a route are treated the same,
+// e.g. in the permission map and the list of paths exempt from authentication.
+func canonicalPath(path string) string {
+	if trimmed := strings.TrimPrefix(path, apiVersionPrefix); strings.HasPrefix(trimmed, "/") {
+		return trimmed
 	}
+	return path
 }
 
 func (h *API_impl) cors() {
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
-	config.AllowMethods = []string{"GET", "POST", "PATCH", "DELETE"}
-	config.AllowHeaders = []string{"Authorization", "Content-Type"}
+	config.AllowMethods = []string{"GET", "HEAD", "POST", "PATCH", "DELETE"}
+	config.AllowHeaders = []string{"Authorization", "Content-Type", "API-Version", requestIdHeader}
+	config.ExposeHeaders = []string{"Deprecation", "Link", "Warning", requestIdHeader}
 	h.router.Use(cors.New(config))
 }
 
-func (h *API_impl) Run() {
-	h.cors()
-	h.registerRoutes()
-	log.Printf("starting api on port %s...", os.Getenv("PORT"))
-	err := http.ListenAndServe(":"+os.Getenv("PORT"), h.router)
-	if err != nil {
-		panic(err)
-	}
+func (h *API_impl) Build() *gin.Engine {
+	h.build.Do(func() {
+		h.cors()
+		// after cors, so browsers can read the 503
+		h.router.Use(h.rejectDuringMaintenance)
+		h.registerRoutes()
+	})
+	return h.router
+}
+
+func (h *API_impl) Serve(addr string) error {
+	router := h.Build()
+	log.Printf("starting api on %s...", addr)
+	return http.ListenAndServe(addr, router)
 }
@@ -0,0 +1,736 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"user.service.altiore.io/api/openapi"
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/types"
+)
+
+const testGroupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+
+// The core repository over fakeMemberships. Transactions run their callback with a nil tx, which the fake's
+// WithTx methods ignore. Methods a test doesn't need aren't implemented and panic, which the recovery middleware
+// answers with a 500. Reads fail with err when it's set.
+type fakeCore struct {
+	repository.CoreRepository
+	store *fakeMemberships
+	err   error
+	// Optional, called as a method of a transaction starts, failing it with the error returned. E.g. to make
+	// concurrent requests overlap, or a signup fail after the user was created.
+	before func(method string) error
+
+	mu          sync.Mutex
+	users       map[string]*types.User       // by id, written as the transaction creating them commits
+	pending     map[*sql.Tx][]func()         // writes of transactions yet to commit
+	invitations map[string]*types.Invitation // by the token of their link
+	joins       int                          // memberships added
+	deleted     map[string]bool              // groups deleted, which read as not found
+	owned       map[string]string            // group id by owner and lower-cased name, of the groups created
+	created     map[string][]time.Time       // when each user created their groups, newest first
+}
+
+func (fake *fakeCore) hold(method string) error {
+	if fake.before != nil {
+		return fake.before(method)
+	}
+	return nil
+}
+
+func (fake *fakeCore) WithTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return fake.WithTransactionOpts(ctx, nil, fn)
+}
+
+func (fake *fakeCore) WithReadTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return fake.WithTransactionOpts(ctx, &sql.TxOptions{ReadOnly: true}, fn)
+}
+
+// Runs the callback with a transaction only the fake's methods tell apart, applying its pending writes if it succeeds.
+func (fake *fakeCore) WithTransactionOpts(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx := &sql.Tx{}
+	err := fn(tx)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if err == nil {
+		for _, write := range fake.pending[tx] {
+			write()
+		}
+	}
+	delete(fake.pending, tx)
+	return err
+}
+
+// Applies a write as the transaction commits, called with fake.mu held.
+func (fake *fakeCore) write(tx *sql.Tx, write func()) {
+	if tx == nil {
+		write()
+		return
+	}
+	if fake.pending == nil {
+		fake.pending = make(map[*sql.Tx][]func())
+	}
+	fake.pending[tx] = append(fake.pending[tx], write)
+}
+
+// Adds a user directly, as if they had signed up.
+func (fake *fakeCore) addUser(userId string, email string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.users == nil {
+		fake.users = make(map[string]*types.User)
+	}
+	fake.users[userId] = &types.User{Id: userId, Email: email}
+}
+
+func (fake *fakeCore) UserExists(uid string) error {
+	_, err := fake.ReadUserById(uid)
+	return err
+}
+
+func (fake *fakeCore) ReadUserById(userId string) (*types.User, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	user, exists := fake.users[userId]
+	if !exists {
+		return nil, fmt.Errorf("%w: user %s", types.ErrNotFound, userId)
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (fake *fakeCore) ReadUserByEmail(email string) (*types.User, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, user := range fake.users {
+		if user.Email == email {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: user with email %s", types.ErrNotFound, email)
+}
+
+// Fails like the user table's unique keys for a taken id or address.
+func (fake *fakeCore) CreateUserWithTx(tx *sql.Tx, userId string, email string, password string, locale string) error {
+	if err := fake.hold("CreateUserWithTx"); err != nil {
+		return err
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, user := range fake.users {
+		if user.Id == userId || user.Email == email {
+			return fmt.Errorf("%w: key user.email", types.ErrDuplicate)
+		}
+	}
+	fake.write(tx, func() {
+		if fake.users == nil {
+			fake.users = make(map[string]*types.User)
+		}
+		fake.users[userId] = &types.User{Id: userId, Email: email}
+	})
+	return nil
+}
+
+// Adds the user to a new group of their own if they aren't a member of any.
+func (fake *fakeCore) EnsureDefaultGroupWithTx(tx *sql.Tx, userId string) error {
+	if err := fake.hold("EnsureDefaultGroupWithTx"); err != nil {
+		return err
+	}
+	fake.store.mu.Lock()
+	defer fake.store.mu.Unlock()
+	for key, isMember := range fake.store.members {
+		if member, _, _ := strings.Cut(key, " "); member == userId && isMember {
+			return nil
+		}
+	}
+	fake.store.members[userId+" "+uuid.NewString()] = true
+	return nil
+}
+
+func (fake *fakeCore) FindOwnedGroupByNameWithTx(tx *sql.Tx, userId string, name string) (string, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if groupId, exists := fake.owned[userId+"/"+strings.ToLower(name)]; exists {
+		return groupId, nil
+	}
+	return "", fmt.Errorf("%w: group %s", types.ErrNotFound, name)
+}
+
+func (fake *fakeCore) ReadGroupCreationLimit(ctx context.Context, userId string) (*int, bool, error) {
+	return nil, false, nil
+}
+
+func (fake *fakeCore) RecentGroupCreationsWithTx(tx *sql.Tx, userId string, since time.Time, limit int) ([]time.Time, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	recent := make([]time.Time, 0)
+	for _, createdAt := range fake.created[userId] {
+		if createdAt.Before(since) || len(recent) == limit {
+			break
+		}
+		recent = append(recent, createdAt)
+	}
+	return recent, nil
+}
+
+// Adds the user to a new group, which is returned like the repository returns it.
+func (fake *fakeCore) CreateOrganisationWithTx(tx *sql.Tx, name string, userId string) (*types.Organisation, error) {
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	group := &types.Organisation{Id: uuid.NewString(), Name: name, Slug: types.Slugify(name), MemberCount: 1,
+		CreatedBy: &types.GroupCreator{UserId: userId}, CreatedAt: &createdAt}
+	fake.store.set(userId, group.Id, true)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.write(tx, func() {
+		if fake.owned == nil {
+			fake.owned = make(map[string]string)
+		}
+		fake.owned[userId+"/"+strings.ToLower(name)] = group.Id
+		if fake.created == nil {
+			fake.created = make(map[string][]time.Time)
+		}
+		fake.created[userId] = append([]time.Time{createdAt}, fake.created[userId]...)
+	})
+	return group, nil
+}
+
+func (fake *fakeCore) IsMember(ctx context.Context, userId string, groupId string) (bool, error) {
+	return fake.store.IsMember(ctx, userId, groupId)
+}
+
+func (fake *fakeCore) IsMemberWithTx(tx *sql.Tx, userId string, groupId string) (bool, error) {
+	return fake.store.IsMember(context.Background(), userId, groupId)
+}
+
+// Fails like the unique key on organisation_user for a user who already is a member.
+func (fake *fakeCore) AddUserToOrganisationWithTx(tx *sql.Tx, userId string, groupId string) error {
+	if err := fake.hold("AddUserToOrganisationWithTx"); err != nil {
+		return err
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if isMember, _ := fake.store.IsMember(context.Background(), userId, groupId); isMember {
+		return fmt.Errorf("%w: key organisation_user.userId_organisationId", types.ErrDuplicate)
+	}
+	fake.store.set(userId, groupId, true)
+	fake.joins++
+	return nil
+}
+
+func (fake *fakeCore) ReadGroup(ctx context.Context, groupId string) (*types.Organisation, error) {
+	return fake.ReadGroupWithTx(nil, groupId)
+}
+
+func (fake *fakeCore) ReadGroupWithTx(tx *sql.Tx, groupId string) (*types.Organisation, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.deleted[groupId] {
+		return nil, fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+	}
+	return &types.Organisation{Id: groupId, Name: "Group"}, nil
+}
+
+// Creates the user unless they exist, like CreateUserWithTx.
+func (fake *fakeCore) EnsureUserWithTx(tx *sql.Tx, userId string, email string) (bool, error) {
+	if _, err := fake.ReadUserById(userId); err == nil {
+		return false, nil
+	}
+	return true, fake.CreateUserWithTx(tx, userId, email, "", types.DEFAULT_LOCALE)
+}
+
+// Adds an invitation for the user to the group, returning the token of its link.
+func (fake *fakeCore) invite(userId string, email string, groupId string) string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.invitations == nil {
+		fake.invitations = make(map[string]*types.Invitation)
+	}
+	token := uuid.NewString()
+	fake.invitations[token] = &types.Invitation{Id: uuid.NewString(), UserId: userId, Email: email, GroupId: groupId}
+	return token
+}
+
+// Stores the address as given, unlike the repository, so an address the handlers didn't normalise won't match later.
+func (fake *fakeCore) CreateInvitation(userId string, email string, groupId string, invitedBy string) (*types.Invitation, string, error) {
+	token := fake.invite(userId, email, groupId)
+	invitation, err := fake.LookupInvitation(token)
+	return invitation, token, err
+}
+
+func (fake *fakeCore) LookupInvitation(token string) (*types.Invitation, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	invitation, exists := fake.invitations[token]
+	if !exists {
+		return nil, types.ErrInvitationNotFound
+	}
+	copied := *invitation
+	return &copied, nil
+}
+
+func (fake *fakeCore) ReadInvitation(ctx context.Context, id string) (*types.Invitation, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, invitation := range fake.invitations {
+		if invitation.Id == id {
+			copied := *invitation
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: invitation %s", types.ErrInvitationNotFound, id)
+}
+
+func (fake *fakeCore) ReadGroupInvitation(ctx context.Context, groupId string, id string) (*types.Invitation, error) {
+	invitation, err := fake.ReadInvitation(ctx, id)
+	if err != nil || invitation.GroupId != groupId {
+		return nil, fmt.Errorf("%w: invitation %s", types.ErrNotFound, id)
+	}
+	return invitation, nil
+}
+
+func (fake *fakeCore) DeleteInvitation(id string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for token, invitation := range fake.invitations {
+		if invitation.Id == id {
+			delete(fake.invitations, token)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invitation %s", types.ErrInvitationNotFound, id)
+}
+
+func (fake *fakeCore) DeleteInvitationWithTx(tx *sql.Tx, id string) error {
+	return fake.DeleteInvitation(id)
+}
+
+func (fake *fakeCore) OrganisationList(userId string) ([]*types.Organisation, error) {
+	return []*types.Organisation{}, fake.err
+}
+
+func (fake *fakeCore) ReadServices(includeRetired bool) ([]*types.Service, error) {
+	return []*types.Service{}, fake.err
+}
+
+func (fake *fakeCore) ReadGroupInvitations(groupId string) ([]*types.Invitation, error) {
+	return []*types.Invitation{}, fake.err
+}
+
+func (fake *fakeCore) ReadServiceUsageWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUsage, error) {
+	return []*types.ServiceUsage{}, fake.err
+}
+
+func (fake *fakeCore) ReadServiceUsesWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUse, error) {
+	return []*types.ServiceUse{}, fake.err
+}
+
+func (fake *fakeCore) ReadOrganisationMembersWithTx(tx *sql.Tx, id string) ([]*types.OrganisationMember, error) {
+	return []*types.OrganisationMember{}, fake.err
+}
+
+func (fake *fakeCore) ReadNotificationPreferences(ctx context.Context, userId string) (*types.NotificationPreferences, error) {
+	return &types.NotificationPreferences{}, fake.err
+}
+
+// The role repository over fakeMemberships for the roles members hold, with the roles groups define kept apart.
+// Reads fail with err when it's set.
+type fakeRoles struct {
+	repository.RoleRepository
+	store *fakeMemberships
+	err   error
+
+	mu      sync.Mutex
+	defined map[string][]*types.Role // by group
+}
+
+func (fake *fakeRoles) ReadRoles(groupId string) ([]*types.Role, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]*types.Role{}, fake.defined[groupId]...), fake.err
+}
+
+// Creates the roles whose name the group doesn't have yet, ignoring case like the repository.
+func (fake *fakeRoles) CreateRolesWithTx(tx *sql.Tx, groupId string, roles []*types.RoleConfig) ([]string, []string, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.defined == nil {
+		fake.defined = make(map[string][]*types.Role)
+	}
+	created, skipped := make([]string, 0), make([]string, 0)
+	for _, config := range roles {
+		if slices.ContainsFunc(fake.defined[groupId], func(role *types.Role) bool { return strings.EqualFold(role.Name, config.Name) }) {
+			skipped = append(skipped, config.Name)
+			continue
+		}
+		fake.defined[groupId] = append(fake.defined[groupId], &types.Role{Id: uuid.NewString(), Name: config.Name, GroupId: groupId, Permissions: config.Permissions})
+		created = append(created, config.Name)
+	}
+	return created, skipped, nil
+}
+
+func (fake *fakeRoles) GetMembersWithRoles(groupId string) ([]*types.MemberRole, error) {
+	return []*types.MemberRole{}, fake.err
+}
+
+func (fake *fakeRoles) HasPermission(tx *sql.Tx, userId string, groupId string, permission string) error {
+	info, exists := types.LookupPermission(permission)
+	if !exists {
+		return fmt.Errorf("%w: %s", types.ErrUnknownPermission, permission)
+	}
+	roles, err := fake.store.ReadMemberRoles(userId, groupId)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(roles, func(role *types.Role) bool { return info.Granted(&role.Permissions) }) {
+		return fmt.Errorf("%w: missing permission %s", types.ErrForbiddenOperation, permission)
+	}
+	return nil
+}
+
+func (fake *fakeRoles) ReadMemberRoles(userId string, groupId string) ([]*types.Role, error) {
+	return fake.store.ReadMemberRoles(userId, groupId)
+}
+
+// The email service, recording the group names the invitation and removal mails it creates show.
+type recordingEmail struct {
+	service.EmailService
+	mu     sync.Mutex
+	groups []string
+}
+
+func (email *recordingEmail) record(group string) {
+	email.mu.Lock()
+	defer email.mu.Unlock()
+	email.groups = append(email.groups, group)
+}
+
+func (email *recordingEmail) CreateInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error) {
+	email.record(data.Group)
+	return email.EmailService.CreateInvitationMail(to, locale, data)
+}
+
+func (email *recordingEmail) CreateSignupAndInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error) {
+	email.record(data.Group)
+	return email.EmailService.CreateSignupAndInvitationMail(to, locale, data)
+}
+
+func (email *recordingEmail) CreateRemovedFromGroup(to string, locale string, data *types.RemovedFromGroupMailData) (*types.EmailMessage, error) {
+	email.record(data.Group)
+	return email.EmailService.CreateRemovedFromGroup(to, locale, data)
+}
+
+// The whole API as main.go wires it, over fakes. Firebase is the in-memory fake, so a user's bearer token is their id.
+type testAPI struct {
+	router   *gin.Engine
+	api      *API_impl
+	store    *fakeMemberships
+	core     *fakeCore
+	roles    *fakeRoles
+	log      *fakeLog
+	firebase *firebasetest.FakeFirebaseService
+	mails    *recordingEmail
+	resolver *service.PermissionResolverImpl
+	token    service.TokenService
+}
+
+func newTestAPI(t testing.TB) *testAPI {
+	t.Helper()
+	// signs the tokens of internal requests
+	t.Setenv("SERVICE_TOKEN_SECRET", "test-secret")
+	email, err := service.NewEmailService(&service.EmailServiceOpts{Provider: &service.NoopEmailProvider{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeMemberships()
+	a := &testAPI{
+		store:    store,
+		core:     &fakeCore{store: store},
+		roles:    &fakeRoles{store: store},
+		log:      &fakeLog{},
+		firebase: firebasetest.NewFakeFirebaseService(&service.FirebaseServiceOpts{Email: email}),
+		mails:    &recordingEmail{EmailService: email},
+		resolver: service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store}),
+		token:    service.NewTokenService(nil),
+	}
+	var (
+		webhook = service.NewWebhookService(&service.WebhookServiceOpts{})
+		limiter = service.NewRateLimiter(&service.RateLimiterOpts{})
+	)
+	a.api = NewAPI(&API_opts{Handlers: []types.Handler{
+		NewMiddlewareHandler(&MiddlewareHandlerOpts{Core: a.core, Role: a.roles, Log: a.log, Firebase: a.firebase, Token: a.token, Permissions: a.resolver}),
+		NewUserHandler(&UserHandlerOpts{Core: a.core, Firebase: a.firebase, Email: a.mails, Events: service.NewEventPublisher(&service.EventPublisherOpts{}),
+			Log: a.log, Limiter: limiter, Webhook: webhook, Token: a.token}),
+		NewServiceHandler(&ServiceHandlerOpts{Core: a.core}),
+		NewGroupHandler(&GroupHandlerOpts{Core: a.core, Role: a.roles, Firebase: a.firebase, Email: a.mails,
+			Case: service.NewCaseService(&service.CaseServiceOpts{Token: a.token}), Webhook: webhook, Limiter: limiter, Token: a.token, Log: a.log, Permissions: a.resolver}),
+		NewTokenHandler(&TokenHandlerOpts{Core: a.core, Firebase: a.firebase, Token: a.token}),
+		NewLogHandler(&LogHandlerOpts{Log: a.log, Role: a.roles, Core: a.core, Email: a.mails, Permissions: a.resolver}),
+		NewInternalHandler(&InternalHandlerOpts{Core: a.core, Role: a.roles, Log: a.log, Firebase: a.firebase, Permissions: a.resolver, Webhook: webhook, Token: a.token}),
+		NewDocsHandler(&DocsHandlerOpts{Version: "test"}),
+	}})
+	a.router = a.api.Build()
+	return a
+}
+
+// Adds the user to the group with a role granting every permission.
+func (a *testAPI) owner(userId string, groupId string) {
+	a.store.set(userId, groupId, true)
+	owner := &types.Role{Name: "Group Owner", GroupId: groupId}
+	for _, permission := range types.PermissionCatalogue {
+		*permission.Field(&owner.Permissions) = true
+	}
+	a.store.mu.Lock()
+	a.store.roles[userId+" "+groupId] = []*types.Role{owner}
+	a.store.mu.Unlock()
+	a.firebase.AddUser(&firebasetest.User{UID: userId, Email: userId + "@example.com"})
+	a.core.addUser(userId, userId+"@example.com")
+}
+
+// Sends a request as the user, anonymously if userId is empty. A non-nil body is sent as JSON.
+func (a *testAPI) do(method string, path string, userId string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		raw, _ := json.Marshal(body)
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if userId != "" {
+		request.Header.Set("Authorization", "Bearer "+userId)
+	}
+	recorder := httptest.NewRecorder()
+	a.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Sends a request as an internal service. A non-nil body is sent as JSON.
+func (a *testAPI) doInternal(method string, path string, body any) *httptest.ResponseRecorder {
+	token, err := a.token.NewToken("user-service")
+	if err != nil {
+		panic(err)
+	}
+	var raw []byte
+	if body != nil {
+		raw, _ = json.Marshal(body)
+	}
+	request := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Internal-Token", token)
+	recorder := httptest.NewRecorder()
+	a.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// The error envelope of a response, nil if it has none.
+func responseError(recorder *httptest.ResponseRecorder) *types.APIError {
+	var body struct {
+		Error *types.APIError `json:"error"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body.Error
+}
+
+// A failing database answers 500 INTERNAL with a generic message, never the driver's error, which names hosts,
+// users and schema.
+func TestDatabaseErrorsStayOutOfResponses(t *testing.T) {
+	const raw = "Error 1045 (28000): Access denied for user 'svc'@'10.0.0.5' to table organisation_user"
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.core.err = errors.New(raw)
+	a.roles.err = errors.New(raw)
+	a.log.err = errors.New(raw)
+
+	for _, path := range []string{
+		"/v1/api/group/list",
+		"/v1/api/service/list",
+		"/v1/api/user/me/notifications",
+		"/v1/api/group/" + testGroupId + "/members",
+		"/v1/api/group/" + testGroupId + "/invitations",
+		"/v1/api/group/" + testGroupId + "/role/defined_roles",
+		"/v1/api/group/" + testGroupId + "/role/member_roles",
+		"/v1/api/group/" + testGroupId + "/logs",
+		"/v1/api/group/" + testGroupId + "/logs/count",
+	} {
+		t.Run(path, func(t *testing.T) {
+			recorder := a.do(http.MethodGet, path, "owner", nil)
+			if recorder.Code != http.StatusInternalServerError {
+				t.Fatalf("got %d %s, want 500", recorder.Code, recorder.Body.String())
+			}
+			if apiErr := responseError(recorder); apiErr == nil || apiErr.Code != types.CODE_INTERNAL {
+				t.Errorf("got %s, want the %s error", recorder.Body.String(), types.CODE_INTERNAL)
+			}
+			for _, leak := range []string{"Access denied", "10.0.0.5", "organisation_user", "1045"} {
+				if strings.Contains(recorder.Body.String(), leak) {
+					t.Errorf("the response leaks %q: %s", leak, recorder.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// Fills the parameters of a route template, e.g. /api/group/:id/logs to /api/group/<testGroupId>/logs.
+func routePath(template string) string {
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == ":id" || segment == ":groupId":
+			segments[i] = testGroupId
+		case strings.HasPrefix(segment, ":"):
+			segments[i] = "x"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Every route answers under /v1 and at its deprecated unprefixed path alike, only the latter marked as deprecated.
+func TestRoutesAnswerWithAndWithoutThePrefix(t *testing.T) {
+	a := newTestAPI(t)
+	registered := make(map[string]bool)
+	for _, route := range a.router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for _, route := range a.router.Routes() {
+		canonical := canonicalPath(route.Path)
+		if canonical == "/healthz" || canonical == "/readyz" {
+			if canonical != route.Path {
+				t.Errorf("%s %s is versioned, the probes are for the load balancer only", route.Method, route.Path)
+			}
+			continue
+		}
+		if !registered[route.Method+" "+apiVersionPrefix+canonical] || !registered[route.Method+" "+canonical] {
+			t.Errorf("%s %s isn't registered both with and without %s", route.Method, canonical, apiVersionPrefix)
+			continue
+		}
+		if canonical == route.Path {
+			continue
+		}
+		t.Run(route.Method+" "+canonical, func(t *testing.T) {
+			versioned := a.do(route.Method, routePath(route.Path), "", nil)
+			unversioned := a.do(route.Method, routePath(canonical), "", nil)
+			for _, recorder := range []*httptest.ResponseRecorder{versioned, unversioned} {
+				if apiErr := responseError(recorder); apiErr != nil && (apiErr.Code == types.CODE_METHOD_NOT_ALLOWED || apiErr.Message == "no such route") {
+					t.Fatalf("the route didn't match: %d %s", recorder.Code, recorder.Body.String())
+				}
+			}
+			if versioned.Code != unversioned.Code {
+				t.Errorf("got %d with the prefix and %d without", versioned.Code, unversioned.Code)
+			}
+			if versionedErr, unversionedErr := responseError(versioned), responseError(unversioned); (versionedErr == nil) != (unversionedErr == nil) ||
+				(versionedErr != nil && versionedErr.Code != unversionedErr.Code) {
+				t.Errorf("got %s with the prefix and %s without", versioned.Body.String(), unversioned.Body.String())
+			}
+			if versioned.Header().Get("Deprecation") != "" {
+				t.Error("the versioned path is marked as deprecated")
+			}
+			if unversioned.Header().Get("Deprecation") != "true" || !strings.Contains(unversioned.Header().Get("Link"), "<"+apiVersionPrefix+routePath(canonical)+">") {
+				t.Errorf("the unprefixed path isn't marked as deprecated: %v", unversioned.Header())
+			}
+		})
+	}
+}
+
+// A known path with the wrong method and a misspelt path answer with the error envelope, not gin's plain text.
+func TestUnknownMethodsAndPathsAnswerWithJSON(t *testing.T) {
+	a := newTestAPI(t)
+	for _, path := range []string{"/v1/api/user/login", "/api/user/login"} {
+		recorder := a.do(http.MethodGet, path, "", nil)
+		apiErr := responseError(recorder)
+		if recorder.Code != http.StatusMethodNotAllowed || apiErr == nil || apiErr.Code != types.CODE_METHOD_NOT_ALLOWED {
+			t.Errorf("GET %s got %d %s, want 405 %s", path, recorder.Code, recorder.Body.String(), types.CODE_METHOD_NOT_ALLOWED)
+			continue
+		}
+		if allow := recorder.Header().Get("Allow"); allow != http.MethodPost {
+			t.Errorf("GET %s allows %q, want POST", path, allow)
+		}
+		if details, _ := json.Marshal(apiErr.Details); string(details) != `{"allowed":["POST"]}` {
+			t.Errorf("GET %s lists %s as allowed", path, details)
+		}
+	}
+	for _, path := range []string{"/v1/api/grup/list", "/api/usr/me", "/nothing"} {
+		recorder := a.do(http.MethodGet, path, "", nil)
+		if apiErr := responseError(recorder); recorder.Code != http.StatusNotFound || apiErr == nil || apiErr.Code != types.CODE_NOT_FOUND {
+			t.Errorf("GET %s got %d %s, want 404 %s", path, recorder.Code, recorder.Body.String(), types.CODE_NOT_FOUND)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Errorf("GET %s answered with %s", path, contentType)
+		}
+	}
+}
+
+// Every endpoint creating something answers 201 with the created resource and where to read it.
+func TestCreatedResourcesAreLocated(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		userId string
+		body   any
+		id     string // the field of the body naming the resource
+	}{
+		{"group", "/v1/api/group/create", "owner", map[string]string{"name": "Acme"}, "id"},
+		{"invitation", "/v1/api/group/member/invite", "owner", map[string]string{"email": "invitee@example.com", "groupId": testGroupId, "name": "Group"}, "id"},
+		{"email and password signup", "/v1/api/user/signup/email_password", "", &types.SignupEmailPasswordBody{UID: "new-user", Email: "new@example.com", Password: "password"}, "uid"},
+		{"provider signup", "/v1/api/user/signup", "", &types.SignupProviderBody{UID: "new-user", Email: "new@example.com"}, "uid"},
+		{"full signup", "/v1/api/user/signup/full", "", &types.SignupFullBody{Email: "new@example.com", Password: "Correct-Horse-7-battery", Name: "New"}, "uid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAPI(t)
+			a.owner("owner", testGroupId)
+
+			recorder := a.do(http.MethodPost, test.path, test.userId, test.body)
+			if recorder.Code != http.StatusCreated {
+				t.Fatalf("got %d %s, want 201", recorder.Code, recorder.Body.String())
+			}
+			var body map[string]any
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("the body isn't a JSON object: %s", recorder.Body.String())
+			}
+			id, _ := body[test.id].(string)
+			if id == "" {
+				t.Fatalf("the body %s has no %s", recorder.Body.String(), test.id)
+			}
+			location := recorder.Header().Get("Location")
+			if !strings.HasPrefix(location, apiVersionPrefix+"/") || !strings.Contains(location, "/"+id) {
+				t.Errorf("located at %q, want a versioned path with %s", location, id)
+			}
+			if !slices.ContainsFunc(a.router.Routes(), func(route gin.RouteInfo) bool {
+				return route.Method == http.MethodGet && matchesRoute(route.Path, location)
+			}) {
+				t.Errorf("nothing can be read at %s", location)
+			}
+		})
+	}
+}
+
+// The OpenAPI description can't drift from the router: every versioned route is described.
+func TestEveryRouteIsDescribed(t *testing.T) {
+	for _, route := range newTestAPI(t).router.Routes() {
+		if !strings.HasPrefix(route.Path, apiVersionPrefix+"/") {
+			continue
+		}
+		if !openapi.Describes(route.Method, canonicalPath(route.Path)) {
+			t.Errorf("route %s %s is missing from the OpenAPI description", route.Method, route.Path)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// How often groups due a weekly audit digest are looked for. Digests go out on the first run after
+// Monday 00:00 UTC, or once an instance is back up if none was running then.
+const auditDigestInterval = time.Hour
+
+// Mails last week's digest to every group with it turned on. Every instance runs this, a group's digest is
+// claimed before it's sent so only one of them sends it.
+func (handler *GroupHandlerImpl) auditDigestWorker() {
+	ticker := time.NewTicker(auditDigestInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		ctx := context.Background()
+		weekStart := auditDigestWeekStart(time.Now())
+		groupIds, err := handler.core.ReadAuditDigestGroups(ctx, weekStart)
+		if err != nil {
+			log.Printf("error reading groups due an audit digest: %+v\n", err)
+			continue
+		}
+		for _, groupId := range groupIds {
+			claimed, err := handler.core.ClaimAuditDigest(ctx, groupId, weekStart)
+			if err != nil {
+				log.Printf("error claiming audit digest of group %s: %+v\n", groupId, err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+			// the week is claimed, so a failing group misses this digest rather than stopping the others
+			if err := handler.sendAuditDigest(ctx, groupId, weekStart.AddDate(0, 0, -7), weekStart); err != nil {
+				log.Printf("error sending audit digest of group %s: %+v\n", groupId, err)
+			}
+		}
+	}
+}
+
+// Start of the week now is in, Monday 00:00 UTC.
+func auditDigestWeekStart(now time.Time) time.Time {
+	now = now.UTC()
+	daysSinceMonday := (int(now.Weekday()) + 6) % 7
+	return time.Date(now.Year(), now.Month(), now.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+}
+
+// Summarizes the group's log from the start of from to the start of to, and mails it to the members with ViewLogs.
+func (handler *GroupHandlerImpl) sendAuditDigest(ctx context.Context, groupId string, from time.Time, to time.Time) error {
+	group, err := handler.core.ReadGroup(ctx, groupId)
+	if err != nil {
+		return err
+	}
+	summary, err := handler.log.Summarize(ctx, groupId, from, to)
+	if err != nil {
+		return err
+	}
+	data := &types.AuditDigestMailData{
+		Group:   group.Name,
+		From:    from.Format(time.DateOnly),
+		To:      to.AddDate(0, 0, -1).Format(time.DateOnly),
+		Summary: summary,
+		Link:    handler.portal_domain,
+	}
+	for _, entry := range summary {
+		data.Total += entry.Count
+	}
+
+	members, err := handler.core.ReadOrganisationMembers(groupId)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Disabled {
+			continue
+		}
+		permissions, err := handler.permissions.MemberPermissions(member.Id, groupId)
+		if err != nil {
+			log.Printf("error reading permissions of %s in group %s: %+v\n", member.Id, groupId, err)
+			continue
+		}
+		if !permissions.ViewLogs {
+			continue
+		}
+		user, err := handler.permissions.User(member.Id)
+		if err != nil {
+			log.Printf("error reading user %s: %+v\n", member.Id, err)
+			continue
+		}
+		message, err := handler.email.CreateAuditDigest(user.Email, user.Locale, data)
+		if err != nil {
+			return err
+		}
+		handler.email.Enqueue(message)
+	}
+	return nil
+}
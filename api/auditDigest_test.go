@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+func TestAuditDigestWeekStart(t *testing.T) {
+	monday := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	for _, now := range []time.Time{
+		monday,
+		monday.Add(time.Hour * 13),
+		time.Date(2024, 1, 14, 23, 59, 0, 0, time.UTC),
+		// still Sunday in UTC
+		time.Date(2024, 1, 15, 0, 30, 0, 0, time.FixedZone("CET", 3600)),
+	} {
+		if weekStart := auditDigestWeekStart(now); !weekStart.Equal(monday) {
+			t.Errorf("the week of %v started %v, want %v", now, weekStart, monday)
+		}
+	}
+}
+
+type fakeDigestCore struct {
+	*fakeCore
+	members []*types.OrganisationMember
+}
+
+func (fake *fakeDigestCore) ReadOrganisationMembers(id string) ([]*types.OrganisationMember, error) {
+	return fake.members, nil
+}
+
+type fakeDigestLog struct {
+	*fakeLog
+	summary []*types.LogSummary
+}
+
+func (fake *fakeDigestLog) Summarize(ctx context.Context, groupId string, from time.Time, to time.Time) ([]*types.LogSummary, error) {
+	return fake.summary, nil
+}
+
+// Records the digests rendered, by recipient.
+type digestMails struct {
+	service.EmailService
+	mu   sync.Mutex
+	sent map[string]*types.AuditDigestMailData
+}
+
+func (email *digestMails) CreateAuditDigest(to string, locale string, data *types.AuditDigestMailData) (*types.EmailMessage, error) {
+	email.mu.Lock()
+	email.sent[to] = data
+	email.mu.Unlock()
+	return email.EmailService.CreateAuditDigest(to, locale, data)
+}
+
+// The digest goes to the enabled members holding ViewLogs only, and totals the week's entries.
+func TestAuditDigestGoesToMembersWithViewLogs(t *testing.T) {
+	store := newFakeMemberships()
+	auditor := &types.Role{Name: "Auditor", GroupId: testGroupId}
+	auditor.ViewLogs = true
+	for _, userId := range []string{"auditor", "disabled", "member"} {
+		store.set(userId, testGroupId, true)
+	}
+	store.roles["auditor "+testGroupId] = []*types.Role{auditor}
+	store.roles["disabled "+testGroupId] = []*types.Role{auditor}
+	email, err := service.NewEmailService(&service.EmailServiceOpts{Provider: &service.NoopEmailProvider{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := &digestMails{EmailService: email, sent: make(map[string]*types.AuditDigestMailData)}
+	handler := &GroupHandlerImpl{
+		core: &fakeDigestCore{fakeCore: &fakeCore{store: store}, members: []*types.OrganisationMember{
+			{Id: "auditor"}, {Id: "disabled", Disabled: true}, {Id: "member"},
+		}},
+		log: &fakeDigestLog{fakeLog: &fakeLog{}, summary: []*types.LogSummary{
+			{Action: types.INVITE_MEMBER, Status: "OK", Count: 2}, {Action: types.REMOVE_MEMBER, Status: "OK", Count: 1},
+		}},
+		email:       mails,
+		permissions: service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store}),
+	}
+
+	weekStart := auditDigestWeekStart(time.Now())
+	if err := handler.sendAuditDigest(context.Background(), testGroupId, weekStart.AddDate(0, 0, -7), weekStart); err != nil {
+		t.Fatal(err)
+	}
+	recipients := make([]string, 0)
+	for to := range mails.sent {
+		recipients = append(recipients, to)
+	}
+	if !slices.Equal(recipients, []string{"auditor@example.com"}) {
+		t.Fatalf("mailed %v, want the auditor only", recipients)
+	}
+	if data := mails.sent["auditor@example.com"]; data.Total != 3 || data.To != weekStart.AddDate(0, 0, -1).Format(time.DateOnly) {
+		t.Errorf("got %+v, want 3 entries up to the Sunday before %v", data, weekStart)
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/api/openapi"
+)
+
+type DocsHandler interface {
+	RegisterRoutes(*gin.RouterGroup)
+}
+
+type DocsHandlerOpts struct {
+	Version string
+}
+
+type DocsHandlerImpl struct {
+	document *openapi.Document
+}
+
+func NewDocsHandler(opts *DocsHandlerOpts) *DocsHandlerImpl {
+	return &DocsHandlerImpl{
+		document: openapi.Build(apiVersionPrefix, opts.Version),
+	}
+}
+
+func (handler *DocsHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/api/openapi.json", handler.openAPI)
+	router.GET("/api/docs", handler.docs)
+}
+
+// Serves the OpenAPI description of the API.
+func (handler *DocsHandlerImpl) openAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.document)
+}
+
+// Serves Swagger UI for the OpenAPI description, loaded from a CDN.
+func (handler *DocsHandlerImpl) docs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>User service API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>
+		SwaggerUIBundle({ url: "` + apiVersionPrefix + `/api/openapi.json", dom_id: "#swagger-ui" });
+	</script>
+</body>
+</html>`
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+// Responds with the error envelope and stops the handler chain.
+// The message is sent to the client, so it must never contain internal error text, log that instead.
+func AbortWithError(c *gin.Context, status int, code string, message string) {
+	AbortWithErrorDetails(c, status, code, message, nil)
+}
+
+// Same as AbortWithError, with details the client can act on, e.g. the ids a request got wrong.
+func AbortWithErrorDetails(c *gin.Context, status int, code string, message string, details any) {
+	c.AbortWithStatusJSON(status, gin.H{"error": &types.APIError{Code: code, Message: message, Details: details}})
+}
+
+// Responds to a request body or query that couldn't be bound. Validation messages only describe the request,
+// so they are safe to pass on as details.
+func abortInvalidRequest(c *gin.Context, err error) {
+	AbortWithErrorDetails(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "invalid request", err.Error())
+}
+
+// Logs err and responds with a generic internal error, keeping the details out of the response.
+func abortInternal(c *gin.Context, context string, err error) {
+	log.Printf("[%s] %s: %+v\n", c.GetString("requestId"), context, err)
+	AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+}
+
+// Picks between the status code a response had before status codes were normalised and the conventional one:
+// 401 for missing or invalid credentials, 403 for a known identity lacking permission and 404 only for missing resources.
+// The portal still relies on the legacy codes, so for one release the conventional ones are opt-in, per request with
+// the "API-Version: 2" header or for every request with API_STATUS_CODES=v2. The next release makes them the default.
+func versionedStatus(c *gin.Context, legacy int, conventional int) int {
+	if c.GetHeader("API-Version") == "2" || os.Getenv("API_STATUS_CODES") == "v2" {
+		return conventional
+	}
+	return legacy
+}
+
+// Takes a token for each policy and key pair, responding 429 with Retry-After if any of them ran out.
+// Internal services aren't limited. Returns whether the request may go on.
+func allowRequest(c *gin.Context, limiter service.RateLimiter, policyKeys ...string) bool {
+	if c.GetBool("internal-service") {
+		return true
+	}
+	var retryAfter time.Duration
+	for i := 0; i+1 < len(policyKeys); i += 2 {
+		if allowed, wait := limiter.Allow(policyKeys[i], policyKeys[i+1]); !allowed && wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter == 0 {
+		return true
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	AbortWithError(c, http.StatusTooManyRequests, types.CODE_RATE_LIMITED, "too many requests, try again later")
+	return false
+}
@@ -1,13 +1,24 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/repository"
@@ -16,7 +27,7 @@ import (
 )
 
 type GroupHandler interface {
-	RegisterRoutes(c *gin.Engine)
+	RegisterRoutes(c *gin.RouterGroup)
 }
 
 type GroupHandlerOpts struct {
@@ -24,41 +35,77 @@ type GroupHandlerOpts struct {
 	Role     repository.RoleRepository
 	Firebase service.FirebaseService
 	Email    service.EmailService
+	Case     service.CaseService
+	Webhook  service.WebhookService
+	Limiter  service.RateLimiter
+	Token    service.TokenService
+	// for the log entries of routes the middleware doesn't log
+	Log         repository.LogRepository
+	Permissions service.PermissionResolver
 }
 
 type GroupHandlerImpl struct {
 	core          repository.CoreRepository
 	role          repository.RoleRepository
-	case_         *service.CaseService
+	case_         service.CaseService
+	webhook       service.WebhookService
 	email         service.EmailService
 	firebase      service.FirebaseService
+	limiter       service.RateLimiter
+	token         service.TokenService
+	log           repository.LogRepository
+	permissions   service.PermissionResolver
 	domain        string
 	portal_domain string
+
+	// groups a user may create per 24 hours, unless they're allowed otherwise
+	groupCreationLimit int
+	// whether metadata updates must name the version they were made on, see UpdateGroupBody
+	requireGroupVersion bool
 }
 
 func NewGroupHandler(opts *GroupHandlerOpts) *GroupHandlerImpl {
-	return &GroupHandlerImpl{
+	h := &GroupHandlerImpl{
 		core:          opts.Core,
 		role:          opts.Role,
 		firebase:      opts.Firebase,
-		case_:         service.NewCaseService(),
+		case_:         opts.Case,
+		webhook:       opts.Webhook,
 		email:         opts.Email,
+		limiter:       opts.Limiter,
+		token:         opts.Token,
+		log:           opts.Log,
+		permissions:   opts.Permissions,
 		domain:        os.Getenv("DOMAIN"),
 		portal_domain: os.Getenv("PORTAL_DOMAIN"),
+
+		groupCreationLimit:  groupCreationDailyLimit(),
+		requireGroupVersion: os.Getenv("GROUP_VERSION_REQUIRED") == "true",
 	}
+	go h.purgeWorker()
+	go h.auditDigestWorker()
+	return h
 }
 
-func (handler *GroupHandlerImpl) RegisterRoutes(router *gin.Engine) {
+func (handler *GroupHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 
 	// steamline endpoints, so :groupId is present in the path were relevant / expected ..
 
 	router.POST("/api/group/create", handler.createOrganisation)
 	router.GET("/api/group/list", handler.organisationList)
+	router.GET("/api/group/permissions", handler.permissionCatalogue)
 	router.GET("/api/group/:id", handler.getGroup)
 	router.PATCH("/api/group/:id/update", handler.updateMetadata)
 	router.DELETE("/api/group/:id/delete", handler.deleteGroup)
 	router.GET("/api/group/:id/members", handler.members)
+	router.GET("/api/group/:id/my_permissions", handler.myPermissions)
+	router.GET("/api/group/:id/service_usage", handler.serviceUsage)
+	router.GET("/api/group/:id/usage", handler.usage)
 	router.POST("/api/group/member/invite", handler.inviteMember)
+	router.POST("/api/group/:id/member/invite_batch", handler.inviteMemberBatch)
+	router.GET("/api/group/:id/invitations", handler.invitations)
+	router.GET("/api/group/:id/invitation/:invitationId", handler.invitation)
+	router.DELETE("/api/group/:id/invitation/:invitationId", handler.revokeInvitation)
 	router.GET("/api/group/join", handler.joinGroup)
 	router.DELETE("/api/group/member/remove", handler.removeMember)
 
@@ -66,6 +113,8 @@ func (handler *GroupHandlerImpl) RegisterRoutes(router *gin.Engine) {
 	router.POST("/api/group/:id/role/update", handler.updateRoles)
 	router.POST("/api/group/:id/role/delete", handler.deleteRole)
 	router.GET("/api/group/:id/role/member_roles", handler.getMemberRoles)
+	router.GET("/api/group/:id/export_config", handler.exportConfig)
+	router.POST("/api/group/:id/import_config", handler.importConfig)
 
 	router.POST("/api/group/:id/member/add_role", handler.addMemberRole)
 	router.POST("/api/group/:id/member/remove_role", handler.removeMemberRole)
@@ -73,65 +122,127 @@ func (handler *GroupHandlerImpl) RegisterRoutes(router *gin.Engine) {
 	router.GET("/api/group/reject", handler.rejectGroup)
 }
 
+// Checks membership again within a transaction, so it shares a snapshot with the reads that follow it.
+// The groupMembership middleware has already turned non-members away, this closes the gap to a concurrent removal.
+// Non-members are reported as types.ErrNotFound.
+func (handler *GroupHandlerImpl) checkMemberWithTx(c *gin.Context, tx *sql.Tx) error {
+	if c.GetBool("internal-service") {
+		return nil
+	}
+	isMember, err := handler.core.IsMemberWithTx(tx, c.GetString("userId"), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return fmt.Errorf("%w: group %s", types.ErrNotFound, c.Param("id"))
+	}
+	return nil
+}
+
+// Get the catalogue of all known permissions.
+func (handler *GroupHandlerImpl) permissionCatalogue(c *gin.Context) {
+	c.JSON(http.StatusOK, types.PermissionCatalogue)
+}
+
+// Get the requesting user's aggregated permissions within the group.
+func (handler *GroupHandlerImpl) myPermissions(c *gin.Context) {
+	permissions, err := handler.permissions.MemberPermissions(c.GetString("userId"), c.Param("id"))
+	if err != nil {
+		abortInternal(c, "error reading member permissions", err)
+		return
+	}
+	c.JSON(http.StatusOK, permissions)
+}
+
 // Add role to group member.
 func (handler *GroupHandlerImpl) addMemberRole(c *gin.Context) {
 	ctx := c.Request.Context()
-	var body struct {
-		UserId string `json:"userId" binding:"required"`
-		RoleId string `json:"roleId" binding:"required"`
-	}
+	var body types.MemberRoleBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	handler.setRoleAuditDetail(c, body)
 	err := handler.core.WithTransaction(ctx, func(tx *sql.Tx) error {
-		return handler.role.AddMemberRole(tx, body.UserId, body.RoleId)
+		return handler.role.AddMemberRole(tx, c.Param("id"), body.UserId, body.RoleId)
 	})
 	if err != nil {
 		log.Printf("error mapping role to user: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_ROLE_NOT_FOUND, "role not found in the group")
+		case errors.Is(err, types.ErrForbiddenOperation):
+			AbortWithError(c, http.StatusForbidden, types.CODE_NOT_A_MEMBER, "user is not a member of the group")
+		case errors.Is(err, types.ErrAlreadyAssigned), errors.Is(err, types.ErrDuplicate):
+			SetAuditAlreadyExists(c)
+			AbortWithError(c, http.StatusConflict, types.CODE_ROLE_ALREADY_ASSIGNED, "role is already assigned to the user")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
 		return
-
 	}
+	handler.permissions.InvalidateMember(body.UserId, c.Param("id"))
 	c.Status(http.StatusOK)
 }
 
 func (handler *GroupHandlerImpl) removeMemberRole(c *gin.Context) {
 	ctx := c.Request.Context()
-	var body struct {
-		UserId string `json:"userId" binding:"required"`
-		RoleId string `json:"roleId" binding:"required"`
-	}
+	var body types.MemberRoleBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	handler.setRoleAuditDetail(c, body)
 	err := handler.core.WithTransaction(ctx, func(tx *sql.Tx) error {
-		return handler.role.RemoveMemberRole(tx, body.UserId, body.RoleId)
+		return handler.role.RemoveMemberRole(tx, c.Param("id"), body.UserId, body.RoleId)
 	})
 	if err != nil {
 		log.Printf("error removing member role: %+v\n", err)
 		switch {
 		case errors.Is(err, types.ErrForbiddenOperation):
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			AbortWithError(c, http.StatusForbidden, types.CODE_LAST_GROUP_OWNER, "cannot remove the last Group Owner role from the group")
 		case errors.Is(err, types.ErrNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			AbortWithError(c, http.StatusNotFound, types.CODE_ROLE_NOT_FOUND, "role not found in the group")
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
 		return
 	}
+	handler.permissions.InvalidateMember(body.UserId, c.Param("id"))
 	c.Status(http.StatusOK)
 }
 
+// Records which role a member was given or lost, by name, as ids alone don't tell much once the role is gone.
+func (handler *GroupHandlerImpl) setRoleAuditDetail(c *gin.Context, body types.MemberRoleBody) {
+	detail := map[string]any{"userId": body.UserId, "roleId": body.RoleId}
+	if role := handler.findRole(c.Param("id"), body.RoleId); role != nil {
+		detail["role"] = role.Name
+	}
+	SetAuditDetail(c, detail)
+}
+
+// Looks up one of the group's roles, nil if it doesn't exist or can't be read.
+func (handler *GroupHandlerImpl) findRole(groupId string, roleId string) *types.Role {
+	roles, err := handler.role.ReadRoles(groupId)
+	if err != nil {
+		log.Printf("error reading roles for the log: %+v\n", err)
+		return nil
+	}
+	for _, role := range roles {
+		if role.Id == roleId {
+			return role
+		}
+	}
+	return nil
+}
+
 // Get all members with their associated roles within a group.
 func (handler *GroupHandlerImpl) getMemberRoles(c *gin.Context) {
 	_ = c.Request.Context()
 	groupId := c.Param("id")
 	member_roles, err := handler.role.GetMembersWithRoles(groupId)
 	if err != nil {
-		log.Printf("error getting member roles: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		abortInternal(c, "error getting member roles", err)
 		return
 	}
 	c.JSON(http.StatusOK, member_roles)
@@ -140,12 +251,12 @@ func (handler *GroupHandlerImpl) getMemberRoles(c *gin.Context) {
 func (handler *GroupHandlerImpl) getDefinedRoles(c *gin.Context) {
 	groupId := c.Param("id")
 	if groupId == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no group id"})
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "no group id")
 		return
 	}
 	roles, err := handler.role.ReadRoles(groupId)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortInternal(c, "error reading roles", err)
 		return
 	}
 	if len(roles) == 0 {
@@ -158,82 +269,369 @@ func (handler *GroupHandlerImpl) getDefinedRoles(c *gin.Context) {
 func (handler *GroupHandlerImpl) updateRoles(c *gin.Context) {
 	var body []*types.Role
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
-	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		return handler.role.UpdateRolesWithTx(tx, body, c.Param("id"))
+
+	// every submitted role must belong to the group being updated
+	mismatched := make([]string, 0)
+	for _, role := range body {
+		if role.GroupId != c.Param("id") {
+			mismatched = append(mismatched, role.Id)
+		}
+	}
+	if len(mismatched) > 0 {
+		AbortWithErrorDetails(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "roles do not belong to the group", gin.H{"roleIds": mismatched})
+		return
+	}
+	// the roles as they were, so the log entry can tell what changed
+	existing, err := handler.role.ReadRoles(c.Param("id"))
+	if err != nil {
+		abortInternal(c, "error reading roles", err)
+		return
+	}
+	SetAuditDetail(c, roleChanges(existing, body))
+
+	// roles are reconciled row by row, reading what others committed meanwhile is fine
+	var summary *types.RoleUpdateSummary
+	err = handler.core.WithTransactionOpts(c.Request.Context(), &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+		var err error
+		summary, err = handler.role.UpdateRolesWithTx(tx, body, c.Param("id"))
+		return err
 	})
 	if err != nil {
 		log.Printf("error updating roles: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			// the id of another group's role
+			AbortWithError(c, http.StatusNotFound, types.CODE_ROLE_NOT_FOUND, "role not found in the group")
+		case errors.Is(err, types.ErrDuplicateRoleName), errors.Is(err, types.ErrDuplicate):
+			// the latter when another request created a role with the same name concurrently
+			AbortWithError(c, http.StatusConflict, types.CODE_DUPLICATE_ROLE_NAME, "duplicate role name")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
 		return
 	}
-	c.Status(http.StatusOK)
+	handler.permissions.InvalidateGroup(c.Param("id"))
+	c.JSON(http.StatusOK, summary)
 }
 
-func (handler *GroupHandlerImpl) deleteRole(c *gin.Context) {
-	var body struct {
-		RoleId string `json:"roleId" binding:"required"`
+// Describes what applying the submitted roles changes, by role name: which roles are created and deleted,
+// and which permissions of the remaining roles change to what. Mirrors the "Group Owner" rule of UpdateRolesWithTx.
+func roleChanges(existing []*types.Role, submitted []*types.Role) map[string]any {
+	existingMap := make(map[string]*types.Role)
+	for _, role := range existing {
+		existingMap[role.Id] = role
 	}
+	created, deleted := make([]string, 0), make([]string, 0)
+	updated := make([]gin.H, 0)
+	kept := make(map[string]bool)
+	for _, role := range submitted {
+		kept[role.Id] = true
+		current, exists := existingMap[role.Id]
+		if role.Name == "Group Owner" || (exists && current.Name == "Group Owner") {
+			continue
+		}
+		if !exists {
+			created = append(created, role.Name)
+			continue
+		}
+		permissions := make(map[string]bool)
+		for _, permission := range types.PermissionCatalogue {
+			if granted := permission.Granted(&role.Permissions); granted != permission.Granted(&current.Permissions) {
+				permissions[permission.Key] = granted
+			}
+		}
+		if len(permissions) == 0 && role.Name == current.Name {
+			continue
+		}
+		change := gin.H{"role": role.Name, "permissions": permissions}
+		if role.Name != current.Name {
+			change["oldName"] = current.Name
+		}
+		updated = append(updated, change)
+	}
+	for _, role := range existing {
+		if !kept[role.Id] && role.Name != "Group Owner" {
+			deleted = append(deleted, role.Name)
+		}
+	}
+	return map[string]any{"created": created, "updated": updated, "deleted": deleted}
+}
+
+func (handler *GroupHandlerImpl) deleteRole(c *gin.Context) {
+	var body types.DeleteRoleBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	detail := map[string]any{"roleId": body.RoleId}
+	if role := handler.findRole(c.Param("id"), body.RoleId); role != nil {
+		detail["role"] = role.Name
+	}
+	SetAuditDetail(c, detail)
 	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		return handler.role.DeleteRoleWithTx(tx, body.RoleId)
+		return handler.role.DeleteRoleWithTx(tx, c.Param("id"), body.RoleId)
 	})
 	if err != nil {
-		log.Printf("error deleting group role: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_ROLE_NOT_FOUND, "role not found in the group")
+		case errors.Is(err, types.ErrForbiddenOperation):
+			AbortWithError(c, http.StatusForbidden, types.CODE_OWNER_ROLE_PROTECTED, "the Group Owner role cannot be deleted")
+		default:
+			abortInternal(c, "error deleting group role", err)
+		}
 		return
 	}
+	handler.permissions.InvalidateGroup(c.Param("id"))
 	c.Status(http.StatusOK)
 }
 
+// Exports the group's roles by name, to be imported into another group, with ?members=true also its members' addresses.
+func (handler *GroupHandlerImpl) exportConfig(c *gin.Context) {
+	groupId := c.Param("id")
+	roles, err := handler.role.ReadRoles(groupId)
+	if err != nil {
+		abortInternal(c, "error reading roles", err)
+		return
+	}
+	group, err := handler.core.ReadGroup(c.Request.Context(), groupId)
+	if err != nil {
+		abortInternal(c, "error reading group", err)
+		return
+	}
+	handler.resolveCreator(c, group.CreatedBy)
+	config := &types.GroupConfig{Roles: make([]*types.RoleConfig, 0, len(roles)), CreatedBy: group.CreatedBy}
+	for _, role := range roles {
+		// every group has an owner role of its own
+		if role.Name == "Group Owner" {
+			continue
+		}
+		config.Roles = append(config.Roles, &types.RoleConfig{Name: role.Name, Permissions: role.Permissions})
+	}
+	if c.Query("members") == "true" {
+		members, err := handler.core.ReadOrganisationMembers(groupId)
+		if err != nil {
+			abortInternal(c, "error reading group members", err)
+			return
+		}
+		config.Members = make([]string, 0, len(members))
+		for _, member := range members {
+			if member.Email != "" {
+				config.Members = append(config.Members, member.Email)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, config)
+}
+
+// Sets up exported roles in the group in one transaction, skipping those whose name the group already has.
+// Exported members are invited, which takes the InviteMember permission too.
+func (handler *GroupHandlerImpl) importConfig(c *gin.Context) {
+	var body types.GroupConfig
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	groupId := c.Param("id")
+	if len(body.Members) > 0 && !c.GetBool("internal-service") {
+		permissions, err := handler.permissions.MemberPermissions(c.GetString("userId"), groupId)
+		if err != nil {
+			abortInternal(c, "error reading member permissions", err)
+			return
+		}
+		if !permissions.InviteMember {
+			AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "importing members takes the InviteMember permission")
+			return
+		}
+	}
+
+	result := &types.ImportConfigResult{}
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		var err error
+		result.Created, result.Skipped, err = handler.role.CreateRolesWithTx(tx, groupId, body.Roles)
+		return err
+	})
+	if err != nil {
+		log.Printf("error importing roles: %+v\n", err)
+		switch {
+		case errors.Is(err, types.ErrDuplicate):
+			// a role of the same name was created concurrently
+			AbortWithError(c, http.StatusConflict, types.CODE_DUPLICATE_ROLE_NAME, "duplicate role name")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
+		return
+	}
+	handler.permissions.InvalidateGroup(groupId)
+	SetAuditDetail(c, map[string]any{"created": result.Created, "skipped": result.Skipped})
+
+	if len(body.Members) > 0 {
+		if result.Invitations, err = handler.inviteEmails(c, groupId, body.Members); err != nil {
+			// the roles are in place, so this is only reported
+			log.Printf("error inviting imported members: %+v\n", err)
+			AbortWithErrorDetails(c, http.StatusInternalServerError, types.CODE_INTERNAL, "roles were imported, inviting the members failed", result)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 // Gets a group's metadata.
 func (handler *GroupHandlerImpl) getGroup(c *gin.Context) {
-	ctx := c.Request.Context()
 	groupId := c.Param("id")
-	group, err := handler.core.ReadGroup(ctx, groupId)
+	var group *types.Organisation
+	err := handler.core.WithReadTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.checkMemberWithTx(c, tx); err != nil {
+			return err
+		}
+		var err error
+		group, err = handler.core.ReadGroupWithTx(tx, groupId)
+		return err
+	})
 	if err != nil {
 		log.Printf("failed to read group %s: %v\n", groupId, err)
 		switch {
 		case errors.Is(err, types.ErrNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
 			return
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 			return
 		}
 	}
+	handler.resolveCreator(c, group.CreatedBy)
 	c.JSON(http.StatusOK, group)
 }
 
+// Fills in the creator's display name, and their current email, from firebase. Left as stored if it can't be reached.
+func (handler *GroupHandlerImpl) resolveCreator(c *gin.Context, creator *types.GroupCreator) {
+	if creator == nil {
+		return
+	}
+	users, err := handler.firebase.GetUsers(c.Request.Context(), []string{creator.UserId})
+	if err != nil {
+		log.Printf("error resolving group creator from firebase: %+v\n", err)
+		return
+	}
+	if user, exists := users[creator.UserId]; exists {
+		if user.Email != "" {
+			creator.Email = user.Email
+		}
+		creator.DisplayName = user.DisplayName
+	}
+}
+
+// Updates the group's name, slug and settings. Each update increments the group's version, which the body
+// may name to have the update refused with 409 VERSION_CONFLICT if someone else updated the group since.
 func (handler *GroupHandlerImpl) updateMetadata(c *gin.Context) {
 	groupId := c.Param("id")
-	var body struct {
-		Name string `json:"name"`
-	}
+	var body types.UpdateGroupBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
+		return
+	}
+	if body.Version == nil && handler.requireGroupVersion {
+		abortInvalidRequest(c, errors.New("version is required, read it from the group"))
 		return
 	}
+	var name string
+	if body.Name != nil {
+		var err error
+		if name, err = validGroupName(*body.Name); err != nil {
+			abortInvalidRequest(c, err)
+			return
+		}
+	}
+	var slug string
+	if body.Slug != nil {
+		if slug = strings.ToLower(strings.TrimSpace(*body.Slug)); slug != "" {
+			if err := types.ValidateSlug(slug); err != nil {
+				abortInvalidRequest(c, err)
+				return
+			}
+		}
+	}
+	var (
+		old     *types.Organisation
+		version int
+	)
 	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		// update name if requested
-		if body.Name != "" {
-			if err := handler.core.UpdateGroupNameWithTx(tx, groupId, body.Name); err != nil {
+		var err error
+		if version, err = handler.core.UpdateGroupVersionWithTx(tx, groupId, body.Version); err != nil {
+			return err
+		}
+		if body.Name != nil || body.Slug != nil {
+			if old, err = handler.core.ReadGroupWithTx(tx, groupId); err != nil {
+				return err
+			}
+		}
+		// update name if requested, the slug stays as it is
+		if body.Name != nil {
+			if err := handler.core.UpdateGroupNameWithTx(tx, groupId, name); err != nil {
+				return err
+			}
+		}
+		if body.Slug != nil {
+			if err := handler.core.UpdateGroupSlugWithTx(tx, groupId, slug); err != nil {
+				return err
+			}
+		}
+		if body.AuditDigest != nil {
+			if err := handler.core.UpdateGroupAuditDigestWithTx(tx, groupId, *body.AuditDigest); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
 	if err != nil {
-		log.Printf("failed to commit group metadata changes: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		case errors.Is(err, types.ErrSlugTaken):
+			AbortWithError(c, http.StatusConflict, types.CODE_SLUG_TAKEN, "slug is taken by another group")
+		case errors.Is(err, types.ErrConflict):
+			AbortWithErrorDetails(c, http.StatusConflict, types.CODE_VERSION_CONFLICT, "the group was changed since it was read, reload it", gin.H{"version": version})
+		default:
+			abortInternal(c, "failed to commit group metadata changes", err)
+		}
 		return
 	}
-	c.Status(http.StatusOK)
+	detail := make(map[string]any)
+	if body.Name != nil {
+		detail["oldName"], detail["newName"] = old.Name, name
+	}
+	if body.Slug != nil {
+		detail["oldSlug"], detail["newSlug"] = old.Slug, slug
+	}
+	if body.AuditDigest != nil {
+		detail["auditDigest"] = *body.AuditDigest
+	}
+	if len(detail) > 0 {
+		SetAuditDetail(c, detail)
+	}
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
+
+// Longest group name accepted, in characters.
+const maxGroupNameLength = 100
+
+// Trims a group name and checks it's fit for display, returning the trimmed name.
+func validGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", errors.New("name must not be empty")
+	case utf8.RuneCountInString(name) > maxGroupNameLength:
+		return "", fmt.Errorf("name must be at most %d characters", maxGroupNameLength)
+	case strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) && !unicode.IsSpace(r) }) >= 0:
+		return "", errors.New("name must only contain printable characters")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "", errors.New("name must not contain control characters")
+	}
+	return name, nil
 }
 
 // Delete a group and related data.
@@ -242,54 +640,251 @@ func (handler *GroupHandlerImpl) deleteGroup(c *gin.Context) {
 		return handler.core.DeleteGroupWithTx(tx, c.GetString("userId"), c.Param("id"))
 	})
 	if err != nil {
-		log.Printf("error deleting group: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		abortInternal(c, "error deleting group", err)
 		return
 	}
+	handler.permissions.InvalidateGroup(c.Param("id"))
+	// the group's cases are kept until it's purged, so a restored group has them back
+	handler.webhook.Emit(types.WEBHOOK_GROUP_DELETED, gin.H{"groupId": c.Param("id")})
 	c.Status(http.StatusOK)
 }
 
+// How often deleted groups past their restore window are looked for.
+const groupPurgeInterval = time.Hour
+
+// Cleans up deleted groups for good once they can no longer be restored, along with their cases.
+func (handler *GroupHandlerImpl) purgeWorker() {
+	ticker := time.NewTicker(groupPurgeInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		ctx := context.Background()
+		groupIds, err := handler.core.ReadExpiredGroups(ctx)
+		if err != nil {
+			log.Printf("error reading groups to purge: %+v\n", err)
+			continue
+		}
+		for _, groupId := range groupIds {
+			err := handler.core.WithTransaction(ctx, func(tx *sql.Tx) error {
+				return handler.core.PurgeGroupWithTx(tx, groupId)
+			})
+			if err != nil {
+				// restored since it was read, or failed and tried again next time
+				log.Printf("error purging group %s: %+v\n", groupId, err)
+				continue
+			}
+			log.Printf("purged group %s\n", groupId)
+			// the group is gone, so a failing case cleanup is only retried in the background
+			if err := handler.case_.DeleteCasesForGroup(ctx, groupId); err != nil {
+				log.Printf("error cleaning up cases for group %s: %+v\n", groupId, err)
+			}
+		}
+	}
+}
+
+const (
+	// Groups a user may create per groupCreationWindow, unless GROUP_CREATION_DAILY_LIMIT says otherwise.
+	defaultGroupCreationLimit = 20
+	groupCreationWindow       = time.Hour * 24
+)
+
+// The number of groups a user may create per day by default, from GROUP_CREATION_DAILY_LIMIT.
+func groupCreationDailyLimit() int {
+	value := os.Getenv("GROUP_CREATION_DAILY_LIMIT")
+	if value == "" {
+		return defaultGroupCreationLimit
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		log.Fatalf("GROUP_CREATION_DAILY_LIMIT must be a positive number, got %q", value)
+	}
+	return limit
+}
+
+// Checks the user hasn't created as many groups within the last day as they may. Returns ErrGroupLimitReached
+// if they have, along with when the oldest of those stops counting.
+func (handler *GroupHandlerImpl) checkGroupCreationLimit(ctx context.Context, tx *sql.Tx, userId string) (time.Time, error) {
+	limit := handler.groupCreationLimit
+	override, overridden, err := handler.core.ReadGroupCreationLimit(ctx, userId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if overridden {
+		if override == nil {
+			return time.Time{}, nil
+		}
+		limit = *override
+	}
+	created, err := handler.core.RecentGroupCreationsWithTx(tx, userId, time.Now().Add(-groupCreationWindow), limit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(created) < limit {
+		return time.Time{}, nil
+	}
+	return created[len(created)-1].Add(groupCreationWindow), types.ErrGroupLimitReached
+}
+
 // Create a group and adds the requesting user to it.
 func (handler *GroupHandlerImpl) createOrganisation(c *gin.Context) {
-	var body struct {
-		Name string `json:"name" binding:"required"`
-	}
+	var body types.CreateGroupBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
-	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		return handler.core.CreateOrganisationWithTx(tx, body.Name, c.GetString("userId"))
+	name, err := validGroupName(body.Name)
+	if err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	var group *types.Organisation
+	var existingId string
+	var resetAt time.Time
+	err = handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if !c.GetBool("internal-service") {
+			var err error
+			if resetAt, err = handler.checkGroupCreationLimit(c.Request.Context(), tx, c.GetString("userId")); err != nil {
+				return err
+			}
+		}
+		if !body.AllowDuplicateName {
+			var err error
+			existingId, err = handler.core.FindOwnedGroupByNameWithTx(tx, c.GetString("userId"), name)
+			switch {
+			case err == nil:
+				return types.ErrDuplicate
+			case !errors.Is(err, types.ErrNotFound):
+				return err
+			}
+		}
+		var err error
+		group, err = handler.core.CreateOrganisationWithTx(tx, name, c.GetString("userId"))
+		return err
 	})
 	if err != nil {
-		log.Printf("error creating group: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		if errors.Is(err, types.ErrDuplicate) && existingId != "" {
+			AbortWithErrorDetails(c, http.StatusConflict, types.CODE_GROUP_EXISTS, "you already own a group with this name", gin.H{"groupId": existingId})
+			return
+		}
+		if errors.Is(err, types.ErrGroupLimitReached) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(resetAt).Seconds()))))
+			AbortWithErrorDetails(c, http.StatusTooManyRequests, types.CODE_GROUP_LIMIT, "too many groups created within a day", gin.H{"resetAt": resetAt})
+			return
+		}
+		abortInternal(c, "error creating group", err)
 		return
 	}
-	c.Status(http.StatusOK)
+	respondCreated(c, "/api/group/"+group.Id, group)
 }
 
 func (handler *GroupHandlerImpl) members(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no group id set"})
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "no group id set")
+		return
+	}
+
+	// paging is opt-in, so clients expecting every member as a list keep working
+	_, hasLimit := c.GetQuery("limit")
+	_, hasCursor := c.GetQuery("cursor")
+	paged := hasLimit || hasCursor
+	limit, after, err := memberPageQuery(c)
+	if err != nil {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, err.Error())
 		return
 	}
-	members, err := handler.core.ReadOrganisationMembers(id)
+
+	var (
+		members []*types.OrganisationMember
+		page    *types.MemberPage
+	)
+	err = handler.core.WithReadTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.checkMemberWithTx(c, tx); err != nil {
+			return err
+		}
+		var err error
+		if paged {
+			page, err = handler.core.ReadOrganisationMembersPageWithTx(tx, id, after, limit)
+			if err == nil {
+				members = page.Members
+			}
+			return err
+		}
+		members, err = handler.core.ReadOrganisationMembersWithTx(tx, id)
+		return err
+	})
 	if err != nil {
 		log.Printf("error reading group members: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		return
+	}
+
+	// firebase is the source of truth for provider accounts, if it can't be reached the members are returned as stored
+	uids := make([]string, len(members))
+	for i, member := range members {
+		uids[i] = member.Id
+	}
+	users, err := handler.firebase.GetUsers(c.Request.Context(), uids)
+	if err != nil {
+		log.Printf("error enriching group members from firebase: %+v\n", err)
+	}
+	for _, member := range members {
+		if user, exists := users[member.Id]; exists {
+			if user.Email != "" {
+				member.Email = user.Email
+			}
+			member.DisplayName = user.DisplayName
+			member.Disabled = user.Disabled
+		}
+	}
+	if !paged {
+		c.JSON(http.StatusOK, members)
 		return
 	}
-	c.JSON(http.StatusOK, members)
+	if page.Next != nil {
+		cursor, _ := json.Marshal(page.Next)
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(cursor)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// Page sizes of the member listing.
+const (
+	defaultMemberPageSize = 50
+	maxMemberPageSize     = 200
+)
+
+// Reads ?limit, capped at maxMemberPageSize, and ?cursor, the nextCursor of the previous page.
+func memberPageQuery(c *gin.Context) (int, *types.MemberCursor, error) {
+	limit := defaultMemberPageSize
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return 0, nil, fmt.Errorf("limit must be a positive number")
+		}
+		limit = min(parsed, maxMemberPageSize)
+	}
+	value := c.Query("cursor")
+	if value == "" {
+		return limit, nil, nil
+	}
+	var cursor types.MemberCursor
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(raw, &cursor) != nil || cursor.Id == "" {
+		return 0, nil, fmt.Errorf("invalid cursor")
+	}
+	return limit, &cursor, nil
 }
 
 // Get a list of groups the user is associated with.
 func (handler *GroupHandlerImpl) organisationList(c *gin.Context) {
 	organisationList, err := handler.core.OrganisationList(c.GetString("userId"))
 	if err != nil {
-		log.Printf("error reading list of groups: %+v\n", err)
-		c.String(http.StatusInternalServerError, err.Error())
+		abortInternal(c, "error reading list of groups", err)
 		return
 	}
 	c.JSON(http.StatusOK, organisationList)
@@ -297,120 +892,436 @@ func (handler *GroupHandlerImpl) organisationList(c *gin.Context) {
 
 func (handler *GroupHandlerImpl) inviteMember(c *gin.Context) {
 
-	var body struct {
-		Email   string `json:"email" binding:"required"`
-		GroupId string `json:"groupId" binding:"required"`
-		Name    string `json:"name" binding:"required"`
-	}
+	var body types.InviteMemberBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
+	body.Email = types.NormalizeEmail(body.Email)
 	if _, err := mail.ParseAddress(body.Email); err != nil {
 		log.Println("tried to invite using a bad email.")
-		c.String(http.StatusBadRequest, "invalid mail")
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "invalid mail")
 		return
 	}
 
-	// attempt to get userId from firebase,
-	// if the user doesn't exist, keep going, but make a signup invitation instead
-	userId, err := handler.firebase.GetUserIdByEmail(body.Email)
-	if err == nil && userId != "" {
-		// if a user was found in firebase, check whether they are already a part of the group
-		if err := handler.core.IsUserAlreadyMember(userId, body.GroupId); err != nil {
-			c.JSON(http.StatusConflict, gin.H{"error": "user is already a member of the group"})
+	// the group is given in the body, so the permission is checked here rather than by the middleware
+	if !c.GetBool("internal-service") {
+		if err := handler.role.HasPermission(nil, c.GetString("userId"), body.GroupId, types.INVITE_MEMBER); err != nil {
+			log.Printf("error checking invite permission: %+v\n", err)
+			switch {
+			case errors.Is(err, types.ErrForbiddenOperation):
+				AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "missing permission")
+			default:
+				AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+			}
+			return
+		}
+		// the middleware only logs routes with the group in the path, so this one is logged here once it's answered
+		defer handler.logAction(c, body.GroupId, types.INVITE_MEMBER)
+		SetAuditDetail(c, map[string]any{"email": body.Email})
+	}
+	warnIgnoredName(c, body.Name)
+
+	// the mail shows the group's own name, never one given by the client
+	group, err := handler.core.ReadGroup(c.Request.Context(), body.GroupId)
+	if err != nil {
+		log.Printf("error reading group %s to invite to: %+v\n", body.GroupId, err)
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
+		return
+	}
+
+	if !allowRequest(c, handler.limiter,
+		service.RATE_LIMIT_INVITE_PER_CALLER, c.GetString("userId"),
+		service.RATE_LIMIT_INVITE_PER_ADDRESS, body.Email) {
+		return
+	}
+
+	// if firebase doesn't know the address, keep going, but make a signup invitation instead
+	userId, memberIds := handler.resolveInvitee(body.Email)
+	for _, memberId := range memberIds {
+		isMember, err := handler.core.IsMember(c.Request.Context(), memberId, body.GroupId)
+		if err != nil {
+			abortInternal(c, "error checking membership of invited user", err)
+			return
+		}
+		if isMember {
+			SetAuditAlreadyExists(c)
+			AbortWithError(c, http.StatusConflict, types.CODE_ALREADY_MEMBER, "user is already a member of the group")
 			return
 		}
 	}
 
 	// generate link
-	invitationId, err := handler.core.CreateInvitation(userId, body.Email, body.GroupId)
+	invitation, token, err := handler.core.CreateInvitation(userId, body.Email, body.GroupId, c.GetString("userId"))
 	if err != nil {
 		log.Printf("error creating invitation: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error creating invitation"})
+		switch {
+		case errors.Is(err, types.ErrDuplicate):
+			SetAuditAlreadyExists(c)
+			AbortWithError(c, http.StatusConflict, types.CODE_INVITATION_EXISTS, "invitation already exists")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
+		return
+	}
+	if err := handler.sendInvitation(c, body.GroupId, group.Name, body.Email, userId, invitation.Id, token); err != nil {
+		abortInternal(c, "error creating invitation mail", err)
+		return
+	}
+	respondCreated(c, "/api/group/"+invitation.GroupId+"/invitation/"+invitation.Id, invitation)
+}
+
+// Deprecated body fields are still accepted, the response warns they're ignored so clients can drop them.
+func warnIgnoredName(c *gin.Context, name string) {
+	if name != "" {
+		c.Writer.Header().Add("Warning", "299 - \"name is deprecated and ignored, the group's own name is used\"")
+	}
+}
+
+// Records an action by a user in the group's log, with the status it was answered with, for routes the
+// middleware doesn't log because the group isn't in the path.
+func (handler *GroupHandlerImpl) logAction(c *gin.Context, groupId string, action string) {
+	userId := c.GetString("userId")
+	handler.log.NewEntry(&types.LogEntry{
+		GroupId:   groupId,
+		Action:    action,
+		Status:    auditStatus(c),
+		UserId:    userId,
+		Email:     handler.permissions.UserEmail(userId),
+		Timestamp: time.Now().Format(time.RFC3339),
+		Detail:    auditDetail(c),
+	})
+}
+
+// Lists a group's pending invitations with who sent them, to those who may invite members.
+func (handler *GroupHandlerImpl) invitations(c *gin.Context) {
+	invitations, err := handler.core.ReadGroupInvitations(c.Param("id"))
+	if err != nil {
+		abortInternal(c, "error reading group invitations", err)
+		return
+	}
+
+	// firebase is the source of truth for provider accounts, if it can't be reached the stored emails are returned
+	var uids []string
+	for _, invitation := range invitations {
+		if invitation.InvitedBy != nil {
+			uids = append(uids, *invitation.InvitedBy)
+		}
+	}
+	users, err := handler.firebase.GetUsers(c.Request.Context(), uids)
+	if err != nil {
+		log.Printf("error enriching group invitations from firebase: %+v\n", err)
+	}
+	for _, invitation := range invitations {
+		if invitation.InvitedBy == nil {
+			continue
+		}
+		if user, exists := users[*invitation.InvitedBy]; exists {
+			if user.Email != "" {
+				invitation.InvitedByEmail = user.Email
+			}
+			invitation.InvitedByName = user.DisplayName
+		}
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+// Reads a pending invitation by its id, to those who may invite members.
+func (handler *GroupHandlerImpl) invitation(c *gin.Context) {
+	invitation, err := handler.core.ReadGroupInvitation(c.Request.Context(), c.Param("id"), c.Param("invitationId"))
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_INVITATION_NOT_FOUND, "invitation not found")
+			return
+		}
+		abortInternal(c, "error reading invitation", err)
 		return
 	}
+	c.JSON(http.StatusOK, invitation)
+}
+
+// Deletes a pending invitation by its id, as listed by invitations, so its link stops working.
+func (handler *GroupHandlerImpl) revokeInvitation(c *gin.Context) {
+	invitation, err := handler.core.RevokeInvitation(c.Request.Context(), c.Param("id"), c.Param("invitationId"))
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_INVITATION_NOT_FOUND, "invitation not found")
+			return
+		}
+		abortInternal(c, "error revoking invitation", err)
+		return
+	}
+	SetAuditDetail(c, map[string]any{"email": invitation.Email})
+	c.Status(http.StatusOK)
+}
+
+// Announces a created invitation and queues its mail, userId being empty if the address has no account yet.
+// Only the mail carries the token, anything else refers to the invitation by its id.
+func (handler *GroupHandlerImpl) sendInvitation(c *gin.Context, groupId string, groupName string, email string, userId string, invitationId string, token string) error {
+	handler.webhook.Emit(types.WEBHOOK_INVITATION_CREATED, gin.H{"groupId": groupId, "invitationId": invitationId, "email": email})
 
 	var link string
 	if userId == "" {
-		link = fmt.Sprintf("%s/signup?inv=%s", handler.portal_domain, invitationId)
+		link = fmt.Sprintf("%s/signup?inv=%s", handler.portal_domain, token)
 	} else {
-		link = fmt.Sprintf("%s/api/group/join?inv=%s", handler.domain, invitationId)
+		link = fmt.Sprintf("%s%s/api/group/join?inv=%s", handler.domain, apiVersionPrefix, token)
 	}
 
 	// if no user was found, send an signin invitation flow
 	// else send a simple accept / reject invitation flow
-	var message string
+	// registered users get the mail in their own locale, others in the inviter's
+	locale := requestLocale(c, "")
+	if user, err := handler.core.ReadUserByEmail(email); err == nil {
+		locale = user.Locale
+	}
+	data := &types.InvitationMailData{Group: groupName, Link: link}
+	var message *types.EmailMessage
+	var err error
 	if userId == "" {
-		message = handler.email.CreateSignupAndInvitationMail(body.Email, body.Name, link)
+		message, err = handler.email.CreateSignupAndInvitationMail(email, locale, data)
 	} else {
-		message = handler.email.CreateInvitationMail(body.Email, body.Name, link)
+		message, err = handler.email.CreateInvitationMail(email, locale, data)
 	}
-	if err := handler.email.Send([]string{body.Email}, message); err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
-		return
+	if err != nil {
+		return err
 	}
-	c.Status(http.StatusOK)
+	handler.email.Enqueue(message)
+	return nil
 }
 
-func (handler *GroupHandlerImpl) joinGroup(c *gin.Context) {
-	ctx := c.Request.Context()
-	invitationId := c.Query("inv")
-	if invitationId == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no invitation id set"})
+// Invites up to maxBatchInvitations addresses at once. Every address gets its own result rather than one bad address
+// failing the batch, responding 207 unless all of them were invited. The invitations are created in one transaction,
+// the mails are sent afterwards.
+func (handler *GroupHandlerImpl) inviteMemberBatch(c *gin.Context) {
+	var body types.InviteBatchBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
 		return
 	}
-
-	// lookup invitation
-	userId, groupId, email, err := handler.core.LookupInvitation(invitationId)
+	results, err := handler.inviteEmails(c, c.Param("id"), body.Emails)
 	if err != nil {
-		log.Printf("error looking up invitation: %+v\n", err)
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		abortInternal(c, "error creating invitations", err)
+		return
+	}
+
+	status := http.StatusOK
+	invited := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.Status != types.INVITATION_INVITED {
+			status = http.StatusMultiStatus
+			continue
+		}
+		invited = append(invited, result.Email)
+	}
+	SetAuditDetail(c, map[string]any{"emails": invited})
+	c.JSON(status, gin.H{"results": results})
+}
+
+// Invites the addresses to the group in one transaction and mails the invitations, with one result per address
+// in the order given, repeats only invited once. Members and pending invitees are left alone.
+func (handler *GroupHandlerImpl) inviteEmails(c *gin.Context, groupId string, emails []string) ([]*types.InvitationResult, error) {
+	results := make([]*types.InvitationResult, 0, len(emails))
+	seen := make(map[string]bool)
+	var pending []*types.InvitationResult
+	for _, email := range emails {
+		email = types.NormalizeEmail(email)
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		result := &types.InvitationResult{Email: email}
+		results = append(results, result)
+		_, parseErr := mail.ParseAddress(email)
 		switch {
-		case errors.Is(err, types.ErrNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": "no invitation found for the given invitationId"})
+		case parseErr != nil:
+			result.Status = types.INVITATION_INVALID
+		case !handler.allowInvitation(c, email):
+			result.Status = types.INVITATION_RATE_LIMITED
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "error looking up invitation"})
+			pending = append(pending, result)
+		}
+	}
+
+	// accounts are looked up before the transaction, so it isn't held open for firebase
+	userIds := make(map[string]string)
+	memberIds := make(map[string][]string)
+	for _, result := range pending {
+		userIds[result.Email], memberIds[result.Email] = handler.resolveInvitee(result.Email)
+	}
+
+	var group *types.Organisation
+	tokens := make(map[string]string)
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		var err error
+		if group, err = handler.core.ReadGroupWithTx(tx, groupId); err != nil {
+			return err
+		}
+	invitees:
+		for _, result := range pending {
+			for _, memberId := range memberIds[result.Email] {
+				isMember, err := handler.core.IsMemberWithTx(tx, memberId, groupId)
+				if err != nil {
+					return err
+				}
+				if isMember {
+					result.Status = types.INVITATION_ALREADY_MEMBER
+					continue invitees
+				}
+			}
+			invitation, token, err := handler.core.CreateInvitationWithTx(tx, userIds[result.Email], result.Email, groupId, c.GetString("userId"))
+			switch {
+			case errors.Is(err, types.ErrDuplicate):
+				result.Status = types.INVITATION_ALREADY_INVITED
+			case err != nil:
+				return err
+			default:
+				result.Status = types.INVITATION_INVITED
+				result.InvitationId = invitation.Id
+				tokens[result.Email] = token
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		if result.Status != types.INVITATION_INVITED {
+			continue
 		}
+		// the invitation stands even if its mail can't be created, it can be sent again by inviting once more
+		if err := handler.sendInvitation(c, groupId, group.Name, result.Email, userIds[result.Email], result.InvitationId, tokens[result.Email]); err != nil {
+			log.Printf("error creating invitation mail: %+v\n", err)
+		}
+	}
+	return results, nil
+}
+
+// Resolves an invited address to its firebase account, empty if there's none, and to every user id it's known by,
+// as a user of ours may exist without firebase knowing the address, e.g. one who never linked it.
+func (handler *GroupHandlerImpl) resolveInvitee(email string) (string, []string) {
+	var memberIds []string
+	userId, err := handler.firebase.GetUserIdByEmail(email)
+	if err != nil {
+		userId = ""
+	}
+	if userId != "" {
+		memberIds = append(memberIds, userId)
+	}
+	if user, err := handler.core.ReadUserByEmail(email); err == nil && user.Id != userId {
+		memberIds = append(memberIds, user.Id)
+	}
+	return userId, memberIds
+}
+
+// Takes an invitation from the caller's and the address' rate limits, internal services aren't limited.
+func (handler *GroupHandlerImpl) allowInvitation(c *gin.Context, email string) bool {
+	if c.GetBool("internal-service") {
+		return true
+	}
+	allowedCaller, _ := handler.limiter.Allow(service.RATE_LIMIT_INVITE_PER_CALLER, c.GetString("userId"))
+	allowedAddress, _ := handler.limiter.Allow(service.RATE_LIMIT_INVITE_PER_ADDRESS, email)
+	return allowedCaller && allowedAddress
+}
+
+func (handler *GroupHandlerImpl) joinGroup(c *gin.Context) {
+	ctx := c.Request.Context()
+	token := c.Query("inv")
+	if token == "" {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "no invitation token set")
 		return
 	}
 
-	// if invitation was for a user, not yet registered and only the email were provided,
-	// then lookup the user as they have only registered after receiving the invite.
-	user, err := handler.core.ReadUserByEmail(email)
+	// lookup invitation
+	invitation, ok := handler.lookupInvitation(c, token)
+	if !ok {
+		return
+	}
+	groupId := invitation.GroupId
+	userId, err := handler.invitedUserId(invitation)
 	if err != nil {
+		log.Printf("error resolving invited user of invitation %s: %+v\n", invitation.Id, err)
 		switch {
 		case errors.Is(err, types.ErrNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			// nobody has an account with the address, the invitation is kept for them to sign up with
+			AbortWithErrorDetails(c, http.StatusNotFound, types.CODE_SIGNUP_REQUIRED, "no account with the invited address, sign up first",
+				gin.H{"redirect_url": fmt.Sprintf("%s/signup?inv=%s", handler.portal_domain, url.QueryEscape(token))})
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading user"})
+			abortInternal(c, "error resolving invited user", err)
 		}
 		return
 	}
 
-	// bind to user only known (registered in our system) after the invitation was sent
-	if userId == "" {
-		userId = user.Id
-	}
+	// joining is idempotent, a user who already is a member, e.g. after clicking the link twice, just has the invitation used up
+	var joined bool
+	// repeatable read whatever the server default, the group is checked and joined in one snapshot
+	err = handler.core.WithTransactionOpts(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, func(tx *sql.Tx) error {
+
+		// a deleted group can't be joined, the invitation is kept in case it's restored
+		if _, err := handler.core.ReadGroupWithTx(tx, groupId); err != nil {
+			return err
+		}
 
-	err = handler.core.WithTransaction(ctx, func(tx *sql.Tx) error {
+		// an account only firebase knows is mid-onboarding, it gets its row here so the membership has a user
+		created, err := handler.core.EnsureUserWithTx(tx, userId, invitation.Email)
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Printf("created user %s while joining group %s, firebase knew them but we didn't\n", userId, groupId)
+		}
 
 		// add user to group
-		if err := handler.core.AddUserToOrganisationWithTx(tx, userId, groupId); err != nil {
+		isMember, err := handler.core.IsMemberWithTx(tx, userId, groupId)
+		if err != nil {
 			return err
 		}
+		if !isMember {
+			if err := handler.core.AddUserToOrganisationWithTx(tx, userId, groupId); err != nil {
+				return err
+			}
+			joined = true
+		}
 
-		// delete invitation
-		if err := handler.core.DeleteInvitationWithTx(tx, invitationId); err != nil {
+		// delete invitation, unless a concurrent join with the same link got to it first
+		if err := handler.core.DeleteInvitationWithTx(tx, invitation.Id); err != nil && !errors.Is(err, types.ErrInvitationNotFound) {
 			return err
 		}
 
 		return nil
 	})
+	if errors.Is(err, types.ErrDuplicate) {
+		// the membership was added concurrently after our snapshot was taken, the invitation is used up all the same
+		joined = false
+		if err = handler.core.DeleteInvitation(invitation.Id); errors.Is(err, types.ErrInvitationNotFound) {
+			err = nil
+		}
+	}
 	if err != nil {
 		log.Printf("error: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
 		return
 	}
+	if joined {
+		// a check for the group made before joining may have cached no permissions
+		handler.permissions.InvalidateMember(userId, groupId)
+		handler.webhook.Emit(types.WEBHOOK_MEMBER_ADDED, gin.H{"groupId": groupId, "userId": userId})
+	}
 
 	// redirect to an error page if things went wrong -> the user should not experience an 'error' http blank page thing..
 
@@ -421,60 +1332,347 @@ func (handler *GroupHandlerImpl) joinGroup(c *gin.Context) {
 	})
 }
 
-func (handler *GroupHandlerImpl) rejectGroup(c *gin.Context) {
+// The user an invitation is for: the account it was sent to, or if the address had none at the time, the one registered
+// with it since, in our database or otherwise in firebase, e.g. after signing up through a provider.
+// Returns types.ErrNotFound if nobody has an account with the address.
+func (handler *GroupHandlerImpl) invitedUserId(invitation *types.Invitation) (string, error) {
+	if invitation.UserId != "" {
+		return invitation.UserId, nil
+	}
+	user, err := handler.core.ReadUserByEmail(invitation.Email)
+	if err == nil {
+		return user.Id, nil
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		return "", err
+	}
+	return handler.firebase.GetUserIdByEmail(invitation.Email)
+}
 
-	invitationId := c.Query("inv")
-	if invitationId == "" {
-		c.JSON(http.StatusNotFound, gin.H{"error": "no invitation id given"})
-		return
+// Looks up the invitation of a link's token, responding if there is none. Links from before tokens carried
+// the invitation id and are answered 410, so the invitee knows to ask for a new one.
+func (handler *GroupHandlerImpl) lookupInvitation(c *gin.Context, token string) (*types.Invitation, bool) {
+	invitation, err := handler.core.LookupInvitation(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, types.ErrInvitationNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_INVITATION_NOT_FOUND, "no invitation found for the given token")
+		case errors.Is(err, types.ErrInvitationExpired):
+			AbortWithError(c, http.StatusGone, types.CODE_INVITATION_EXPIRED, "this invitation link has expired, ask the group to invite you again")
+		default:
+			abortInternal(c, "error looking up invitation", err)
+		}
+		return nil, false
 	}
+	return invitation, true
+}
 
-	// remove invitation from db
-	if err := handler.core.DeleteInvitation(invitationId); err != nil {
-		log.Printf("error deleting invitation: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error deleting invitation"})
+// Rejects an invitation, given either the token from its link or, for the signed in invitee, its id.
+// Unknown, already used and someone else's invitations are all reported as not found, so replays don't look like success.
+func (handler *GroupHandlerImpl) rejectGroup(c *gin.Context) {
+	invitation, err := handler.invitationToReject(c)
+	if err == nil {
+		err = handler.core.DeleteInvitation(invitation.Id)
+	}
+	if err != nil {
+		log.Printf("error rejecting invitation: %+v\n", err)
+		switch {
+		case errors.Is(err, types.ErrInvitationNotFound):
+			handler.rejectFailed(c, http.StatusNotFound, types.CODE_INVITATION_NOT_FOUND, "no such invitation")
+		case errors.Is(err, types.ErrInvitationExpired):
+			handler.rejectFailed(c, http.StatusGone, types.CODE_INVITATION_EXPIRED, "this invitation link has expired")
+		default:
+			abortInternal(c, "error rejecting invitation", err)
+		}
 		return
 	}
 
+	// logged before redirecting, the entry takes its status from the response written so far
+	SetAuditDetail(c, map[string]any{"email": invitation.Email})
+	handler.logAction(c, invitation.GroupId, "RejectInvitation")
+
 	// redirect to rejected page (use reset, invited page layout)
-	c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf("%s/rejected", handler.portal_domain))
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/rejected", handler.portal_domain))
+}
+
+// Finds the invitation to reject by the token from its link, which is proof enough, or by its id when the caller's
+// own address is the invited one. An invitation addressed to someone else is reported as not found.
+// The route is exempt from the middleware's token check, so the link works signed out, and the caller is verified here.
+func (handler *GroupHandlerImpl) invitationToReject(c *gin.Context) (*types.Invitation, error) {
+	if token := c.Query("inv"); token != "" {
+		// whoever is signed in is only noted in the log
+		if userId, err := handler.bearerUserId(c); err == nil {
+			c.Set("userId", userId)
+		}
+		return handler.core.LookupInvitation(token)
+	}
+	id := c.Query("id")
+	if id == "" {
+		return nil, fmt.Errorf("%w: neither a token nor an id given", types.ErrInvitationNotFound)
+	}
+	invitation, err := handler.core.ReadInvitation(c.Request.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := handler.bearerUserId(c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invitation %s can only be rejected by id when signed in, %v", types.ErrInvitationNotFound, id, err)
+	}
+	user, err := handler.core.ReadUserById(userId)
+	if errors.Is(err, types.ErrNotFound) {
+		return nil, fmt.Errorf("%w: invitation %s can't be rejected by the unknown user %s", types.ErrInvitationNotFound, id, userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if types.NormalizeEmail(user.Email) != invitation.Email {
+		return nil, fmt.Errorf("%w: invitation %s isn't addressed to the caller", types.ErrInvitationNotFound, id)
+	}
+	c.Set("userId", userId)
+	return invitation, nil
+}
+
+// Verifies the bearer token the way the middleware does, for routes exempt from its check: our own session tokens
+// locally, anything else through firebase.
+func (handler *GroupHandlerImpl) bearerUserId(c *gin.Context) (string, error) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", fmt.Errorf("%w: no bearer token", types.ErrInvalidToken)
+	}
+	if claims, err := handler.token.CheckSessionToken(token); err == nil {
+		return claims.UserId, nil
+	}
+	decodedToken, err := handler.firebase.VerifyToken(token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", types.ErrInvalidToken, err)
+	}
+	return decodedToken.UID, nil
+}
+
+// Browsers are sent to the portal's error page, API clients get the error envelope.
+func (handler *GroupHandlerImpl) rejectFailed(c *gin.Context, status int, code string, message string) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("%s/rejected?error=%s", handler.portal_domain, url.QueryEscape(code)))
+		c.Abort()
+		return
+	}
+	AbortWithError(c, status, code, message)
 }
 
 func (handler *GroupHandlerImpl) removeMember(c *gin.Context) {
 	ctx := c.Request.Context()
-	var body struct {
-		UserId  string `json:"userId" binding:"required"`
-		GroupId string `json:"groupId" binding:"required"`
-		Name    string `json:"name" binding:"required"`
-	}
+	var body types.RemoveMemberBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	if !c.GetBool("internal-service") {
+		// like invitations, the group isn't in the path, so the middleware doesn't log this
+		defer handler.logAction(c, body.GroupId, types.REMOVE_MEMBER)
+	}
+	SetAuditDetail(c, map[string]any{"userId": body.UserId})
+	warnIgnoredName(c, body.Name)
+	var group *types.Organisation
 	err := handler.core.WithTransaction(ctx, func(tx *sql.Tx) error {
+		// the group is given in the body, so the permission is checked here rather than by the middleware
+		if !c.GetBool("internal-service") {
+			if err := handler.role.HasPermission(tx, c.GetString("userId"), body.GroupId, types.REMOVE_MEMBER); err != nil {
+				return err
+			}
+		}
+		// the notification shows the group's own name, never one given by the client
+		var err error
+		if group, err = handler.core.ReadGroupWithTx(tx, body.GroupId); err != nil {
+			return err
+		}
 		return handler.core.RemoveUserFromOrganisationWithTx(tx, body.UserId, body.GroupId)
 	})
 	if err != nil {
 		log.Printf("error removing user from group: %+v\n", err)
-		switch err {
-		case types.ErrNotFound:
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		switch {
+		case errors.Is(err, types.ErrForbiddenOperation):
+			AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "missing permission")
+		case errors.Is(err, types.ErrNotFound) && group == nil:
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_NOT_A_MEMBER, "user is not a member of the group")
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
 		return
 	}
+	handler.permissions.InvalidateMember(body.UserId, body.GroupId)
+	handler.webhook.Emit(types.WEBHOOK_MEMBER_REMOVED, gin.H{"groupId": body.GroupId, "userId": body.UserId})
 
 	// read user's email, to send a notification
 	user, err := handler.core.ReadUserById(body.UserId)
 	if err != nil {
-		log.Printf("error reading user by id: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error reading user email"})
+		abortInternal(c, "error reading user by id", err)
 		return
 	}
-	if err := handler.email.Send([]string{user.Email}, handler.email.CreateRemovedFromGroup(user.Email, body.Name)); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "error sending email"})
+	SetAuditDetail(c, map[string]any{"userId": body.UserId, "email": user.Email})
+	// the notification is optional, so respect the user's preferences,
+	// the removal already happened, so a failed lookup only skips the mail
+	preferences, err := handler.core.ReadNotificationPreferences(c.Request.Context(), body.UserId)
+	if err != nil {
+		log.Printf("error reading notification preferences, skipping removal mail: %+v\n", err)
+		c.Status(http.StatusOK)
 		return
 	}
+	if !preferences.Enabled(types.NOTIFICATION_REMOVED_FROM_GROUP) {
+		c.Status(http.StatusOK)
+		return
+	}
+	message, err := handler.email.CreateRemovedFromGroup(user.Email, user.Locale, &types.RemovedFromGroupMailData{Group: group.Name})
+	if err != nil {
+		abortInternal(c, "error creating removed from group email", err)
+		return
+	}
+	handler.email.Enqueue(message)
 	c.Status(http.StatusOK)
 }
+
+// Most months of history the usage summary goes back.
+const maxUsageHistoryMonths = 24
+
+// Reports the group's month-to-date use of each service against its quota, with ?months=N also the uses of each
+// service in each of the last N calendar months, for charts.
+func (handler *GroupHandlerImpl) usage(c *gin.Context) {
+	months := 0
+	if value := c.Query("months"); value != "" {
+		var err error
+		if months, err = strconv.Atoi(value); err != nil || months < 1 || months > maxUsageHistoryMonths {
+			AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, fmt.Sprintf("months must be between 1 and %d", maxUsageHistoryMonths))
+			return
+		}
+	}
+	groupId := c.Param("id")
+	var services []*types.ServiceUsageSummary
+	err := handler.core.WithReadTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.checkMemberWithTx(c, tx); err != nil {
+			return err
+		}
+		var err error
+		if services, err = handler.core.ReadUsageSummaryWithTx(tx, groupId); err != nil {
+			return err
+		}
+		if months == 0 {
+			return nil
+		}
+		names := make([]string, len(services))
+		for i, service := range services {
+			names[i] = service.ServiceName
+		}
+		history, err := handler.core.ReadMonthlyUsageWithTx(tx, groupId, months, names)
+		if err != nil {
+			return err
+		}
+		for _, service := range services {
+			service.History = history[service.ServiceName]
+			delete(history, service.ServiceName)
+		}
+		// used in earlier months only
+		for name, series := range history {
+			services = append(services, &types.ServiceUsageSummary{ServiceName: name, History: series})
+		}
+		sort.Slice(services, func(i, j int) bool { return services[i].ServiceName < services[j].ServiceName })
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		abortInternal(c, "error reading usage summary", err)
+		return
+	}
+	now := time.Now().UTC()
+	c.JSON(http.StatusOK, &types.GroupUsage{
+		ResetsAt: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
+		Services: services,
+	})
+}
+
+// Parses an optional time query parameter, given either as RFC 3339 or as a date.
+func timeQuery(c *gin.Context, key string) (*time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or a date (YYYY-MM-DD)", key)
+}
+
+// Reports how often each service was used within the group. ?from (inclusive) and ?to (exclusive) limit the
+// report to a time range, which leaves out uses recorded before timestamps were kept. ?detailed=true lists
+// the individual uses, with the email of the user behind each, for auditing, which takes the ViewLogs permission.
+func (handler *GroupHandlerImpl) serviceUsage(c *gin.Context) {
+	from, err := timeQuery(c, "from")
+	if err != nil {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, err.Error())
+		return
+	}
+	to, err := timeQuery(c, "to")
+	if err != nil {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, err.Error())
+		return
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "from must be before to")
+		return
+	}
+	groupId := c.Param("id")
+	detailed := c.Query("detailed") == "true"
+	if detailed && !c.GetBool("internal-service") {
+		permissions, err := handler.permissions.MemberPermissions(c.GetString("userId"), groupId)
+		if err != nil {
+			abortInternal(c, "error reading member permissions", err)
+			return
+		}
+		if !permissions.ViewLogs {
+			AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "the detailed report takes the ViewLogs permission")
+			return
+		}
+	}
+	var usage []*types.ServiceUsage
+	err = handler.core.WithReadTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.checkMemberWithTx(c, tx); err != nil {
+			return err
+		}
+		var err error
+		if usage, err = handler.core.ReadServiceUsageWithTx(tx, groupId, from, to); err != nil {
+			return err
+		}
+		if !detailed {
+			return nil
+		}
+		uses, err := handler.core.ReadServiceUsesWithTx(tx, groupId, from, to)
+		if err != nil {
+			return err
+		}
+		byService := make(map[string]*types.ServiceUsage, len(usage))
+		for _, service := range usage {
+			byService[service.ServiceId] = service
+		}
+		for _, use := range uses {
+			if service, exists := byService[use.ServiceId]; exists {
+				service.Uses = append(service.Uses, use)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		log.Printf("error reading service usage of group %s: %+v\n", groupId, err)
+		AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"services": usage})
+}
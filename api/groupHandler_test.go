@@ -0,0 +1,492 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/types"
+)
+
+// Roles of another group in the body of a role update are refused as a whole, listing each of them.
+func TestUpdateRolesRefusesRolesOfAnotherGroup(t *testing.T) {
+	const otherId = "5f0e6a34-2b6c-4a44-9d1e-7c1b2f0c9a21"
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	body := []*types.Role{
+		{Id: "editor", Name: "Editor", GroupId: testGroupId},
+		{Id: "foreign", Name: "Foreign", GroupId: otherId},
+		{Id: "misspelt", Name: "Misspelt", GroupId: strings.ToUpper(testGroupId)},
+	}
+
+	recorder := a.do(http.MethodPost, "/v1/api/group/"+testGroupId+"/role/update", "owner", body)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400", recorder.Code, recorder.Body.String())
+	}
+	apiErr := responseError(recorder)
+	if apiErr == nil || apiErr.Code != types.CODE_INVALID_REQUEST {
+		t.Fatalf("got %s, want the %s error", recorder.Body.String(), types.CODE_INVALID_REQUEST)
+	}
+	details, _ := json.Marshal(apiErr.Details)
+	if string(details) != `{"roleIds":["foreign","misspelt"]}` {
+		t.Errorf("got details %s, want the ids of the two mismatched roles", details)
+	}
+}
+
+// Clicking an invitation link twice at once joins the group once, and neither click fails.
+func TestDoubleJoinAddsOneMembership(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	token := a.core.invite("invitee", "invitee@example.com", testGroupId)
+
+	// both joins find the user isn't a member yet before either adds them
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	bothChecked := make(chan struct{})
+	go func() { arrived.Wait(); close(bothChecked) }()
+	a.core.before = func(method string) error {
+		if method == "AddUserToOrganisationWithTx" {
+			arrived.Done()
+			select {
+			case <-bothChecked:
+			case <-time.After(time.Second):
+			}
+		}
+		return nil
+	}
+
+	responses := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil)
+		}()
+	}
+	wg.Wait()
+
+	for _, recorder := range responses {
+		if recorder.Code != http.StatusOK {
+			t.Errorf("a join got %d %s, want 200", recorder.Code, recorder.Body.String())
+		}
+	}
+	if a.core.joins != 1 {
+		t.Errorf("added %d memberships, want 1", a.core.joins)
+	}
+	if _, err := a.core.LookupInvitation(token); err != types.ErrInvitationNotFound {
+		t.Errorf("the invitation wasn't used up: %v", err)
+	}
+}
+
+// A member following another invitation to the group has it used up without joining twice.
+func TestJoiningAsAMemberUsesUpTheInvitation(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("member", testGroupId)
+	token := a.core.invite("member", "member@example.com", testGroupId)
+
+	if recorder := a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", recorder.Code, recorder.Body.String())
+	}
+	if a.core.joins != 0 {
+		t.Errorf("added %d memberships for a member", a.core.joins)
+	}
+	if _, err := a.core.LookupInvitation(token); err != types.ErrInvitationNotFound {
+		t.Errorf("the invitation wasn't used up: %v", err)
+	}
+}
+
+// An invitation sent before the address had an account is joined by whoever signed up with it since, firebase
+// accounts we don't know yet included. Without any account the invitee is sent to sign up, and the invitation kept.
+func TestJoiningResolvesInviteesSignedUpSince(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.firebase.AddUser(&firebasetest.User{UID: "onboarding", Email: "onboarding@example.com"})
+	token := a.core.invite("", "onboarding@example.com", testGroupId)
+
+	if recorder := a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", recorder.Code, recorder.Body.String())
+	}
+	if user, err := a.core.ReadUserById("onboarding"); err != nil || user.Email != "onboarding@example.com" {
+		t.Errorf("the user wasn't created: %+v, %v", user, err)
+	}
+	if isMember, _ := a.core.IsMember(context.Background(), "onboarding", testGroupId); !isMember {
+		t.Error("the invitee didn't join the group")
+	}
+
+	token = a.core.invite("", "nobody@example.com", testGroupId)
+	recorder := a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil)
+	apiErr := responseError(recorder)
+	if recorder.Code != http.StatusNotFound || apiErr == nil || apiErr.Code != types.CODE_SIGNUP_REQUIRED {
+		t.Fatalf("got %d %s, want 404 %s", recorder.Code, recorder.Body.String(), types.CODE_SIGNUP_REQUIRED)
+	}
+	if details, _ := apiErr.Details.(map[string]any); !strings.HasSuffix(fmt.Sprint(details["redirect_url"]), "/signup?inv="+token) {
+		t.Errorf("got details %v, want the signup page with the invitation", apiErr.Details)
+	}
+	if _, err := a.core.LookupInvitation(token); err != nil {
+		t.Errorf("the invitation wasn't kept: %v", err)
+	}
+}
+
+// An address invited in one spelling signs up and joins in another, both with the invitation and with its link.
+func TestMixedCaseAddressesInviteSignUpAndJoin(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		invited  string
+		signedUp string
+		// whether the signup is made with the invitation, or the invitee signs up first and follows the link after
+		withInvitation bool
+	}{
+		{name: "signup with the invitation", invited: " Alice@Example.com", signedUp: "ALICE@example.COM ", withInvitation: true},
+		{name: "signup then join", invited: "Bob@EXAMPLE.com ", signedUp: " bob@Example.Com", withInvitation: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestAPI(t)
+			a.owner("owner", testGroupId)
+
+			recorder := a.do(http.MethodPost, "/v1/api/group/member/invite", "owner", map[string]string{"email": tc.invited, "groupId": testGroupId, "name": "Group"})
+			if recorder.Code != http.StatusCreated {
+				t.Fatalf("inviting got %d %s, want 201", recorder.Code, recorder.Body.String())
+			}
+			var token string
+			for candidate, invitation := range a.core.invitations {
+				token = candidate
+				if want := types.NormalizeEmail(tc.invited); invitation.Email != want {
+					t.Errorf("invited %q, want %q", invitation.Email, want)
+				}
+			}
+
+			if tc.withInvitation {
+				recorder = a.do(http.MethodPost, "/v1/api/user/signup/email_password", "",
+					map[string]string{"uid": "invitee", "email": tc.signedUp, "password": "secret", "invitationId": token})
+			} else {
+				recorder = a.do(http.MethodPost, "/v1/api/user/signup", "", map[string]string{"uid": "invitee", "email": tc.signedUp})
+			}
+			if recorder.Code != http.StatusCreated {
+				t.Fatalf("signing up got %d %s, want 201", recorder.Code, recorder.Body.String())
+			}
+			if user, err := a.core.ReadUserById("invitee"); err != nil || user.Email != types.NormalizeEmail(tc.signedUp) {
+				t.Errorf("signed up as %+v, %v, want the normalised address", user, err)
+			}
+			if !tc.withInvitation {
+				if recorder = a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil); recorder.Code != http.StatusOK {
+					t.Fatalf("joining got %d %s, want 200", recorder.Code, recorder.Body.String())
+				}
+			}
+
+			if isMember, _ := a.core.IsMember(context.Background(), "invitee", testGroupId); !isMember {
+				t.Error("the invitee didn't join the group")
+			}
+			if _, err := a.core.LookupInvitation(token); err != types.ErrInvitationNotFound {
+				t.Errorf("the invitation wasn't used up: %v", err)
+			}
+		})
+	}
+}
+
+// Creating a group answers 201 with the new group, which the creator is a member of.
+func TestCreatedGroupIsReturned(t *testing.T) {
+	a := newTestAPI(t)
+	a.core.addUser("creator", "creator@example.com")
+
+	recorder := a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": "Acme"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got %d %s, want 201", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("answered with %s", contentType)
+	}
+	var group types.Organisation
+	if err := json.Unmarshal(recorder.Body.Bytes(), &group); err != nil {
+		t.Fatal(err)
+	}
+	if group.Id == "" || group.Name != "Acme" {
+		t.Fatalf("got %s, want the new group", recorder.Body.String())
+	}
+	if isMember, _ := a.core.IsMember(context.Background(), "creator", group.Id); !isMember {
+		t.Errorf("the creator isn't a member of the group %s returned", group.Id)
+	}
+}
+
+// A second group of the same name is refused with the first one's id, unless the creator asks for it.
+func TestSecondGroupOfTheSameNameIsRefused(t *testing.T) {
+	a := newTestAPI(t)
+	a.core.addUser("creator", "creator@example.com")
+	recorder := a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": "Acme"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got %d %s, want 201", recorder.Code, recorder.Body.String())
+	}
+	var first types.Organisation
+	if err := json.Unmarshal(recorder.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": "ACME"})
+	apiErr := responseError(recorder)
+	if recorder.Code != http.StatusConflict || apiErr == nil || apiErr.Code != types.CODE_GROUP_EXISTS {
+		t.Fatalf("got %d %s, want 409 %s", recorder.Code, recorder.Body.String(), types.CODE_GROUP_EXISTS)
+	}
+	if details, _ := apiErr.Details.(map[string]any); details["groupId"] != first.Id {
+		t.Errorf("got details %v, want the existing group %s", apiErr.Details, first.Id)
+	}
+
+	recorder = a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]any{"name": "Acme", "allowDuplicateName": true})
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("allowing the duplicate got %d %s, want 201", recorder.Code, recorder.Body.String())
+	}
+	if recorder = a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": "Ac\u200bme"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("a name with a zero-width space got %d %s, want 400", recorder.Code, recorder.Body.String())
+	}
+}
+
+// A user who created as many groups within a day as they may is refused another until the oldest stops counting.
+func TestGroupCreationIsCappedPerDay(t *testing.T) {
+	t.Setenv("GROUP_CREATION_DAILY_LIMIT", "2")
+	a := newTestAPI(t)
+	a.core.addUser("creator", "creator@example.com")
+	for _, name := range []string{"First", "Second"} {
+		if recorder := a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": name}); recorder.Code != http.StatusCreated {
+			t.Fatalf("creating %s got %d %s, want 201", name, recorder.Code, recorder.Body.String())
+		}
+	}
+	recorder := a.do(http.MethodPost, "/v1/api/group/create", "creator", map[string]string{"name": "Third"})
+	apiErr := responseError(recorder)
+	if recorder.Code != http.StatusTooManyRequests || apiErr == nil || apiErr.Code != types.CODE_GROUP_LIMIT {
+		t.Fatalf("got %d %s, want 429 %s", recorder.Code, recorder.Body.String(), types.CODE_GROUP_LIMIT)
+	}
+	if retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After")); err != nil || retryAfter <= 0 || retryAfter > 24*60*60 {
+		t.Errorf("got Retry-After %q, want the seconds until the first group stops counting", recorder.Header().Get("Retry-After"))
+	}
+}
+
+// Mails show the group's stored name, a name in the body is ignored with a warning, and a deleted group can't be
+// invited to or removed from.
+func TestMailsShowTheStoredGroupName(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+
+	recorder := a.do(http.MethodPost, "/v1/api/group/member/invite", "owner", map[string]string{"email": "invitee@example.com", "groupId": testGroupId, "name": "Totally Real Bank"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got %d %s, want 201", recorder.Code, recorder.Body.String())
+	}
+	if warning := recorder.Header().Get("Warning"); !strings.Contains(warning, "name is deprecated") {
+		t.Errorf("got warning %q, want the name reported as ignored", warning)
+	}
+	if len(a.mails.groups) != 1 || a.mails.groups[0] != "Group" {
+		t.Errorf("mailed group names %q, want the stored name", a.mails.groups)
+	}
+	recorder = a.do(http.MethodPost, "/v1/api/group/member/invite", "owner", map[string]string{"email": "other@example.com", "groupId": testGroupId})
+	if recorder.Code != http.StatusCreated || recorder.Header().Get("Warning") != "" {
+		t.Errorf("inviting without a name got %d %s, warning %q", recorder.Code, recorder.Body.String(), recorder.Header().Get("Warning"))
+	}
+
+	a.core.deleted = map[string]bool{testGroupId: true}
+	for _, request := range []struct {
+		method, path string
+		body         map[string]string
+	}{
+		{http.MethodPost, "/v1/api/group/member/invite", map[string]string{"email": "late@example.com", "groupId": testGroupId}},
+		{http.MethodDelete, "/v1/api/group/member/remove", map[string]string{"userId": "invitee", "groupId": testGroupId}},
+	} {
+		recorder = a.do(request.method, request.path, "owner", request.body)
+		if apiErr := responseError(recorder); recorder.Code != http.StatusNotFound || apiErr == nil || apiErr.Code != types.CODE_GROUP_NOT_FOUND {
+			t.Errorf("%s to a deleted group got %d %s, want 404 %s", request.path, recorder.Code, recorder.Body.String(), types.CODE_GROUP_NOT_FOUND)
+		}
+	}
+	if len(a.core.invitations) != 2 {
+		t.Errorf("%d invitations exist, want none to the deleted group", len(a.core.invitations))
+	}
+}
+
+// A member is found by their address in our user table too, which firebase may not know.
+func TestMembersUnknownToFirebaseAreNotInvited(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.core.addUser("member", "member@example.com")
+	a.store.set("member", testGroupId, true)
+
+	recorder := a.do(http.MethodPost, "/v1/api/group/member/invite", "owner", map[string]string{"email": "member@example.com", "groupId": testGroupId})
+	if apiErr := responseError(recorder); recorder.Code != http.StatusConflict || apiErr == nil || apiErr.Code != types.CODE_ALREADY_MEMBER {
+		t.Errorf("got %d %s, want 409 %s", recorder.Code, recorder.Body.String(), types.CODE_ALREADY_MEMBER)
+	}
+	if len(a.core.invitations) != 0 {
+		t.Errorf("the member was invited")
+	}
+}
+
+// An invitation is rejected by the token of its link, or by its id by the invitee. Anything else, a replay
+// included, is reported as not found rather than redirected to as if it worked.
+func TestRejectingInvitations(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	for _, userId := range []string{"invitee", "stranger"} {
+		a.firebase.AddUser(&firebasetest.User{UID: userId, Email: userId + "@example.com"})
+		a.core.addUser(userId, userId+"@example.com")
+	}
+	byToken := a.core.invite("", "invitee@example.com", testGroupId)
+	signedOut := a.core.invite("", "invitee@example.com", testGroupId)
+	byId := a.core.invite("", "invitee@example.com", testGroupId)
+	invitation, _ := a.core.LookupInvitation(byId)
+
+	// no user is the link as mailed, followed without an Authorization header
+	tests := []struct {
+		name   string
+		query  string
+		userId string
+		status int
+	}{
+		{"by token", "inv=" + byToken, "invitee", http.StatusSeeOther},
+		{"by token again", "inv=" + byToken, "invitee", http.StatusNotFound},
+		{"by token signed out", "inv=" + signedOut, "", http.StatusSeeOther},
+		{"by an unknown token", "inv=unknown", "invitee", http.StatusNotFound},
+		{"by id signed out", "id=" + invitation.Id, "", http.StatusNotFound},
+		{"by id with an invalid token", "id=" + invitation.Id, "ghost", http.StatusNotFound},
+		{"by id of someone else's invitation", "id=" + invitation.Id, "stranger", http.StatusNotFound},
+		{"by id", "id=" + invitation.Id, "invitee", http.StatusSeeOther},
+		{"with neither", "", "invitee", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := a.do(http.MethodGet, "/v1/api/group/reject?"+test.query, test.userId, nil)
+		if recorder.Code != test.status {
+			t.Errorf("rejecting %s got %d %s, want %d", test.name, recorder.Code, recorder.Body.String(), test.status)
+		}
+		if apiErr := responseError(recorder); test.status == http.StatusNotFound && (apiErr == nil || apiErr.Code != types.CODE_INVITATION_NOT_FOUND) {
+			t.Errorf("rejecting %s got %s, want %s", test.name, recorder.Body.String(), types.CODE_INVITATION_NOT_FOUND)
+		}
+	}
+	if len(a.core.invitations) != 0 {
+		t.Errorf("%d invitations are left, want all three rejected", len(a.core.invitations))
+	}
+	var rejections, signedIn int
+	for _, entry := range a.log.written() {
+		if entry.Action == "RejectInvitation" && entry.GroupId == testGroupId && entry.Status == "OK" &&
+			strings.Contains(string(entry.Detail), "invitee@example.com") {
+			rejections++
+			if entry.UserId == "invitee" {
+				signedIn++
+			}
+		}
+	}
+	if rejections != 3 || signedIn != 2 {
+		t.Errorf("logged %d rejections, %d of them by the invitee, want 3 with the signed in two attributed", rejections, signedIn)
+	}
+
+	// a browser is sent to the portal with the error instead
+	request := httptest.NewRequest(http.MethodGet, "/v1/api/group/reject?inv="+byToken, nil)
+	request.Header.Set("Authorization", "Bearer invitee")
+	request.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+	a.router.ServeHTTP(recorder, request)
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusSeeOther || !strings.HasSuffix(location, "/rejected?error="+types.CODE_INVITATION_NOT_FOUND) {
+		t.Errorf("a browser got %d to %q, want 303 to the rejected page with the error", recorder.Code, location)
+	}
+}
+
+// Pending invitations, who they're for and who sent them, are read by those who may invite members only.
+func TestInvitationsAreReadByInvitersOnly(t *testing.T) {
+	a := newTestAPI(t)
+	for _, userId := range []string{"member", "inviter"} {
+		a.core.addUser(userId, userId+"@example.com")
+		a.store.set(userId, testGroupId, true)
+	}
+	inviter := &types.Role{Name: "Inviter", GroupId: testGroupId}
+	inviter.InviteMember = true
+	a.store.roles["inviter "+testGroupId] = []*types.Role{inviter}
+	invitation, _ := a.core.LookupInvitation(a.core.invite("", "invitee@example.com", testGroupId))
+
+	for _, path := range []string{
+		"/v1/api/group/" + testGroupId + "/invitations",
+		"/v1/api/group/" + testGroupId + "/invitation/" + invitation.Id,
+	} {
+		recorder := a.do(http.MethodGet, path, "member", nil)
+		if apiErr := responseError(recorder); recorder.Code != http.StatusForbidden || apiErr == nil || apiErr.Code != types.CODE_MISSING_PERMISSION {
+			t.Errorf("a plain member reading %s got %d %s, want 403 %s", path, recorder.Code, recorder.Body.String(), types.CODE_MISSING_PERMISSION)
+		}
+		if recorder := a.do(http.MethodGet, path, "inviter", nil); recorder.Code != http.StatusOK {
+			t.Errorf("an inviter reading %s got %d %s, want 200", path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+// Every member sees how much each service is used, the individual uses and who made them are for auditors only.
+func TestDetailedServiceUsageTakesViewLogs(t *testing.T) {
+	a := newTestAPI(t)
+	for _, userId := range []string{"member", "auditor"} {
+		a.core.addUser(userId, userId+"@example.com")
+		a.store.set(userId, testGroupId, true)
+	}
+	auditor := &types.Role{Name: "Auditor", GroupId: testGroupId}
+	auditor.ViewLogs = true
+	a.store.roles["auditor "+testGroupId] = []*types.Role{auditor}
+	path := "/v1/api/group/" + testGroupId + "/service_usage"
+
+	if recorder := a.do(http.MethodGet, path, "member", nil); recorder.Code != http.StatusOK {
+		t.Errorf("a plain member got %d %s for the totals, want 200", recorder.Code, recorder.Body.String())
+	}
+	recorder := a.do(http.MethodGet, path+"?detailed=true", "member", nil)
+	if apiErr := responseError(recorder); recorder.Code != http.StatusForbidden || apiErr == nil || apiErr.Code != types.CODE_MISSING_PERMISSION {
+		t.Errorf("a plain member got %d %s for the uses, want 403 %s", recorder.Code, recorder.Body.String(), types.CODE_MISSING_PERMISSION)
+	}
+	if recorder := a.do(http.MethodGet, path+"?detailed=true", "auditor", nil); recorder.Code != http.StatusOK {
+		t.Errorf("an auditor got %d %s for the uses, want 200", recorder.Code, recorder.Body.String())
+	}
+}
+
+// A group's exported roles imported into another group recreate them, permissions and all, and importing them
+// again skips every one.
+func TestExportedConfigImports(t *testing.T) {
+	const targetId = "5f0e6a34-2b6c-4a44-9d1e-7c1b2f0c9a21"
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.owner("owner", targetId)
+	auditor := &types.Role{Id: "auditor", Name: "Auditor", GroupId: testGroupId}
+	auditor.ViewLogs = true
+	editor := &types.Role{Id: "editor", Name: "Editor", GroupId: testGroupId}
+	editor.CreateCase = true
+	editor.UpdateCaseMetadata = true
+	a.roles.defined = map[string][]*types.Role{testGroupId: {{Id: "owner", Name: "Group Owner", GroupId: testGroupId}, auditor, editor}}
+
+	exported := a.do(http.MethodGet, "/v1/api/group/"+testGroupId+"/export_config", "owner", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export got %d %s", exported.Code, exported.Body.String())
+	}
+	var config types.GroupConfig
+	if err := json.Unmarshal(exported.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Roles) != 2 {
+		t.Fatalf("exported %d roles, want the two besides the owner role", len(config.Roles))
+	}
+
+	imported := a.do(http.MethodPost, "/v1/api/group/"+targetId+"/import_config", "owner", json.RawMessage(exported.Body.Bytes()))
+	var result types.ImportConfigResult
+	json.Unmarshal(imported.Body.Bytes(), &result)
+	if imported.Code != http.StatusOK || len(result.Created) != 2 || len(result.Skipped) != 0 {
+		t.Fatalf("import got %d %s, want both roles created", imported.Code, imported.Body.String())
+	}
+	for _, source := range []*types.Role{auditor, editor} {
+		var copied *types.Role
+		for _, role := range a.roles.defined[targetId] {
+			if role.Name == source.Name {
+				copied = role
+			}
+		}
+		if copied == nil || copied.Permissions != source.Permissions {
+			t.Errorf("role %s was imported as %+v", source.Name, copied)
+		}
+	}
+
+	again := a.do(http.MethodPost, "/v1/api/group/"+targetId+"/import_config", "owner", json.RawMessage(exported.Body.Bytes()))
+	json.Unmarshal(again.Body.Bytes(), &result)
+	if again.Code != http.StatusOK || len(result.Created) != 0 || len(result.Skipped) != 2 {
+		t.Errorf("importing again got %d %s, want both roles skipped", again.Code, again.Body.String())
+	}
+}
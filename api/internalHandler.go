@@ -1,10 +1,17 @@
 package api
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/repository"
 	"user.service.altiore.io/service"
@@ -12,167 +19,200 @@ import (
 )
 
 type InternalHandler interface {
-	RegisterRoutes(router *gin.Engine)
+	RegisterRoutes(router *gin.RouterGroup)
 }
 
 type InternalHandlerImpl struct {
-	core          repository.CoreRepository
-	role          repository.RoleRepository
-	log           repository.LogRepository
-	firebase      service.FirebaseService
-	cache         map[string]*types.User
-	permissionMap map[string]string
+	core        repository.CoreRepository
+	role        repository.RoleRepository
+	log         repository.LogRepository
+	firebase    service.FirebaseService
+	permissions service.PermissionResolver
+	webhook     service.WebhookService
+	token       service.TokenService
+
+	// lets a service that can't get its own token accepted inspect it, see TOKEN_INSPECT_SECRET
+	inspectSecret string
+	// the default of the limits on group creation reported
+	groupCreationLimit int
 }
 
 type InternalHandlerOpts struct {
-	Core     repository.CoreRepository
-	Role     repository.RoleRepository
-	Log      repository.LogRepository
-	Firebase service.FirebaseService
+	Core        repository.CoreRepository
+	Role        repository.RoleRepository
+	Log         repository.LogRepository
+	Firebase    service.FirebaseService
+	Permissions service.PermissionResolver
+	Webhook     service.WebhookService
+	Token       service.TokenService
 }
 
 func NewInternalHandler(opts *InternalHandlerOpts) InternalHandler {
 	h := &InternalHandlerImpl{
-		core:     opts.Core,
-		role:     opts.Role,
-		log:      opts.Log,
-		firebase: opts.Firebase,
-		cache:    make(map[string]*types.User),
-		permissionMap: map[string]string{
-			"/api/case/cis18/create": "CreateCase",
-			"/api/case/nis2/create":  "CreateCase",
-
-			"/api/case/updateMetadata": "UpdateCaseMetadata",
-			"/api/case/delete":         "DeleteCase",
-		},
-	}
-	go h.cacheFlushWorker()
+		core:        opts.Core,
+		role:        opts.Role,
+		log:         opts.Log,
+		firebase:    opts.Firebase,
+		permissions: opts.Permissions,
+		webhook:     opts.Webhook,
+		token:       opts.Token,
+
+		inspectSecret:      os.Getenv("TOKEN_INSPECT_SECRET"),
+		groupCreationLimit: groupCreationDailyLimit(),
+	}
 	return h
 }
 
-func (handler *InternalHandlerImpl) RegisterRoutes(router *gin.Engine) {
+// Checking a user's token is open to any caller and inspecting a token has a check of its own, the rest of the
+// routes are for internal services only.
+func (handler *InternalHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 	router.POST("/api/internal/check_user", handler.checkUser)
 	router.POST("/api/internal/strict_check_user", handler.strictCheckUser)
+	router.POST("/api/internal/token/inspect", handler.inspectToken)
+
+	internal := router.Group("", requireInternalService)
+	internal.POST("/api/internal/users", handler.lookupUsers)
+	internal.POST("/api/internal/service", handler.createService)
+	internal.PATCH("/api/internal/service/:id", handler.updateService)
+	internal.DELETE("/api/internal/service/:id", handler.deleteService)
+	internal.GET("/api/internal/group/:id", handler.groupInfo)
+	internal.POST("/api/internal/group/:id/restore", handler.restoreGroup)
+	internal.GET("/api/internal/group/:id/quota/:serviceName", handler.readQuota)
+	internal.PUT("/api/internal/group/:id/quota/:serviceName", handler.setQuota)
+	internal.DELETE("/api/internal/group/:id/quota/:serviceName", handler.deleteQuota)
+	internal.GET("/api/internal/user/:userId/group_limit", handler.readGroupLimit)
+	internal.PUT("/api/internal/user/:userId/group_limit", handler.setGroupLimit)
+	internal.DELETE("/api/internal/user/:userId/group_limit", handler.deleteGroupLimit)
+	internal.POST("/api/internal/log/sweep", handler.sweepLog)
+	internal.GET("/api/internal/permission_cache", handler.permissionCacheStats)
 }
 
-// Flushes the handler cache periodically.
-func (handler *InternalHandlerImpl) cacheFlushWorker() {
-	log.Println("middlware cache flush worker started.")
-	ticker := time.NewTicker(time.Minute * 30)
-	defer func() {
-		ticker.Stop()
-		log.Println("middleware cache flush worker stopped.")
-	}()
-	for {
-		<-ticker.C
-		handler.cache = make(map[string]*types.User)
+// Turns away anything but internal services, whose token was verified by verifyInternalServiceToken.
+func requireInternalService(c *gin.Context) {
+	if !c.GetBool("internal-service") {
+		AbortWithError(c, http.StatusForbidden, types.CODE_INTERNAL_ONLY, "internal services only")
+		return
 	}
+	c.Next()
 }
 
 func (handler *InternalHandlerImpl) checkUser(c *gin.Context) {
-	var body struct {
-		Token string `json:"token" binding:"required"`
-	}
+	var body types.CheckUserBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.Status(http.StatusBadRequest)
+		abortInvalidRequest(c, err)
 		return
 	}
-	if _, err := handler.firebase.VerifyToken(body.Token); err != nil {
-		c.Status(http.StatusNotFound)
+	decodedToken, err := handler.firebase.VerifyToken(body.Token)
+	if err != nil {
+		AbortWithError(c, versionedStatus(c, http.StatusNotFound, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "invalid token")
 		return
 	}
-	c.Status(http.StatusOK)
+	identity, ok := handler.checkedIdentity(c, decodedToken)
+	if !ok {
+		return
+	}
+	respondChecked(c, identity)
+}
+
+// The identity behind a verified token when the caller asked for it with ?detail=true, combining the token's claims
+// with our user record. Without it the check endpoints answer with a bare status, as callers from before expect.
+// Responds USER_NOT_FOUND if the user has no account here, returns whether the request may go on.
+func (handler *InternalHandlerImpl) checkedIdentity(c *gin.Context, token *auth.Token) (*types.UserIdentity, bool) {
+	if c.Query("detail") != "true" {
+		return nil, true
+	}
+	user, err := handler.permissions.User(token.UID)
+	if err != nil {
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error reading user", err)
+			return nil, false
+		}
+		AbortWithError(c, versionedStatus(c, http.StatusNotFound, http.StatusUnauthorized), types.CODE_USER_NOT_FOUND, "user does not exist")
+		return nil, false
+	}
+	name, _ := token.Claims["name"].(string)
+	return &types.UserIdentity{
+		UserId:   token.UID,
+		Email:    user.Email,
+		Name:     name,
+		Verified: user.Verified,
+	}, true
+}
+
+func respondChecked(c *gin.Context, identity *types.UserIdentity) {
+	if identity == nil {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, identity)
 }
 
 // Checks the user is OK with respect to their token (firebase) and the requested action (permission).
 func (handler *InternalHandlerImpl) strictCheckUser(c *gin.Context) {
-	var body struct {
-		Token   string `json:"token" binding:"required"`
-		GroupId string `json:"groupId" binding:"required"`
-		Action  string `json:"action" binding:"required"`
-	}
+	var body types.StrictCheckUserBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
 
 	// check token
-	// -> check token using firebase service
-	decodedToken, err := handler.firebase.VerifyToken(body.Token)
+	// -> check token using firebase service, bypassing the cache so revoked tokens are caught
+	decodedToken, err := handler.firebase.VerifyTokenStrict(body.Token)
 	if err != nil {
 		log.Printf("%+v\t%+v\n", decodedToken, err)
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "invalid token")
 		return
 	}
 
-	// check that user exists in our database
+	// check that user exists in our database, a database failure shouldn't cost the user their sessions
 	if err := handler.core.UserExists(decodedToken.UID); err != nil {
-		println(err)
-		c.AbortWithStatus(http.StatusForbidden)
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
+		AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_USER_NOT_FOUND, "user does not exist")
 		handler.firebase.RevokeToken(decodedToken.UID)
 		return
 	}
+	identity, ok := handler.checkedIdentity(c, decodedToken)
+	if !ok {
+		return
+	}
 
 	// check permissions
 	// if no permission is needed for the action, dont do anything..
-	action, exists := handler.permissionMap[body.Action]
+	action, exists := handler.permissions.ForAction(body.Action)
 	if !exists {
-		c.Status(http.StatusOK)
+		respondChecked(c, identity)
 		return
 	}
-	memberRoles, err := handler.role.ReadMemberRoles(decodedToken.UID, body.GroupId)
+	memberPermissions, err := handler.permissions.MemberPermissions(decodedToken.UID, body.GroupId)
 	if err != nil {
-		log.Printf("error reading member roles: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		abortInternal(c, "error reading member permissions", err)
 		return
 	}
 
 	log.Printf("permission needed: %s\n", action)
-	for _, e := range memberRoles {
-		log.Printf("member role: %+v\n", e)
-	}
 
-	if !EvaluatePermission(memberRoles, action) {
+	hasPermission, err := EvaluatePermission(memberPermissions, action)
+	if err != nil {
+		abortInternal(c, "error evaluating permission", err)
+		return
+	}
+	if !hasPermission {
 		log.Printf("user doesnt have permission for %s\n", action)
-		c.JSON(http.StatusForbidden, gin.H{"error": "missing permissions"})
+		AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "missing permission")
 		return
 	}
 
 	// log entry here
 
 	// get email by userId
-	var email string
-	user, exists := handler.cache[decodedToken.UID]
-	if !exists {
-		user, err := handler.core.ReadUserById(decodedToken.UID)
-		if err != nil {
-			log.Printf("error reading user by id to get mail for logging: %+v\n", err)
-			// Set a default value in case of error
-			email = "Error reading email"
-		} else {
-			email = user.Email
-		}
-	} else {
-		email = user.Email
-	}
-
-	// Transform status code to business comprehendable
-	var status string
-	switch c.Writer.Status() {
-	case http.StatusOK:
-		status = "OK"
-	case http.StatusInternalServerError:
-		status = "Error"
-	case http.StatusForbidden:
-		status = "Forbidden"
-	case http.StatusConflict:
-		status = "OK"
-	case http.StatusBadRequest:
-		status = "Error"
-	case http.StatusUnauthorized:
-		status = "Unauthorized"
-	}
+	email := handler.permissions.UserEmail(decodedToken.UID)
+
+	// respond before logging, so the entry carries the status actually sent
+	respondChecked(c, identity)
+	status := auditStatus(c)
 
 	handler.log.NewEntry(&types.LogEntry{
 		GroupId:   body.GroupId,
@@ -182,6 +222,312 @@ func (handler *InternalHandlerImpl) strictCheckUser(c *gin.Context) {
 		Email:     email,
 		Timestamp: time.Now().Format(time.RFC3339),
 	})
+}
+
+// Looks up the Firebase profiles of many users at once, for other services only.
+// Unknown uids are left out of the response.
+func (handler *InternalHandlerImpl) lookupUsers(c *gin.Context) {
+	var body types.LookupUsersBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	users, err := handler.firebase.GetUsers(c.Request.Context(), body.UIDs)
+	if err != nil {
+		abortInternal(c, "error looking up users", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// Writes the response for a failed service catalogue change.
+func serviceCatalogueError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		AbortWithError(c, http.StatusNotFound, types.CODE_SERVICE_NOT_FOUND, "service not found")
+	case errors.Is(err, types.ErrDuplicate):
+		AbortWithError(c, http.StatusConflict, types.CODE_SERVICE_EXISTS, "a service with that name and implementation group already exists")
+	case errors.Is(err, types.ErrServiceInUse):
+		AbortWithError(c, http.StatusConflict, types.CODE_SERVICE_IN_USE, "service has been used, retire it instead")
+	default:
+		abortInternal(c, "error changing service catalogue", err)
+	}
+}
+
+// Adds a service to the catalogue, internal services only.
+func (handler *InternalHandlerImpl) createService(c *gin.Context) {
+	var body types.CreateServiceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	service := &types.Service{
+		Name:                body.Name,
+		ImplementationGroup: body.ImplementationGroup,
+		Description:         body.Description,
+	}
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		return handler.core.CreateServiceWithTx(tx, service)
+	})
+	if err != nil {
+		serviceCatalogueError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, service)
+}
+
+// Changes the given fields of a service, setting retired to true retires it and false brings it back.
+// Internal services only.
+func (handler *InternalHandlerImpl) updateService(c *gin.Context) {
+	var body types.UpdateServiceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	var service *types.Service
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		var err error
+		if service, err = handler.core.ReadServiceWithTx(tx, c.Param("id")); err != nil {
+			return err
+		}
+		if body.Name != nil {
+			service.Name = *body.Name
+		}
+		if body.ImplementationGroup != nil {
+			// 0 removes the implementation group, matching how usage is registered
+			service.ImplementationGroup = body.ImplementationGroup
+			if *body.ImplementationGroup == 0 {
+				service.ImplementationGroup = nil
+			}
+		}
+		if body.Description != nil {
+			service.Description = *body.Description
+		}
+		if body.Retired != nil {
+			service.Retired = *body.Retired
+		}
+		return handler.core.UpdateServiceWithTx(tx, service)
+	})
+	if err != nil {
+		serviceCatalogueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, service)
+}
+
+// Deletes a service that was never used, internal services only.
+func (handler *InternalHandlerImpl) deleteService(c *gin.Context) {
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		return handler.core.DeleteServiceWithTx(tx, c.Param("id"))
+	})
+	if err != nil {
+		serviceCatalogueError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// Reads a group for other services, e.g. the case service showing its name. The ETag changes with anything
+// in the response, so callers can refresh with If-None-Match and get a 304 if nothing changed.
+func (handler *InternalHandlerImpl) groupInfo(c *gin.Context) {
+	group, err := handler.core.ReadGroupInfo(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		abortInternal(c, "error reading group", err)
+		return
+	}
+	// the member count changes without touching updatedAt, so it's part of the tag
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%t|%d", group.Id, group.Name, group.MemberCount, group.Deleted, group.UpdatedAt.UnixNano()))))
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", group.UpdatedAt.UTC().Format(http.TimeFormat))
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
 
+// Restores a deleted group with everything it had, for support to undo accidental deletions.
+func (handler *InternalHandlerImpl) restoreGroup(c *gin.Context) {
+	groupId := c.Param("id")
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		return handler.core.RestoreGroupWithTx(tx, groupId)
+	})
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found, or deleted too long ago to restore")
+			return
+		}
+		abortInternal(c, "error restoring group", err)
+		return
+	}
+	handler.webhook.Emit(types.WEBHOOK_GROUP_RESTORED, gin.H{"groupId": groupId})
 	c.Status(http.StatusOK)
 }
+
+// Reads how much of its monthly quota of a service a group has used, 404 if its use of the service is unlimited.
+func (handler *InternalHandlerImpl) readQuota(c *gin.Context) {
+	usage, err := handler.core.ReadQuotaUsage(c.Request.Context(), c.Param("id"), c.Param("serviceName"))
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "the group's use of the service is unlimited")
+			return
+		}
+		abortInternal(c, "error reading quota usage", err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// Limits a group's uses of a service per calendar month, e.g. for groups on the free tier.
+func (handler *InternalHandlerImpl) setQuota(c *gin.Context) {
+	var body types.SetQuotaBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	ctx := c.Request.Context()
+	groupId, serviceName := c.Param("id"), c.Param("serviceName")
+	if _, err := handler.core.ReadGroup(ctx, groupId); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+			return
+		}
+		abortInternal(c, "error reading group", err)
+		return
+	}
+	if err := handler.core.SetServiceQuota(ctx, groupId, serviceName, *body.MonthlyLimit); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_SERVICE_NOT_FOUND, "service not found")
+			return
+		}
+		abortInternal(c, "error setting quota", err)
+		return
+	}
+	usage, err := handler.core.ReadQuotaUsage(ctx, groupId, serviceName)
+	if err != nil {
+		abortInternal(c, "error reading quota usage", err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// Lifts a group's limit on uses of a service.
+func (handler *InternalHandlerImpl) deleteQuota(c *gin.Context) {
+	if err := handler.core.DeleteServiceQuota(c.Request.Context(), c.Param("id"), c.Param("serviceName")); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "the group's use of the service is unlimited")
+			return
+		}
+		abortInternal(c, "error deleting quota", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Reads how many groups a user may create per day.
+func (handler *InternalHandlerImpl) readGroupLimit(c *gin.Context) {
+	handler.respondGroupLimit(c, c.Param("userId"))
+}
+
+// Allows a user a number of groups per day other than GROUP_CREATION_DAILY_LIMIT, or lifts their limit,
+// e.g. for a customer setting up groups by script.
+func (handler *InternalHandlerImpl) setGroupLimit(c *gin.Context) {
+	var body types.SetGroupCreationLimitBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	if body.Unlimited == (body.DailyLimit != nil) {
+		abortInvalidRequest(c, errors.New("either dailyLimit or unlimited must be given"))
+		return
+	}
+	userId := c.Param("userId")
+	if _, err := handler.core.ReadUserById(userId); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_USER_NOT_FOUND, "user not found")
+			return
+		}
+		abortInternal(c, "error reading user", err)
+		return
+	}
+	if err := handler.core.SetGroupCreationLimit(c.Request.Context(), userId, body.DailyLimit); err != nil {
+		abortInternal(c, "error setting group creation limit", err)
+		return
+	}
+	handler.respondGroupLimit(c, userId)
+}
+
+// Puts a user back on the default limit of groups per day.
+func (handler *InternalHandlerImpl) deleteGroupLimit(c *gin.Context) {
+	if err := handler.core.DeleteGroupCreationLimit(c.Request.Context(), c.Param("userId")); err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "the user has the default limit")
+			return
+		}
+		abortInternal(c, "error deleting group creation limit", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (handler *InternalHandlerImpl) respondGroupLimit(c *gin.Context, userId string) {
+	override, overridden, err := handler.core.ReadGroupCreationLimit(c.Request.Context(), userId)
+	if err != nil {
+		abortInternal(c, "error reading group creation limit", err)
+		return
+	}
+	limit := &types.GroupCreationLimit{UserId: userId, DailyLimit: &handler.groupCreationLimit, Overridden: overridden}
+	if overridden {
+		limit.DailyLimit, limit.Unlimited = override, override == nil
+	}
+	c.JSON(http.StatusOK, limit)
+}
+
+// Runs the log retention sweep now rather than waiting for its daily run, e.g. for testing.
+func (handler *InternalHandlerImpl) sweepLog(c *gin.Context) {
+	removed, err := handler.log.SweepExpired(c.Request.Context())
+	if err != nil {
+		if errors.Is(err, types.ErrSweepRunning) {
+			AbortWithError(c, http.StatusConflict, types.CODE_ALREADY_RUNNING, "a sweep is already running")
+			return
+		}
+		abortInternal(c, "error sweeping log", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// Reports why a token is or isn't accepted as an internal token. A service whose token is being rejected can't
+// authenticate with it, so besides a valid internal token the TOKEN_INSPECT_SECRET is accepted in X-Inspect-Secret,
+// the route is exempt from user authentication for that reason. Disabled for anyone else when the secret isn't set.
+func (handler *InternalHandlerImpl) inspectToken(c *gin.Context) {
+	secret := c.GetHeader("X-Inspect-Secret")
+	bootstrap := handler.inspectSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(handler.inspectSecret)) == 1
+	if !c.GetBool("internal-service") && !bootstrap {
+		AbortWithError(c, http.StatusForbidden, types.CODE_INTERNAL_ONLY, "internal services only")
+		return
+	}
+	var body types.InspectTokenBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	inspection := handler.token.Inspect(body.Token)
+	// the token itself is never logged, the fingerprint is enough to tell tokens apart
+	log.Printf("inspected internal token %s: valid=%t %s\n", tokenFingerprint(body.Token), inspection.Valid, inspection.Reason)
+	c.JSON(http.StatusOK, inspection)
+}
+
+// A short hash identifying a token in logs without revealing it.
+func tokenFingerprint(token string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(token)))[:19]
+}
+
+// Reports how often permission checks were answered from the permission cache, for metrics.
+func (handler *InternalHandlerImpl) permissionCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, handler.permissions.PermissionCacheStats())
+}
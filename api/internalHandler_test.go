@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/types"
+)
+
+// Knows the users of fakeMemberships with a membership, for UserExists.
+type fakeUserDirectory struct {
+	repository.CoreRepository
+	store *fakeMemberships
+}
+
+func (fake *fakeUserDirectory) UserExists(uid string) error {
+	fake.store.mu.Lock()
+	defer fake.store.mu.Unlock()
+	for key := range fake.store.members {
+		if userId, _, _ := strings.Cut(key, " "); userId == uid {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: user %s", types.ErrNotFound, uid)
+}
+
+// Serves the internal routes, with the fake firebase taking the uid as the token.
+func newInternalRouter(store *fakeMemberships, resolver service.PermissionResolver, entries *fakeLog) *gin.Engine {
+	router := gin.New()
+	NewInternalHandler(&InternalHandlerOpts{
+		Core:        &fakeUserDirectory{store: store},
+		Role:        store,
+		Log:         entries,
+		Firebase:    firebasetest.NewFakeFirebaseService(nil),
+		Permissions: resolver,
+	}).RegisterRoutes(&router.RouterGroup)
+	return router
+}
+
+func strictCheckUser(router *gin.Engine, body gin.H) *httptest.ResponseRecorder {
+	raw, _ := json.Marshal(body)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/internal/strict_check_user", bytes.NewReader(raw)))
+	return recorder
+}
+
+func TestStrictCheckUser(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("author", groupId, true)
+	store.set("reader", groupId, true)
+	author := &types.Role{Name: "Author", GroupId: groupId}
+	author.CreateCase = true
+	store.roles["author "+groupId] = []*types.Role{author}
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	entries := &fakeLog{}
+	router := newInternalRouter(store, resolver, entries)
+
+	tests := []struct {
+		name   string
+		token  string
+		action string
+		status int
+		logged string // the permission of the entry logged, if any
+	}{
+		{"a member with the permission", "author", "/api/case/cis18/create", http.StatusOK, types.CREATE_CASE},
+		{"a member without the permission", "reader", "/api/case/nis2/create", http.StatusForbidden, ""},
+		{"an action needing no permission", "reader", "/api/case/read", http.StatusOK, ""},
+		{"an unknown user", "stranger", "/api/case/cis18/create", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(entries.written())
+			recorder := strictCheckUser(router, gin.H{"token": test.token, "groupId": groupId, "action": test.action})
+			if recorder.Code != test.status {
+				t.Fatalf("got %d %s, want %d", recorder.Code, recorder.Body.String(), test.status)
+			}
+			written := entries.written()[before:]
+			if test.logged == "" {
+				if len(written) != 0 {
+					t.Errorf("logged %+v, want nothing", written)
+				}
+				return
+			}
+			if len(written) != 1 || written[0].Action != test.logged || written[0].Status != "OK" || written[0].GroupId != groupId {
+				t.Errorf("logged %+v, want a single OK %s entry", written, test.logged)
+			}
+		})
+	}
+}
+
+// The middleware checks routes and strictCheckUser checks the actions of other services through the same resolver,
+// so a revoked role is refused by both at once.
+func TestRouteAndActionChecksAgree(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("editor", groupId, true)
+	editor := &types.Role{Name: "Editor", GroupId: groupId}
+	editor.ManageRoles = true
+	editor.DeleteCase = true
+	store.roles["editor "+groupId] = []*types.Role{editor}
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	entries := &fakeLog{}
+
+	middleware := &MiddlewareHandlerImpl{core: &fakeCore{store: store}, role: store, log: entries, permissions: resolver, slugs: make(map[string]string)}
+	routes := gin.New()
+	routes.Use(func(c *gin.Context) { c.Set("userId", "editor") }, middleware.groupMembership, middleware.checkPermission, middleware.logUserAction)
+	routes.POST("/api/group/:id/role/delete", func(c *gin.Context) { c.Status(http.StatusOK) })
+	deleteRole := func() int {
+		recorder := httptest.NewRecorder()
+		routes.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/group/"+groupId+"/role/delete", nil))
+		return recorder.Code
+	}
+	internal := newInternalRouter(store, resolver, entries)
+	deleteCase := func() int {
+		return strictCheckUser(internal, gin.H{"token": "editor", "groupId": groupId, "action": "/api/case/delete"}).Code
+	}
+
+	if route, action := deleteRole(), deleteCase(); route != http.StatusOK || action != http.StatusOK {
+		t.Fatalf("a member with the permissions got %d for the route and %d for the action", route, action)
+	}
+	store.mu.Lock()
+	store.roles["editor "+groupId] = nil
+	store.mu.Unlock()
+	resolver.InvalidateMember("editor", groupId)
+	if route, action := deleteRole(), deleteCase(); route != http.StatusForbidden || action != http.StatusForbidden {
+		t.Errorf("a member whose role was revoked got %d for the route and %d for the action, want 403 for both", route, action)
+	}
+}
+
+// A token is inspected by internal services, or by anyone with the inspect secret, and tells which check failed.
+func TestInspectToken(t *testing.T) {
+	t.Setenv("SERVICE_TOKEN_ISSUER", "user-service")
+	t.Setenv("TOKEN_INSPECT_SECRET", "inspect-secret")
+	a := newTestAPI(t)
+	valid, err := a.token.NewToken("user-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SERVICE_TOKEN_SECRET", "another-secret")
+	forged, err := service.NewTokenService(nil).NewToken("user-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspect := func(token string, secret string) (*httptest.ResponseRecorder, *types.TokenInspection) {
+		raw, _ := json.Marshal(types.InspectTokenBody{Token: token})
+		request := httptest.NewRequest(http.MethodPost, "/v1/api/internal/token/inspect", bytes.NewReader(raw))
+		request.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			request.Header.Set("X-Inspect-Secret", secret)
+		}
+		recorder := httptest.NewRecorder()
+		a.router.ServeHTTP(recorder, request)
+		var inspection types.TokenInspection
+		json.Unmarshal(recorder.Body.Bytes(), &inspection)
+		return recorder, &inspection
+	}
+
+	recorder, inspection := inspect(valid, "inspect-secret")
+	if recorder.Code != http.StatusOK || !inspection.Valid || inspection.Reason != "" {
+		t.Errorf("a valid token got %d %s, want it valid", recorder.Code, recorder.Body.String())
+	}
+	recorder, inspection = inspect(forged, "inspect-secret")
+	if recorder.Code != http.StatusOK || inspection.Valid || inspection.Checks.Signature || !strings.HasPrefix(inspection.Reason, "signature") {
+		t.Errorf("a token signed with another secret got %d %s, want the signature failed", recorder.Code, recorder.Body.String())
+	}
+	if inspection.Claims["iss"] != "user-service" {
+		t.Errorf("got claims %v, want them read without trusting the token", inspection.Claims)
+	}
+	if strings.Contains(recorder.Body.String(), "test-secret") {
+		t.Error("the signing secret was given away")
+	}
+	if recorder, _ = inspect(valid, "wrong-secret"); recorder.Code != http.StatusForbidden {
+		t.Errorf("a wrong inspect secret got %d %s, want 403", recorder.Code, recorder.Body.String())
+	}
+}
+
+// With ?detail=true the check endpoints answer with who the token belongs to, without it with a bare status.
+func TestCheckUserDetail(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("user", groupId, true)
+	store.set("deleted", groupId, true)
+	users := &fakeCore{store: store}
+	users.addUser("user", "user@example.com")
+	router := newInternalRouter(store, service.NewPermissionResolver(&service.PermissionResolverOpts{Users: users, Roles: store, Members: store}), &fakeLog{})
+
+	for _, path := range []string{"/api/internal/check_user", "/api/internal/strict_check_user"} {
+		body := gin.H{"token": "user", "groupId": groupId, "action": "/api/case/read"}
+		raw, _ := json.Marshal(body)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(raw)))
+		if recorder.Code != http.StatusOK || recorder.Body.Len() != 0 {
+			t.Errorf("%s got %d %s, want a bare 200", path, recorder.Code, recorder.Body.String())
+		}
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path+"?detail=true", bytes.NewReader(raw)))
+		var identity types.UserIdentity
+		if err := json.Unmarshal(recorder.Body.Bytes(), &identity); recorder.Code != http.StatusOK || err != nil ||
+			identity.UserId != "user" || identity.Email != "user@example.com" {
+			t.Errorf("%s?detail=true got %d %s, want the user's identity", path, recorder.Code, recorder.Body.String())
+		}
+
+		// a token whose user has no account here
+		raw, _ = json.Marshal(gin.H{"token": "deleted", "groupId": groupId, "action": "/api/case/read"})
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path+"?detail=true", bytes.NewReader(raw)))
+		if apiErr := responseError(recorder); recorder.Code != http.StatusNotFound || apiErr == nil || apiErr.Code != types.CODE_USER_NOT_FOUND {
+			t.Errorf("%s?detail=true for a user without an account got %d %s, want 404 %s", path, recorder.Code, recorder.Body.String(), types.CODE_USER_NOT_FOUND)
+		}
+	}
+}
+
+// Every internal route but the token checks turns away signed-in users before its handler runs.
+func TestInternalRoutesRefuseUsers(t *testing.T) {
+	open := map[string]bool{"/api/internal/check_user": true, "/api/internal/strict_check_user": true, "/api/internal/token/inspect": true}
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	for _, route := range a.router.Routes() {
+		canonical := canonicalPath(route.Path)
+		if !strings.HasPrefix(canonical, "/api/internal/") || open[canonical] {
+			continue
+		}
+		recorder := a.do(route.Method, routePath(route.Path), "owner", map[string]any{})
+		if apiErr := responseError(recorder); recorder.Code != http.StatusForbidden || apiErr == nil || apiErr.Code != types.CODE_INTERNAL_ONLY {
+			t.Errorf("%s %s as a user got %d %s, want 403 %s", route.Method, route.Path, recorder.Code, recorder.Body.String(), types.CODE_INTERNAL_ONLY)
+		}
+	}
+	if a.api.maintenance.Load() {
+		t.Error("a user turned maintenance on")
+	}
+}
@@ -1,42 +1,169 @@
 package api
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
 )
 
 type LogHandler interface {
-	RegisterRoutes(router *gin.Engine)
+	RegisterRoutes(router *gin.RouterGroup)
 }
 
 type LogHandlerImpl struct {
-	log repository.LogRepository
+	log         repository.LogRepository
+	role        repository.RoleRepository
+	core        repository.CoreRepository
+	email       service.EmailService
+	permissions service.PermissionResolver
+
+	// what the alert scan looks for, and whether group owners are mailed the alerts
+	alertRules    []service.AlertRule
+	alertEmails   bool
+	portal_domain string
 }
 
 type LogHandlerOpts struct {
-	Log repository.LogRepository
+	Log  repository.LogRepository
+	Role repository.RoleRepository
+	// for the alert scan
+	Core        repository.CoreRepository
+	Email       service.EmailService
+	Permissions service.PermissionResolver
 }
 
 func NewLogHandler(opts *LogHandlerOpts) LogHandler {
-	return &LogHandlerImpl{
-		log: opts.Log,
+	handler := &LogHandlerImpl{
+		log:           opts.Log,
+		role:          opts.Role,
+		core:          opts.Core,
+		email:         opts.Email,
+		permissions:   opts.Permissions,
+		alertRules:    service.NewAlertRules(),
+		alertEmails:   os.Getenv("ALERT_EMAILS") == "true",
+		portal_domain: os.Getenv("PORTAL_DOMAIN"),
 	}
+	go handler.alertWorker()
+	return handler
 }
 
-func (handler *LogHandlerImpl) RegisterRoutes(router *gin.Engine) {
-	router.GET("/api/logs/:groupId", handler.getGroupLogs)
+// Membership and the ViewLogs permission are checked by the middleware, like every other /api/group/:id route.
+func (handler *LogHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/api/group/:id/logs", handler.getGroupLogs)
+	router.GET("/api/group/:id/logs/count", handler.countGroupLogs)
+	router.GET("/api/group/:id/logs/stream", handler.streamGroupLogs)
+	router.GET("/api/group/:id/alerts", handler.getGroupAlerts)
+	router.GET("/api/logs/:groupId", handler.getGroupLogsDeprecated)
 }
 
 // Gets all logs associated with the group by id.
 func (handler *LogHandlerImpl) getGroupLogs(c *gin.Context) {
+	handler.readGroupLogs(c, c.Param("id"))
+}
+
+// Number of entries in the group's log, e.g. for a badge, without downloading them.
+func (handler *LogHandlerImpl) countGroupLogs(c *gin.Context) {
+	count, err := handler.log.CountByGroupId(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortInternal(c, "error counting group logs", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": count})
+}
+
+// The group's alert entries, newest first, e.g. for a badge. With ?since= only those written since, in RFC 3339.
+func (handler *LogHandlerImpl) getGroupAlerts(c *gin.Context) {
+	var since time.Time
+	if value := c.Query("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			abortInvalidRequest(c, fmt.Errorf("since must be a RFC 3339 time: %w", err))
+			return
+		}
+	}
+	alerts, err := handler.log.ReadAlerts(c.Request.Context(), c.Param("id"), since)
+	if err != nil {
+		abortInternal(c, "error reading group alerts", err)
+		return
+	}
+	c.JSON(http.StatusOK, alerts)
+}
+
+// Comments sent while no entries are written, so proxies don't close an idle stream.
+const logStreamHeartbeat = time.Second * 30
+
+// Streams the group's new entries as server-sent "log" events, until the client disconnects.
+// Entries from before connecting aren't sent, they're read with getGroupLogs. The stream ends early if the
+// client can't keep up, after which it should reconnect and read the log again.
+func (handler *LogHandlerImpl) streamGroupLogs(c *gin.Context) {
+	entries, unsubscribe, err := handler.log.Subscribe(c.Param("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, types.ErrTooManyStreams):
+			AbortWithError(c, http.StatusTooManyRequests, types.CODE_TOO_MANY_STREAMS, "too many live views of this log are open")
+		default:
+			abortInternal(c, "error subscribing to group logs", err)
+		}
+		return
+	}
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(logStreamHeartbeat)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case entry, open := <-entries:
+			if !open {
+				return false
+			}
+			c.SSEvent("log", entry)
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		}
+	})
+}
+
+// Deprecated path of getGroupLogs. It isn't under /api/group/:id, so the permission is checked here.
+func (handler *LogHandlerImpl) getGroupLogsDeprecated(c *gin.Context) {
 	groupId := c.Param("groupId")
+	c.Header("Deprecation", "true")
+	c.Header("Link", fmt.Sprintf("<%s/api/group/%s/logs>; rel=\"successor-version\"", apiVersionPrefix, groupId))
+	if !c.GetBool("internal-service") {
+		if err := handler.role.HasPermission(nil, c.GetString("userId"), groupId, types.VIEW_LOGS); err != nil {
+			switch {
+			case errors.Is(err, types.ErrForbiddenOperation):
+				AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "missing permission")
+			default:
+				abortInternal(c, "error checking log permission", err)
+			}
+			return
+		}
+	}
+	handler.readGroupLogs(c, groupId)
+}
+
+func (handler *LogHandlerImpl) readGroupLogs(c *gin.Context, groupId string) {
 	logs, err := handler.log.ReadByGroupId(c.Request.Context(), groupId)
 	if err != nil {
-		log.Printf("error reading group logs: %+v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		abortInternal(c, "error reading group logs", err)
 		return
 	}
 	c.JSON(http.StatusOK, logs)
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"user.service.altiore.io/types"
+)
+
+// The group's log is read at /api/group/:id/logs and at the deprecated /api/logs/:groupId alike, and counted
+// without being read, all only by members allowed to view it.
+func TestGroupLogsAreReadAndCounted(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.store.set("member", testGroupId, true)
+	a.core.addUser("member", "member@example.com")
+	a.core.addUser("stranger", "stranger@example.com")
+	for _, entry := range []*types.LogEntry{
+		{GroupId: testGroupId, Action: types.INVITE_MEMBER, UserId: "owner"},
+		{GroupId: testGroupId, Action: types.REMOVE_MEMBER, UserId: "owner"},
+		{GroupId: "another-group", Action: types.INVITE_MEMBER, UserId: "owner"},
+	} {
+		a.log.NewEntry(entry)
+	}
+
+	for _, path := range []string{"/v1/api/group/" + testGroupId + "/logs", "/v1/api/logs/" + testGroupId} {
+		recorder := a.do(http.MethodGet, path, "owner", nil)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("GET %s got %d %s", path, recorder.Code, recorder.Body.String())
+			continue
+		}
+		var entries []*types.LogEntry
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil || len(entries) != 2 {
+			t.Errorf("GET %s read %s, want the group's 2 entries", path, recorder.Body.String())
+		}
+	}
+	deprecated := a.do(http.MethodGet, "/v1/api/logs/"+testGroupId, "owner", nil)
+	if deprecated.Header().Get("Deprecation") != "true" || deprecated.Header().Get("Link") != "</v1/api/group/"+testGroupId+"/logs>; rel=\"successor-version\"" {
+		t.Errorf("the deprecated path doesn't point at its successor: %v", deprecated.Header())
+	}
+	recorder := a.do(http.MethodGet, "/v1/api/group/"+testGroupId+"/logs/count", "owner", nil)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"count":2}` {
+		t.Errorf("counting got %d %s, want 200 {\"count\":2}", recorder.Code, recorder.Body.String())
+	}
+
+	for _, path := range []string{"/v1/api/group/" + testGroupId + "/logs", "/v1/api/group/" + testGroupId + "/logs/count", "/v1/api/logs/" + testGroupId} {
+		if recorder := a.do(http.MethodGet, path, "member", nil); recorder.Code != http.StatusForbidden {
+			t.Errorf("GET %s without permission got %d %s, want 403", path, recorder.Code, recorder.Body.String())
+		}
+	}
+	for _, path := range []string{"/v1/api/group/" + testGroupId + "/logs", "/v1/api/group/" + testGroupId + "/logs/count"} {
+		if recorder := a.do(http.MethodGet, path, "stranger", nil); recorder.Code != http.StatusNotFound {
+			t.Errorf("GET %s by a non-member got %d %s, want 404", path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/types"
+)
+
+// Seconds clients are told to wait before retrying while in maintenance, unless MAINTENANCE_RETRY_AFTER says otherwise.
+const defaultMaintenanceRetryAfter = 120
+
+// Paths served during maintenance, so the load balancer can see the state and the mode can be turned off again.
+var maintenanceExemptPaths = map[string]bool{
+	"/healthz":                  true,
+	"/readyz":                   true,
+	"/api/internal/maintenance": true,
+}
+
+// Reads the state to start in from MAINTENANCE_MODE, for planned windows.
+func (h *API_impl) initMaintenance() {
+	h.maintenanceRetryAfter = defaultMaintenanceRetryAfter
+	if seconds, err := strconv.Atoi(os.Getenv("MAINTENANCE_RETRY_AFTER")); err == nil && seconds > 0 {
+		h.maintenanceRetryAfter = seconds
+	}
+	if os.Getenv("MAINTENANCE_MODE") == "true" {
+		h.maintenance.Store(true)
+		log.Println("starting in maintenance mode")
+	}
+}
+
+// Responds 503 to new requests while in maintenance. The flag is only read as a request comes in,
+// so requests already being handled when it's turned on are left to finish.
+func (h *API_impl) rejectDuringMaintenance(c *gin.Context) {
+	if !h.maintenance.Load() || maintenanceExemptPaths[canonicalPath(c.Request.URL.Path)] {
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(h.maintenanceRetryAfter))
+	AbortWithError(c, http.StatusServiceUnavailable, types.CODE_MAINTENANCE, "down for maintenance")
+}
+
+// Turns maintenance mode on or off, internal services only.
+func (h *API_impl) setMaintenance(c *gin.Context) {
+	var body types.MaintenanceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	if previous := h.maintenance.Swap(*body.Enabled); previous != *body.Enabled {
+		log.Printf("maintenance mode set to %t\n", *body.Enabled)
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": *body.Enabled})
+}
+
+// Liveness, the process is up.
+func (h *API_impl) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness, reports not ready during maintenance so the load balancer drains this instance,
+// or when a dependency check fails, listing the failed checks.
+func (h *API_impl) readyz(c *gin.Context) {
+	if h.maintenance.Load() {
+		c.Header("Retry-After", strconv.Itoa(h.maintenanceRetryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "maintenance"})
+		return
+	}
+	if failed := h.readiness.failed(c.Request.Context()); len(failed) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": failed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+const (
+	readinessCheckTimeout = time.Second * 5
+	// Probes run every few seconds, logging in to e.g. the SMTP server that often would get us throttled.
+	readinessCacheTTL = time.Second * 30
+)
+
+// Runs the readiness checks, keeping the outcome for readinessCacheTTL.
+type readiness struct {
+	checks map[string]func(ctx context.Context) error
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	failures  map[string]string
+}
+
+// Failed checks by name with their error, empty when all pass.
+func (r *readiness) failed(ctx context.Context) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.checks) == 0 || time.Since(r.checkedAt) < readinessCacheTTL {
+		return r.failures
+	}
+	// a probe giving up early mustn't be remembered as a failed check
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+	defer cancel()
+	failures := make(map[string]string)
+	for name, check := range r.checks {
+		if err := check(ctx); err != nil {
+			log.Printf("readiness check %s failed: %v\n", name, err)
+			failures[name] = err.Error()
+		}
+	}
+	r.checkedAt, r.failures = time.Now(), failures
+	return failures
+}
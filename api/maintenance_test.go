@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// Turning maintenance on lets requests being handled finish and answers new ones 503, while the process stays live.
+func TestMaintenanceLetsInFlightRequestsFinish(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	token := a.core.invite("invitee", "invitee@example.com", testGroupId)
+	started, release := make(chan struct{}), make(chan struct{})
+	a.core.before = func(method string) error {
+		if method == "AddUserToOrganisationWithTx" {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() { inFlight <- a.do(http.MethodGet, "/v1/api/group/join?inv="+token, "", nil) }()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the join didn't start")
+	}
+
+	if recorder := a.doInternal(http.MethodPost, "/v1/api/internal/maintenance", map[string]bool{"enabled": true}); recorder.Code != http.StatusOK {
+		t.Fatalf("turning maintenance on got %d %s", recorder.Code, recorder.Body.String())
+	}
+	for _, path := range []string{"/v1/api/group/list", "/api/group/list"} {
+		recorder := a.do(http.MethodGet, path, "owner", nil)
+		if apiErr := responseError(recorder); recorder.Code != http.StatusServiceUnavailable || apiErr == nil || apiErr.Code != types.CODE_MAINTENANCE {
+			t.Errorf("a new request to %s got %d %s, want 503 %s", path, recorder.Code, recorder.Body.String(), types.CODE_MAINTENANCE)
+		}
+		if recorder.Header().Get("Retry-After") == "" {
+			t.Errorf("the 503 to %s doesn't say when to retry", path)
+		}
+	}
+	if recorder := a.do(http.MethodGet, "/healthz", "", nil); recorder.Code != http.StatusOK {
+		t.Errorf("liveness got %d during maintenance, want 200", recorder.Code)
+	}
+	if recorder := a.do(http.MethodGet, "/readyz", "", nil); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness got %d during maintenance, want 503 so the instance is drained", recorder.Code)
+	}
+
+	close(release)
+	if recorder := <-inFlight; recorder.Code != http.StatusOK {
+		t.Errorf("the request in flight got %d %s, want 200", recorder.Code, recorder.Body.String())
+	}
+	if a.core.joins != 1 {
+		t.Errorf("the request in flight added %d memberships, want 1", a.core.joins)
+	}
+
+	a.core.before = nil
+	if recorder := a.doInternal(http.MethodPost, "/v1/api/internal/maintenance", map[string]bool{"enabled": false}); recorder.Code != http.StatusOK {
+		t.Fatalf("turning maintenance off got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := a.do(http.MethodGet, "/v1/api/group/list", "owner", nil); recorder.Code != http.StatusOK {
+		t.Errorf("a request after maintenance got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestMaintenanceIsForInternalServicesOnly(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	recorder := a.do(http.MethodPost, "/v1/api/internal/maintenance", "owner", map[string]bool{"enabled": true})
+	if recorder.Code != http.StatusForbidden || a.api.maintenance.Load() {
+		t.Errorf("a user turning maintenance on got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,39 +18,48 @@ import (
 )
 
 type MiddlewareHandler interface {
-	RegisterRoutes(*gin.Engine)
+	RegisterRoutes(*gin.RouterGroup)
 }
 
 type MiddlewareHandlerOpts struct {
-	Core     repository.CoreRepository
-	Role     repository.RoleRepository
-	Log      repository.LogRepository
-	Firebase service.FirebaseService
-	Token    service.TokenService
+	Core        repository.CoreRepository
+	Role        repository.RoleRepository
+	Log         repository.LogRepository
+	Firebase    service.FirebaseService
+	Token       service.TokenService
+	Permissions service.PermissionResolver
 }
 
 type MiddlewareHandlerImpl struct {
-	core     repository.CoreRepository
-	role     repository.RoleRepository
-	log      repository.LogRepository
-	firebase service.FirebaseService
-	token    service.TokenService
-	cache    map[string]*types.User
-
-	exemptPaths   []*regexp.Regexp
-	permissionMap map[string]string
+	core        repository.CoreRepository
+	role        repository.RoleRepository
+	log         repository.LogRepository
+	firebase    service.FirebaseService
+	token       service.TokenService
+	permissions service.PermissionResolver
+
+	exemptPaths []*regexp.Regexp
+
+	// the group ids of slugs, flushed every slugCacheTTL
+	slugs   map[string]string
+	slugsMu sync.Mutex
 }
 
+// How long a slug resolves to the group that had it, after it was changed.
+const slugCacheTTL = time.Second * 30
+
 func NewMiddlewareHandler(opts *MiddlewareHandlerOpts) *MiddlewareHandlerImpl {
 	h := &MiddlewareHandlerImpl{
-		core:     opts.Core,
-		role:     opts.Role,
-		log:      opts.Log,
-		firebase: opts.Firebase,
-		token:    opts.Token,
-		cache:    make(map[string]*types.User),
+		core:        opts.Core,
+		role:        opts.Role,
+		log:         opts.Log,
+		firebase:    opts.Firebase,
+		token:       opts.Token,
+		permissions: opts.Permissions,
 		exemptPaths: []*regexp.Regexp{
 			regexp.MustCompile("/api/token/verify"),
+			// takes the session token in its body, expired ones included
+			regexp.MustCompile("^/api/token/refresh$"),
 			regexp.MustCompile("^/api/user/([a-zA-Z0-9]+)/exists$"),
 			regexp.MustCompile("/api/user/registerServiceUsed"),
 			regexp.MustCompile("/api/user/signup"),
@@ -56,57 +68,32 @@ func NewMiddlewareHandler(opts *MiddlewareHandlerOpts) *MiddlewareHandlerImpl {
 			regexp.MustCompile("/api/user/start_password_reset"),
 			regexp.MustCompile("/api/user/reset_password"),
 			regexp.MustCompile("/api/group/join"),
+			// the invitation link's token is proof enough, a rejection by id verifies the bearer token itself
+			regexp.MustCompile("^/api/group/reject$"),
+			// checks the internal token or its own secret itself, for services whose token is rejected
+			regexp.MustCompile("^/api/internal/token/inspect$"),
+			regexp.MustCompile("^/api/openapi.json$"),
+			regexp.MustCompile("^/api/docs$"),
 		},
-		permissionMap: map[string]string{
-
-			"PATCH /api/group/:id/update":  "RenameGroup",
-			"DELETE /api/group/:id/delete": "DeleteGroup",
-
-			"POST /api/group/member/invite":   "InviteMember",
-			"DELETE /api/group/member/remove": "RemoveMember",
-
-			"": "",
-			/*
-				CREATE_CASE          = "CreateCase"
-				UPDATE_CASE_METADATA = "UpdateCaseMetadata"
-				DELETE_CASE          = "DeleteCase"
-				EXPORT_CASE          = "ExportCase"
-
-				VIEW_LOGS   = "ViewLogs"
-				EXPORT_LOGS = "ExportLogs"
-			*/
-		},
+		slugs: make(map[string]string),
 	}
-	go h.cacheFlushWorker()
+	go h.slugFlushWorker()
 	return h
 }
 
-func (handler *MiddlewareHandlerImpl) RegisterRoutes(router *gin.Engine) {
+func (handler *MiddlewareHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 	router.Use(handler.verifyInternalServiceToken)
 	router.Use(handler.verifyToken)
+	router.Use(handler.groupMembership)
 	router.Use(handler.checkPermission)
 	router.Use(handler.logUserAction)
 }
 
-// Flushes the handler cache periodically.
-func (handler *MiddlewareHandlerImpl) cacheFlushWorker() {
-	log.Println("middlware cache flush worker started.")
-	ticker := time.NewTicker(time.Minute * 30)
-	defer func() {
-		ticker.Stop()
-		log.Println("middleware cache flush worker stopped.")
-	}()
-	for {
-		<-ticker.C
-		handler.cache = make(map[string]*types.User)
-	}
-}
-
 func (handler *MiddlewareHandlerImpl) verifyInternalServiceToken(c *gin.Context) {
 	if token := c.GetHeader("X-Internal-Token"); token != "" {
 		if err := handler.token.CheckToken(token); err != nil {
 			log.Printf("internal token check resulted in error: %+v\n", err)
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid token"})
+			AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "invalid token")
 			return
 		}
 		// set this to skip other middleware (they are user minded, not service minded)
@@ -114,7 +101,9 @@ func (handler *MiddlewareHandlerImpl) verifyInternalServiceToken(c *gin.Context)
 	}
 }
 
-// Verifies the token for every incoming request.
+// Verifies the token for every incoming request. Every rejection is the error envelope, so the portal can tell
+// AUTH_HEADER_MISSING and AUTH_HEADER_MALFORMED (a client bug) from TOKEN_INVALID (refresh the token and retry)
+// and USER_UNKNOWN (the account is gone, sign out). All of them are 401 with conventional status codes.
 func (handler *MiddlewareHandlerImpl) verifyToken(c *gin.Context) {
 
 	// skip if it's a service request
@@ -125,7 +114,7 @@ func (handler *MiddlewareHandlerImpl) verifyToken(c *gin.Context) {
 
 	// don't verify on specified paths
 	for _, path := range handler.exemptPaths {
-		if path.MatchString(c.Request.URL.Path) {
+		if path.MatchString(canonicalPath(c.Request.URL.Path)) {
 			c.Next()
 			return
 		}
@@ -134,44 +123,142 @@ func (handler *MiddlewareHandlerImpl) verifyToken(c *gin.Context) {
 	// check if the authorization header is set
 	authorization := c.GetHeader("Authorization")
 	if authorization == "" {
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("no Authorization header set"))
+		AbortWithError(c, versionedStatus(c, http.StatusBadRequest, http.StatusUnauthorized), types.CODE_AUTH_HEADER_MISSING, "no Authorization header set")
 		return
 	}
 
 	// check if the authorization header format is correct
 	if !strings.HasPrefix(authorization, "Bearer ") {
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("incorrect authorization header format"))
+		AbortWithError(c, versionedStatus(c, http.StatusBadRequest, http.StatusUnauthorized), types.CODE_AUTH_HEADER_MALFORMED, "incorrect authorization header format")
 		return
 	}
 
 	// extract token from header
 	token := strings.TrimPrefix(authorization, "Bearer ")
 	if token == "" {
-		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("no token set in header"))
+		AbortWithError(c, versionedStatus(c, http.StatusBadRequest, http.StatusUnauthorized), types.CODE_AUTH_HEADER_MALFORMED, "no token set in header")
 		return
 	}
 
-	// decode and verify token through firebase
-	decodedToken, err := handler.firebase.VerifyToken(token)
-	if err != nil {
-		log.Printf("%+v\t%+v\n", decodedToken, err)
-		c.AbortWithStatus(http.StatusForbidden)
+	// our own session tokens are verified locally, anything else is decoded and verified through firebase
+	var userId string
+	claims, err := handler.token.CheckSessionToken(token)
+	switch {
+	case err == nil:
+		userId = claims.UserId
+		c.Set("sessionId", claims.SessionId)
+	case errors.Is(err, types.ErrSessionExpired):
+		AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "session token expired")
 		return
+	default:
+		decodedToken, err := handler.firebase.VerifyToken(token)
+		if err != nil {
+			log.Printf("%+v\t%+v\n", decodedToken, err)
+			AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "invalid token")
+			return
+		}
+		userId = decodedToken.UID
 	}
 
-	// check that user exists in our database
-	if err := handler.core.UserExists(decodedToken.UID); err != nil {
-		println(err)
-		c.AbortWithStatus(http.StatusForbidden)
-		handler.firebase.RevokeToken(decodedToken.UID)
+	// check that user exists in our database, a database failure shouldn't cost the user their sessions
+	if err := handler.core.UserExists(userId); err != nil {
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
+		AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_USER_UNKNOWN, "user does not exist")
+		handler.firebase.RevokeToken(userId)
 		return
 	}
 
 	// set userId for request and continue
-	c.Set("userId", decodedToken.UID)
+	c.Set("userId", userId)
 	c.Next()
 }
 
+// Ensures the user is a member of the group in the path of every /api/group/:id route, and sets "groupId" for
+// the handlers. Non-members receive a 404, so the existence of the group isn't confirmed to them.
+// The group may be given by its slug, which is replaced with its id for everything after this.
+func (handler *MiddlewareHandlerImpl) groupMembership(c *gin.Context) {
+
+	route := canonicalPath(c.FullPath())
+	if route != "/api/group/:id" && !strings.HasPrefix(route, "/api/group/:id/") {
+		c.Next()
+		return
+	}
+
+	if !handler.resolveGroupSlug(c) {
+		return
+	}
+
+	// skip if it's a service request
+	if c.GetBool("internal-service") {
+		c.Next()
+		return
+	}
+
+	// memberships are cached by the resolver, removing a member or deleting the group drops them
+	groupId := c.Param("id")
+	isMember, err := handler.permissions.IsMember(c.Request.Context(), c.GetString("userId"), groupId)
+	if err != nil {
+		abortInternal(c, "error checking group membership", err)
+		return
+	}
+	if !isMember {
+		AbortWithError(c, http.StatusNotFound, types.CODE_GROUP_NOT_FOUND, "group not found")
+		return
+	}
+
+	c.Set("groupId", groupId)
+	c.Next()
+}
+
+// Replaces a slug in the :id parameter with the id of its group, returns false if the request was aborted.
+// A value no group has as its slug is left as it is, for the membership check to turn away.
+func (handler *MiddlewareHandlerImpl) resolveGroupSlug(c *gin.Context) bool {
+	slug := c.Param("id")
+	if types.IsGroupId(slug) {
+		return true
+	}
+	handler.slugsMu.Lock()
+	groupId, cached := handler.slugs[slug]
+	handler.slugsMu.Unlock()
+	if !cached {
+		var err error
+		groupId, err = handler.core.ResolveGroupSlug(c.Request.Context(), slug)
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			return true
+		case err != nil:
+			abortInternal(c, "error resolving group slug", err)
+			return false
+		}
+		handler.slugsMu.Lock()
+		handler.slugs[slug] = groupId
+		handler.slugsMu.Unlock()
+	}
+	for i := range c.Params {
+		if c.Params[i].Key == "id" {
+			c.Params[i].Value = groupId
+		}
+	}
+	return true
+}
+
+// Flushes the slug cache periodically, a changed slug may resolve to its group until then.
+func (handler *MiddlewareHandlerImpl) slugFlushWorker() {
+	ticker := time.NewTicker(slugCacheTTL)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		handler.slugsMu.Lock()
+		handler.slugs = make(map[string]string)
+		handler.slugsMu.Unlock()
+	}
+}
+
+// Evaluates the user's roles against the permission the route needs. Group routes have passed groupMembership
+// by now, so only the roles are left to check.
 func (handler *MiddlewareHandlerImpl) checkPermission(c *gin.Context) {
 
 	// skip if it's a service request
@@ -181,7 +268,7 @@ func (handler *MiddlewareHandlerImpl) checkPermission(c *gin.Context) {
 	}
 
 	// create a key and retrieve needed permission
-	neededPermission, exists := handler.permissionMap[fmt.Sprintf("%s %s", c.Request.Method, c.FullPath())]
+	neededPermission, exists := handler.permissions.ForRoute(c.Request.Method, canonicalPath(c.FullPath()))
 	if !exists {
 		// this means that the endpoint has no required perms, and therefore isn't a group-related endpoint either;
 		// -> permissions are related to group user management, nothing else.
@@ -193,23 +280,27 @@ func (handler *MiddlewareHandlerImpl) checkPermission(c *gin.Context) {
 	// set this, so other middleware can differ requests requiring perms
 	c.Set("needsPermission", true)
 
-	// ensure the 'id' path parameter exists in the path
-	groupId, exists := c.Params.Get("id")
-	if !exists {
-		log.Printf("assumed groupId was present, but wasn't.\n")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	// set by groupMembership for every route under /api/group/:id
+	groupId := c.GetString("groupId")
+	if groupId == "" {
+		abortInternal(c, "error checking permission", fmt.Errorf("%s %s needs a permission but is not under /api/group/:id", c.Request.Method, c.FullPath()))
 		return
 	}
-	memberRoles, err := handler.role.ReadMemberRoles(c.GetString("userId"), groupId)
+	memberPermissions, err := handler.permissions.MemberPermissions(c.GetString("userId"), groupId)
 	if err != nil {
-		log.Printf("error reading member roles: %+v\n", err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		abortInternal(c, "error reading member permissions", err)
+		return
+	}
+
+	hasPermission, err := EvaluatePermission(memberPermissions, neededPermission)
+	if err != nil {
+		abortInternal(c, "error evaluating permission", err)
 		return
 	}
 
 	// permission status is set for later use, so the logging handler can
 	// register the request.
-	c.Set("hasPermission", EvaluatePermission(memberRoles, neededPermission))
+	c.Set("hasPermission", hasPermission)
 }
 
 // Logs the request whenever a user has to be verified, for documentation purposes.
@@ -233,11 +324,18 @@ func (handler *MiddlewareHandlerImpl) logUserAction(c *gin.Context) {
 
 	// evaluate what to do with the request
 	// go next immediately, because the user should not be affected by this at all (good point?)
+	// either way the response status is final once the switch is done, which is what gets logged
 	switch hasPermission {
 	case true:
 		c.Next()
 	case false:
-		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing permission"})
+		AbortWithError(c, http.StatusForbidden, types.CODE_MISSING_PERMISSION, "missing permission")
+	}
+
+	// reads aren't actions, logging them would e.g. add to the log every time it's viewed.
+	// refused reads are logged all the same, repeated attempts at reading e.g. the log are worth an alert
+	if c.Request.Method == http.MethodGet && hasPermission {
+		return
 	}
 
 	// only log events for group use cases, anything else is meaningless..
@@ -247,9 +345,9 @@ func (handler *MiddlewareHandlerImpl) logUserAction(c *gin.Context) {
 	}
 
 	// transform path to use case, end users are most interested in user actions (rename group, invite member etc)
-	action, exists := handler.permissionMap[fmt.Sprintf("%s %s", c.Request.Method, c.FullPath())]
+	action, exists := handler.permissions.ForRoute(c.Request.Method, canonicalPath(c.FullPath()))
 	if !exists {
-		action = c.FullPath()
+		action = canonicalPath(c.FullPath())
 	}
 
 	// check if there was a userId bound to the request
@@ -259,37 +357,9 @@ func (handler *MiddlewareHandlerImpl) logUserAction(c *gin.Context) {
 	}
 
 	// get email by userId
-	var email string
-	user, exists := handler.cache[userId]
-	if !exists {
-		user, err := handler.core.ReadUserById(userId)
-		if err != nil {
-			log.Printf("error reading user by id to get mail for logging: %+v\n", err)
-			// Set a default value in case of error
-			email = "Error reading email"
-		} else {
-			email = user.Email
-		}
-	} else {
-		email = user.Email
-	}
+	email := handler.permissions.UserEmail(userId)
 
-	// Transform status code to business comprehendable
-	var status string
-	switch c.Writer.Status() {
-	case http.StatusOK:
-		status = "OK"
-	case http.StatusInternalServerError:
-		status = "Error"
-	case http.StatusForbidden:
-		status = "Forbidden"
-	case http.StatusConflict:
-		status = "OK"
-	case http.StatusBadRequest:
-		status = "Error"
-	case http.StatusUnauthorized:
-		status = "Unauthorized"
-	}
+	status := auditStatus(c)
 
 	handler.log.NewEntry(&types.LogEntry{
 		GroupId:   groupId,
@@ -298,54 +368,67 @@ func (handler *MiddlewareHandlerImpl) logUserAction(c *gin.Context) {
 		UserId:    userId,
 		Email:     email,
 		Timestamp: time.Now().Format(time.RFC3339),
+		Detail:    auditDetail(c),
 	})
 }
 
-// checkPermission checks if a user has the necessary permission
-func EvaluatePermission(roles []*types.Role, neededPermission string) bool {
-	for _, role := range roles {
-		switch neededPermission {
-		case types.RENAME_GROUP:
-			if role.RenameGroup {
-				return true
-			}
-		case types.DELETE_GROUP:
-			if role.DeleteGroup {
-				return true
-			}
-		case types.INVITE_MEMBER:
-			if role.InviteMember {
-				return true
-			}
-		case types.REMOVE_MEMBER:
-			if role.RemoveMember {
-				return true
-			}
-		case types.CREATE_CASE:
-			if role.CreateCase {
-				return true
-			}
-		case types.UPDATE_CASE_METADATA:
-			if role.UpdateCaseMetadata {
-				return true
-			}
-		case types.DELETE_CASE:
-			if role.DeleteCase {
-				return true
-			}
-		case types.EXPORT_CASE:
-			if role.ExportCase {
-				return true
-			}
-		case types.VIEW_LOGS:
-			if role.ViewLogs {
-				return true
-			}
-		case types.EXPORT_LOGS:
-			if role.ExportLogs {
-				return true
-			}
-		}
+// Attaches detail to the log entry of the request, e.g. what a group was renamed to.
+// Only has an effect on requests that are logged, either by logUserAction or by the handler itself.
+func SetAuditDetail(c *gin.Context, detail map[string]any) {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		log.Printf("error encoding audit detail: %+v\n", err)
+		return
+	}
+	c.Set("auditDetail", json.RawMessage(raw))
+}
+
+// Detail set by the handler, nil if there is none.
+func auditDetail(c *gin.Context) json.RawMessage {
+	value, _ := c.Get("auditDetail")
+	detail, _ := value.(json.RawMessage)
+	return detail
+}
+
+// Marks the request's conflict as the requested state already existing, e.g. a role assigned twice, so it's logged
+// as OK. Any other conflict is logged as Conflict.
+func SetAuditAlreadyExists(c *gin.Context) {
+	c.Set("auditAlreadyExists", true)
+}
+
+// The status the request is logged with, from the response written so far.
+func auditStatus(c *gin.Context) string {
+	if c.Writer.Status() == http.StatusConflict && c.GetBool("auditAlreadyExists") {
+		return "OK"
+	}
+	return statusToBusiness(c.Writer.Status())
+}
+
+// Transforms a response status code to a business comprehendable one for the log.
+func statusToBusiness(status int) string {
+	switch status {
+	case http.StatusConflict:
+		return "Conflict"
+	case http.StatusForbidden:
+		return types.LOG_STATUS_FORBIDDEN
+	case http.StatusUnauthorized:
+		return "Unauthorized"
+	case http.StatusNotFound:
+		return "Not found"
+	case http.StatusTooManyRequests:
+		return "Rate limited"
+	}
+	if status >= http.StatusBadRequest {
+		return "Error"
+	}
+	return "OK"
+}
+
+// Checks if the aggregated permissions grant the needed permission, an unknown permission is an error rather than a deny.
+func EvaluatePermission(permissions *types.Permissions, neededPermission string) (bool, error) {
+	permission, exists := types.LookupPermission(neededPermission)
+	if !exists {
+		return false, fmt.Errorf("%w: %s", types.ErrUnknownPermission, neededPermission)
 	}
-	return false
+	return permission.Granted(permissions), nil
 }
@@ -0,0 +1,417 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Memberships and the roles members hold, as stored. Methods a test doesn't need aren't implemented and panic.
+type fakeMemberships struct {
+	repository.RoleRepository
+	mu      sync.Mutex
+	members map[string]bool // "userId groupId"
+	roles   map[string][]*types.Role
+}
+
+func newFakeMemberships() *fakeMemberships {
+	return &fakeMemberships{members: make(map[string]bool), roles: make(map[string][]*types.Role)}
+}
+
+func (fake *fakeMemberships) set(userId string, groupId string, isMember bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.members[userId+" "+groupId] = isMember
+}
+
+func (fake *fakeMemberships) IsMember(ctx context.Context, userId string, groupId string) (bool, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.members[userId+" "+groupId], nil
+}
+
+func (fake *fakeMemberships) ReadMemberRoles(userId string, groupId string) ([]*types.Role, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.roles[userId+" "+groupId], nil
+}
+
+func (fake *fakeMemberships) ReadUserById(userId string) (*types.User, error) {
+	return &types.User{Id: userId, Email: userId + "@example.com"}, nil
+}
+
+// Serves GET /api/group/:id behind the membership check, as the given user.
+func newMembershipRouter(permissions service.PermissionResolver, userId string) *gin.Engine {
+	middleware := &MiddlewareHandlerImpl{permissions: permissions, slugs: make(map[string]string)}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("userId", userId) }, middleware.groupMembership)
+	router.GET("/api/group/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+func getGroupStatus(router *gin.Engine, groupId string) int {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/group/"+groupId, nil))
+	return recorder.Code
+}
+
+func TestGroupMembershipIsRevokedOnRemoval(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("member", groupId, true)
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	router := newMembershipRouter(resolver, "member")
+
+	if status := getGroupStatus(router, groupId); status != http.StatusOK {
+		t.Fatalf("a member got %d", status)
+	}
+	// cached now, removing the member is only seen through the invalidation removeMember does
+	store.set("member", groupId, false)
+	resolver.InvalidateMember("member", groupId)
+	if status := getGroupStatus(router, groupId); status != http.StatusNotFound {
+		t.Errorf("a removed member got %d, want 404", status)
+	}
+}
+
+func TestGroupMembershipIsRevokedOnGroupDeletion(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("member", groupId, true)
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	router := newMembershipRouter(resolver, "member")
+
+	if status := getGroupStatus(router, groupId); status != http.StatusOK {
+		t.Fatalf("a member got %d", status)
+	}
+	store.set("member", groupId, false)
+	resolver.InvalidateGroup(groupId)
+	if status := getGroupStatus(router, groupId); status != http.StatusNotFound {
+		t.Errorf("a member of a deleted group got %d, want 404", status)
+	}
+}
+
+func TestGroupMembershipTurnsAwayNonMembers(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	router := newMembershipRouter(resolver, "stranger")
+
+	if status := getGroupStatus(router, groupId); status != http.StatusNotFound {
+		t.Fatalf("a non-member got %d, want 404", status)
+	}
+	// non-memberships aren't cached, so joining takes effect at once
+	store.set("stranger", groupId, true)
+	if status := getGroupStatus(router, groupId); status != http.StatusOK {
+		t.Errorf("a new member got %d", status)
+	}
+}
+
+// The permission middleware of a group route, reading the member's roles on every request.
+func BenchmarkPermissionMiddleware(b *testing.B) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	manager := &types.Role{Name: "Manager", GroupId: groupId}
+	manager.ManageRoles = true
+	store.set("manager", groupId, true)
+	store.roles["manager "+groupId] = []*types.Role{manager}
+	middleware := &MiddlewareHandlerImpl{core: &fakeCore{store: store}, role: store, slugs: make(map[string]string),
+		permissions: service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("userId", "manager") }, middleware.groupMembership, middleware.checkPermission)
+	router.POST("/api/group/:id/role/update", func(c *gin.Context) {
+		if !c.GetBool("hasPermission") {
+			c.Status(http.StatusForbidden)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	request := httptest.NewRequest(http.MethodPost, "/api/group/"+groupId+"/role/update", nil)
+
+	for i := 0; i < b.N; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("got %d", recorder.Code)
+		}
+	}
+}
+
+// Each way authentication fails has its own code, 401 with API-Version 2 and the legacy status without.
+func TestAuthenticationFailuresAreTold(t *testing.T) {
+	t.Setenv("SESSION_TOKENS", "true")
+	t.Setenv("SESSION_TOKEN_SECRET", "session-secret")
+	t.Setenv("SERVICE_TOKEN_ISSUER", "user-service")
+	a := newTestAPI(t)
+	a.owner("user", testGroupId)
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "user-service", "aud": "session", "sub": "user", "sid": "session", "exp": time.Now().Add(-time.Minute).Unix(),
+	}).SignedString([]byte("session-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		code          string
+		legacy        int
+	}{
+		{name: "no header", authorization: "", code: types.CODE_AUTH_HEADER_MISSING, legacy: http.StatusBadRequest},
+		{name: "not a bearer token", authorization: "Token user", code: types.CODE_AUTH_HEADER_MALFORMED, legacy: http.StatusBadRequest},
+		{name: "no token", authorization: "Bearer ", code: types.CODE_AUTH_HEADER_MALFORMED, legacy: http.StatusBadRequest},
+		{name: "expired session", authorization: "Bearer " + expired, code: types.CODE_TOKEN_INVALID, legacy: http.StatusForbidden},
+		{name: "unknown user", authorization: "Bearer ghost", code: types.CODE_USER_UNKNOWN, legacy: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for version, status := range map[string]int{"": tc.legacy, "2": http.StatusUnauthorized} {
+				request := httptest.NewRequest(http.MethodGet, "/v1/api/group/list", nil)
+				if tc.authorization != "" {
+					request.Header.Set("Authorization", tc.authorization)
+				}
+				if version != "" {
+					request.Header.Set("API-Version", version)
+				}
+				recorder := httptest.NewRecorder()
+				a.router.ServeHTTP(recorder, request)
+				if apiErr := responseError(recorder); recorder.Code != status || apiErr == nil || apiErr.Code != tc.code {
+					t.Errorf("API-Version %q got %d %s, want %d %s", version, recorder.Code, recorder.Body.String(), status, tc.code)
+				}
+			}
+		})
+	}
+	if recorder := a.do(http.MethodGet, "/v1/api/group/list", "user", nil); recorder.Code != http.StatusOK {
+		t.Errorf("a known user got %d %s", recorder.Code, recorder.Body.String())
+	}
+	session, err := a.token.NewSessionToken(&types.Session{Id: "session", UserId: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := a.do(http.MethodGet, "/v1/api/group/list", session.Token, nil); recorder.Code != http.StatusOK {
+		t.Errorf("a session token got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// Collects the entries written to the log.
+type fakeLog struct {
+	repository.LogRepository
+	mu      sync.Mutex
+	entries []*types.LogEntry
+	err     error // of the reads, when set
+}
+
+func (fake *fakeLog) NewEntry(entry *types.LogEntry) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.entries = append(fake.entries, entry)
+}
+
+func (fake *fakeLog) ReadByGroupId(ctx context.Context, groupId string) (any, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	logs := []*types.LogEntry{}
+	for _, entry := range fake.entries {
+		if entry.GroupId == groupId {
+			logs = append(logs, entry)
+		}
+	}
+	return logs, nil
+}
+
+func (fake *fakeLog) CountByGroupId(ctx context.Context, groupId string) (int64, error) {
+	logs, err := fake.ReadByGroupId(ctx, groupId)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(logs.([]*types.LogEntry))), nil
+}
+
+func (fake *fakeLog) written() []*types.LogEntry {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]*types.LogEntry(nil), fake.entries...)
+}
+
+// Serves the routes behind the membership, permission and logging middleware, as the given user.
+func newPermissionRouter(store *fakeMemberships, entries *fakeLog, userId string, routes func(router *gin.Engine)) *gin.Engine {
+	resolver := service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})
+	middleware := &MiddlewareHandlerImpl{core: &fakeCore{store: store}, role: store, log: entries, permissions: resolver, slugs: make(map[string]string)}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("userId", userId) },
+		middleware.groupMembership, middleware.checkPermission, middleware.logUserAction)
+	routes(router)
+	return router
+}
+
+func TestForbiddenReadsAreLogged(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("reader", groupId, true)
+	store.set("viewer", groupId, true)
+	viewer := &types.Role{Name: "Viewer", GroupId: groupId}
+	viewer.ViewLogs = true
+	store.roles["viewer "+groupId] = []*types.Role{viewer}
+	entries := &fakeLog{}
+	routes := func(router *gin.Engine) {
+		router.GET("/api/group/:id/logs", func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+
+	recorder := httptest.NewRecorder()
+	newPermissionRouter(store, entries, "reader", routes).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/group/"+groupId+"/logs", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("a member without ViewLogs got %d", recorder.Code)
+	}
+	written := entries.written()
+	if len(written) != 1 || written[0].Status != types.LOG_STATUS_FORBIDDEN || written[0].Action != types.VIEW_LOGS ||
+		written[0].UserId != "reader" || written[0].GroupId != groupId {
+		t.Fatalf("got log entries %+v, want a single Forbidden ViewLogs entry", written)
+	}
+
+	// permitted reads aren't actions, they stay out of the log
+	recorder = httptest.NewRecorder()
+	newPermissionRouter(store, entries, "viewer", routes).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/group/"+groupId+"/logs", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("a member with ViewLogs got %d", recorder.Code)
+	}
+	if written := entries.written(); len(written) != 1 {
+		t.Errorf("a permitted read was logged: %+v", written[1:])
+	}
+}
+
+func TestFailedActionsAreLoggedAsError(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("editor", groupId, true)
+	editor := &types.Role{Name: "Editor", GroupId: groupId}
+	editor.ManageRoles = true
+	store.roles["editor "+groupId] = []*types.Role{editor}
+	entries := &fakeLog{}
+	router := newPermissionRouter(store, entries, "editor", func(router *gin.Engine) {
+		router.POST("/api/group/:id/role/update", func(c *gin.Context) {
+			abortInternal(c, "error updating roles", errors.New("connection reset"))
+		})
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/group/"+groupId+"/role/update", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want 500", recorder.Code)
+	}
+	written := entries.written()
+	if len(written) != 1 || written[0].Status != "Error" || written[0].Action != types.MANAGE_ROLES {
+		t.Fatalf("got log entries %+v, want a single ManageRoles entry with status Error", written)
+	}
+}
+
+// A fakeCore knowing the groups' slugs.
+type fakeSlugCore struct {
+	*fakeCore
+	slugs map[string]string
+}
+
+func (fake *fakeSlugCore) ResolveGroupSlug(ctx context.Context, slug string) (string, error) {
+	if groupId, exists := fake.slugs[slug]; exists {
+		return groupId, nil
+	}
+	return "", types.ErrNotFound
+}
+
+// A group route given a slug runs with the group's id, and a slug of no group is a group not found.
+func TestSlugsResolveToTheirGroup(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("member", groupId, true)
+	core := &fakeSlugCore{fakeCore: &fakeCore{store: store}, slugs: map[string]string{"acme": groupId, "other": "6d0f1e8a-7a43-4c51-b3d5-1c7f0c1d2e3f"}}
+	middleware := &MiddlewareHandlerImpl{core: core, role: store, slugs: make(map[string]string),
+		permissions: service.NewPermissionResolver(&service.PermissionResolverOpts{Users: store, Roles: store, Members: store})}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("userId", "member") }, middleware.groupMembership)
+	router.GET("/api/group/:id/members", func(c *gin.Context) { c.String(http.StatusOK, c.Param("id")) })
+
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{
+		{"acme", http.StatusOK},
+		{groupId, http.StatusOK},
+		{"other", http.StatusNotFound},
+		{"nobody", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/group/"+tc.id+"/members", nil))
+		if recorder.Code != tc.want {
+			t.Errorf("%s got %d, want %d", tc.id, recorder.Code, tc.want)
+		}
+		if recorder.Code == http.StatusOK && recorder.Body.String() != groupId {
+			t.Errorf("%s reached the handler as %s, want %s", tc.id, recorder.Body.String(), groupId)
+		}
+	}
+}
+
+// A conflict is logged as OK only when the handler says the requested state already exists, e.g. a role assigned
+// twice, any other conflict as Conflict.
+func TestConflictsAreLoggedAsConflictUnlessAlreadyExisting(t *testing.T) {
+	const groupId = "0b7c1c52-0b0e-4d8f-9a34-0d6a2e0c2f11"
+	store := newFakeMemberships()
+	store.set("editor", groupId, true)
+	editor := &types.Role{Name: "Editor", GroupId: groupId}
+	editor.ManageRoles = true
+	store.roles["editor "+groupId] = []*types.Role{editor}
+	entries := &fakeLog{}
+	router := newPermissionRouter(store, entries, "editor", func(router *gin.Engine) {
+		router.POST("/api/group/:id/member/add_role", func(c *gin.Context) {
+			SetAuditAlreadyExists(c)
+			AbortWithError(c, http.StatusConflict, types.CODE_ROLE_ALREADY_ASSIGNED, "role is already assigned to the user")
+		})
+		router.POST("/api/group/:id/role/update", func(c *gin.Context) {
+			AbortWithError(c, http.StatusConflict, types.CODE_DUPLICATE_ROLE_NAME, "duplicate role name")
+		})
+	})
+
+	for path, want := range map[string]string{"member/add_role": "OK", "role/update": "Conflict"} {
+		before := len(entries.written())
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/group/"+groupId+"/"+path, nil))
+		written := entries.written()[before:]
+		if recorder.Code != http.StatusConflict || len(written) != 1 || written[0].Status != want {
+			t.Errorf("%s got %d and log entries %+v, want 409 logged as %s", path, recorder.Code, written, want)
+		}
+	}
+}
+
+func TestStatusToBusiness(t *testing.T) {
+	tests := map[int]string{
+		http.StatusOK:                  "OK",
+		http.StatusCreated:             "OK",
+		http.StatusNoContent:           "OK",
+		http.StatusConflict:            "Conflict",
+		http.StatusBadRequest:          "Error",
+		http.StatusUnauthorized:        "Unauthorized",
+		http.StatusForbidden:           types.LOG_STATUS_FORBIDDEN,
+		http.StatusNotFound:            "Not found",
+		http.StatusTooManyRequests:     "Rate limited",
+		http.StatusInternalServerError: "Error",
+		http.StatusServiceUnavailable:  "Error",
+	}
+	for status, expected := range tests {
+		if business := statusToBusiness(status); business != expected {
+			t.Errorf("statusToBusiness(%d) = %q, want %q", status, business, expected)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Package openapi describes the API as an OpenAPI 3 document, so clients don't have to read the handlers to
+// find out what to send. Routes are listed by hand in routes.go, their schemas are derived from the body and
+// response types the handlers use.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+type Operation struct {
+	Summary     string                `json:"summary"`
+	Tags        []string              `json:"tags"`
+	Security    []map[string][]string `json:"security"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Who may call a route.
+type Auth int
+
+const (
+	// A user's Firebase ID token, as "Authorization: Bearer <token>".
+	AuthUser Auth = iota
+	// A service token, as "X-Internal-Token".
+	AuthInternal
+	// Anyone, the route is exempt from authentication.
+	AuthNone
+)
+
+// A JSON object written inline by a handler (gin.H), described by example values of each field's type.
+type Object map[string]any
+
+// A query parameter.
+type Query struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// A route as registered on the router, with what it expects and returns.
+type Route struct {
+	Method  string
+	Path    string // the gin route template, e.g. /api/group/:id
+	Summary string
+	Tag     string
+	Auth    Auth
+	Query   []Query
+	// A value of the request body type, nil for routes without one.
+	Body any
+	// Status of a successful response, http.StatusOK when unset.
+	Status int
+	// A value of the response type, nil for responses without a body.
+	Response any
+}
+
+// Builds the document, with every path under prefix, e.g. "/v1".
+func Build(prefix string, version string) *Document {
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: "User service", Version: version},
+		Paths:   make(map[string]map[string]*Operation),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]*SecurityScheme{
+				"user":     {Type: "http", Scheme: "bearer", BearerFormat: "Firebase ID token"},
+				"internal": {Type: "apiKey", In: "header", Name: "X-Internal-Token"},
+			},
+		},
+	}
+	for _, route := range routes {
+		path, parameters := openAPIPath(prefix + route.Path)
+		for _, query := range route.Query {
+			parameters = append(parameters, &Parameter{
+				Name:        query.Name,
+				In:          "query",
+				Description: query.Description,
+				Required:    query.Required,
+				Schema:      &Schema{Type: "string"},
+			})
+		}
+		operation := &Operation{
+			Summary:    route.Summary,
+			Tags:       []string{route.Tag},
+			Security:   security(route.Auth),
+			Parameters: parameters,
+			Responses:  make(map[string]*Response),
+		}
+		if route.Body != nil {
+			operation.RequestBody = &RequestBody{
+				Required: true,
+				Content:  map[string]MediaType{"application/json": {Schema: doc.schema(reflect.TypeOf(route.Body))}},
+			}
+		}
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := &Response{Description: http.StatusText(status)}
+		if route.Response != nil {
+			success.Content = map[string]MediaType{"application/json": {Schema: doc.responseSchema(route.Response)}}
+		}
+		operation.Responses[fmt.Sprint(status)] = success
+		operation.Responses["default"] = &Response{
+			Description: "Error",
+			Content:     map[string]MediaType{"application/json": {Schema: doc.schema(reflect.TypeOf(ErrorResponse{}))}},
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*Operation)
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = operation
+	}
+	return doc
+}
+
+// Whether the route is described, path being the gin route template without a version prefix.
+func Describes(method string, path string) bool {
+	for _, route := range routes {
+		if route.Method == method && route.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts a gin route template to an OpenAPI path, e.g. /api/group/:id to /api/group/{id}, with its path parameters.
+func openAPIPath(path string) (string, []*Parameter) {
+	var parameters []*Parameter
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := segment[1:]
+			segments[i] = "{" + name + "}"
+			parameter := &Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}}
+			// the membership middleware resolves slugs on these
+			if i == 3 && strings.HasPrefix(path, "/api/group/:id") {
+				parameter.Description = "group id or slug"
+			}
+			parameters = append(parameters, parameter)
+		}
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+func security(auth Auth) []map[string][]string {
+	switch auth {
+	case AuthUser:
+		return []map[string][]string{{"user": {}}}
+	case AuthInternal:
+		return []map[string][]string{{"internal": {}}}
+	}
+	return []map[string][]string{}
+}
+
+func (doc *Document) responseSchema(response any) *Schema {
+	object, isObject := response.(Object)
+	if !isObject {
+		return doc.schema(reflect.TypeOf(response))
+	}
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for name, value := range object {
+		schema.Properties[name] = doc.schema(reflect.TypeOf(value))
+		schema.Required = append(schema.Required, name)
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// Derives a schema from a Go type the way encoding/json encodes it. Named structs become components
+// referenced by name, so they must be unique across packages.
+func (doc *Document) schema(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	if t.Kind() == reflect.Pointer {
+		schema := doc.schema(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		// only used for JSON objects whose shape depends on the entry, e.g. log details
+		return &Schema{Type: "object"}
+	case t.Kind() == reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &Schema{Type: "number"}
+	case t.Kind() == reflect.String:
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &Schema{Type: "array", Items: doc.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: doc.schema(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		if t.Name() == "" {
+			return doc.structSchema(t)
+		}
+		if _, exists := doc.Components.Schemas[t.Name()]; !exists {
+			// reserve the name first, so recursive types refer to themselves
+			doc.Components.Schemas[t.Name()] = &Schema{}
+			*doc.Components.Schemas[t.Name()] = *doc.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	// interfaces and anything else can be any JSON value
+	return &Schema{}
+}
+
+func (doc *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = doc.schema(field.Type)
+		binding := "," + field.Tag.Get("binding") + ","
+		if strings.Contains(binding, ",required,") && !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// The envelope every failing request responds with, see api.AbortWithError.
+type ErrorResponse struct {
+	Error types.APIError `json:"error" binding:"required"`
+}
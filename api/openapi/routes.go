@@ -0,0 +1,154 @@
+package openapi
+
+import (
+	"net/http"
+
+	"user.service.altiore.io/types"
+)
+
+// Every route the API registers, checked against the router at startup so a new route can't go undocumented.
+var routes = []Route{
+
+	// user
+	{Method: http.MethodGet, Path: "/api/user/:userId/exists", Summary: "Check a user exists", Tag: "user", Auth: AuthNone},
+	{Method: http.MethodHead, Path: "/api/user/:userId/exists", Summary: "Check a user exists, without a body", Tag: "user", Auth: AuthNone},
+	{Method: http.MethodPost, Path: "/api/user/registerServiceUsed", Summary: "Register a service use by a group member", Tag: "user", Auth: AuthNone, Body: types.RegisterServiceUsedBody{}},
+	{Method: http.MethodPost, Path: "/api/user/login", Summary: "Log in, answers with a session token while they're enabled", Tag: "user", Auth: AuthNone, Body: types.LoginBody{}, Response: types.SessionToken{}},
+	{Method: http.MethodPost, Path: "/api/user/signup", Summary: "Sign up with a provider account", Tag: "user", Auth: AuthNone, Body: types.SignupProviderBody{}, Status: http.StatusCreated,
+		Response: Object{"uid": ""}},
+	{Method: http.MethodPost, Path: "/api/user/signup/email_password", Summary: "Sign up with email and password", Tag: "user", Auth: AuthNone, Body: types.SignupEmailPasswordBody{}, Status: http.StatusCreated,
+		Response: Object{"uid": ""}},
+	{Method: http.MethodPost, Path: "/api/user/signup/full", Summary: "Sign up with email and password, creating the account", Tag: "user", Auth: AuthNone,
+		Body: types.SignupFullBody{}, Status: http.StatusCreated, Response: Object{"uid": ""}},
+	{Method: http.MethodGet, Path: "/api/user/signup/verify", Summary: "Verify an email address, redirects to the portal", Tag: "user", Auth: AuthUser,
+		Query: []Query{{Name: "u", Description: "id of the user to verify", Required: true}}, Status: http.StatusPermanentRedirect},
+	{Method: http.MethodPost, Path: "/api/user/start_password_reset", Summary: "Mail a password reset link", Tag: "user", Auth: AuthNone, Body: types.StartPasswordResetBody{}},
+	{Method: http.MethodPost, Path: "/api/user/reset_password", Summary: "Reset a password", Tag: "user", Auth: AuthNone, Body: types.ResetPasswordBody{}},
+	{Method: http.MethodGet, Path: "/api/user/me/notifications", Summary: "Read notification preferences", Tag: "user", Auth: AuthUser, Response: types.NotificationPreferences{}},
+	{Method: http.MethodPatch, Path: "/api/user/me/notifications", Summary: "Update notification preferences", Tag: "user", Auth: AuthUser,
+		Body: types.UpdateNotificationPreferencesBody{}, Response: types.NotificationPreferences{}},
+	{Method: http.MethodPost, Path: "/api/user/me/logout_all", Summary: "Revoke all sessions", Tag: "user", Auth: AuthUser,
+		Response: Object{"revokedAt": "", "effectiveBy": ""}},
+
+	// service
+	{Method: http.MethodGet, Path: "/api/service/list", Summary: "List services", Tag: "service", Auth: AuthUser,
+		Query: []Query{{Name: "include_retired", Description: "\"true\" to include retired services"}}, Response: []*types.Service{}},
+	{Method: http.MethodGet, Path: "/api/service/implementationGroups", Summary: "List the implementation groups of a service", Tag: "service", Auth: AuthUser,
+		Query: []Query{{Name: "name", Description: "name of the service", Required: true}}, Response: Object{"groups": []int{}}},
+
+	// group
+	{Method: http.MethodPost, Path: "/api/group/create", Summary: "Create a group", Tag: "group", Auth: AuthUser, Body: types.CreateGroupBody{},
+		Status: http.StatusCreated, Response: types.Organisation{}},
+	{Method: http.MethodGet, Path: "/api/group/list", Summary: "List the user's groups", Tag: "group", Auth: AuthUser, Response: []*types.Organisation{}},
+	{Method: http.MethodGet, Path: "/api/group/permissions", Summary: "List every permission a role can grant", Tag: "group", Auth: AuthUser, Response: []*types.PermissionInfo{}},
+	{Method: http.MethodGet, Path: "/api/group/:id", Summary: "Read a group", Tag: "group", Auth: AuthUser, Response: types.Organisation{}},
+	{Method: http.MethodPatch, Path: "/api/group/:id/update", Summary: "Rename a group or change its slug and settings", Tag: "group", Auth: AuthUser,
+		Body: types.UpdateGroupBody{}, Response: Object{"version": 0}},
+	{Method: http.MethodDelete, Path: "/api/group/:id/delete", Summary: "Delete a group", Tag: "group", Auth: AuthUser},
+	{Method: http.MethodGet, Path: "/api/group/:id/members", Summary: "List a group's members, as a list or paged when limit or cursor is given", Tag: "group", Auth: AuthUser,
+		Query: []Query{
+			{Name: "limit", Description: "members per page, 50 by default and at most 200; paged responses are {members, nextCursor, total}"},
+			{Name: "cursor", Description: "nextCursor of the previous page"},
+		},
+		Response: []*types.OrganisationMember{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/my_permissions", Summary: "Read the user's permissions in a group", Tag: "group", Auth: AuthUser, Response: types.Permissions{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/usage", Summary: "Report a group's month-to-date service usage against its quotas", Tag: "group", Auth: AuthUser,
+		Query: []Query{{Name: "months", Description: "number of calendar months, up to 24, to include the uses of per month"}}, Response: types.GroupUsage{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/service_usage", Summary: "Report a group's service usage", Tag: "group", Auth: AuthUser,
+		Query: []Query{
+			{Name: "from", Description: "inclusive start, RFC 3339 or YYYY-MM-DD"},
+			{Name: "to", Description: "exclusive end, RFC 3339 or YYYY-MM-DD"},
+			{Name: "detailed", Description: "\"true\" to list every use and who made it, takes ViewLogs"},
+		},
+		Response: Object{"services": []*types.ServiceUsage{}}},
+	{Method: http.MethodPost, Path: "/api/group/member/invite", Summary: "Invite a member by email", Tag: "group", Auth: AuthUser, Body: types.InviteMemberBody{},
+		Status: http.StatusCreated, Response: types.Invitation{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/member/invite_batch", Summary: "Invite up to 50 members by email", Tag: "group", Auth: AuthUser,
+		Body: types.InviteBatchBody{}, Response: Object{"results": []*types.InvitationResult{}}},
+	{Method: http.MethodGet, Path: "/api/group/:id/invitations", Summary: "List a group's pending invitations", Tag: "group", Auth: AuthUser, Response: []*types.Invitation{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/invitation/:invitationId", Summary: "Read a pending invitation", Tag: "group", Auth: AuthUser, Response: types.Invitation{}},
+	{Method: http.MethodDelete, Path: "/api/group/:id/invitation/:invitationId", Summary: "Revoke a pending invitation", Tag: "group", Auth: AuthUser},
+	{Method: http.MethodGet, Path: "/api/group/join", Summary: "Accept an invitation", Tag: "group", Auth: AuthNone,
+		Query: []Query{{Name: "inv", Description: "token from the invitation link", Required: true}}, Response: Object{"redirect_url": "", "group_url": ""}},
+	{Method: http.MethodGet, Path: "/api/group/reject", Summary: "Reject an invitation, redirects to the portal", Tag: "group", Auth: AuthNone,
+		Query: []Query{
+			{Name: "inv", Description: "token from the invitation link"},
+			{Name: "id", Description: "invitation id, instead of the token when signed in as the invitee with a bearer token"},
+		}, Status: http.StatusSeeOther},
+	{Method: http.MethodDelete, Path: "/api/group/member/remove", Summary: "Remove a member", Tag: "group", Auth: AuthUser, Body: types.RemoveMemberBody{}},
+
+	// roles
+	{Method: http.MethodGet, Path: "/api/group/:id/role/defined_roles", Summary: "List a group's roles", Tag: "role", Auth: AuthUser, Response: []*types.Role{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/role/update", Summary: "Create and update roles", Tag: "role", Auth: AuthUser, Body: []*types.Role{}, Response: types.RoleUpdateSummary{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/role/delete", Summary: "Delete a role", Tag: "role", Auth: AuthUser, Body: types.DeleteRoleBody{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/role/member_roles", Summary: "List members with their roles", Tag: "role", Auth: AuthUser, Response: []*types.MemberRole{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/export_config", Summary: "Export a group's roles to set them up in another group", Tag: "role", Auth: AuthUser,
+		Query: []Query{{Name: "members", Description: "\"true\" to include the members' addresses"}}, Response: types.GroupConfig{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/import_config", Summary: "Create exported roles in a group and invite exported members", Tag: "role", Auth: AuthUser,
+		Body: types.GroupConfig{}, Response: types.ImportConfigResult{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/member/add_role", Summary: "Give a member a role", Tag: "role", Auth: AuthUser, Body: types.MemberRoleBody{}},
+	{Method: http.MethodPost, Path: "/api/group/:id/member/remove_role", Summary: "Take a role from a member", Tag: "role", Auth: AuthUser, Body: types.MemberRoleBody{}},
+
+	// token
+	{Method: http.MethodPost, Path: "/api/token/verify", Summary: "Verify a user token, answers with a session token while they're enabled", Tag: "token", Auth: AuthNone,
+		Body: types.VerifyTokenBody{}, Response: types.SessionToken{}},
+	{Method: http.MethodPost, Path: "/api/token/refresh", Summary: "Exchange a session token for a new one of the same session", Tag: "token", Auth: AuthNone,
+		Body: types.RefreshSessionBody{}, Response: types.SessionToken{}},
+
+	// log
+	{Method: http.MethodGet, Path: "/api/group/:id/logs", Summary: "Read a group's log", Tag: "log", Auth: AuthUser, Response: []*types.LogEntry{}},
+	{Method: http.MethodGet, Path: "/api/group/:id/logs/count", Summary: "Count the entries in a group's log", Tag: "log", Auth: AuthUser, Response: Object{"count": 0}},
+	{Method: http.MethodGet, Path: "/api/group/:id/logs/stream", Summary: "Stream new entries of a group's log as server-sent \"log\" events", Tag: "log", Auth: AuthUser},
+	{Method: http.MethodGet, Path: "/api/group/:id/alerts", Summary: "Read the alerts raised on suspicious activity in a group's log", Tag: "log", Auth: AuthUser,
+		Query: []Query{{Name: "since", Description: "only alerts written since, in RFC 3339"}}, Response: []*types.LogEntry{}},
+	{Method: http.MethodGet, Path: "/api/logs/:groupId", Summary: "Read a group's log, deprecated for /api/group/:id/logs", Tag: "log", Auth: AuthUser, Response: []*types.LogEntry{}},
+
+	// internal
+	{Method: http.MethodPost, Path: "/api/internal/check_user", Summary: "Check a user token", Tag: "internal", Auth: AuthInternal, Body: types.CheckUserBody{},
+		Query: []Query{{Name: "detail", Description: "\"true\" to answer with who the token belongs to"}}, Response: types.UserIdentity{}},
+	{Method: http.MethodPost, Path: "/api/internal/strict_check_user", Summary: "Check a user may perform an action in a group", Tag: "internal", Auth: AuthInternal,
+		Body: types.StrictCheckUserBody{}, Query: []Query{{Name: "detail", Description: "\"true\" to answer with who the token belongs to"}}, Response: types.UserIdentity{}},
+	{Method: http.MethodPost, Path: "/api/internal/users", Summary: "Look up users by id", Tag: "internal", Auth: AuthInternal,
+		Body: types.LookupUsersBody{}, Response: Object{"users": map[string]*types.FirebaseUser{}}},
+	{Method: http.MethodPost, Path: "/api/internal/service", Summary: "Add a service to the catalogue", Tag: "internal", Auth: AuthInternal,
+		Body: types.CreateServiceBody{}, Status: http.StatusCreated, Response: types.Service{}},
+	{Method: http.MethodPatch, Path: "/api/internal/service/:id", Summary: "Update a service", Tag: "internal", Auth: AuthInternal, Body: types.UpdateServiceBody{}, Response: types.Service{}},
+	{Method: http.MethodDelete, Path: "/api/internal/service/:id", Summary: "Delete a service that was never used", Tag: "internal", Auth: AuthInternal},
+	{Method: http.MethodPost, Path: "/api/internal/maintenance", Summary: "Turn maintenance mode on or off", Tag: "internal", Auth: AuthInternal,
+		Body: types.MaintenanceBody{}, Response: Object{"enabled": false}},
+	{Method: http.MethodGet, Path: "/api/internal/group/:id", Summary: "Read a group, answers 304 to a matching If-None-Match", Tag: "internal", Auth: AuthInternal,
+		Response: types.GroupInfo{}},
+	{Method: http.MethodPost, Path: "/api/internal/token/inspect", Summary: "Report why an internal token is or isn't accepted", Tag: "internal", Auth: AuthInternal,
+		Body: types.InspectTokenBody{}, Response: types.TokenInspection{}},
+	{Method: http.MethodGet, Path: "/api/internal/permission_cache", Summary: "Report the permission cache's hits and misses", Tag: "internal", Auth: AuthInternal,
+		Response: types.PermissionCacheStats{}},
+	{Method: http.MethodPost, Path: "/api/internal/group/:id/restore", Summary: "Restore a group deleted within the last 30 days", Tag: "internal", Auth: AuthInternal},
+	{Method: http.MethodGet, Path: "/api/internal/group/:id/quota/:serviceName", Summary: "Read a group's use of its monthly quota of a service", Tag: "internal", Auth: AuthInternal,
+		Response: types.QuotaUsage{}},
+	{Method: http.MethodPut, Path: "/api/internal/group/:id/quota/:serviceName", Summary: "Limit a group's uses of a service per calendar month", Tag: "internal", Auth: AuthInternal,
+		Body: types.SetQuotaBody{}, Response: types.QuotaUsage{}},
+	{Method: http.MethodDelete, Path: "/api/internal/group/:id/quota/:serviceName", Summary: "Lift a group's limit on uses of a service", Tag: "internal", Auth: AuthInternal,
+		Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/internal/user/:userId/group_limit", Summary: "Read how many groups a user may create per day", Tag: "internal", Auth: AuthInternal,
+		Response: types.GroupCreationLimit{}},
+	{Method: http.MethodPut, Path: "/api/internal/user/:userId/group_limit", Summary: "Allow a user another number of groups per day, or no limit", Tag: "internal", Auth: AuthInternal,
+		Body: types.SetGroupCreationLimitBody{}, Response: types.GroupCreationLimit{}},
+	{Method: http.MethodDelete, Path: "/api/internal/user/:userId/group_limit", Summary: "Put a user back on the default limit of groups per day", Tag: "internal", Auth: AuthInternal,
+		Status: http.StatusNoContent},
+	{Method: http.MethodPost, Path: "/api/internal/log/sweep", Summary: "Delete log entries past their retention period now", Tag: "internal", Auth: AuthInternal,
+		Response: Object{"removed": int64(0)}},
+
+	// admin, only with ADMIN_API_ENABLED=true and for operators
+	{Method: http.MethodGet, Path: "/api/admin/users", Summary: "Find users by the start of their email", Tag: "admin", Auth: AuthUser,
+		Query: []Query{{Name: "email", Description: "start of the email", Required: true}}, Response: []*types.AdminUser{}},
+	{Method: http.MethodGet, Path: "/api/admin/user/:userId/groups", Summary: "List a user's groups", Tag: "admin", Auth: AuthUser, Response: []*types.Organisation{}},
+	{Method: http.MethodPost, Path: "/api/admin/user/:userId/verify", Summary: "Mark a user verified", Tag: "admin", Auth: AuthUser},
+	{Method: http.MethodPost, Path: "/api/admin/group/:id/owner", Summary: "Make a member the group's only owner", Tag: "admin", Auth: AuthUser,
+		Body: types.ReassignOwnerBody{}, Response: Object{"previousOwners": []string{}}},
+	{Method: http.MethodGet, Path: "/api/admin/group/:id/logs", Summary: "Read any group's log, or the platform log of admin actions as \"platform\"", Tag: "admin", Auth: AuthUser,
+		Response: []*types.LogEntry{}},
+
+	// docs
+	{Method: http.MethodGet, Path: "/api/openapi.json", Summary: "This document", Tag: "docs", Auth: AuthNone},
+	{Method: http.MethodGet, Path: "/api/docs", Summary: "Browse this document", Tag: "docs", Auth: AuthNone},
+}
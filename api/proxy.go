@@ -0,0 +1,30 @@
+package api
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trusts X-Forwarded-For only from the proxies in TRUSTED_PROXIES, a comma separated list of IPs or CIDRs,
+// e.g. the load balancer's ranges. gin trusts every peer by default, which lets any client pick its own IP.
+// Without the variable no peer is trusted and the client IP is the connection's address.
+func (h *API_impl) trustProxies() {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := h.router.SetTrustedProxies(proxies); err != nil {
+		log.Fatalf("TRUSTED_PROXIES is invalid: %v", err)
+	}
+}
+
+// Resolves the client IP once, for the log and rate limiting to read as "clientIP".
+func clientIP(c *gin.Context) {
+	c.Set("clientIP", c.ClientIP())
+	c.Next()
+}
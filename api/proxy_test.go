@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestForwardedForIsOnlyTrustedFromProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxies  string
+		peer     string
+		expected string
+	}{
+		{"no trusted proxies", "", "203.0.113.7:51000", "203.0.113.7"},
+		{"an untrusted peer", "10.1.0.0/16", "203.0.113.7:51000", "203.0.113.7"},
+		{"a trusted proxy", "10.1.0.0/16", "10.1.2.3:51000", "198.51.100.9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", test.proxies)
+			api := NewAPI(&API_opts{})
+			api.router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.GetString("clientIP")) })
+
+			request := httptest.NewRequest(http.MethodGet, "/ip", nil)
+			request.RemoteAddr = test.peer
+			// a client claiming to be an internal host, on top of what the proxy appended
+			request.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.9")
+			request.Header.Set("X-Real-IP", "10.0.0.1")
+			recorder := httptest.NewRecorder()
+			api.router.ServeHTTP(recorder, request)
+			if ip := recorder.Body.String(); ip != test.expected {
+				t.Errorf("got client IP %s, want %s", ip, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"user.service.altiore.io/types"
+)
+
+// Forwards recovered panics to an error tracker, e.g. Sentry or Error Reporting.
+// Called on the request goroutine, so implementations should hand off anything slow.
+type ErrorReporter interface {
+	ReportPanic(report *types.PanicReport)
+}
+
+const requestIdHeader = "X-Request-Id"
+
+// A request id passed in by a caller is kept if it looks sane, so a request can be followed across services.
+var validRequestId = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// Tags every request with an id, returned in the X-Request-Id header, for logs and support requests.
+func requestId(c *gin.Context) {
+	id := c.GetHeader(requestIdHeader)
+	if !validRequestId.MatchString(id) {
+		id = uuid.NewString()
+	}
+	c.Set("requestId", id)
+	c.Header(requestIdHeader, id)
+	c.Next()
+}
+
+// Recovers panics from handlers, logs them with their stack and responds with the error envelope rather than
+// gin's bare 500. Transactions roll back before their panic gets here, see CoreRepository.WithTransaction.
+func (h *API_impl) recovery(c *gin.Context) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		// the client is gone, net/http handles this one itself
+		if r == http.ErrAbortHandler {
+			panic(r)
+		}
+		report := &types.PanicReport{
+			RequestId: c.GetString("requestId"),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			ClientIP:  c.GetString("clientIP"),
+			Panic:     fmt.Sprint(r),
+			Stack:     string(debug.Stack()),
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+		entry, _ := json.Marshal(report)
+		log.Printf("panic recovered: %s\n", entry)
+		if h.reporter != nil {
+			h.reporter.ReportPanic(report)
+		}
+		// a handler that already started its response can't be given another one
+		if c.Writer.Written() {
+			c.Abort()
+			return
+		}
+		AbortWithErrorDetails(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error", gin.H{"requestId": report.RequestId})
+	}()
+	c.Next()
+}
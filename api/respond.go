@@ -0,0 +1,14 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Responds 201 with the created resource, and its canonical route under the current version in Location,
+// e.g. respondCreated(c, "/api/group/"+group.Id, group).
+func respondCreated(c *gin.Context, path string, resource any) {
+	c.Header("Location", apiVersionPrefix+path)
+	c.JSON(http.StatusCreated, resource)
+}
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -9,7 +8,7 @@ import (
 )
 
 type ServiceHandler interface {
-	RegisterRoutes(*gin.Engine)
+	RegisterRoutes(*gin.RouterGroup)
 }
 
 type ServiceHandlerOpts struct {
@@ -26,27 +25,27 @@ func NewServiceHandler(opts *ServiceHandlerOpts) *ServiceHandlerImpl {
 	}
 }
 
-func (h *ServiceHandlerImpl) RegisterRoutes(router *gin.Engine) {
+func (h *ServiceHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 	router.GET("/api/service/list", h.serviceList)
 	router.GET("/api/service/implementationGroups", h.implementationGroups)
 }
 
+// Retired services are left out, unless ?include_retired=true is given.
 // This endpoint might be misplaced, can be relocated later on.
 func (h *ServiceHandlerImpl) serviceList(c *gin.Context) {
-	services, err := h.core.ReadServices()
+	services, err := h.core.ReadServices(c.Query("include_retired") == "true")
 	if err != nil {
-		log.Println(err)
-		c.Status(http.StatusInternalServerError)
+		abortInternal(c, "error reading services", err)
 		return
 	}
 	c.JSON(http.StatusOK, services)
 }
 
+// Lists the implementation groups of a service, e.g. {"groups": [1, 2, 3]}.
 func (h *ServiceHandlerImpl) implementationGroups(c *gin.Context) {
-	groups, err := h.core.ImplementationGroupCount(c.Query("name"))
+	groups, err := h.core.ImplementationGroups(c.Query("name"))
 	if err != nil {
-		log.Println(err)
-		c.Status(http.StatusInternalServerError)
+		abortInternal(c, "error reading implementation groups", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"groups": groups})
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/types"
+)
+
+// Answers ImplementationGroups with fixed groups per service, or fails.
+type fakeServiceCatalogue struct {
+	repository.CoreRepository
+	groups map[string][]int
+	err    error
+}
+
+func (fake *fakeServiceCatalogue) ImplementationGroups(serviceName string) ([]int, error) {
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	if groups, exists := fake.groups[serviceName]; exists {
+		return groups, nil
+	}
+	return []int{}, nil
+}
+
+func getImplementationGroups(core repository.CoreRepository, name string) *httptest.ResponseRecorder {
+	router := gin.New()
+	NewServiceHandler(&ServiceHandlerOpts{Core: core}).RegisterRoutes(&router.RouterGroup)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/service/implementationGroups?name="+name, nil))
+	return recorder
+}
+
+func TestImplementationGroups(t *testing.T) {
+	core := &fakeServiceCatalogue{groups: map[string][]int{"scanner": {1, 2, 3}, "backup": {2}}}
+	tests := []struct {
+		name   string
+		groups string
+	}{
+		{"scanner", `{"groups":[1,2,3]}`},
+		{"backup", `{"groups":[2]}`},
+		// no groups is an empty list, not null
+		{"unknown", `{"groups":[]}`},
+	}
+	for _, test := range tests {
+		recorder := getImplementationGroups(core, test.name)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != test.groups {
+			t.Errorf("%s: got %d %s, want %s", test.name, recorder.Code, recorder.Body.String(), test.groups)
+		}
+	}
+}
+
+func TestImplementationGroupsFailure(t *testing.T) {
+	core := &fakeServiceCatalogue{err: fmt.Errorf("%w: %w", types.ErrGenericSQL, errors.New("dial tcp 10.0.0.5:3306: connection refused"))}
+	recorder := getImplementationGroups(core, "scanner")
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want 500", recorder.Code)
+	}
+	var body struct {
+		Error *types.APIError `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body.Error == nil || body.Error.Code != types.CODE_INTERNAL {
+		t.Errorf("got %s, want the internal error envelope", recorder.Body.String())
+	}
+	if strings.Contains(recorder.Body.String(), "10.0.0.5") || strings.Contains(recorder.Body.String(), "groups") {
+		t.Errorf("the response gives away more than the error: %s", recorder.Body.String())
+	}
+}
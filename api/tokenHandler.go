@@ -1,48 +1,52 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/repository"
 	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
 )
 
 type TokenHandler interface {
-	RegisterRoutes(*gin.Engine)
+	RegisterRoutes(*gin.RouterGroup)
 }
 
 type TokenHandlerOpts struct {
 	Core     repository.CoreRepository
 	Firebase service.FirebaseService
+	Token    service.TokenService
 }
 
 type TokenHandlerImpl struct {
 	core     repository.CoreRepository
 	firebase service.FirebaseService
+	token    service.TokenService
 }
 
 func NewTokenHandler(opts *TokenHandlerOpts) *TokenHandlerImpl {
 	return &TokenHandlerImpl{
 		core:     opts.Core,
 		firebase: opts.Firebase,
+		token:    opts.Token,
 	}
 }
 
-func (handler *TokenHandlerImpl) RegisterRoutes(router *gin.Engine) {
+func (handler *TokenHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 	router.POST("/api/token/verify", handler.verify)
+	router.POST("/api/token/refresh", handler.refresh)
 }
 
 // Verify a user's token.
 func (handler *TokenHandlerImpl) verify(c *gin.Context) {
 
 	// parse and validate body
-	var body struct {
-		Token string `json:"token" binding:"required"`
-	}
+	var body types.VerifyTokenBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
 
@@ -50,17 +54,99 @@ func (handler *TokenHandlerImpl) verify(c *gin.Context) {
 	decodedToken, err := handler.firebase.VerifyToken(body.Token)
 	if err != nil {
 		log.Println("invalid token according to firebase")
-		c.String(http.StatusForbidden, "invalid token")
+		AbortWithError(c, versionedStatus(c, http.StatusForbidden, http.StatusUnauthorized), types.CODE_TOKEN_INVALID, "invalid token")
 		return
 	}
 
 	// check user exists in db(?)
 	if err := handler.core.UserExists(decodedToken.UID); err != nil {
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
 		log.Println("user not found in database")
-		c.String(http.StatusBadRequest, "user does not exist")
+		AbortWithError(c, versionedStatus(c, http.StatusBadRequest, http.StatusUnauthorized), types.CODE_USER_NOT_FOUND, "user does not exist")
+		return
+	}
+
+	// send response, with a session token while they're enabled
+	respondSession(c, handler.core, handler.token, decodedToken.UID)
+}
+
+// Exchanges a session token, expired or not, for a new one of the same session. Revoked sessions and sessions
+// older than SESSION_MAX_AGE are SESSION_EXPIRED, the user has to sign in through firebase again.
+func (handler *TokenHandlerImpl) refresh(c *gin.Context) {
+	if !handler.token.SessionsEnabled() {
+		AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "session tokens are not enabled")
+		return
+	}
+
+	var body types.RefreshSessionBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
 		return
 	}
 
-	// send response
-	c.Status(http.StatusOK)
+	claims, err := handler.token.CheckSessionToken(body.Token)
+	if err != nil && !errors.Is(err, types.ErrSessionExpired) {
+		log.Printf("refusing to refresh session token: %+v\n", err)
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_TOKEN_INVALID, "invalid token")
+		return
+	}
+
+	// the revocation list is only consulted here, which is why session tokens are short-lived
+	session, err := handler.core.ReadSession(c.Request.Context(), claims.SessionId)
+	if err != nil {
+		if !errors.Is(err, types.ErrSessionNotFound) {
+			abortInternal(c, "error reading session", err)
+			return
+		}
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_SESSION_EXPIRED, "session expired")
+		return
+	}
+	if session.UserId != claims.UserId {
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_TOKEN_INVALID, "invalid token")
+		return
+	}
+	if err := handler.token.CheckSessionRefresh(session); err != nil {
+		log.Printf("refusing to refresh session %s: %+v\n", session.Id, err)
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_SESSION_EXPIRED, "session expired")
+		return
+	}
+
+	if err := handler.core.UserExists(session.UserId); err != nil {
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
+		AbortWithError(c, http.StatusUnauthorized, types.CODE_USER_UNKNOWN, "user does not exist")
+		return
+	}
+
+	sessionToken, err := handler.token.NewSessionToken(session)
+	if err != nil {
+		abortInternal(c, "error issuing session token", err)
+		return
+	}
+	c.JSON(http.StatusOK, sessionToken)
+}
+
+// Starts a session for a user that just proved who they are and answers with its session token,
+// or with no body while session tokens are disabled.
+func respondSession(c *gin.Context, core repository.CoreRepository, token service.TokenService, userId string) {
+	if !token.SessionsEnabled() {
+		c.Status(http.StatusOK)
+		return
+	}
+	session, err := core.CreateSession(c.Request.Context(), userId)
+	if err != nil {
+		abortInternal(c, "error creating session", err)
+		return
+	}
+	sessionToken, err := token.NewSessionToken(session)
+	if err != nil {
+		abortInternal(c, "error issuing session token", err)
+		return
+	}
+	c.JSON(http.StatusOK, sessionToken)
 }
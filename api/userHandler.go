@@ -1,13 +1,14 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"user.service.altiore.io/repository"
@@ -16,21 +17,34 @@ import (
 )
 
 type UserHandler interface {
-	RegisterRoutes(*gin.Engine)
+	RegisterRoutes(*gin.RouterGroup)
 }
 
 type UserHandlerOpts struct {
 	Core     repository.CoreRepository
 	Firebase service.FirebaseService
 	Email    service.EmailService
+	Events   service.EventPublisher
+	Log      repository.LogRepository
+	Limiter  service.RateLimiter
+	Webhook  service.WebhookService
+	Token    service.TokenService
 }
 
 type UserHandlerImpl struct {
 	core          repository.CoreRepository
 	firebase      service.FirebaseService
 	email         service.EmailService
+	events        service.EventPublisher
+	log           repository.LogRepository
+	limiter       service.RateLimiter
+	webhook       service.WebhookService
+	token         service.TokenService
 	portal_domain string
 	domain        string
+
+	// whether users signing up with an invitation also get a group of their own, SIGNUP_INVITED_DEFAULT_GROUP=true
+	invitedDefaultGroup bool
 }
 
 func NewUserHandler(opts *UserHandlerOpts) *UserHandlerImpl {
@@ -38,115 +52,144 @@ func NewUserHandler(opts *UserHandlerOpts) *UserHandlerImpl {
 		core:          opts.Core,
 		firebase:      opts.Firebase,
 		email:         opts.Email,
+		events:        opts.Events,
+		log:           opts.Log,
+		limiter:       opts.Limiter,
+		webhook:       opts.Webhook,
+		token:         opts.Token,
 		portal_domain: os.Getenv("PORTAL_DOMAIN"),
 		domain:        os.Getenv("DOMAIN"),
+
+		invitedDefaultGroup: os.Getenv("SIGNUP_INVITED_DEFAULT_GROUP") == "true",
 	}
 }
 
-func (handler *UserHandlerImpl) RegisterRoutes(router *gin.Engine) {
+func (handler *UserHandlerImpl) RegisterRoutes(router *gin.RouterGroup) {
 	router.GET("/api/user/:userId/exists", handler.userExists)
+	router.HEAD("/api/user/:userId/exists", handler.userExists)
 	router.POST("/api/user/registerServiceUsed", handler.registerServiceUsed)
 
 	router.POST("/api/user/login", handler.login)
 	router.POST("/api/user/signup", handler.signup_PROVIDER)
 	router.POST("/api/user/signup/email_password", handler.signup_EMAIL_PASSWORD)
+	router.POST("/api/user/signup/full", handler.signup_FULL)
 	router.GET("/api/user/signup/verify", handler.SignupVerify)
 
 	router.POST("/api/user/start_password_reset", handler.startPasswordReset)
 	router.POST("/api/user/reset_password", handler.resetPassword)
+
+	router.GET("/api/user/me/notifications", handler.readNotificationPreferences)
+	router.PATCH("/api/user/me/notifications", handler.updateNotificationPreferences)
+	router.POST("/api/user/me/logout_all", handler.logoutAll)
 }
 
 func (handler *UserHandlerImpl) login(c *gin.Context) {
-	var body struct {
-		UID      string `json:"uid" binding:"required"`
-		Email    string `json:"email" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}
+	var body types.LoginBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	body.Email = types.NormalizeEmail(body.Email)
 	if err := handler.core.Login(body.UID, body.Email, body.Password); err != nil {
 		log.Printf("error logging in: %+v\n", err)
 		switch {
 		case errors.Is(err, types.ErrUserNotVerified):
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "user is not verified"})
+			AbortWithError(c, versionedStatus(c, http.StatusUnauthorized, http.StatusForbidden), types.CODE_USER_NOT_VERIFIED, "user is not verified")
 			return
 		case errors.Is(err, types.ErrInvalidPassword):
-			c.JSON(http.StatusNotFound, gin.H{"error": "invalid credentials"})
+			AbortWithError(c, versionedStatus(c, http.StatusNotFound, http.StatusUnauthorized), types.CODE_INVALID_CREDENTIALS, "invalid credentials")
 			return
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
 		return
 	}
-	c.Status(http.StatusOK)
+	respondSession(c, handler.core, handler.token, body.UID)
 }
 
 func (handler *UserHandlerImpl) startPasswordReset(c *gin.Context) {
 
-	var body struct {
-		Email string `json:"email" binding:"required"`
-	}
+	var body types.StartPasswordResetBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
+	body.Email = types.NormalizeEmail(body.Email)
 	if err := types.Validate.Struct(body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
+		return
+	}
+
+	// limited before the lookup, so it can't be used to probe for accounts either
+	if !allowRequest(c, handler.limiter,
+		service.RATE_LIMIT_RESET_PER_CALLER, c.GetString("clientIP"),
+		service.RATE_LIMIT_RESET_PER_ADDRESS, body.Email) {
 		return
 	}
 
 	// check user with email exists, only in our system, firebase emails are not relevant (we shouldnt have to reset google, microsoft email passwords!)
 	user, err := handler.core.ReadUserByEmail(body.Email)
 	if err != nil {
-		c.String(http.StatusNotFound, err.Error())
+		if errors.Is(err, types.ErrNotFound) {
+			AbortWithError(c, http.StatusNotFound, types.CODE_USER_NOT_FOUND, "user not found")
+			return
+		}
+		abortInternal(c, "error reading user by email", err)
 		return
 	}
 
 	// send email
 	link := fmt.Sprintf("%s/reset?u=%s", handler.portal_domain, user.Id)
-	if err := handler.email.Send([]string{body.Email}, handler.email.CreateResetPassword(body.Email, link)); err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	message, err := handler.email.CreateResetPassword(body.Email, user.Locale, &types.ResetPasswordMailData{Link: link})
+	if err != nil {
+		abortInternal(c, "error creating reset password mail", err)
 		return
 	}
+	handler.email.Enqueue(message)
 
 	c.Status(http.StatusOK)
 }
 
 func (handler *UserHandlerImpl) resetPassword(c *gin.Context) {
 
-	var body struct {
-		UID         string `json:"uid" binding:"required"`
-		NewPassword string `json:"newPassword" binding:"required"`
-	}
+	var body types.ResetPasswordBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
 	if err := types.Validate.Struct(body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
 
 	// check user exists with given uid
 	if err := handler.core.UserExists(body.UID); err != nil {
-		c.String(http.StatusNotFound, "user not found")
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
+		AbortWithError(c, http.StatusNotFound, types.CODE_USER_NOT_FOUND, "user not found")
 		return
 	}
 
 	// hash and update their password
 	if err := handler.core.UpdatePassword(body.UID, body.NewPassword); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInternal(c, "error updating password", err)
 		return
 	}
 
-	// update password in firebase
+	// update password in firebase, which may reject it, e.g. for being too weak
 	if err := handler.firebase.SetNewPassword(body.UID, body.NewPassword); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		log.Printf("error setting new password in firebase: %+v\n", err)
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVALID_REQUEST, "the new password was rejected")
 		return
 	}
 
+	// a new password ends every existing session
+	if _, err := handler.revokeSessions(body.UID, "ResetPassword"); err != nil {
+		log.Printf("error revoking sessions after password reset: %+v\n", err)
+	}
+
 	c.Status(http.StatusOK)
 }
 
@@ -157,76 +200,199 @@ func (handler *UserHandlerImpl) SignupVerify(c *gin.Context) {
 
 	// update user's verified field to true
 	if err := handler.core.VerifyUser(userId); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInternal(c, "error verifying user", err)
 		return
 	}
+	handler.events.PublishUserEvent(types.EVENT_USER_VERIFIED, userId)
 
 	// redirect to login
 	c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf("%s/login", handler.portal_domain))
 }
 
-// Sign up using email, password.
+// Sign up using email, password. With an invitation the user joins its group as part of the signup, and only gets
+// a default group of their own if invitedDefaultGroup is set.
 func (handler *UserHandlerImpl) signup_EMAIL_PASSWORD(c *gin.Context) {
-	var body struct {
-		UID          string  `json:"uid" binding:"required"`
-		Email        string  `json:"email" binding:"required"`
-		Password     string  `json:"password" binding:"required"`
-		InvitationId *string `json:"invitationId"`
-	}
+	var body types.SignupEmailPasswordBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+		abortInvalidRequest(c, err)
 		return
 	}
+	body.Email = types.NormalizeEmail(body.Email)
+	locale := requestLocale(c, body.Locale)
+
+	// the invitation is checked before anything is written, a signup with a bad one fails as a whole
+	var invitation *types.Invitation
+	if body.InvitationId != nil && *body.InvitationId != "" {
+		var ok bool
+		if invitation, ok = handler.signupInvitation(c, *body.InvitationId, body.Email); !ok {
+			return
+		}
+	}
+
 	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		if err := handler.core.CreateUserWithTx(tx, body.UID, body.Email, body.Password); err != nil {
-			if strings.Contains(err.Error(), "Duplicate entry") {
+		if err := handler.core.CreateUserWithTx(tx, body.UID, body.Email, body.Password, locale); err != nil {
+			if errors.Is(err, types.ErrDuplicate) {
 				return types.ErrUserAlreadyExists
 			} else {
 				log.Printf("error occured while creating user: %+v\n", err)
 				return err
 			}
 		}
-		// create default group and map user to it
-		if err := handler.core.CreateOrganisationWithTx(tx, "My Group", body.UID); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return err
+		if invitation != nil {
+			// a deleted group can't be joined, the invitation is kept in case it's restored
+			if _, err := handler.core.ReadGroupWithTx(tx, invitation.GroupId); err != nil {
+				return err
+			}
+			if err := handler.core.AddUserToOrganisationWithTx(tx, body.UID, invitation.GroupId); err != nil {
+				return err
+			}
+			if err := handler.core.DeleteInvitationWithTx(tx, invitation.Id); err != nil {
+				return err
+			}
+			if handler.invitedDefaultGroup {
+				_, err := handler.core.CreateOrganisationWithTx(tx, types.DEFAULT_GROUP_NAME, body.UID)
+				return err
+			}
 		}
-		return nil
+		// create default group and map user to it, unless they joined a group above
+		return handler.core.EnsureDefaultGroupWithTx(tx, body.UID)
 	})
 	if err != nil {
 		log.Printf("error signing up: %+v\n", err)
+		handler.rollbackFirebaseUser(body.UID, err)
 		switch {
 		case errors.Is(err, types.ErrUserAlreadyExists):
-			c.JSON(http.StatusConflict, gin.H{"error": "user already exists"})
+			AbortWithError(c, http.StatusConflict, types.CODE_USER_EXISTS, "user already exists")
+		case errors.Is(err, types.ErrInvitationNotFound):
+			AbortWithError(c, http.StatusBadRequest, types.CODE_INVITATION_NOT_FOUND, "the invitation was already used")
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusBadRequest, types.CODE_GROUP_NOT_FOUND, "the invitation's group no longer exists")
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
 		return
 	}
+	handler.events.PublishUserEvent(types.EVENT_USER_SIGNED_UP, body.UID)
+	if invitation != nil {
+		handler.webhook.Emit(types.WEBHOOK_MEMBER_ADDED, gin.H{"groupId": invitation.GroupId, "userId": body.UID})
+	}
+	handler.sendSignupVerification(body.UID, body.Email, locale)
+	respondCreated(c, "/api/user/"+body.UID+"/exists", gin.H{"uid": body.UID})
+
+}
+
+// Sign up with email and password, creating the Firebase account here rather than in the portal, so the password
+// policy is enforced and a failed signup doesn't leave an account behind. Responds with the new uid.
+func (handler *UserHandlerImpl) signup_FULL(c *gin.Context) {
+	var body types.SignupFullBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	if err := types.ValidatePassword(body.Password); err != nil {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_WEAK_PASSWORD, err.Error())
+		return
+	}
+	body.Email = types.NormalizeEmail(body.Email)
+	locale := requestLocale(c, body.Locale)
+
+	uid, err := handler.firebase.CreateUser(body.Email, body.Password, body.Name)
+	if err != nil {
+		if errors.Is(err, types.ErrUserAlreadyExists) {
+			AbortWithError(c, http.StatusConflict, types.CODE_USER_EXISTS, "user already exists")
+			return
+		}
+		abortInternal(c, "error creating firebase user", err)
+		return
+	}
 
-	// send verification email
-	go func() {
-		if err := handler.email.Send([]string{body.Email}, handler.email.CreateSignupVerification(body.Email, fmt.Sprintf("%s/api/user/signup/verify?u=%s", handler.domain, body.UID))); err != nil {
-			log.Printf("error sending verification email to %s\n", body.Email)
+	err = handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.core.CreateUserWithTx(tx, uid, body.Email, body.Password, locale); err != nil {
+			if errors.Is(err, types.ErrDuplicate) {
+				return types.ErrUserAlreadyExists
+			}
+			return err
+		}
+		return handler.core.EnsureDefaultGroupWithTx(tx, uid)
+	})
+	if err != nil {
+		log.Printf("error signing up: %+v\n", err)
+		// the account is ours, even if the address turned out to be taken in the database
+		if err := handler.firebase.DeleteUser(uid); err != nil {
+			log.Printf("error deleting firebase user %s after failed signup: %+v\n", uid, err)
+		}
+		switch {
+		case errors.Is(err, types.ErrUserAlreadyExists):
+			AbortWithError(c, http.StatusConflict, types.CODE_USER_EXISTS, "user already exists")
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
-	}()
-	c.Status(http.StatusCreated)
+		return
+	}
+	handler.events.PublishUserEvent(types.EVENT_USER_SIGNED_UP, uid)
+	handler.sendSignupVerification(uid, body.Email, locale)
+	respondCreated(c, "/api/user/"+uid+"/exists", gin.H{"uid": uid})
+}
+
+// Queues the mail with the link that verifies a new user's address, failing to create it only gets logged.
+func (handler *UserHandlerImpl) sendSignupVerification(uid string, email string, locale string) {
+	message, err := handler.email.CreateSignupVerification(email, locale, &types.VerificationMailData{Link: fmt.Sprintf("%s%s/api/user/signup/verify?u=%s", handler.domain, apiVersionPrefix, uid)})
+	if err != nil {
+		log.Printf("error creating verification email for %s: %+v\n", email, err)
+		return
+	}
+	handler.email.Enqueue(message)
+}
+
+// Deletes the Firebase account the portal created for a signup that failed, so the address can sign up again.
+// An account that already existed is left alone, as is one we can't tell about because the database is unreachable.
+// Best effort, the signup has failed either way.
+func (handler *UserHandlerImpl) rollbackFirebaseUser(uid string, signupErr error) {
+	if errors.Is(signupErr, types.ErrUserAlreadyExists) {
+		return
+	}
+	if err := handler.core.UserExists(uid); !errors.Is(err, types.ErrNotFound) {
+		log.Printf("not deleting firebase user %s after failed signup, user exists or can't be checked: %v\n", uid, err)
+		return
+	}
+	if err := handler.firebase.DeleteUser(uid); err != nil {
+		log.Printf("error deleting firebase user %s after failed signup: %+v\n", uid, err)
+	}
+}
 
+// Looks up the invitation a signup was made with, which must be for the address signing up.
+// Responds 400 if it can't be used, the signup shouldn't go ahead without the group the user was invited to.
+func (handler *UserHandlerImpl) signupInvitation(c *gin.Context, token string, email string) (*types.Invitation, bool) {
+	invitation, err := handler.core.LookupInvitation(token)
+	switch {
+	case errors.Is(err, types.ErrInvitationNotFound):
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVITATION_NOT_FOUND, "no invitation found for the given token")
+		return nil, false
+	case errors.Is(err, types.ErrInvitationExpired):
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVITATION_EXPIRED, "this invitation link has expired, ask the group to invite you again")
+		return nil, false
+	case err != nil:
+		abortInternal(c, "error looking up invitation", err)
+		return nil, false
+	}
+	if invitation.Email != email {
+		AbortWithError(c, http.StatusBadRequest, types.CODE_INVITATION_NOT_FOUND, "the invitation is for another address")
+		return nil, false
+	}
+	return invitation, true
 }
 
 // Signup using a third party provider, Google, Microsoft etc.
 func (handler *UserHandlerImpl) signup_PROVIDER(c *gin.Context) {
-	var body struct {
-		UID   string `json:"uid" binding:"required"`
-		Email string `json:"email" binding:"required"`
-	}
+	var body types.SignupProviderBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortInvalidRequest(c, err)
 		return
 	}
+	body.Email = types.NormalizeEmail(body.Email)
 	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
-		if err := handler.core.CreateUserWithTx(tx, body.UID, body.Email, "dawoidjawodijawodijawodijawdoaidoawijda120ei12090#01310"); err != nil {
-			if strings.Contains(err.Error(), "Duplicate entry") {
+		if err := handler.core.CreateUserWithTx(tx, body.UID, body.Email, "dawoidjawodijawodijawodijawdoaidoawijda120ei12090#01310", requestLocale(c, body.Locale)); err != nil {
+			if errors.Is(err, types.ErrDuplicate) {
 				return types.ErrUserAlreadyExists
 			} else {
 				log.Printf("error occured while creating user: %+v\n", err)
@@ -234,29 +400,31 @@ func (handler *UserHandlerImpl) signup_PROVIDER(c *gin.Context) {
 			}
 		}
 		// create default group and map user to it
-		if err := handler.core.CreateOrganisationWithTx(tx, "My Group", body.UID); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
-			return err
-		}
-		return nil
+		return handler.core.EnsureDefaultGroupWithTx(tx, body.UID)
 	})
 	if err != nil {
 		log.Printf("error signing up: %+v\n", err)
+		handler.rollbackFirebaseUser(body.UID, err)
 		switch {
 		case errors.Is(err, types.ErrUserAlreadyExists):
-			c.JSON(http.StatusConflict, gin.H{"error": "user already exists"})
+			AbortWithError(c, http.StatusConflict, types.CODE_USER_EXISTS, "user already exists")
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
 		}
 		return
 	}
-	c.Status(http.StatusCreated)
+	handler.events.PublishUserEvent(types.EVENT_USER_SIGNED_UP, body.UID)
+	respondCreated(c, "/api/user/"+body.UID+"/exists", gin.H{"uid": body.UID})
 }
 
-// Checks whether a user exists in database.
+// Checks whether a user exists in database, answering 200 or 404. Also served for HEAD, which skips the body.
 func (handler *UserHandlerImpl) userExists(c *gin.Context) {
 	if err := handler.core.UserExists(c.Param("userId")); err != nil {
-		c.Status(http.StatusNotFound)
+		if !errors.Is(err, types.ErrNotFound) {
+			abortInternal(c, "error checking user exists", err)
+			return
+		}
+		AbortWithError(c, http.StatusNotFound, types.CODE_USER_NOT_FOUND, "user not found")
 		return
 	}
 	c.Status(http.StatusOK)
@@ -268,18 +436,137 @@ func (handler *UserHandlerImpl) registerServiceUsed(c *gin.Context) {
 	// parse body
 	var body *types.RegisterServiceUsedBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		log.Println(err)
-		c.Status(http.StatusBadRequest)
+		abortInvalidRequest(c, err)
 		return
 	}
 
-	// register used services
-	if err := handler.core.RegisterUsedService(body.ServiceName, body.ImplementationGroup, body.OrganisationId, body.UserId); err != nil {
+	// register used services, only for members of an existing group
+	err := handler.core.WithTransaction(c.Request.Context(), func(tx *sql.Tx) error {
+		if err := handler.core.LockMembershipWithTx(tx, body.UserId, body.OrganisationId); err != nil {
+			return err
+		}
+		return handler.core.RegisterUsedServiceWithTx(tx, body.ServiceName, body.ImplementationGroup, body.OrganisationId, body.UserId, body.IdempotencyKey)
+	})
+	if err != nil {
 		log.Println(err)
-		c.Status(http.StatusForbidden)
+		switch {
+		case errors.Is(err, types.ErrNotFound):
+			AbortWithError(c, http.StatusNotFound, types.CODE_NOT_FOUND, "group or service not found")
+		case errors.Is(err, types.ErrForbiddenOperation):
+			AbortWithError(c, http.StatusForbidden, types.CODE_NOT_A_MEMBER, "user is not a member of the group")
+		case errors.Is(err, types.ErrQuotaExceeded):
+			// the numbers are only for the message shown to the user, so the use is refused even if they can't be read
+			var details any
+			if usage, err := handler.core.ReadQuotaUsage(c.Request.Context(), body.OrganisationId, body.ServiceName); err == nil {
+				details = usage
+			} else {
+				log.Printf("error reading quota usage: %+v\n", err)
+			}
+			AbortWithErrorDetails(c, http.StatusPaymentRequired, types.CODE_QUOTA_EXCEEDED, "the group has used up its monthly quota of the service", details)
+		default:
+			AbortWithError(c, http.StatusInternalServerError, types.CODE_INTERNAL, "internal error")
+		}
 		return
 	}
 
 	// send response to client
 	c.Status(http.StatusOK)
 }
+
+// Read the caller's notification preferences.
+func (handler *UserHandlerImpl) readNotificationPreferences(c *gin.Context) {
+	preferences, err := handler.core.ReadNotificationPreferences(c.Request.Context(), c.GetString("userId"))
+	if err != nil {
+		abortInternal(c, "error reading notification preferences", err)
+		return
+	}
+	c.JSON(http.StatusOK, preferences)
+}
+
+// Update the caller's notification preferences, only the given categories are changed.
+func (handler *UserHandlerImpl) updateNotificationPreferences(c *gin.Context) {
+	var body types.UpdateNotificationPreferencesBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortInvalidRequest(c, err)
+		return
+	}
+	userId := c.GetString("userId")
+	preferences, err := handler.core.ReadNotificationPreferences(c.Request.Context(), userId)
+	if err != nil {
+		abortInternal(c, "error reading notification preferences", err)
+		return
+	}
+	if body.RemovedFromGroup != nil {
+		preferences.RemovedFromGroup = *body.RemovedFromGroup
+	}
+	if body.InvitationAccepted != nil {
+		preferences.InvitationAccepted = *body.InvitationAccepted
+	}
+	if err := handler.core.UpdateNotificationPreferences(c.Request.Context(), userId, preferences); err != nil {
+		abortInternal(c, "error updating notification preferences", err)
+		return
+	}
+	c.JSON(http.StatusOK, preferences)
+}
+
+// Ends every session of the caller, e.g. after a suspected credential leak.
+func (handler *UserHandlerImpl) logoutAll(c *gin.Context) {
+	revokedAt, err := handler.revokeSessions(c.GetString("userId"), "LogoutAll")
+	if err != nil {
+		abortInternal(c, "error revoking sessions", err)
+		return
+	}
+	// this instance rejects the old tokens right away, other instances once their token cache entries expire,
+	// and session tokens once they expire, as they can't be refreshed anymore
+	effective := service.FirebaseTokenCacheTTL
+	if handler.token.SessionsEnabled() && handler.token.SessionTTL() > effective {
+		effective = handler.token.SessionTTL()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"revokedAt":   revokedAt.Format(time.RFC3339),
+		"effectiveBy": revokedAt.Add(effective).Format(time.RFC3339),
+	})
+}
+
+// Revokes the user's refresh tokens, which also drops their cached verified tokens, and their sessions with us,
+// and records it in the log of every group they're in.
+func (handler *UserHandlerImpl) revokeSessions(userId string, action string) (time.Time, error) {
+	revokedAt := time.Now()
+	if err := handler.firebase.RevokeToken(userId); err != nil {
+		return revokedAt, err
+	}
+	if handler.token.SessionsEnabled() {
+		if err := handler.core.RevokeSessions(context.Background(), userId); err != nil {
+			return revokedAt, err
+		}
+	}
+	user, err := handler.core.ReadUserById(userId)
+	if err != nil {
+		log.Printf("error reading user for session revocation log: %+v\n", err)
+		return revokedAt, nil
+	}
+	groups, err := handler.core.OrganisationList(userId)
+	if err != nil {
+		log.Printf("error reading groups for session revocation log: %+v\n", err)
+		return revokedAt, nil
+	}
+	for _, group := range groups {
+		handler.log.NewEntry(&types.LogEntry{
+			GroupId:   group.Id,
+			Action:    action,
+			Status:    "OK",
+			UserId:    userId,
+			Email:     user.Email,
+			Timestamp: revokedAt.Format(time.RFC3339),
+		})
+	}
+	return revokedAt, nil
+}
+
+// The locale to use for a request, an explicitly given locale takes precedence over the Accept-Language header.
+func requestLocale(c *gin.Context, preferred string) string {
+	if preferred != "" {
+		return service.MatchLocale(preferred)
+	}
+	return service.MatchLocale(c.GetHeader("Accept-Language"))
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/types"
+)
+
+// A signup failing after the portal created the Firebase account deletes it, so the address can sign up again.
+// An account whose user already exists is someone's, and is left alone.
+func TestFailedSignupsDeleteTheFirebaseUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		exists  bool // whether the user signed up before
+		status  int
+		deleted bool
+	}{
+		{"email and password", "/v1/api/user/signup/email_password", false, http.StatusInternalServerError, true},
+		{"provider", "/v1/api/user/signup", false, http.StatusInternalServerError, true},
+		{"email and password by an existing user", "/v1/api/user/signup/email_password", true, http.StatusConflict, false},
+		{"provider by an existing user", "/v1/api/user/signup", true, http.StatusConflict, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestAPI(t)
+			a.firebase.AddUser(&firebasetest.User{UID: "new-user", Email: "new@example.com"})
+			if test.exists {
+				a.core.addUser("new-user", "new@example.com")
+			}
+			a.core.before = func(method string) error {
+				if method == "EnsureDefaultGroupWithTx" {
+					return errors.New("connection reset")
+				}
+				return nil
+			}
+
+			recorder := a.do(http.MethodPost, test.path, "", &types.SignupEmailPasswordBody{UID: "new-user", Email: "new@example.com", Password: "password"})
+			if recorder.Code != test.status {
+				t.Fatalf("got %d %s, want %d", recorder.Code, recorder.Body.String(), test.status)
+			}
+			if deleted := a.firebase.User("new-user") == nil; deleted != test.deleted {
+				t.Errorf("the firebase user was deleted: %v, want %v", deleted, test.deleted)
+			}
+			if err := a.core.UserExists("new-user"); test.exists != (err == nil) {
+				t.Errorf("the failed signup was kept: %v", err)
+			}
+		})
+	}
+}
+
+// A signup with an invitation that fails once the user is written deletes the account signing up, not the one the
+// invitation was resolved to or the inviter's, and leaves the invitation to be used again.
+func TestFailedInvitationSignupDeletesTheRightFirebaseUser(t *testing.T) {
+	a := newTestAPI(t)
+	a.owner("owner", testGroupId)
+	a.firebase.AddUser(&firebasetest.User{UID: "invited-account", Email: "new@example.com"})
+	a.firebase.AddUser(&firebasetest.User{UID: "new-user", Email: "new@example.com"})
+	token := a.core.invite("invited-account", "new@example.com", testGroupId)
+	a.core.before = func(method string) error {
+		if method == "AddUserToOrganisationWithTx" {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	recorder := a.do(http.MethodPost, "/v1/api/user/signup/email_password", "",
+		&types.SignupEmailPasswordBody{UID: "new-user", Email: "new@example.com", Password: "password", InvitationId: &token})
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %s, want 500", recorder.Code, recorder.Body.String())
+	}
+	if a.firebase.User("new-user") != nil {
+		t.Error("the firebase user signing up was left behind")
+	}
+	for _, uid := range []string{"invited-account", "owner"} {
+		if a.firebase.User(uid) == nil {
+			t.Errorf("the firebase user %s was deleted", uid)
+		}
+	}
+	if err := a.core.UserExists("new-user"); err == nil {
+		t.Error("the failed signup was kept")
+	}
+	if _, err := a.core.LookupInvitation(token); err != nil {
+		t.Errorf("the invitation was used up by the failed signup: %v", err)
+	}
+}
+
+// Signing up in full creates the Firebase account here, which is deleted if anything after fails.
+func TestFailedFullSignupDeletesTheFirebaseUser(t *testing.T) {
+	a := newTestAPI(t)
+	a.core.before = func(method string) error {
+		if method == "EnsureDefaultGroupWithTx" {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	recorder := a.do(http.MethodPost, "/v1/api/user/signup/full", "", &types.SignupFullBody{Email: "new@example.com", Password: "Correct-Horse-7-battery", Name: "New"})
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %s, want 500", recorder.Code, recorder.Body.String())
+	}
+	if uid, err := a.firebase.GetUserIdByEmail("new@example.com"); err == nil {
+		t.Errorf("the firebase user %s was left behind", uid)
+	}
+}
+
+// Signing up in full with a password outside the policy is refused before any account is created.
+func TestWeakPasswordsAreRefused(t *testing.T) {
+	for _, password := range []string{"short-7", "no-digits-at-all", "1234567890", strings.Repeat("a1", 65)} {
+		a := newTestAPI(t)
+		recorder := a.do(http.MethodPost, "/v1/api/user/signup/full", "", &types.SignupFullBody{Email: "new@example.com", Password: password, Name: "New"})
+		if apiErr := responseError(recorder); recorder.Code != http.StatusBadRequest || apiErr == nil || apiErr.Code != types.CODE_WEAK_PASSWORD {
+			t.Errorf("%q got %d %s, want 400 %s", password, recorder.Code, recorder.Body.String(), types.CODE_WEAK_PASSWORD)
+		}
+		if uid, err := a.firebase.GetUserIdByEmail("new@example.com"); err == nil {
+			t.Errorf("%q created the firebase user %s", password, uid)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+
+	"user.service.altiore.io/repository"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+// Creates the first user of a fresh environment, verified and owning a default group, and prints their credentials.
+// With --password-file the generated password is written to a new file only its owner can read instead, as the output
+// often ends up in CI or container logs. Run as `user-service bootstrap --email <address> --name <name>`, the HTTP
+// server isn't started. A user that already exists is left alone, so running it again does nothing. A Firebase account
+// of the address without a user is refused, unless --reuse-firebase-user says to give it a new password and carry on.
+func bootstrap(args []string) error {
+	flags := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	email := flags.String("email", "", "email address of the user to create")
+	name := flags.String("name", "", "display name of the user to create")
+	passwordFile := flags.String("password-file", "", "new file to write the generated password to, rather than printing it")
+	reuseFirebaseUser := flags.Bool("reuse-firebase-user", false, "set a new password on an existing firebase account of the address and use it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, err := mail.ParseAddress(*email); err != nil || *name == "" {
+		return fmt.Errorf("usage: user-service bootstrap --email <address> --name <name> [--password-file <path>] [--reuse-firebase-user]")
+	}
+	address := types.NormalizeEmail(*email)
+
+	emailService, err := service.NewEmailService(&service.EmailServiceOpts{})
+	if err != nil {
+		return fmt.Errorf("error initializing email service: %w", err)
+	}
+	firebase := newFirebaseService(&service.FirebaseServiceOpts{Email: emailService})
+	role, err := repository.NewRoleRepository(&repository.RoleRepositoryOpts{Key: "1"})
+	if err != nil {
+		return fmt.Errorf("error initializing role repository: %w", err)
+	}
+	core, err := repository.NewCoreRepository(&repository.CoreRepositoryOpts{Role: role}, "1")
+	if err != nil {
+		return fmt.Errorf("error initializing core repository: %w", err)
+	}
+
+	user, err := core.ReadUserByEmail(address)
+	switch {
+	case err == nil:
+		fmt.Printf("user %s already exists (%s), nothing to do\n", address, user.Id)
+		return nil
+	case !errors.Is(err, types.ErrNotFound):
+		return fmt.Errorf("error checking for an existing user: %w", err)
+	}
+
+	// written before anything is created, so a password file that can't be written doesn't leave a user nobody can
+	// sign in as. It's removed again unless the password was set in firebase, after which it's the only copy.
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+	passwordSet := false
+	if *passwordFile != "" {
+		if err := writePasswordFile(*passwordFile, password); err != nil {
+			return err
+		}
+		defer func() {
+			if !passwordSet {
+				os.Remove(*passwordFile)
+			}
+		}()
+	}
+
+	// e.g. left behind by a run that failed after creating it, or someone's own account, so it's only taken over when
+	// asked to
+	userId, err := firebase.GetUserIdByEmail(address)
+	if err == nil {
+		if !*reuseFirebaseUser {
+			return fmt.Errorf("firebase user %s (%s) already exists, pass --reuse-firebase-user to set a new password on it and carry on", address, userId)
+		}
+		log.Printf("firebase user %s already exists, setting a new password\n", userId)
+		if err := firebase.SetNewPassword(userId, password); err != nil {
+			return fmt.Errorf("error setting password of firebase user: %w", err)
+		}
+	} else if userId, err = firebase.CreateUser(address, password, *name); err != nil {
+		return fmt.Errorf("error creating firebase user: %w", err)
+	}
+	passwordSet = true
+
+	err = core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+		if err := core.CreateUserWithTx(tx, userId, address, password, types.DEFAULT_LOCALE); err != nil {
+			return err
+		}
+		return core.EnsureDefaultGroupWithTx(tx, userId)
+	})
+	if err != nil {
+		if errors.Is(err, types.ErrDuplicate) {
+			// created meanwhile, but the firebase password was set all the same
+			fmt.Printf("user %s already exists (%s), its firebase password was set anew\n", address, userId)
+			printCredentials(address, password, *passwordFile)
+			return nil
+		}
+		return fmt.Errorf("error creating user: %w", err)
+	}
+	if err := core.VerifyUser(userId); err != nil {
+		return fmt.Errorf("error verifying user: %w", err)
+	}
+
+	fmt.Printf("created user %s (%s), owning group %q\n", address, userId, types.DEFAULT_GROUP_NAME)
+	printCredentials(address, password, *passwordFile)
+	return nil
+}
+
+// Prints the credentials to sign in with, or where the password was written to when it was.
+func printCredentials(address string, password string, passwordFile string) {
+	if passwordFile != "" {
+		fmt.Printf("email: %s, the password is in %s\n", address, passwordFile)
+		return
+	}
+	fmt.Printf("email: %s\npassword: %s\n", address, password)
+}
+
+// Writes the password to a new file only its owner can read, an existing file is refused rather than overwritten.
+func writePasswordFile(path string, password string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating password file: %w", err)
+	}
+	if _, err := fmt.Fprintln(file, password); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("error writing password file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error writing password file: %w", err)
+	}
+	return nil
+}
+
+// A random password of 24 characters.
+func generatePassword() (string, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("error generating password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -18,8 +20,6 @@ func LoadEnvironmentVariables() {
 		"DB_BUSINESS_PASS",
 		"DB_BUSINESS_HOST",
 		"DB_BUSINESS_PORT",
-		"EMAIL_SERVICE_EMAIL",
-		"EMAIL_SERVICE_PASSWORD",
 		"DOMAIN",
 		"PORTAL_DOMAIN",
 		"SERVICE_TOKEN_SECRET",
@@ -31,4 +31,59 @@ func LoadEnvironmentVariables() {
 			log.Fatalf("%s environment variable not set", k)
 		}
 	}
+
+	validateFirebaseCredentials()
+	validateSessionTokens()
+	validateAdminAPI()
+}
+
+// The admin API is only registered with ADMIN_API_ENABLED=true, and then only serves the operators in ADMIN_UIDS.
+func validateAdminAPI() {
+	if os.Getenv("ADMIN_API_ENABLED") != "true" {
+		return
+	}
+	if strings.TrimSpace(os.Getenv("ADMIN_UIDS")) == "" {
+		log.Fatal("ADMIN_UIDS must list the operators' uids when ADMIN_API_ENABLED is set")
+	}
+	log.Println("admin API enabled")
+}
+
+// Session tokens are behind SESSION_TOKENS=true while clients move over, and need a secret of their own when enabled.
+func validateSessionTokens() {
+	if os.Getenv("SESSION_TOKENS") != "true" {
+		return
+	}
+	secret := os.Getenv("SESSION_TOKEN_SECRET")
+	switch {
+	case len(secret) < 32:
+		log.Fatal("SESSION_TOKEN_SECRET must be at least 32 characters when SESSION_TOKENS is enabled")
+	case secret == os.Getenv("SERVICE_TOKEN_SECRET"):
+		log.Fatal("SESSION_TOKEN_SECRET must differ from SERVICE_TOKEN_SECRET")
+	}
+	log.Println("session tokens enabled")
+}
+
+// Firebase credentials are given either as raw JSON or as a file path, falling back to Application Default Credentials when neither is set.
+// The auth emulator needs no credentials, and neither does running locally against the in-memory fake.
+func validateFirebaseCredentials() {
+	credentials := os.Getenv("FIREBASE_CREDENTIALS_JSON")
+	path := os.Getenv("FIREBASE_CREDENTIALS_FILE")
+	switch {
+	case os.Getenv("FIREBASE_AUTH_EMULATOR_HOST") != "":
+		log.Printf("using firebase auth emulator at %s\n", os.Getenv("FIREBASE_AUTH_EMULATOR_HOST"))
+	case credentials != "" && path != "":
+		log.Fatal("only one of FIREBASE_CREDENTIALS_JSON and FIREBASE_CREDENTIALS_FILE may be set")
+	case credentials != "":
+		if !json.Valid([]byte(credentials)) {
+			log.Fatal("FIREBASE_CREDENTIALS_JSON is not valid JSON")
+		}
+	case path != "":
+		if _, err := os.Stat(path); err != nil {
+			log.Fatalf("FIREBASE_CREDENTIALS_FILE can't be read: %v", err)
+		}
+	case os.Getenv("ENV") == "LOCAL":
+		log.Println("no firebase credentials set, using in-memory firebase")
+	default:
+		log.Println("no firebase credentials set, using application default credentials")
+	}
 }
@@ -1,118 +1,174 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"user.service.altiore.io/api"
 	"user.service.altiore.io/config"
 	"user.service.altiore.io/repository"
 	"user.service.altiore.io/service"
+	"user.service.altiore.io/service/firebasetest"
+	"user.service.altiore.io/singleton"
 	"user.service.altiore.io/types"
 )
 
+// Firebase is faked in memory when running locally with neither credentials nor the auth emulator configured.
+func newFirebaseService(opts *service.FirebaseServiceOpts) service.FirebaseService {
+	if os.Getenv("ENV") == "LOCAL" && os.Getenv("FIREBASE_AUTH_EMULATOR_HOST") == "" &&
+		os.Getenv("FIREBASE_CREDENTIALS_JSON") == "" && os.Getenv("FIREBASE_CREDENTIALS_FILE") == "" {
+		log.Println("using in-memory firebase, tokens are user ids")
+		return firebasetest.NewFakeFirebaseService(opts)
+	}
+	return service.NewFirebaseService(opts, "1")
+}
+
 type App struct {
 	API api.API
 }
 
-func InitApp() *App {
+// Checks the email provider accepts our credentials before serving, when EMAIL_VERIFY_ON_STARTUP=true.
+// Off by default so local development without a mail server still boots, the noop provider passes anyway.
+func verifyEmail(email service.EmailService) error {
+	if os.Getenv("EMAIL_VERIFY_ON_STARTUP") != "true" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return email.Verify(ctx)
+}
+
+// Builds every repository and service once, and hands them to the handlers.
+// Fails if the database can't be reached, see DB_CONNECT_ATTEMPTS, or the email service is misconfigured.
+func InitApp() (*App, error) {
+	email, err := service.NewEmailService(&service.EmailServiceOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing email service: %w", err)
+	}
+	if err := verifyEmail(email); err != nil {
+		return nil, fmt.Errorf("error verifying email service: %w", err)
+	}
+	var (
+		token    = service.NewTokenService(nil)
+		firebase = newFirebaseService(&service.FirebaseServiceOpts{Email: email})
+	)
+	role, err := repository.NewRoleRepository(&repository.RoleRepositoryOpts{Key: "1"})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing role repository: %w", err)
+	}
+	core, err := repository.NewCoreRepository(&repository.CoreRepositoryOpts{Role: role}, "1")
+	if err != nil {
+		return nil, fmt.Errorf("error initializing core repository: %w", err)
+	}
+	logs, err := repository.NewLogRepository(&repository.LogRepositoryOpts{Key: "1"})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing log repository: %w", err)
+	}
+	var (
+		events  = service.NewEventPublisher(&service.EventPublisherOpts{})
+		webhook = service.NewWebhookService(&service.WebhookServiceOpts{})
+		case_   = service.NewCaseService(&service.CaseServiceOpts{Token: token})
+		limiter = service.NewRateLimiter(&service.RateLimiterOpts{})
+		perms   = service.NewPermissionResolver(&service.PermissionResolverOpts{Users: core, Roles: role, Members: core})
+	)
+	handlers := []types.Handler{
+		api.NewMiddlewareHandler(&api.MiddlewareHandlerOpts{
+			Core:        core,
+			Role:        role,
+			Log:         logs,
+			Firebase:    firebase,
+			Token:       token,
+			Permissions: perms,
+		}),
+		api.NewUserHandler(&api.UserHandlerOpts{
+			Core:     core,
+			Firebase: firebase,
+			Email:    email,
+			Events:   events,
+			Log:      logs,
+			Limiter:  limiter,
+			Webhook:  webhook,
+			Token:    token,
+		}),
+		api.NewServiceHandler(&api.ServiceHandlerOpts{
+			Core: core,
+		}),
+		api.NewGroupHandler(&api.GroupHandlerOpts{
+			Core:        core,
+			Role:        role,
+			Firebase:    firebase,
+			Email:       email,
+			Case:        case_,
+			Webhook:     webhook,
+			Limiter:     limiter,
+			Token:       token,
+			Log:         logs,
+			Permissions: perms,
+		}),
+		api.NewTokenHandler(&api.TokenHandlerOpts{
+			Core:     core,
+			Firebase: firebase,
+			Token:    token,
+		}),
+		api.NewLogHandler(&api.LogHandlerOpts{
+			Log:         logs,
+			Role:        role,
+			Core:        core,
+			Email:       email,
+			Permissions: perms,
+		}),
+		api.NewInternalHandler(&api.InternalHandlerOpts{
+			Core:        core,
+			Role:        role,
+			Log:         logs,
+			Firebase:    firebase,
+			Permissions: perms,
+			Webhook:     webhook,
+			Token:       token,
+		}),
+		api.NewDocsHandler(&api.DocsHandlerOpts{
+			Version: "1.0.0",
+		}),
+	}
+	// support tasks for operators, off unless asked for
+	if os.Getenv("ADMIN_API_ENABLED") == "true" {
+		handlers = append(handlers, api.NewAdminHandler(&api.AdminHandlerOpts{
+			Core:        core,
+			Role:        role,
+			Log:         logs,
+			Firebase:    firebase,
+			Permissions: perms,
+		}))
+	}
 	return &App{
 		API: api.NewAPI(&api.API_opts{
-			Handlers: []types.Handler{
-				api.NewMiddlewareHandler(&api.MiddlewareHandlerOpts{
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-							Key: "1",
-						}),
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-					Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-						Key: "1",
-					}),
-					Log: repository.NewLogRepository(&repository.LogRepositoryOpts{Key: "1"}),
-					Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-						Email: service.NewEmailService(),
-					}, "1"),
-					Token: service.NewTokenService(nil),
-				}),
-				api.NewUserHandler(&api.UserHandlerOpts{
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-							Key: "1",
-						}),
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-					Email: service.NewEmailService(),
-					Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-						Email: service.NewEmailService(),
-					}, "1"),
-				}),
-				api.NewServiceHandler(&api.ServiceHandlerOpts{
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-							Key: "1",
-						}),
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-				}),
-				api.NewGroupHandler(&api.GroupHandlerOpts{
-					Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-						Key: "1",
-					}),
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-							Key: "1",
-						}),
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-					Email: service.NewEmailService(),
-					Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-						Email: service.NewEmailService(),
-					}, "1"),
-				}),
-				api.NewTokenHandler(&api.TokenHandlerOpts{
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{
-							Key: "1",
-						}),
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-					Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-						Email: service.NewEmailService(),
-					}, "1"),
-				}),
-				api.NewLogHandler(&api.LogHandlerOpts{
-					Log: repository.NewLogRepository(&repository.LogRepositoryOpts{Key: "1"}),
-				}),
-				api.NewInternalHandler(&api.InternalHandlerOpts{
-					Core: repository.NewCoreRepository(&repository.CoreRepositoryOpts{
-						Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-							Email: service.NewEmailService(),
-						}, "1"),
-					}, "1"),
-					Role: repository.NewRoleRepository(&repository.RoleRepositoryOpts{Key: "1"}),
-					Log:  repository.NewLogRepository(&repository.LogRepositoryOpts{Key: "1"}),
-					Firebase: service.NewFirebaseService(&service.FirebaseServiceOpts{
-						Email: service.NewEmailService(),
-					}, "1"),
-				}),
+			ReadinessChecks: map[string]func(ctx context.Context) error{
+				"email": email.Verify,
 			},
+			Handlers: handlers,
 		}),
-	}
+	}, nil
 }
 
 func main() {
-	log.Println("starting user service...")
 	config.LoadEnvironmentVariables()
-	app := InitApp()
-	app.API.Run()
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		if err := bootstrap(os.Args[2:]); err != nil {
+			log.Fatalf("error bootstrapping: %v", err)
+		}
+		return
+	}
+	log.Println("starting user service...")
+	app, err := InitApp()
+	if err != nil {
+		log.Fatalf("error starting user service: %v", err)
+	}
+	log.Printf("instances: %s\n", singleton.Summary())
+	app.API.Build()
+	if err := app.API.Serve(":" + os.Getenv("PORT")); err != nil {
+		log.Fatalf("error serving api: %v", err)
+	}
 }
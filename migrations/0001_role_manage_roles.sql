@@ -0,0 +1,5 @@
+-- Adds the ManageRoles permission, existing roles default to not having it.
+ALTER TABLE role ADD COLUMN manage_roles BOOLEAN NOT NULL DEFAULT false;
+
+-- Group owners keep full control over their group's roles.
+UPDATE role SET manage_roles = true WHERE name = 'Group Owner';
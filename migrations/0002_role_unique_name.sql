@@ -0,0 +1,2 @@
+-- Role names are unique within a group, the default collation makes this case-insensitive.
+ALTER TABLE role ADD UNIQUE INDEX role_organisation_name (organisationId, name);
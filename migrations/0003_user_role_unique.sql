@@ -0,0 +1,6 @@
+-- Remove duplicate role assignments, keeping one mapping per user and role.
+DELETE ur1 FROM user_role ur1
+INNER JOIN user_role ur2 ON ur1.userId = ur2.userId AND ur1.roleId = ur2.roleId AND ur1.id > ur2.id;
+
+-- A role can only be assigned to a user once.
+ALTER TABLE user_role ADD UNIQUE INDEX user_role_user_role (userId, roleId);
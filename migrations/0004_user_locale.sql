@@ -0,0 +1,2 @@
+-- The locale emails are sent to the user in, existing users keep receiving English mails.
+ALTER TABLE user ADD COLUMN locale VARCHAR(8) NOT NULL DEFAULT 'en';
@@ -0,0 +1,6 @@
+-- Per-user opt-outs for non-transactional mail. Users without a row receive everything.
+CREATE TABLE notification_preferences (
+    userId VARCHAR(128) NOT NULL PRIMARY KEY,
+    removed_from_group BOOLEAN NOT NULL DEFAULT TRUE,
+    invitation_accepted BOOLEAN NOT NULL DEFAULT TRUE
+);
@@ -0,0 +1,4 @@
+-- Services are retired rather than deleted once used, so used_service keeps pointing at them.
+ALTER TABLE service ADD COLUMN retired BOOLEAN NOT NULL DEFAULT FALSE;
+-- Only covers services with an implementation group, as MySQL allows repeated NULLs; the repository checks the rest.
+ALTER TABLE service ADD UNIQUE INDEX service_name_implementation_group (name, implementationGroup);
@@ -0,0 +1,3 @@
+-- When a service was used. Rows recorded before this column existed stay NULL and are left out of ranged usage reports.
+ALTER TABLE used_service ADD COLUMN usedAt DATETIME NULL;
+ALTER TABLE used_service ADD INDEX used_service_organisation_used_at (organisationId, usedAt);
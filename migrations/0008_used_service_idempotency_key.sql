@@ -0,0 +1,4 @@
+-- Lets callers retry registering a use without counting it twice, e.g. keyed by the case that was created.
+-- Uses registered without a key are NULL, which the unique index doesn't restrict.
+ALTER TABLE used_service ADD COLUMN idempotencyKey VARCHAR(128) NULL;
+ALTER TABLE used_service ADD UNIQUE INDEX used_service_idempotency_key (idempotencyKey);
@@ -0,0 +1,3 @@
+-- The user who sent an invitation, userId being the invitee's. Invitations sent before this and
+-- those created by internal services are NULL.
+ALTER TABLE invitation ADD COLUMN invitedBy VARCHAR(128) NULL;
@@ -0,0 +1,10 @@
+-- Emails are stored trimmed and lowercased from now on, see types.NormalizeEmail. Bring existing rows in line.
+-- Invitations that only differed in case or whitespace are the same invitation, the oldest row by id is kept.
+DELETE i FROM invitation i
+    INNER JOIN invitation j ON j.organisationId = i.organisationId
+        AND LOWER(TRIM(j.email)) = LOWER(TRIM(i.email))
+        AND j.id < i.id;
+UPDATE invitation SET email = LOWER(TRIM(email));
+-- Accounts only differing in case are separate users and can't be merged here, if this fails on a unique
+-- index the conflicting rows have to be resolved by hand first.
+UPDATE user SET email = LOWER(TRIM(email));
@@ -0,0 +1,3 @@
+-- Optional detail of a log entry as a JSON object, e.g. the old and new name of a renamed group.
+-- Added last, the log repository inserts by position.
+ALTER TABLE log ADD COLUMN detail JSON NULL;
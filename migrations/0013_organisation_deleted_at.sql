@@ -0,0 +1,4 @@
+-- When a group was deleted. Deleted groups are hidden but kept with their memberships, roles and
+-- invitations, so they can be restored for a while before they're cleaned up for good.
+ALTER TABLE organisation ADD COLUMN deletedAt DATETIME NULL;
+CREATE INDEX organisation_deleted_at ON organisation (deletedAt);
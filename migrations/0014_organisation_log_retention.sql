@@ -0,0 +1,2 @@
+-- Months a group's log entries are kept for, NULL for the default (LOG_RETENTION_MONTHS).
+ALTER TABLE organisation ADD COLUMN logRetentionMonths INT NULL;
@@ -0,0 +1,3 @@
+-- When a group last changed, e.g. was renamed, deleted or restored, so other services can refresh
+-- what they keep of it cheaply. Existing groups start out as changed now.
+ALTER TABLE organisation ADD COLUMN updatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP;
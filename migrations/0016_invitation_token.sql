@@ -0,0 +1,4 @@
+-- Invitation links carry a random token rather than the row id, only its sha256 is stored. Invitations sent
+-- before this keep a NULL tokenHash: their links answer 410 and listings mark them expired, so the group can
+-- send them again, which replaces them.
+ALTER TABLE invitation ADD COLUMN tokenHash CHAR(64) NULL, ADD UNIQUE INDEX invitation_token_hash (tokenHash);
@@ -0,0 +1,6 @@
+-- An address can only have one pending invitation per group, however many members invite it.
+-- Duplicates from before are removed first, the oldest row by id is kept.
+DELETE i FROM invitation i
+    INNER JOIN invitation j ON j.organisationId = i.organisationId AND j.email = i.email AND j.id < i.id;
+
+ALTER TABLE invitation ADD UNIQUE INDEX invitation_group_email (organisationId, email);
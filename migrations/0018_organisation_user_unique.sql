@@ -0,0 +1,6 @@
+-- Remove duplicate memberships, keeping one row per user and group.
+DELETE ou1 FROM organisation_user ou1
+INNER JOIN organisation_user ou2 ON ou1.userId = ou2.userId AND ou1.organisationId = ou2.organisationId AND ou1.id > ou2.id;
+
+-- A user can only be a member of a group once, a concurrent second join fails rather than adding another row.
+ALTER TABLE organisation_user ADD UNIQUE INDEX organisation_user_user_organisation (userId, organisationId);
@@ -0,0 +1,8 @@
+-- Sessions behind the session tokens we issue, a revoked session can't be refreshed.
+CREATE TABLE session (
+    id CHAR(36) NOT NULL PRIMARY KEY,
+    userId VARCHAR(128) NOT NULL,
+    createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revokedAt DATETIME NULL,
+    INDEX session_user (userId)
+);
@@ -0,0 +1,8 @@
+-- Monthly limits on a group's uses of a service, by service name across implementation groups.
+-- Groups without a row for a service may use it without limit.
+CREATE TABLE service_quota (
+    organisationId VARCHAR(128) NOT NULL,
+    serviceName VARCHAR(255) NOT NULL,
+    monthlyLimit INT NOT NULL,
+    PRIMARY KEY (organisationId, serviceName)
+);
@@ -0,0 +1,2 @@
+-- Operators allowed to use the admin API, which also requires their uid to be listed in ADMIN_UIDS.
+ALTER TABLE user ADD COLUMN platformAdmin BOOLEAN NOT NULL DEFAULT FALSE;
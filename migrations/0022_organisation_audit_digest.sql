@@ -0,0 +1,4 @@
+-- Whether a group's members with ViewLogs get a weekly summary of its log, and the start of the week
+-- the last one was claimed for, so a single instance sends each digest.
+ALTER TABLE organisation ADD COLUMN auditDigest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE organisation ADD COLUMN auditDigestSentAt DATETIME NULL;
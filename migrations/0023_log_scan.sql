@@ -0,0 +1,6 @@
+-- How far periodic scans of the log got, claimed with a conditional update so each stretch is scanned once.
+CREATE TABLE log_scan (
+    name VARCHAR(64) NOT NULL PRIMARY KEY,
+    scannedUntil DATETIME NOT NULL
+);
+INSERT INTO log_scan (name, scannedUntil) VALUES ('alerts', UTC_TIMESTAMP());
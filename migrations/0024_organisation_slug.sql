@@ -0,0 +1,4 @@
+-- Readable name of a group for URLs, e.g. "acme-finance", usable wherever the group's id is. Groups created
+-- before slugs have none until one is set.
+ALTER TABLE organisation ADD COLUMN slug VARCHAR(63) NULL;
+CREATE UNIQUE INDEX organisation_slug ON organisation (slug);
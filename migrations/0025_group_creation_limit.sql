@@ -0,0 +1,11 @@
+-- Who created a group and when, so creations can be counted per user. Groups from before have neither and
+-- don't count.
+ALTER TABLE organisation ADD COLUMN createdBy VARCHAR(128) NULL;
+ALTER TABLE organisation ADD COLUMN createdAt DATETIME NULL;
+CREATE INDEX organisation_created_by ON organisation (createdBy, createdAt);
+
+-- Users allowed a different number of groups per day than GROUP_CREATION_DAILY_LIMIT, NULL for no limit.
+CREATE TABLE group_creation_limit (
+    userId VARCHAR(128) NOT NULL PRIMARY KEY,
+    dailyLimit INT NULL
+);
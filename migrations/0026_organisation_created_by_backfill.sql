@@ -0,0 +1,13 @@
+-- Groups from before createdBy was recorded are attributed to their owner, if they have exactly one.
+-- createdAt stays NULL, as it isn't known, so they don't count towards the group creation limit.
+UPDATE organisation o
+INNER JOIN (
+    SELECT r.organisationId, MIN(ur.userId) AS userId
+    FROM role r
+    INNER JOIN user_role ur ON ur.roleId = r.id
+    WHERE r.name = 'Group Owner'
+    GROUP BY r.organisationId
+    HAVING COUNT(DISTINCT ur.userId) = 1
+) owner ON owner.organisationId = o.id
+SET o.createdBy = owner.userId
+WHERE o.createdBy IS NULL;
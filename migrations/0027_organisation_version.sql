@@ -0,0 +1,2 @@
+-- Counts changes to a group's metadata, so an update made on a stale read can be refused.
+ALTER TABLE organisation ADD COLUMN version INT NOT NULL DEFAULT 1;
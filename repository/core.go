@@ -6,197 +6,254 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
+	"math/rand"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/cloudsqlconn"
-	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	"user.service.altiore.io/service"
+	"user.service.altiore.io/singleton"
 	"user.service.altiore.io/types"
 )
 
 type CoreRepository interface {
+	// Runs fn in a transaction, committing if it returns nil and rolling back otherwise.
+	// On a deadlock or lock wait timeout the whole transaction is retried, so fn may run more than once:
+	// it must only change state through tx, and leave side effects such as responding, sending mail or
+	// emitting events until WithTransaction has returned.
 	WithTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error
+	// Runs fn in a read-only transaction, so reads spanning several queries see one consistent snapshot.
+	// Writes through tx fail. The same retry contract as WithTransaction applies.
+	WithReadTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error
+	// Same as WithTransaction with the given options, e.g. a stricter isolation level than the database default.
+	// Statements the WithTx methods run through tx use ctx, so cancelling it aborts the transaction mid-way.
+	// If fn panics the transaction is rolled back before the panic continues, it's never left open.
+	WithTransactionOpts(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error
 
 	NewTransaction(ctx context.Context, readOnly bool) (*sql.Tx, error)
 	CommitTransaction(tx *sql.Tx) error
 	ReadUserById(userId string) (*types.User, error)
 	UpdateGroupName(groupId string, name string) error
 	UpdateGroupNameWithTx(tx *sql.Tx, groupId string, name string) error
+	UpdateGroupVersionWithTx(tx *sql.Tx, groupId string, version *int) (int, error)
 	DeleteGroupWithTx(tx *sql.Tx, userId string, groupId string) error
+	RestoreGroupWithTx(tx *sql.Tx, groupId string) error
+	ReadExpiredGroups(ctx context.Context) ([]string, error)
+	UpdateGroupAuditDigestWithTx(tx *sql.Tx, groupId string, enabled bool) error
+	UpdateGroupSlugWithTx(tx *sql.Tx, groupId string, slug string) error
+	ResolveGroupSlug(ctx context.Context, slug string) (string, error)
+	RecentGroupCreationsWithTx(tx *sql.Tx, userId string, since time.Time, limit int) ([]time.Time, error)
+	ReadGroupCreationLimit(ctx context.Context, userId string) (*int, bool, error)
+	SetGroupCreationLimit(ctx context.Context, userId string, dailyLimit *int) error
+	DeleteGroupCreationLimit(ctx context.Context, userId string) error
+	ReadAuditDigestGroups(ctx context.Context, weekStart time.Time) ([]string, error)
+	ClaimAuditDigest(ctx context.Context, groupId string, weekStart time.Time) (bool, error)
+	PurgeGroupWithTx(tx *sql.Tx, groupId string) error
 	UpdatePassword(uid string, password string) error
 	Login(uid string, email string, password string) error
-	Signup(userId string, name string) error
+	Signup(userId string, name string) (*types.Organisation, error)
 	ReadUserByEmail(email string) (*types.User, error)
 	VerifyUser(userId string) error
 	CreateUser(tx *sql.Tx, userId string) error
-	CreateUserWithTx(tx *sql.Tx, userId string, email string, password string) error
+	CreateUserWithTx(tx *sql.Tx, userId string, email string, password string, locale string) error
+	EnsureUserWithTx(tx *sql.Tx, userId string, email string) (bool, error)
 	UserExists(uid string) error
-	ReadServices() ([]*types.Service, error)
-	ImplementationGroupCount(serviceName string) (int, error)
-	RegisterUsedService(serviceName string, implementationGroup *int, organisationId string, userId string) error
-	RegisterUsedServiceWithTx(tx *sql.Tx, serviceName string, implementationGroup *int, organisationId string, userId string) error
+	ReadServices(includeRetired bool) ([]*types.Service, error)
+	ReadServiceWithTx(tx *sql.Tx, serviceId string) (*types.Service, error)
+	CreateServiceWithTx(tx *sql.Tx, service *types.Service) error
+	UpdateServiceWithTx(tx *sql.Tx, service *types.Service) error
+	DeleteServiceWithTx(tx *sql.Tx, serviceId string) error
+	ImplementationGroups(serviceName string) ([]int, error)
+	ReadServiceUsageWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUsage, error)
+	ReadServiceUsesWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUse, error)
+	RegisterUsedService(serviceName string, implementationGroup *int, organisationId string, userId string, idempotencyKey string) error
+	RegisterUsedServiceWithTx(tx *sql.Tx, serviceName string, implementationGroup *int, organisationId string, userId string, idempotencyKey string) error
+	SetServiceQuota(ctx context.Context, organisationId string, serviceName string, monthlyLimit int) error
+	DeleteServiceQuota(ctx context.Context, organisationId string, serviceName string) error
+	ReadQuotaUsage(ctx context.Context, organisationId string, serviceName string) (*types.QuotaUsage, error)
+	ReadUsageSummaryWithTx(tx *sql.Tx, groupId string) ([]*types.ServiceUsageSummary, error)
+	IsPlatformAdmin(ctx context.Context, userId string) (bool, error)
+	SearchUsersByEmail(ctx context.Context, query string, limit int) ([]*types.AdminUser, error)
+	ReadMonthlyUsageWithTx(tx *sql.Tx, groupId string, months int, serviceNames []string) (map[string][]*types.MonthlyUsage, error)
 	OrganisationList(userId string) ([]*types.Organisation, error)
 	ReadOrganisationMembers(id string) ([]*types.OrganisationMember, error)
-	CreateInvitation(userId string, email string, groupId string) (string, error)
-	IsUserAlreadyMember(userId string, groupId string) error
+	ReadOrganisationMembersWithTx(tx *sql.Tx, id string) ([]*types.OrganisationMember, error)
+	ReadOrganisationMembersPageWithTx(tx *sql.Tx, groupId string, after *types.MemberCursor, limit int) (*types.MemberPage, error)
+	CreateInvitation(userId string, email string, groupId string, invitedBy string) (*types.Invitation, string, error)
+	CreateInvitationWithTx(tx *sql.Tx, userId string, email string, groupId string, invitedBy string) (*types.Invitation, string, error)
+	ReadGroupInvitations(groupId string) ([]*types.Invitation, error)
+	ReadGroupInvitation(ctx context.Context, groupId string, id string) (*types.Invitation, error)
+	RevokeInvitation(ctx context.Context, groupId string, id string) (*types.Invitation, error)
+	IsMember(ctx context.Context, userId string, groupId string) (bool, error)
+	IsMemberWithTx(tx *sql.Tx, userId string, groupId string) (bool, error)
+	LockMembershipWithTx(tx *sql.Tx, userId string, groupId string) error
 	ReadGroup(ctx context.Context, groupId string) (*types.Organisation, error)
-	LookupInvitation(invitationId string) (string, string, string, error)
+	ReadGroupWithTx(tx *sql.Tx, groupId string) (*types.Organisation, error)
+	ReadGroupInfo(ctx context.Context, groupId string) (*types.GroupInfo, error)
+	LookupInvitation(token string) (*types.Invitation, error)
+	ReadInvitation(ctx context.Context, id string) (*types.Invitation, error)
 	DeleteInvitation(id string) error
 	DeleteInvitationWithTx(tx *sql.Tx, id string) error
 	AddUserToOrganisationWithTx(tx *sql.Tx, userId string, groupId string) error
 	AddUserToOrganisation(userId string, organisationId string) error
-	InvitationSignup(invitationId string, email string, password string, name string) error
 	DeleteUser(userId string) error
 	DeleteUserWithTx(tx *sql.Tx, userId string) error
 	RemoveUserFromOrganisationWithTx(tx *sql.Tx, userId string, organisationId string) error
-	CreateOrganisationWithTx(tx *sql.Tx, name string, userId string) error
+	CreateOrganisationWithTx(tx *sql.Tx, name string, userId string) (*types.Organisation, error)
+	FindOwnedGroupByNameWithTx(tx *sql.Tx, userId string, name string) (string, error)
+	EnsureDefaultGroupWithTx(tx *sql.Tx, userId string) error
+	ReadNotificationPreferences(ctx context.Context, userId string) (*types.NotificationPreferences, error)
+	UpdateNotificationPreferences(ctx context.Context, userId string, preferences *types.NotificationPreferences) error
+	CreateSession(ctx context.Context, userId string) (*types.Session, error)
+	ReadSession(ctx context.Context, id string) (*types.Session, error)
+	RevokeSessions(ctx context.Context, userId string) error
 }
 
 type CoreRepositoryOpts struct {
-	Firebase service.FirebaseService
-	Role     RoleRepository
+	Role RoleRepository
 }
 
-var (
-	core_repository_instance_map = make(map[string]*CoreRepositoryImpl)
-	mu                           sync.Mutex
-)
+var coreRepositories = singleton.NewRegistry[*CoreRepositoryImpl]("core repository", 1)
 
 type CoreRepositoryImpl struct {
-	client   *sql.DB
-	firebase service.FirebaseService
-	role     RoleRepository
+	client     *sql.DB
+	reads      *readRouter
+	role       RoleRepository
+	txAttempts int
 }
 
-func NewCoreRepository(opts *CoreRepositoryOpts, key string) *CoreRepositoryImpl {
-	mu.Lock()
-	defer mu.Unlock()
-	if instance, exists := core_repository_instance_map[key]; exists {
-		return instance
-	}
-
-	var (
-		uri                = ""
-		user               = os.Getenv("DB_BUSINESS_USER")
-		pass               = os.Getenv("DB_BUSINESS_PASS")
-		host               = os.Getenv("DB_BUSINESS_HOST")
-		port               = os.Getenv("DB_BUSINESS_PORT")
-		instance_conn_name = os.Getenv("DB_BUSINESS_INSTANCE_CONN_NAME")
-	)
-
-	switch os.Getenv("ENV") {
+// Base delay before retrying a transaction, doubled per attempt and jittered.
+const txRetryBaseDelay = time.Millisecond * 50
 
-	case "LOCAL":
-		log.Println("loading connection info for local mysql server")
-		uri = fmt.Sprintf("%s:%s@tcp(%s:%s)/core?parseTime=true", user, pass, host, port)
-
-	default:
-		log.Println("loading connection info for google cloud mysql server...")
-		d, err := cloudsqlconn.NewDialer(context.Background())
+func NewCoreRepository(opts *CoreRepositoryOpts, key string) (*CoreRepositoryImpl, error) {
+	return coreRepositories.Get(key, func() (*CoreRepositoryImpl, error) {
+		db, err := openDatabase()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		mysql.RegisterDialContext("cloudsqlconn", func(ctx context.Context, addr string) (net.Conn, error) {
-			return d.Dial(ctx, instance_conn_name, []cloudsqlconn.DialOption{}...)
-		})
-		uri = fmt.Sprintf("%s:%s@cloudsqlconn(localhost:%s)/core?parseTime=true", user, pass, port)
-	}
-	db, err := sql.Open("mysql", uri)
-	if err != nil {
-		panic(err)
-	}
-	if err := db.Ping(); err != nil {
-		panic(err)
-	}
 
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+		txAttempts := 3
+		if attempts, err := strconv.Atoi(os.Getenv("DB_TX_ATTEMPTS")); err == nil && attempts > 0 {
+			txAttempts = attempts
+		}
 
-	core_repository_instance_map[key] = &CoreRepositoryImpl{
-		client:   db,
-		firebase: opts.Firebase,
-		role:     opts.Role,
-	}
-	log.Println("initialized core repository")
-	return core_repository_instance_map[key]
+		log.Println("initialized core repository")
+		return &CoreRepositoryImpl{
+			client:     db,
+			reads:      newReadRouter(db),
+			role:       opts.Role,
+			txAttempts: txAttempts,
+		}, nil
+	})
 }
 
 // Constructs and wraps a callback with a transaction, ensuring proper commit and rollback handling.
+// Deadlocks and lock wait timeouts are retried up to DB_TX_ATTEMPTS times (default 3) with jittered backoff, unless the context is done.
 func (repository *CoreRepositoryImpl) WithTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return repository.WithTransactionOpts(ctx, nil, fn)
+}
+
+// Same as WithTransaction, but the transaction is read-only.
+func (repository *CoreRepositoryImpl) WithReadTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return repository.WithTransactionOpts(ctx, &sql.TxOptions{ReadOnly: true}, fn)
+}
+
+// Same as WithTransaction with the given options, nil for the database defaults.
+func (repository *CoreRepositoryImpl) WithTransactionOpts(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	delay := txRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := repository.withTransaction(ctx, opts, fn)
+		if err == nil || !isRetryableTxError(err) || attempt >= repository.txAttempts {
+			return err
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		log.Printf("retrying transaction in %s (attempt %d): %+v\n", wait, attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// Runs a single attempt of the callback in a transaction.
+func (repository *CoreRepositoryImpl) withTransaction(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
 
 	// create tx
-	tx, err := repository.NewTransaction(ctx, false)
+	tx, err := repository.beginTx(ctx, opts)
 	if err != nil {
 		return err
 	}
+	defer txContexts.Delete(tx)
 
-	// define commit and rollback handling (defer)
+	// roll back if the callback panics
 	defer func() {
 		if r := recover(); r != nil {
 			repository.RollbackTransaction(tx)
 			panic(r)
-		} else if err != nil {
-			repository.RollbackTransaction(tx)
-		} else {
-			err = repository.CommitTransaction(tx)
 		}
 	}()
 
 	// invoke callback
-	err = fn(tx)
-
-	// return error
-	return err
+	if err := fn(tx); err != nil {
+		repository.RollbackTransaction(tx)
+		return err
+	}
+	return repository.CommitTransaction(tx)
 }
 
 func (repository *CoreRepositoryImpl) RollbackTransaction(tx *sql.Tx) {
+	txContexts.Delete(tx)
 	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		log.Printf("transaction rollback failed: %+v\n", err)
 	}
 }
 
-// Creates a new transaction.
+// Creates a new transaction, its statements run with ctx. It's ended with CommitTransaction or RollbackTransaction.
 func (repository *CoreRepositoryImpl) NewTransaction(ctx context.Context, readOnly bool) (*sql.Tx, error) {
-	opts := &sql.TxOptions{}
-	if readOnly {
-		opts.ReadOnly = true
-	}
+	return repository.beginTx(ctx, &sql.TxOptions{ReadOnly: readOnly})
+}
+
+func (repository *CoreRepositoryImpl) beginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
 	tx, err := repository.client.BeginTx(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	txContexts.Store(tx, ctx)
 	return tx, nil
 }
 
 // Attempts to commit the transaction and performs a rollback if an error occurs.
 func (repository *CoreRepositoryImpl) CommitTransaction(tx *sql.Tx) error {
+	txContexts.Delete(tx)
 	if err := tx.Commit(); err != nil {
 		log.Printf("transaction commit failed: %+v\n", err)
 		if err := tx.Rollback(); err != nil {
 			log.Printf("transaction rollback failed: %+v\n", err)
 			return fmt.Errorf("%w: %v", types.ErrRollback, err)
 		}
-		return fmt.Errorf("%w: %v", types.ErrTxCommit, err)
+		return fmt.Errorf("%w: %w", types.ErrTxCommit, err)
 	}
 	return nil
 }
 
 func (repository *CoreRepositoryImpl) ReadUserById(userId string) (*types.User, error) {
-	stmt, err := repository.client.Prepare("SELECT * FROM user WHERE id = ? LIMIT 1")
+	stmt, err := repository.client.Prepare("SELECT id, email, password, lastLogin, verified, locale FROM user WHERE id = ? LIMIT 1")
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
 
 	var user types.User
-	if err := stmt.QueryRow(userId).Scan(&user.Id, &user.Email, &user.Password, &user.LastLogin, &user.Verified); err != nil {
-		return nil, fmt.Errorf("error scanning data into variable: %v", err)
+	err = stmt.QueryRow(userId).Scan(&user.Id, &user.Email, &user.Password, &user.LastLogin, &user.Verified, &user.Locale)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: user %s", types.ErrNotFound, userId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return &user, nil
 }
@@ -206,56 +263,345 @@ func (repository *CoreRepositoryImpl) UpdateGroupName(groupId string, name strin
 	return repository.UpdateGroupNameWithTx(nil, groupId, name)
 }
 
-// Updates the group's name.
+// Updates the group's name, returns ErrNotFound if there is no such group.
 func (repository *CoreRepositoryImpl) UpdateGroupNameWithTx(tx *sql.Tx, groupId string, name string) error {
 	var c types.Execer = repository.client
 	if tx != nil {
-		c = tx
+		c = txExecer(tx)
 	}
-	stmt, err := c.Prepare("UPDATE organisation SET name = ? WHERE id = ?")
+	stmt, err := c.Prepare("UPDATE organisation SET name = ? WHERE id = ? AND deletedAt IS NULL")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(name, groupId); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+	result, err := stmt.Exec(name, groupId)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	// MySQL doesn't count rows that already had the name, so nothing affected doesn't mean nothing matched
+	var exists bool
+	if err := c.QueryRow("SELECT EXISTS(SELECT 1 FROM organisation WHERE id = ? AND deletedAt IS NULL)", groupId).Scan(&exists); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
 	}
 	return nil
 }
 
-// Deletes the group and all associations, if the user deleting it has no groups left, this creates a default group afterwards.
+// Increments the group's version ahead of changing its metadata, returning the new version. With a version given
+// the group must still be at it, else ErrConflict is returned. ErrNotFound if there is no such group.
+func (repository *CoreRepositoryImpl) UpdateGroupVersionWithTx(tx *sql.Tx, groupId string, version *int) (int, error) {
+	query, args := "UPDATE organisation SET version = version + 1 WHERE id = ? AND deletedAt IS NULL", []any{groupId}
+	if version != nil {
+		query, args = query+" AND version = ?", append(args, *version)
+	}
+	result, err := txExecer(tx).Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	var current int
+	if err := txExecer(tx).QueryRow("SELECT version FROM organisation WHERE id = ? AND deletedAt IS NULL", groupId).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+		}
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count == 0 {
+		return current, fmt.Errorf("%w: group %s is at version %d, not %d", types.ErrConflict, groupId, current, *version)
+	}
+	return current, nil
+}
+
+// Marks the group deleted, which hides it from everything but RestoreGroupWithTx. Its memberships, roles and
+// invitations are kept until PurgeGroupWithTx cleans it up once the restore window has passed.
+// If the user deleting it has no groups left, this creates a default group afterwards.
 func (repository *CoreRepositoryImpl) DeleteGroupWithTx(tx *sql.Tx, userId string, groupId string) error {
 
-	stmt, err := tx.Prepare("CALL GroupCleanup(?)")
-	if err != nil {
+	// before the deletion, so concurrent removals of this user's memberships take turns, see EnsureDefaultGroupWithTx
+	if err := lockUser(tx, userId); err != nil {
 		return err
 	}
+
+	stmt, err := txExecer(tx).Prepare("UPDATE organisation SET deletedAt = NOW() WHERE id = ? AND deletedAt IS NULL")
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+	}
 	defer stmt.Close()
 	if _, err := stmt.Exec(groupId); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	return repository.EnsureDefaultGroupWithTx(tx, userId)
+}
+
+// Undoes DeleteGroupWithTx within the restore window, restoring a group that isn't deleted does nothing.
+// Returns ErrNotFound if there is no such group, or its restore window has passed.
+func (repository *CoreRepositoryImpl) RestoreGroupWithTx(tx *sql.Tx, groupId string) error {
+	var deletedAt sql.NullTime
+	if err := txExecer(tx).QueryRow("SELECT deletedAt FROM organisation WHERE id = ? FOR UPDATE", groupId).Scan(&deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+		}
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !deletedAt.Valid {
+		return nil
+	}
+	result, err := txExecer(tx).Exec("UPDATE organisation SET deletedAt = NULL WHERE id = ? AND deletedAt > NOW() - INTERVAL ? DAY", groupId, types.GROUP_RESTORE_WINDOW_DAYS)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: group %s can no longer be restored", types.ErrNotFound, groupId)
+	}
+	return nil
+}
+
+// Reads the ids of deleted groups whose restore window has passed.
+func (repository *CoreRepositoryImpl) ReadExpiredGroups(ctx context.Context) ([]string, error) {
+	rows, err := repository.client.QueryContext(ctx, "SELECT id FROM organisation WHERE deletedAt <= NOW() - INTERVAL ? DAY", types.GROUP_RESTORE_WINDOW_DAYS)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	groupIds := make([]string, 0)
+	for rows.Next() {
+		var groupId string
+		if err := rows.Scan(&groupId); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		groupIds = append(groupIds, groupId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return groupIds, nil
+}
+
+// Turns the group's weekly audit digest on or off, returns ErrNotFound if there is no such group.
+// Turning it on counts the current week as sent, so the first digest covers a whole week.
+func (repository *CoreRepositoryImpl) UpdateGroupAuditDigestWithTx(tx *sql.Tx, groupId string, enabled bool) error {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	// MySQL assigns left to right, so auditDigest is still the old value when auditDigestSentAt is set
+	result, err := c.Exec("UPDATE organisation SET auditDigestSentAt = IF(? AND NOT auditDigest, UTC_TIMESTAMP(), auditDigestSentAt), "+
+		"auditDigest = ? WHERE id = ? AND deletedAt IS NULL", enabled, enabled, groupId)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	// nothing affected if the setting didn't change either
+	var exists bool
+	if err := c.QueryRow("SELECT EXISTS(SELECT 1 FROM organisation WHERE id = ? AND deletedAt IS NULL)", groupId).Scan(&exists); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+	}
+	return nil
+}
+
+// Sets the group's slug, an empty slug removes it. Returns ErrSlugTaken if another group has it,
+// ErrNotFound if there is no such group.
+func (repository *CoreRepositoryImpl) UpdateGroupSlugWithTx(tx *sql.Tx, groupId string, slug string) error {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	value := sql.NullString{String: slug, Valid: slug != ""}
+	result, err := c.Exec("UPDATE organisation SET slug = ? WHERE id = ? AND deletedAt IS NULL", value, groupId)
+	if err != nil {
+		err = wrapSQLError(err)
+		if errors.Is(err, types.ErrDuplicate) {
+			return fmt.Errorf("%w: %s", types.ErrSlugTaken, slug)
+		}
 		return err
 	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	// nothing affected if the slug didn't change either
+	var exists bool
+	if err := c.QueryRow("SELECT EXISTS(SELECT 1 FROM organisation WHERE id = ? AND deletedAt IS NULL)", groupId).Scan(&exists); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+	}
+	return nil
+}
 
-	// check if user is associated with atleast one group, if not, create a default
-	stmt2, err := tx.Prepare("CALL GetUserOrganisations(?)")
+// Looks up the id of the group with the slug, deleted groups included so they can be restored by it.
+// Reads the primary, as a slug that was just set must resolve at once. Returns ErrNotFound if no group has it.
+func (repository *CoreRepositoryImpl) ResolveGroupSlug(ctx context.Context, slug string) (string, error) {
+	var groupId string
+	err := repository.client.QueryRowContext(ctx, "SELECT id FROM organisation WHERE slug = ?", slug).Scan(&groupId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: no group with slug %s", types.ErrNotFound, slug)
+	}
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	defer stmt2.Close()
-	rows, err := stmt2.Query(userId)
+	return groupId, nil
+}
+
+// When the user created groups since the given time, newest first and at most limit of them. Deleted groups count,
+// so deleting doesn't make room for more. Locks the user until the transaction ends, so concurrent creations by
+// the same user take turns and the second one counts the first's group.
+func (repository *CoreRepositoryImpl) RecentGroupCreationsWithTx(tx *sql.Tx, userId string, since time.Time, limit int) ([]time.Time, error) {
+	if err := lockUser(tx, userId); err != nil {
+		return nil, err
+	}
+	rows, err := txExecer(tx).Query("SELECT createdAt FROM organisation WHERE createdBy = ? AND createdAt >= ? "+
+		"ORDER BY createdAt DESC LIMIT ?", userId, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	created := make([]time.Time, 0)
+	for rows.Next() {
+		var createdAt time.Time
+		if err := rows.Scan(&createdAt); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		created = append(created, createdAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return created, nil
+}
+
+// The number of groups per day the user is allowed instead of the default, nil for no limit.
+// Returns false if the user has the default.
+func (repository *CoreRepositoryImpl) ReadGroupCreationLimit(ctx context.Context, userId string) (*int, bool, error) {
+	var dailyLimit sql.NullInt64
+	err := repository.client.QueryRowContext(ctx, "SELECT dailyLimit FROM group_creation_limit WHERE userId = ?", userId).Scan(&dailyLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !dailyLimit.Valid {
+		return nil, true, nil
+	}
+	limit := int(dailyLimit.Int64)
+	return &limit, true, nil
+}
+
+// Allows the user a number of groups per day other than the default, nil for no limit.
+func (repository *CoreRepositoryImpl) SetGroupCreationLimit(ctx context.Context, userId string, dailyLimit *int) error {
+	_, err := repository.client.ExecContext(ctx, "INSERT INTO group_creation_limit (userId, dailyLimit) VALUES (?, ?) "+
+		"ON DUPLICATE KEY UPDATE dailyLimit = VALUES(dailyLimit)", userId, dailyLimit)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return nil
+}
+
+// Puts the user back on the default limit, returns ErrNotFound if they're on it already.
+func (repository *CoreRepositoryImpl) DeleteGroupCreationLimit(ctx context.Context, userId string) error {
+	result, err := repository.client.ExecContext(ctx, "DELETE FROM group_creation_limit WHERE userId = ?", userId)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: user %s has the default group creation limit", types.ErrNotFound, userId)
+	}
+	return nil
+}
+
+// Reads the ids of groups with the audit digest on that haven't had one since weekStart.
+func (repository *CoreRepositoryImpl) ReadAuditDigestGroups(ctx context.Context, weekStart time.Time) ([]string, error) {
+	rows, err := repository.client.QueryContext(ctx, "SELECT id FROM organisation WHERE auditDigest AND deletedAt IS NULL "+
+		"AND (auditDigestSentAt IS NULL OR auditDigestSentAt < ?)", weekStart)
 	if err != nil {
-		log.Printf("error reading user groups: %+v\n", err)
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	defer rows.Close()
+	groupIds := make([]string, 0)
+	for rows.Next() {
+		var groupId string
+		if err := rows.Scan(&groupId); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		groupIds = append(groupIds, groupId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return groupIds, nil
+}
 
-	// otherwise create a default group for the user
-	if !rows.Next() {
-		rows.Close()
-		if err = repository.CreateOrganisationWithTx(tx, "My organisation", userId); err != nil {
-			return err
+// Marks the group's digest for the week starting at weekStart as sent. Returns false if it already was,
+// e.g. by another instance, or the digest was turned off since, in which case it must not be sent.
+func (repository *CoreRepositoryImpl) ClaimAuditDigest(ctx context.Context, groupId string, weekStart time.Time) (bool, error) {
+	// updatedAt is kept, sending a digest doesn't change the group
+	result, err := repository.client.ExecContext(ctx, "UPDATE organisation SET auditDigestSentAt = ?, updatedAt = updatedAt "+
+		"WHERE id = ? AND auditDigest AND deletedAt IS NULL AND (auditDigestSentAt IS NULL OR auditDigestSentAt < ?)", weekStart, groupId, weekStart)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return count == 1, nil
+}
+
+// Deletes a deleted group and all associations for good, once its restore window has passed.
+// Returns ErrNotFound if the group isn't up for it, e.g. because it was restored in the meantime.
+func (repository *CoreRepositoryImpl) PurgeGroupWithTx(tx *sql.Tx, groupId string) error {
+	var id string
+	err := txExecer(tx).QueryRow("SELECT id FROM organisation WHERE id = ? AND deletedAt <= NOW() - INTERVAL ? DAY FOR UPDATE", groupId, types.GROUP_RESTORE_WINDOW_DAYS).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: group %s is not up for purging", types.ErrNotFound, groupId)
 		}
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 
+	stmt, err := txExecer(tx).Prepare("CALL GroupCleanup(?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(groupId); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -289,8 +635,8 @@ func (repository *CoreRepositoryImpl) Login(uid string, email string, password s
 		Password string
 		Verified bool
 	}
-	if err := stmt.QueryRow(uid, email).Scan(&user.Id, &user.Email, &user.Password, &user.Verified); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+	if err := stmt.QueryRow(uid, types.NormalizeEmail(email)).Scan(&user.Id, &user.Email, &user.Password, &user.Verified); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	// check verified status
 	if !user.Verified {
@@ -303,10 +649,10 @@ func (repository *CoreRepositoryImpl) Login(uid string, email string, password s
 	return nil
 }
 
-func (repository *CoreRepositoryImpl) Signup(userId string, name string) error {
+func (repository *CoreRepositoryImpl) Signup(userId string, name string) (*types.Organisation, error) {
 	tx, err := repository.client.Begin()
 	if err != nil {
-		return types.ErrTxCancelled
+		return nil, types.ErrTxCancelled
 	}
 
 	defer func() {
@@ -318,32 +664,36 @@ func (repository *CoreRepositoryImpl) Signup(userId string, name string) error {
 	}()
 
 	// create user
-	if err := repository.CreateUserWithTx(tx, userId, "", ""); err != nil {
-		return err
+	if err := repository.CreateUserWithTx(tx, userId, "", "", types.DEFAULT_LOCALE); err != nil {
+		return nil, err
 	}
 
 	// create organisation and map user to it
-	if err := repository.CreateOrganisationWithTx(tx, name, userId); err != nil {
-		return err
+	group, err := repository.CreateOrganisationWithTx(tx, name, userId)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return group, nil
 }
 
-// Read a user by their given email.
+// Read a user by their given email, ErrNotFound if nobody has it.
 func (repository *CoreRepositoryImpl) ReadUserByEmail(email string) (*types.User, error) {
-	stmt, err := repository.client.Prepare("SELECT id, email FROM user WHERE email = ?")
+	stmt, err := repository.client.Prepare("SELECT id, email, locale FROM user WHERE email = ?")
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
 	var user types.User
-	if err := stmt.QueryRow(email).Scan(&user.Id, &user.Email); err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrNotFound, err)
+	if err := stmt.QueryRow(types.NormalizeEmail(email)).Scan(&user.Id, &user.Email, &user.Locale); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: user with email %s", types.ErrNotFound, email)
+		}
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return &user, nil
 }
@@ -364,15 +714,16 @@ func (repository *CoreRepositoryImpl) VerifyUser(userId string) error {
 
 // Create a user in our system.
 func (repository *CoreRepositoryImpl) CreateUser(tx *sql.Tx, userId string) error {
-	return repository.CreateUserWithTx(nil, userId, "", "")
+	return repository.CreateUserWithTx(nil, userId, "", "", types.DEFAULT_LOCALE)
 }
 
-func (repository *CoreRepositoryImpl) CreateUserWithTx(tx *sql.Tx, userId string, email string, password string) error {
+// Create a user in our system, locale is the language emails are sent to them in.
+func (repository *CoreRepositoryImpl) CreateUserWithTx(tx *sql.Tx, userId string, email string, password string, locale string) error {
 	var c types.Execer = repository.client
 	if tx != nil {
-		c = tx
+		c = txExecer(tx)
 	}
-	stmt, err := c.Prepare("INSERT INTO user (id, email, password, lastLogin, verified) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := c.Prepare("INSERT INTO user (id, email, password, lastLogin, verified, locale) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return types.ErrPrepareStatement
 	}
@@ -381,27 +732,51 @@ func (repository *CoreRepositoryImpl) CreateUserWithTx(tx *sql.Tx, userId string
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(userId, email, hash_password, "", false)
+	_, err = stmt.Exec(userId, types.NormalizeEmail(email), hash_password, "", false, locale)
 	if err != nil {
-		return err
+		return wrapSQLError(err)
 	}
 	return nil
 }
 
+// Creates the user with the given email unless they exist already, reporting whether they were created.
+// For accounts firebase knows but we don't yet, e.g. someone who signed up through a provider and hasn't finished onboarding.
+func (repository *CoreRepositoryImpl) EnsureUserWithTx(tx *sql.Tx, userId string, email string) (bool, error) {
+	var users int
+	if err := txExecer(tx).QueryRow("SELECT COUNT(*) FROM user WHERE id = ? FOR UPDATE", userId).Scan(&users); err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if users > 0 {
+		return false, nil
+	}
+	if err := repository.CreateUserWithTx(tx, userId, email, "", types.DEFAULT_LOCALE); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Checks that the user exists, returning types.ErrNotFound if it doesn't.
+// Runs on every authenticated request, so it's a single query without preparing a statement.
 func (repository *CoreRepositoryImpl) UserExists(uid string) error {
-	stmt, err := repository.client.Prepare("SELECT * FROM user where id = ?")
-	if err != nil {
-		return err
+	var exists bool
+	if err := repository.client.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)", uid).Scan(&exists); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	_, err = stmt.Exec(uid)
-	if err != nil {
-		return err
+	if !exists {
+		return fmt.Errorf("%w: user %s", types.ErrNotFound, uid)
 	}
 	return nil
 }
 
-func (repository *CoreRepositoryImpl) ReadServices() ([]*types.Service, error) {
-	rows, err := repository.client.Query("SELECT * FROM service ORDER BY name")
+const serviceColumns = "id, name, implementationGroup, description, retired"
+
+// Reads the service catalogue, retired services are only included when asked for.
+func (repository *CoreRepositoryImpl) ReadServices(includeRetired bool) ([]*types.Service, error) {
+	query := "SELECT " + serviceColumns + " FROM service"
+	if !includeRetired {
+		query += " WHERE retired = FALSE"
+	}
+	rows, err := repository.reads.reader("ReadServices").Query(query + " ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
@@ -409,7 +784,7 @@ func (repository *CoreRepositoryImpl) ReadServices() ([]*types.Service, error) {
 	var services []*types.Service
 	for rows.Next() {
 		service := &types.Service{}
-		err := rows.Scan(&service.Id, &service.Name, &service.ImplementationGroup, &service.Description)
+		err := rows.Scan(&service.Id, &service.Name, &service.ImplementationGroup, &service.Description, &service.Retired)
 		if err != nil {
 			return nil, err
 		}
@@ -421,215 +796,713 @@ func (repository *CoreRepositoryImpl) ReadServices() ([]*types.Service, error) {
 	return services, nil
 }
 
-func (repository *CoreRepositoryImpl) ImplementationGroupCount(serviceName string) (int, error) {
-	stmt, err := repository.client.Prepare("SELECT COUNT(*) FROM service WHERE name = ?")
+func (repository *CoreRepositoryImpl) ReadServiceWithTx(tx *sql.Tx, serviceId string) (*types.Service, error) {
+	var service types.Service
+	err := txExecer(tx).QueryRow("SELECT "+serviceColumns+" FROM service WHERE id = ?", serviceId).
+		Scan(&service.Id, &service.Name, &service.ImplementationGroup, &service.Description, &service.Retired)
 	if err != nil {
-		return 0, nil
-	}
-	defer stmt.Close()
-	var count int
-	if err := stmt.QueryRow(serviceName).Scan(&count); err != nil {
-		return 0, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: service %s", types.ErrNotFound, serviceId)
+		}
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	return count, nil
+	return &service, nil
 }
 
-func (repository *CoreRepositoryImpl) RegisterUsedService(serviceName string, implementationGroup *int, organisationId string, userId string) error {
-	return repository.RegisterUsedServiceWithTx(nil, serviceName, implementationGroup, organisationId, userId)
-}
-
-// Register a user has used a service.
-func (repository *CoreRepositoryImpl) RegisterUsedServiceWithTx(tx *sql.Tx, serviceName string, implementationGroup *int, organisationId string, userId string) error {
-
-	var c types.Execer = repository.client
-	if tx != nil {
-		c = tx
+// Adds a service to the catalogue and sets its id.
+// Returns types.ErrDuplicate if the name and implementation group pair is taken.
+func (repository *CoreRepositoryImpl) CreateServiceWithTx(tx *sql.Tx, service *types.Service) error {
+	if err := ensureUniqueService(tx, service); err != nil {
+		return err
 	}
-
-	// dynamically create query, as not all services has implementation groups
-	var query string
-	var args []interface{}
-	if implementationGroup == nil || *implementationGroup == 0 {
-		query = "SELECT id FROM service WHERE name = ? AND implementationGroup IS NULL LIMIT 1"
-		args = []interface{}{serviceName}
-	} else {
-		query = "SELECT id FROM service WHERE name = ? AND implementationGroup = ? LIMIT 1"
-		args = []interface{}{serviceName, implementationGroup}
+	service.Id = uuid.NewString()
+	if _, err := txExecer(tx).Exec("INSERT INTO service (id, name, implementationGroup, description, retired) VALUES (?, ?, ?, ?, ?)",
+		service.Id, service.Name, service.ImplementationGroup, service.Description, service.Retired); err != nil {
+		return wrapSQLError(err)
 	}
+	return nil
+}
 
-	// get serviceId by name and implementationGroup
-	stmt, err := c.Prepare(query)
-	if err != nil {
+// Overwrites a service, retiring it is done by setting service.Retired.
+// Returns types.ErrDuplicate if the name and implementation group pair is taken by another service.
+func (repository *CoreRepositoryImpl) UpdateServiceWithTx(tx *sql.Tx, service *types.Service) error {
+	if err := ensureUniqueService(tx, service); err != nil {
 		return err
 	}
-	defer stmt.Close()
-	var serviceId string
-	if err := stmt.QueryRow(args...).Scan(&serviceId); err != nil {
-		return err
+	result, err := txExecer(tx).Exec("UPDATE service SET name = ?, implementationGroup = ?, description = ?, retired = ? WHERE id = ?",
+		service.Name, service.ImplementationGroup, service.Description, service.Retired, service.Id)
+	if err != nil {
+		return wrapSQLError(err)
 	}
-
-	// insert into used_services (id, userId, serviceId)
-	if _, err = c.Exec("INSERT INTO used_service (id, organisationId, serviceId, userId) VALUES (?, ?, ?, ?)", uuid.NewString(), organisationId, serviceId, userId); err != nil {
-		return err
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		// no change also affects zero rows, so tell the two apart
+		if _, err := repository.ReadServiceWithTx(tx, service.Id); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Read organisations for the user
-func (repository *CoreRepositoryImpl) OrganisationList(userId string) ([]*types.Organisation, error) {
-	stmt, err := repository.client.Prepare("CALL GetUserOrganisations(?)")
+// Deletes a service that has never been used, used services can only be retired.
+func (repository *CoreRepositoryImpl) DeleteServiceWithTx(tx *sql.Tx, serviceId string) error {
+	var used bool
+	if err := txExecer(tx).QueryRow("SELECT EXISTS(SELECT 1 FROM used_service WHERE serviceId = ?)", serviceId).Scan(&used); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if used {
+		return fmt.Errorf("%w: service %s", types.ErrServiceInUse, serviceId)
+	}
+	result, err := txExecer(tx).Exec("DELETE FROM service WHERE id = ?", serviceId)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return wrapSQLError(err)
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(userId)
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: service %s", types.ErrNotFound, serviceId)
+	}
+	return nil
+}
+
+// Builds the filter shared by the usage reports, from is inclusive and to is exclusive.
+// Uses without a timestamp never match a range, as comparisons against NULL are false.
+func serviceUsageFilter(groupId string, from *time.Time, to *time.Time) (string, []interface{}) {
+	filter := "us.organisationId = ?"
+	args := []interface{}{groupId}
+	if from != nil {
+		filter += " AND us.usedAt >= ?"
+		args = append(args, from.UTC())
+	}
+	if to != nil {
+		filter += " AND us.usedAt < ?"
+		args = append(args, to.UTC())
+	}
+	return filter, args
+}
+
+// Counts the uses of each service within a group, optionally limited to a time range.
+func (repository *CoreRepositoryImpl) ReadServiceUsageWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUsage, error) {
+	filter, args := serviceUsageFilter(groupId, from, to)
+	rows, err := txExecer(tx).Query("SELECT s.id, s.name, s.implementationGroup, COUNT(*) FROM used_service us "+
+		"INNER JOIN service s ON us.serviceId = s.id "+
+		"WHERE "+filter+" "+
+		"GROUP BY s.id, s.name, s.implementationGroup "+
+		"ORDER BY s.name, s.implementationGroup", args...)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	defer rows.Close()
-	var organisations []*types.Organisation
+	usage := []*types.ServiceUsage{}
 	for rows.Next() {
-		var org types.Organisation
-		if err := rows.Scan(&org.Id, &org.Name); err != nil {
-			return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		var service types.ServiceUsage
+		if err := rows.Scan(&service.ServiceId, &service.Name, &service.ImplementationGroup, &service.Count); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 		}
-		organisations = append(organisations, &org)
+		usage = append(usage, &service)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	return organisations, nil
+	return usage, nil
 }
 
-// Get all members associated with an organisation.
+// Reads the individual uses of services within a group, with the email of the user behind each, newest first.
+// The email is empty if the user has since been deleted.
+func (repository *CoreRepositoryImpl) ReadServiceUsesWithTx(tx *sql.Tx, groupId string, from *time.Time, to *time.Time) ([]*types.ServiceUse, error) {
+	filter, args := serviceUsageFilter(groupId, from, to)
+	rows, err := txExecer(tx).Query("SELECT us.serviceId, us.userId, COALESCE(u.email, ''), us.usedAt FROM used_service us "+
+		"LEFT JOIN user u ON us.userId = u.id "+
+		"WHERE "+filter+" "+
+		"ORDER BY us.usedAt DESC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	var uses []*types.ServiceUse
+	for rows.Next() {
+		var use types.ServiceUse
+		var usedAt sql.NullTime
+		if err := rows.Scan(&use.ServiceId, &use.UserId, &use.Email, &usedAt); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if usedAt.Valid {
+			use.UsedAt = &usedAt.Time
+		}
+		uses = append(uses, &use)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return uses, nil
+}
+
+// Checks no other service has the same name and implementation group, the unique index can't see duplicates without a group.
+func ensureUniqueService(exe types.Execer, service *types.Service) error {
+	var taken bool
+	err := exe.QueryRow("SELECT EXISTS(SELECT 1 FROM service WHERE name = ? AND implementationGroup <=> ? AND id <> ?)",
+		service.Name, service.ImplementationGroup, service.Id).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if taken {
+		return fmt.Errorf("%w: service %s already exists for that implementation group", types.ErrDuplicate, service.Name)
+	}
+	return nil
+}
+
+// Reads the implementation groups a service is offered in, in ascending order.
+func (repository *CoreRepositoryImpl) ImplementationGroups(serviceName string) ([]int, error) {
+	rows, err := repository.client.Query("SELECT implementationGroup FROM service "+
+		"WHERE name = ? AND implementationGroup IS NOT NULL ORDER BY implementationGroup", serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	groups := []int{}
+	for rows.Next() {
+		var group int
+		if err := rows.Scan(&group); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return groups, nil
+}
+
+// Runs in a transaction of its own, as the group's quota can only be enforced within one.
+func (repository *CoreRepositoryImpl) RegisterUsedService(serviceName string, implementationGroup *int, organisationId string, userId string, idempotencyKey string) error {
+	return repository.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+		return repository.RegisterUsedServiceWithTx(tx, serviceName, implementationGroup, organisationId, userId, idempotencyKey)
+	})
+}
+
+// Register a user has used a service.
+// A non-empty idempotencyKey is stored with the use, and registering the same key again is a no-op.
+// Returns ErrQuotaExceeded if the group has used up its monthly quota of the service. The quota is locked
+// while counting, so concurrent uses can't get past it, as long as tx is given.
+func (repository *CoreRepositoryImpl) RegisterUsedServiceWithTx(tx *sql.Tx, serviceName string, implementationGroup *int, organisationId string, userId string, idempotencyKey string) error {
+
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+
+	// dynamically create query, as not all services has implementation groups
+	var query string
+	var args []interface{}
+	if implementationGroup == nil || *implementationGroup == 0 {
+		query = "SELECT id FROM service WHERE name = ? AND implementationGroup IS NULL LIMIT 1"
+		args = []interface{}{serviceName}
+	} else {
+		query = "SELECT id FROM service WHERE name = ? AND implementationGroup = ? LIMIT 1"
+		args = []interface{}{serviceName, implementationGroup}
+	}
+
+	// get serviceId by name and implementationGroup
+	stmt, err := c.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var serviceId string
+	if err := stmt.QueryRow(args...).Scan(&serviceId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: service %s", types.ErrNotFound, serviceName)
+		}
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	// insert into used_services (id, userId, serviceId, usedAt, idempotencyKey)
+	var key sql.NullString
+	if idempotencyKey != "" {
+		key = sql.NullString{String: idempotencyKey, Valid: true}
+
+		// a retried use was counted already, even if the quota has been reached since
+		var registered int
+		if err := c.QueryRow("SELECT COUNT(*) FROM used_service WHERE idempotencyKey = ?", key).Scan(&registered); err != nil {
+			return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if registered > 0 {
+			return nil
+		}
+	}
+	usage, err := readQuotaUsage(c, organisationId, serviceName, true)
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	if usage != nil && usage.Remaining == 0 {
+		return fmt.Errorf("%w: %d of %d uses of %s this month", types.ErrQuotaExceeded, usage.Used, usage.MonthlyLimit, serviceName)
+	}
+	if _, err = c.Exec("INSERT INTO used_service (id, organisationId, serviceId, userId, usedAt, idempotencyKey) VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?)", uuid.NewString(), organisationId, serviceId, userId, key); err != nil {
+		err = wrapSQLError(err)
+		// the key is the only unique column besides the generated id, so a duplicate means it was registered already
+		if key.Valid && errors.Is(err, types.ErrDuplicate) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Read organisations for the user, including the member count and the user's aggregated permissions within each.
+func (repository *CoreRepositoryImpl) OrganisationList(userId string) ([]*types.Organisation, error) {
+	aggregates := make([]string, len(rolePermissionColumns))
+	for i, column := range rolePermissionColumns {
+		aggregates[i] = fmt.Sprintf("COALESCE(MAX(r.%s), 0)", column)
+	}
+	stmt, err := repository.reads.reader("OrganisationList").Prepare("SELECT o.id, o.name, o.slug, " +
+		"(SELECT COUNT(*) FROM organisation_user m WHERE m.organisationId = o.id), " +
+		strings.Join(aggregates, ", ") + " " +
+		"FROM organisation_user ou " +
+		"INNER JOIN organisation o ON ou.organisationId = o.id " +
+		"LEFT JOIN (user_role ur INNER JOIN role r ON ur.roleId = r.id) ON ur.userId = ou.userId AND r.organisationId = o.id " +
+		"WHERE ou.userId = ? AND o.deletedAt IS NULL " +
+		"GROUP BY o.id, o.name, o.slug " +
+		"ORDER BY o.name")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	var organisations []*types.Organisation
+	for rows.Next() {
+		org := types.Organisation{Permissions: &types.Permissions{}}
+		var slug sql.NullString
+		if err := rows.Scan(append([]any{&org.Id, &org.Name, &slug, &org.MemberCount}, permissionFields(org.Permissions)...)...); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		org.Slug = slug.String
+		organisations = append(organisations, &org)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return organisations, nil
+}
+
+// Get all members associated with an organisation, including their roles within it.
 func (repository *CoreRepositoryImpl) ReadOrganisationMembers(id string) ([]*types.OrganisationMember, error) {
-	stmt, err := repository.client.Prepare("CALL GetOrganisationMembers(?)")
+	return repository.ReadOrganisationMembersWithTx(nil, id)
+}
+
+func (repository *CoreRepositoryImpl) ReadOrganisationMembersWithTx(tx *sql.Tx, id string) ([]*types.OrganisationMember, error) {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	stmt, err := c.Prepare("SELECT u.id, u.email, u.lastLogin, r.id, r.name " +
+		"FROM organisation_user ou " +
+		"INNER JOIN user u ON ou.userId = u.id " +
+		"LEFT JOIN (user_role ur INNER JOIN role r ON ur.roleId = r.id AND r.organisationId = ?) ON ur.userId = u.id " +
+		"WHERE ou.organisationId = ? " +
+		"ORDER BY u.email, r.name")
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	result, err := stmt.Query(id)
+	result, err := stmt.Query(id, id)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	defer result.Close()
-	var members []*types.OrganisationMember
+	members := make([]*types.OrganisationMember, 0)
+	memberMap := make(map[string]*types.OrganisationMember)
 	for result.Next() {
-		var org types.OrganisationMember
-		if err := result.Scan(&org.Id, &org.Email); err != nil {
-			return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		var (
+			member           types.OrganisationMember
+			roleId, roleName sql.NullString
+		)
+		if err := result.Scan(&member.Id, &member.Email, &member.LastLogin, &roleId, &roleName); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		m, exists := memberMap[member.Id]
+		if !exists {
+			m = &member
+			m.Roles = make([]*types.RoleSummary, 0)
+			memberMap[m.Id] = m
+			members = append(members, m)
+		}
+		if roleId.Valid {
+			m.Roles = append(m.Roles, &types.RoleSummary{Id: roleId.String, Name: roleName.String})
 		}
-		members = append(members, &org)
 	}
 	if err := result.Err(); err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return members, nil
 }
 
-// Create an invitation.
-func (repository *CoreRepositoryImpl) CreateInvitation(userId string, email string, groupId string) (string, error) {
-	// identifier for the mapping between org and email
-	id := uuid.NewString()
-	stmt, err := repository.client.Prepare("INSERT INTO invitation (id, userId, email, organisationId) VALUES (?, ?, ?, ?)")
+// Reads up to limit members of the group following after, nil for the first page, with all of their roles.
+// Members are paged rather than the joined rows, so a member's roles are never split across pages.
+func (repository *CoreRepositoryImpl) ReadOrganisationMembersPageWithTx(tx *sql.Tx, groupId string, after *types.MemberCursor, limit int) (*types.MemberPage, error) {
+	page := &types.MemberPage{Members: make([]*types.OrganisationMember, 0, limit)}
+	if err := txExecer(tx).QueryRow("SELECT COUNT(*) FROM organisation_user WHERE organisationId = ?", groupId).Scan(&page.Total); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	// one more than asked for, to learn whether there's another page
+	query := "SELECT u.id, u.email, u.lastLogin FROM organisation_user ou INNER JOIN user u ON ou.userId = u.id WHERE ou.organisationId = ? "
+	args := []any{groupId}
+	if after != nil {
+		query += "AND (u.email > ? OR (u.email = ? AND u.id > ?)) "
+		args = append(args, after.Email, after.Email, after.Id)
+	}
+	rows, err := txExecer(tx).Query(query+"ORDER BY u.email, u.id LIMIT ?", append(args, limit+1)...)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(id, userId, email, groupId)
+	defer rows.Close()
+	memberMap := make(map[string]*types.OrganisationMember)
+	for rows.Next() {
+		member := &types.OrganisationMember{Roles: make([]*types.RoleSummary, 0)}
+		if err := rows.Scan(&member.Id, &member.Email, &member.LastLogin); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if len(page.Members) == limit {
+			last := page.Members[limit-1]
+			page.Next = &types.MemberCursor{Email: last.Email, Id: last.Id}
+			break
+		}
+		page.Members = append(page.Members, member)
+		memberMap[member.Id] = member
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	rows.Close()
+	if len(page.Members) == 0 {
+		return page, nil
+	}
+
+	// the roles of the members on the page
+	placeholders := make([]string, len(page.Members))
+	args = []any{groupId}
+	for i, member := range page.Members {
+		placeholders[i] = "?"
+		args = append(args, member.Id)
+	}
+	roleRows, err := txExecer(tx).Query("SELECT ur.userId, r.id, r.name FROM user_role ur "+
+		"INNER JOIN role r ON ur.roleId = r.id AND r.organisationId = ? "+
+		"WHERE ur.userId IN ("+strings.Join(placeholders, ", ")+") ORDER BY r.name", args...)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer roleRows.Close()
+	for roleRows.Next() {
+		var (
+			userId string
+			role   types.RoleSummary
+		)
+		if err := roleRows.Scan(&userId, &role.Id, &role.Name); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if member, exists := memberMap[userId]; exists {
+			member.Roles = append(member.Roles, &role)
+		}
 	}
-	return id, nil
+	if err := roleRows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return page, nil
+}
+
+// Create an invitation, invitedBy being the inviting user, empty if it was an internal service.
+// Returns the invitation and the token for its link, which isn't stored and can't be read back.
+func (repository *CoreRepositoryImpl) CreateInvitation(userId string, email string, groupId string, invitedBy string) (*types.Invitation, string, error) {
+	return repository.CreateInvitationWithTx(nil, userId, email, groupId, invitedBy)
 }
 
-// Checks whether a user is already a part of the group.
-func (repository *CoreRepositoryImpl) IsUserAlreadyMember(userId string, groupId string) error {
-	stmt, err := repository.client.Prepare("CALL GetUserOrganisations(?)")
+// Returns ErrDuplicate if the address is already invited to the group, which leaves the transaction usable.
+// An expired invitation from before tokens, see migration 0016, is replaced instead.
+// The pending invitation is looked for before inserting, the unique index from migration 0017 catches concurrent ones.
+func (repository *CoreRepositoryImpl) CreateInvitationWithTx(tx *sql.Tx, userId string, email string, groupId string, invitedBy string) (*types.Invitation, string, error) {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	email = types.NormalizeEmail(email)
+	if _, err := c.Exec("DELETE FROM invitation WHERE organisationId = ? AND email = ? AND tokenHash IS NULL", groupId, email); err != nil {
+		return nil, "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	var pending bool
+	if err := c.QueryRow("SELECT EXISTS(SELECT 1 FROM invitation WHERE organisationId = ? AND email = ?)", groupId, email).Scan(&pending); err != nil {
+		return nil, "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if pending {
+		return nil, "", fmt.Errorf("%w: %s is already invited to group %s", types.ErrDuplicate, email, groupId)
+	}
+	token, tokenHash, err := newInvitationToken()
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	// identifier for the mapping between org and email
+	id := uuid.NewString()
+	stmt, err := c.Prepare("INSERT INTO invitation (id, userId, email, organisationId, invitedBy, tokenHash) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query(userId)
+	var inviter sql.NullString
+	if invitedBy != "" {
+		inviter = sql.NullString{String: invitedBy, Valid: true}
+	}
+	_, err = stmt.Exec(id, userId, email, groupId, inviter, tokenHash)
 	if err != nil {
-		return err
+		return nil, "", wrapSQLError(err)
 	}
-	defer rows.Close()
+	invitation := &types.Invitation{Id: id, UserId: userId, Email: email, GroupId: groupId}
+	if inviter.Valid {
+		invitation.InvitedBy = &inviter.String
+	}
+	return invitation, token, nil
+}
+
+// Checks whether the user is mapped to the group.
+func (repository *CoreRepositoryImpl) IsMember(ctx context.Context, userId string, groupId string) (bool, error) {
 	var isMember bool
-	for rows.Next() {
-		var organisation types.Organisation
-		if err := rows.Scan(&organisation.Id, &organisation.Name); err != nil {
-			return err
-		}
-		if organisation.Id == groupId {
-			isMember = true
-			break
-		}
+	err := repository.client.QueryRowContext(ctx, isMemberQuery, userId, groupId).Scan(&isMember)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	if !isMember {
-		return nil
-	} else {
-		return fmt.Errorf("user is already member of the group")
+	return isMember, nil
+}
+
+// Members of a deleted group aren't members until it's restored.
+const isMemberQuery = "SELECT EXISTS(SELECT 1 FROM organisation_user ou INNER JOIN organisation o ON ou.organisationId = o.id " +
+	"WHERE ou.userId = ? AND ou.organisationId = ? AND o.deletedAt IS NULL)"
+
+// Same as IsMember, within the given transaction.
+func (repository *CoreRepositoryImpl) IsMemberWithTx(tx *sql.Tx, userId string, groupId string) (bool, error) {
+	var isMember bool
+	if err := txExecer(tx).QueryRow(isMemberQuery, userId, groupId).Scan(&isMember); err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return isMember, nil
+}
+
+// Ensures the group exists and the user is a member of it, holding shared locks on both rows until tx ends,
+// so neither can be removed while tx acts on the membership.
+// Returns types.ErrNotFound for a missing group and types.ErrForbiddenOperation for a non-member.
+func (repository *CoreRepositoryImpl) LockMembershipWithTx(tx *sql.Tx, userId string, groupId string) error {
+	var groups int
+	if err := txExecer(tx).QueryRow("SELECT COUNT(*) FROM organisation WHERE id = ? AND deletedAt IS NULL LOCK IN SHARE MODE", groupId).Scan(&groups); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
+	if groups == 0 {
+		return fmt.Errorf("%w: group %s", types.ErrNotFound, groupId)
+	}
+	var memberships int
+	if err := txExecer(tx).QueryRow("SELECT COUNT(*) FROM organisation_user WHERE userId = ? AND organisationId = ? LOCK IN SHARE MODE", userId, groupId).Scan(&memberships); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if memberships == 0 {
+		return fmt.Errorf("%w: user %s is not a member of group %s", types.ErrForbiddenOperation, userId, groupId)
+	}
+	return nil
 }
 
 // Read a group.
 func (repository *CoreRepositoryImpl) ReadGroup(ctx context.Context, groupId string) (*types.Organisation, error) {
-	stmt, err := repository.client.PrepareContext(ctx, "SELECT * FROM organisation WHERE id = ?")
+	stmt, err := repository.client.PrepareContext(ctx, readGroupQuery)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	var group types.Organisation
-	if err := stmt.QueryRow(groupId).Scan(&group.Id, &group.Name); err != nil {
+	return scanGroup(stmt.QueryRow(groupId), groupId)
+}
+
+const readGroupQuery = "SELECT o.id, o.name, o.slug, o.version, o.createdBy, u.email, o.createdAt FROM organisation o " +
+	"LEFT JOIN user u ON u.id = o.createdBy WHERE o.id = ? AND o.deletedAt IS NULL"
+
+// Same as ReadGroup, within the given transaction.
+func (repository *CoreRepositoryImpl) ReadGroupWithTx(tx *sql.Tx, groupId string) (*types.Organisation, error) {
+	return scanGroup(txExecer(tx).QueryRow(readGroupQuery, groupId), groupId)
+}
+
+// Reads a group for other services, including whether it's deleted. Returns ErrNotFound once it's purged.
+func (repository *CoreRepositoryImpl) ReadGroupInfo(ctx context.Context, groupId string) (*types.GroupInfo, error) {
+	var (
+		group          types.GroupInfo
+		deletedAt      sql.NullTime
+		creator, email sql.NullString
+		createdAt      sql.NullTime
+	)
+	err := repository.client.QueryRowContext(ctx, "SELECT o.id, o.name, o.deletedAt, o.updatedAt, "+
+		"(SELECT COUNT(*) FROM organisation_user ou WHERE ou.organisationId = o.id), o.createdBy, u.email, o.createdAt "+
+		"FROM organisation o LEFT JOIN user u ON u.id = o.createdBy WHERE o.id = ?", groupId).
+		Scan(&group.Id, &group.Name, &deletedAt, &group.UpdatedAt, &group.MemberCount, &creator, &email, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: group %s not found", types.ErrNotFound, groupId)
+		}
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if deletedAt.Valid {
+		group.Deleted = true
+		group.DeletedAt = &deletedAt.Time
+	}
+	group.CreatedBy, group.CreatedAt = groupCreator(creator, email, createdAt)
+	return &group, nil
+}
+
+// The creator of a group as read along with it, nil for what isn't recorded.
+func groupCreator(userId sql.NullString, email sql.NullString, createdAt sql.NullTime) (*types.GroupCreator, *time.Time) {
+	var creator *types.GroupCreator
+	if userId.Valid {
+		creator = &types.GroupCreator{UserId: userId.String, Email: email.String}
+	}
+	if !createdAt.Valid {
+		return creator, nil
+	}
+	return creator, &createdAt.Time
+}
+
+func scanGroup(row *sql.Row, groupId string) (*types.Organisation, error) {
+	var (
+		group                types.Organisation
+		slug, creator, email sql.NullString
+		createdAt            sql.NullTime
+	)
+	if err := row.Scan(&group.Id, &group.Name, &slug, &group.Version, &creator, &email, &createdAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("%w: group %s not found", types.ErrNotFound, groupId)
 		}
 		return nil, fmt.Errorf("failed to read group %s: %w", groupId, err)
 	}
+	group.Slug = slug.String
+	group.CreatedBy, group.CreatedAt = groupCreator(creator, email, createdAt)
 	return &group, nil
 }
 
-// Looks up an invitation, ensuring the invitationId is intended for the email.
-func (repository *CoreRepositoryImpl) LookupInvitation(invitationId string) (string, string, string, error) {
-	stmt, err := repository.client.Prepare("SELECT * FROM invitation WHERE id = ?")
+// Looks up an invitation by the token of its link. Returns ErrInvitationExpired for a link from before tokens,
+// which carried the row id instead.
+func (repository *CoreRepositoryImpl) LookupInvitation(token string) (*types.Invitation, error) {
+	stmt, err := repository.client.Prepare("SELECT id, userId, email, organisationId, invitedBy FROM invitation WHERE tokenHash = ?")
 	if err != nil {
-		return "", "", "", types.ErrPrepareStatement
+		return nil, types.ErrPrepareStatement
 	}
 	defer stmt.Close()
-	var inv struct {
-		id     string
-		userId string
-		email  string
-		orgId  string
+	var invitation types.Invitation
+	if err := stmt.QueryRow(invitationTokenHash(token)).Scan(&invitation.Id, &invitation.UserId, &invitation.Email, &invitation.GroupId, &invitation.InvitedBy); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, types.ErrGenericSQL
+		}
+		var expired bool
+		if err := repository.client.QueryRow("SELECT EXISTS(SELECT 1 FROM invitation WHERE id = ? AND tokenHash IS NULL)", token).Scan(&expired); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if expired {
+			return nil, types.ErrInvitationExpired
+		}
+		return nil, types.ErrInvitationNotFound
+	}
+	return &invitation, nil
+}
+
+// Reads a pending invitation by its row id, whichever group it's for. Returns ErrInvitationNotFound if there's none.
+func (repository *CoreRepositoryImpl) ReadInvitation(ctx context.Context, id string) (*types.Invitation, error) {
+	var invitation types.Invitation
+	err := repository.client.QueryRowContext(ctx, "SELECT id, userId, email, organisationId, invitedBy, tokenHash IS NULL FROM invitation WHERE id = ?", id).
+		Scan(&invitation.Id, &invitation.UserId, &invitation.Email, &invitation.GroupId, &invitation.InvitedBy, &invitation.Expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: invitation %s", types.ErrInvitationNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return &invitation, nil
+}
+
+// Reads a group's pending invitations, with the inviter's email as stored by us.
+func (repository *CoreRepositoryImpl) ReadGroupInvitations(groupId string) ([]*types.Invitation, error) {
+	rows, err := repository.client.Query("SELECT i.id, i.userId, i.email, i.organisationId, i.invitedBy, COALESCE(u.email, ''), i.tokenHash IS NULL "+
+		"FROM invitation i LEFT JOIN user u ON i.invitedBy = u.id "+
+		"WHERE i.organisationId = ? ORDER BY i.email", groupId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	invitations := make([]*types.Invitation, 0)
+	for rows.Next() {
+		var invitation types.Invitation
+		if err := rows.Scan(&invitation.Id, &invitation.UserId, &invitation.Email, &invitation.GroupId, &invitation.InvitedBy, &invitation.InvitedByEmail, &invitation.Expired); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		invitations = append(invitations, &invitation)
 	}
-	if err := stmt.QueryRow(invitationId).Scan(&inv.id, &inv.userId, &inv.email, &inv.orgId); err != nil {
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return invitations, nil
+}
+
+// Reads a pending invitation of the group by its row id, ErrNotFound if the group has no such invitation.
+func (repository *CoreRepositoryImpl) ReadGroupInvitation(ctx context.Context, groupId string, id string) (*types.Invitation, error) {
+	var invitation types.Invitation
+	err := repository.client.QueryRowContext(ctx, "SELECT i.id, i.userId, i.email, i.organisationId, i.invitedBy, COALESCE(u.email, ''), i.tokenHash IS NULL "+
+		"FROM invitation i LEFT JOIN user u ON i.invitedBy = u.id WHERE i.id = ? AND i.organisationId = ?", id, groupId).
+		Scan(&invitation.Id, &invitation.UserId, &invitation.Email, &invitation.GroupId, &invitation.InvitedBy, &invitation.InvitedByEmail, &invitation.Expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: invitation %s", types.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return &invitation, nil
+}
+
+// Deletes a pending invitation of the group by its row id, returning it, ErrNotFound if the group has no such invitation.
+func (repository *CoreRepositoryImpl) RevokeInvitation(ctx context.Context, groupId string, id string) (*types.Invitation, error) {
+	var invitation *types.Invitation
+	err := repository.WithTransaction(ctx, func(tx *sql.Tx) error {
+		invitation = &types.Invitation{}
+		err := tx.QueryRowContext(ctx, "SELECT id, userId, email, organisationId, invitedBy FROM invitation WHERE id = ? AND organisationId = ? FOR UPDATE", id, groupId).
+			Scan(&invitation.Id, &invitation.UserId, &invitation.Email, &invitation.GroupId, &invitation.InvitedBy)
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", "", "", types.ErrInvitationNotFound
+			return fmt.Errorf("%w: invitation %s", types.ErrNotFound, id)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 		}
-		return "", "", "", types.ErrGenericSQL
+		return repository.DeleteInvitationWithTx(tx, id)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return inv.userId, inv.orgId, inv.email, nil
+	return invitation, nil
 }
 
-// Delete an invitation.
+// Delete an invitation. Returns ErrInvitationNotFound if nothing was deleted, e.g. because it was already used.
 func (repository *CoreRepositoryImpl) DeleteInvitation(id string) error {
 	return repository.DeleteInvitationWithTx(nil, id)
 }
 
+// Same as DeleteInvitation, within the given transaction.
 func (repository *CoreRepositoryImpl) DeleteInvitationWithTx(tx *sql.Tx, id string) error {
 	var c types.Execer = repository.client
 	if tx != nil {
-		c = tx
+		c = txExecer(tx)
 	}
 	stmt, err := c.Prepare("DELETE FROM invitation WHERE id = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(id)
+	result, err := stmt.Exec(id)
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: invitation %s", types.ErrInvitationNotFound, id)
 	}
 	return nil
 }
@@ -637,7 +1510,7 @@ func (repository *CoreRepositoryImpl) DeleteInvitationWithTx(tx *sql.Tx, id stri
 func (repository *CoreRepositoryImpl) AddUserToOrganisationWithTx(tx *sql.Tx, userId string, groupId string) error {
 	var c types.Execer = repository.client
 	if tx != nil {
-		c = tx
+		c = txExecer(tx)
 	}
 	stmt, err := c.Prepare("INSERT INTO organisation_user (id, userId, organisationId) VALUES (?, ?, ?)")
 	if err != nil {
@@ -645,7 +1518,7 @@ func (repository *CoreRepositoryImpl) AddUserToOrganisationWithTx(tx *sql.Tx, us
 	}
 	defer stmt.Close()
 	if _, err = stmt.Exec(uuid.NewString(), userId, groupId); err != nil {
-		return types.ErrGenericSQL
+		return wrapSQLError(err)
 	}
 	return nil
 }
@@ -654,70 +1527,9 @@ func (repository *CoreRepositoryImpl) AddUserToOrganisation(userId string, organ
 	return repository.AddUserToOrganisationWithTx(nil, userId, organisationId)
 }
 
-// This should probably be deleted, as the transaction flows has generally been moved to the api layer. (already implemented in invite/join)
-func (repository *CoreRepositoryImpl) InvitationSignup(invitationId string, email string, password string, name string) error {
-
-	var userId string
-
-	// new transaction
-	tx, err := repository.client.Begin()
-	if err != nil {
-		return types.ErrTxCancelled
-	}
-
-	// rollback
-	defer func() {
-		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				panic(types.ErrRollback)
-			}
-			// also remove user from firebase, skip if no userId was set
-			if userId == "" {
-				return
-			}
-			if err := repository.firebase.DeleteUser(userId); err != nil {
-				log.Println(err)
-			}
-		}
-	}()
-
-	// check for invitation
-	userId, organisationId, _, err := repository.LookupInvitation(invitationId)
-	if err != nil {
-		return err
-	}
-
-	// create firebase user
-	userId, err = repository.firebase.CreateUser(email, password, name)
-	if err != nil {
-		return err
-	}
-
-	// create user in database
-	if err = repository.CreateUserWithTx(tx, userId, "", ""); err != nil {
-		return err
-	}
-
-	// add user to organisation
-	if err = repository.AddUserToOrganisationWithTx(tx, userId, organisationId); err != nil {
-		return err
-	}
-
-	// delete invitation
-	if err = repository.DeleteInvitationWithTx(tx, invitationId); err != nil {
-		return err
-	}
-
-	if err = tx.Commit(); err != nil {
-		return types.ErrTxCommit
-	}
-
-	return nil
-}
-
 // Non-tx method for deleting a user.
 func (repository *CoreRepositoryImpl) DeleteUser(userId string) error {
-	return repository.DeleteInvitationWithTx(nil, userId)
+	return repository.DeleteUserWithTx(nil, userId)
 }
 
 // Cleanup method to delete everything associated with the userId (user and organisation relations).
@@ -725,7 +1537,7 @@ func (repository *CoreRepositoryImpl) DeleteUserWithTx(tx *sql.Tx, userId string
 
 	var c types.Execer = repository.client
 	if tx != nil {
-		c = tx
+		c = txExecer(tx)
 	}
 
 	// delete user from organisation_user
@@ -737,6 +1549,15 @@ func (repository *CoreRepositoryImpl) DeleteUserWithTx(tx *sql.Tx, userId string
 		return types.ErrGenericSQL
 	}
 
+	// delete user's notification preferences
+	stmt, err = c.Prepare("DELETE FROM notification_preferences WHERE userId = ?")
+	if err != nil {
+		return types.ErrPrepareStatement
+	}
+	if _, err = stmt.Exec(userId); err != nil {
+		return types.ErrGenericSQL
+	}
+
 	// delete user from user
 	stmt, err = c.Prepare("DELETE FROM user WHERE id = ?")
 	if err != nil {
@@ -752,78 +1573,403 @@ func (repository *CoreRepositoryImpl) DeleteUserWithTx(tx *sql.Tx, userId string
 // Remove a user from a group, if user has no group left after removal, create a default one.
 func (repository *CoreRepositoryImpl) RemoveUserFromOrganisationWithTx(tx *sql.Tx, userId string, organisationId string) error {
 
+	// before the delete, so concurrent removals of this user's memberships take turns, see EnsureDefaultGroupWithTx
+	if err := lockUser(tx, userId); err != nil {
+		return err
+	}
+
 	// delete from group
-	stmt1, err := tx.Prepare("DELETE FROM organisation_user WHERE userId = ? AND organisationId = ?")
+	stmt1, err := txExecer(tx).Prepare("DELETE FROM organisation_user WHERE userId = ? AND organisationId = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt1.Close()
 	result, err := stmt1.Exec(userId, organisationId)
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 
 	// check if the mapping actually did exist, if not, return with not found
 	count, err := result.RowsAffected()
 	if err != nil {
 		log.Printf("error checking rows affected: %+v\n", err)
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	if count == 0 {
-		return fmt.Errorf("%w: %v", types.ErrNotFound, err)
+		return fmt.Errorf("%w: user %s is not a member of group %s", types.ErrNotFound, userId, organisationId)
 	}
 
-	// check if user is associated with atleast one group, if not, create a default
-	stmt2, err := tx.Prepare("CALL GetUserOrganisations(?)")
-	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+	return repository.EnsureDefaultGroupWithTx(tx, userId)
+}
+
+// Creates a default group owned by the user if they aren't a member of any group, every user should have one.
+// Callers removing memberships must lock the user with lockUser before removing them. Otherwise two concurrent
+// removals of the user's last two groups each still see the other group and neither creates a default.
+func (repository *CoreRepositoryImpl) EnsureDefaultGroupWithTx(tx *sql.Tx, userId string) error {
+	if err := lockUser(tx, userId); err != nil {
+		return err
 	}
-	defer stmt2.Close()
-	rows, err := stmt2.Query(userId)
-	if err != nil {
-		log.Printf("error reading user groups: %+v\n", err)
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+	// a locking read, so memberships committed by a transaction that held the lock before are seen.
+	// deleted groups don't count, the user can't see them
+	var count int
+	if err := txExecer(tx).QueryRow("SELECT COUNT(*) FROM organisation_user ou INNER JOIN organisation o ON ou.organisationId = o.id "+
+		"WHERE ou.userId = ? AND o.deletedAt IS NULL LOCK IN SHARE MODE", userId).Scan(&count); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
-	defer rows.Close()
+	if count > 0 {
+		return nil
+	}
+	_, err := repository.CreateOrganisationWithTx(tx, types.DEFAULT_GROUP_NAME, userId)
+	return err
+}
 
-	// otherwise create a default group for the user
-	if !rows.Next() {
-		rows.Close()
-		if err = repository.CreateOrganisationWithTx(tx, "My organisation", userId); err != nil {
-			return err
-		}
+// Locks the user's row until the transaction ends, serialising changes to their memberships. Takes the transaction
+// itself rather than an Execer, so the lock is always waited for with the transaction's context.
+func lockUser(tx *sql.Tx, userId string) error {
+	var id string
+	err := txExecer(tx).QueryRow("SELECT id FROM user WHERE id = ? FOR UPDATE", userId).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return nil
 }
 
-func (repository *CoreRepositoryImpl) CreateOrganisationWithTx(tx *sql.Tx, name string, userId string) error {
+// Creates a group owned by the user, returning it.
+func (repository *CoreRepositoryImpl) CreateOrganisationWithTx(tx *sql.Tx, name string, userId string) (*types.Organisation, error) {
 
 	// create organisation
-	stmt1, err := tx.Prepare("INSERT INTO organisation (id, name) VALUES (?, ?)")
+	slug, err := freeSlug(txExecer(tx), types.Slugify(name))
+	if err != nil {
+		return nil, err
+	}
+	stmt1, err := txExecer(tx).Prepare("INSERT INTO organisation (id, name, slug, createdBy, createdAt) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
-		return fmt.Errorf("%w: error creating group: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: error creating group: %v", types.ErrGenericSQL, err)
 	}
 	defer stmt1.Close()
 	organisationId := uuid.NewString()
-	if _, err := stmt1.Exec(organisationId, name); err != nil {
-		return fmt.Errorf("%w: error inserting into organisation: %v", types.ErrGenericSQL, err)
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	if _, err := stmt1.Exec(organisationId, name, slug, userId, createdAt); err != nil {
+		err = wrapSQLError(err)
+		if !errors.Is(err, types.ErrDuplicate) {
+			return nil, fmt.Errorf("error inserting into organisation: %w", err)
+		}
+		// another group took the slug since, a random suffix won't collide again
+		slug = slug + "-" + strings.ReplaceAll(uuid.NewString(), "-", "")[:6]
+		if _, err := stmt1.Exec(organisationId, name, slug, userId, createdAt); err != nil {
+			return nil, fmt.Errorf("error inserting into organisation: %w", wrapSQLError(err))
+		}
 	}
 
 	// map user to organisation
-	stmt2, err := tx.Prepare("INSERT INTO organisation_user (id, organisationId, userId) VALUES (?, ?, ?)")
+	stmt2, err := txExecer(tx).Prepare("INSERT INTO organisation_user (id, organisationId, userId) VALUES (?, ?, ?)")
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt2.Close()
 	if _, err = stmt2.Exec(uuid.NewString(), organisationId, userId); err != nil {
-		return fmt.Errorf("%w: error inserting into organisation_user: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("error inserting into organisation_user: %w", wrapSQLError(err))
 	}
 
 	// create group owner role for the group
 	if err := repository.role.CreateGroupOwnerRole(tx, organisationId, userId); err != nil {
 		log.Printf("create owner role error: %+v\n", err)
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, err
+	}
+
+	return &types.Organisation{Id: organisationId, Name: name, Slug: slug, MemberCount: 1,
+		CreatedBy: &types.GroupCreator{UserId: userId}, CreatedAt: &createdAt}, nil
+}
+
+// The slug, or the slug with the lowest numbered suffix no group has, e.g. "acme-2".
+func freeSlug(exe types.Execer, slug string) (string, error) {
+	rows, err := exe.Query("SELECT slug FROM organisation WHERE slug = ? OR slug LIKE ?", slug, slug+"-%")
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var existing string
+		if err := rows.Scan(&existing); err != nil {
+			return "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		taken[existing] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
+	candidate := slug
+	for i := 2; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d", slug, i)
+	}
+	return candidate, nil
+}
 
+// Returns the id of a group the user holds the "Group Owner" role of with the same name, ignoring case,
+// ErrNotFound if there is none. Locks the user until the transaction ends, so concurrent creations by the
+// same user take turns and the second one sees the first's group.
+func (repository *CoreRepositoryImpl) FindOwnedGroupByNameWithTx(tx *sql.Tx, userId string, name string) (string, error) {
+	if err := lockUser(tx, userId); err != nil {
+		return "", err
+	}
+	var groupId string
+	err := txExecer(tx).QueryRow("SELECT o.id FROM organisation o "+
+		"INNER JOIN role r ON r.organisationId = o.id AND r.name = 'Group Owner' "+
+		"INNER JOIN user_role ur ON ur.roleId = r.id "+
+		"WHERE ur.userId = ? AND o.deletedAt IS NULL AND LOWER(o.name) = LOWER(?) LIMIT 1", userId, name).Scan(&groupId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: no group named %q owned by %s", types.ErrNotFound, name, userId)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return groupId, nil
+}
+
+// Read a user's notification preferences, users who never changed them get the defaults.
+func (repository *CoreRepositoryImpl) ReadNotificationPreferences(ctx context.Context, userId string) (*types.NotificationPreferences, error) {
+	preferences := types.DefaultNotificationPreferences()
+	err := repository.client.QueryRowContext(ctx, "SELECT removed_from_group, invitation_accepted FROM notification_preferences WHERE userId = ?", userId).Scan(&preferences.RemovedFromGroup, &preferences.InvitationAccepted)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return preferences, nil
+}
+
+// Store a user's notification preferences.
+func (repository *CoreRepositoryImpl) UpdateNotificationPreferences(ctx context.Context, userId string, preferences *types.NotificationPreferences) error {
+	_, err := repository.client.ExecContext(ctx, "INSERT INTO notification_preferences (userId, removed_from_group, invitation_accepted) VALUES (?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE removed_from_group = VALUES(removed_from_group), invitation_accepted = VALUES(invitation_accepted)",
+		userId, preferences.RemovedFromGroup, preferences.InvitationAccepted)
+	if err != nil {
+		return wrapSQLError(err)
+	}
+	return nil
+}
+
+// Starts a session for a user that just signed in.
+func (repository *CoreRepositoryImpl) CreateSession(ctx context.Context, userId string) (*types.Session, error) {
+	session := &types.Session{
+		Id:        uuid.NewString(),
+		UserId:    userId,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if _, err := repository.client.ExecContext(ctx, "INSERT INTO session (id, userId, createdAt) VALUES (?, ?, ?)", session.Id, session.UserId, session.CreatedAt); err != nil {
+		return nil, wrapSQLError(err)
+	}
+	return session, nil
+}
+
+func (repository *CoreRepositoryImpl) ReadSession(ctx context.Context, id string) (*types.Session, error) {
+	var (
+		session   types.Session
+		revokedAt sql.NullTime
+	)
+	err := repository.client.QueryRowContext(ctx, "SELECT id, userId, createdAt, revokedAt FROM session WHERE id = ?", id).
+		Scan(&session.Id, &session.UserId, &session.CreatedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: session %s", types.ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+// Revokes every session of the user, their session tokens stay valid until they expire but can't be refreshed.
+func (repository *CoreRepositoryImpl) RevokeSessions(ctx context.Context, userId string) error {
+	if _, err := repository.client.ExecContext(ctx, "UPDATE session SET revokedAt = ? WHERE userId = ? AND revokedAt IS NULL", time.Now().UTC(), userId); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return nil
+}
+
+// Sets the group's monthly limit on uses of a service. Returns ErrNotFound if there is no service of that name.
+func (repository *CoreRepositoryImpl) SetServiceQuota(ctx context.Context, organisationId string, serviceName string, monthlyLimit int) error {
+	var services int
+	if err := repository.client.QueryRowContext(ctx, "SELECT COUNT(*) FROM service WHERE name = ?", serviceName).Scan(&services); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if services == 0 {
+		return fmt.Errorf("%w: service %s", types.ErrNotFound, serviceName)
+	}
+	_, err := repository.client.ExecContext(ctx, "INSERT INTO service_quota (organisationId, serviceName, monthlyLimit) VALUES (?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE monthlyLimit = VALUES(monthlyLimit)", organisationId, serviceName, monthlyLimit)
+	if err != nil {
+		return wrapSQLError(err)
+	}
+	return nil
+}
+
+// Removes the group's limit on uses of a service, returns ErrNotFound if it had none.
+func (repository *CoreRepositoryImpl) DeleteServiceQuota(ctx context.Context, organisationId string, serviceName string) error {
+	result, err := repository.client.ExecContext(ctx, "DELETE FROM service_quota WHERE organisationId = ? AND serviceName = ?", organisationId, serviceName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: no quota of %s for group %s", types.ErrNotFound, serviceName, organisationId)
+	}
 	return nil
 }
+
+// Reads how much of its monthly quota of a service the group has used, ErrNotFound if the group's use is unlimited.
+func (repository *CoreRepositoryImpl) ReadQuotaUsage(ctx context.Context, organisationId string, serviceName string) (*types.QuotaUsage, error) {
+	return readQuotaUsage(repository.client, organisationId, serviceName, false)
+}
+
+// Counts the group's uses of the service since the start of the calendar month, in UTC like usedAt. With lock,
+// the quota's row stays locked until the transaction ends, so uses of a limited service are registered one at a time.
+func readQuotaUsage(c types.Execer, organisationId string, serviceName string, lock bool) (*types.QuotaUsage, error) {
+	query := "SELECT monthlyLimit FROM service_quota WHERE organisationId = ? AND serviceName = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	usage := types.QuotaUsage{ServiceName: serviceName}
+	err := c.QueryRow(query, organisationId, serviceName).Scan(&usage.MonthlyLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no quota of %s for group %s", types.ErrNotFound, serviceName, organisationId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	monthStart := currentMonthStart()
+	err = c.QueryRow("SELECT COUNT(*) FROM used_service us INNER JOIN service s ON us.serviceId = s.id "+
+		"WHERE us.organisationId = ? AND s.name = ? AND us.usedAt >= ?", organisationId, serviceName, monthStart).Scan(&usage.Used)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	usage.Remaining = max(usage.MonthlyLimit-usage.Used, 0)
+	usage.ResetsAt = monthStart.AddDate(0, 1, 0).Format(time.RFC3339)
+	return &usage, nil
+}
+
+// The start of the calendar month quotas are counted in, in UTC like usedAt.
+func currentMonthStart() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Reads the group's month-to-date use of every service it used this month or has a quota of, by service name.
+func (repository *CoreRepositoryImpl) ReadUsageSummaryWithTx(tx *sql.Tx, groupId string) ([]*types.ServiceUsageSummary, error) {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	rows, err := c.Query("SELECT name, SUM(used), MAX(monthlyLimit) FROM ("+
+		"SELECT s.name AS name, 1 AS used, NULL AS monthlyLimit FROM used_service us INNER JOIN service s ON us.serviceId = s.id "+
+		"WHERE us.organisationId = ? AND us.usedAt >= ? "+
+		"UNION ALL SELECT serviceName, 0, monthlyLimit FROM service_quota WHERE organisationId = ?"+
+		") usage_rows GROUP BY name ORDER BY name", groupId, currentMonthStart(), groupId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	summaries := make([]*types.ServiceUsageSummary, 0)
+	for rows.Next() {
+		var (
+			summary types.ServiceUsageSummary
+			limit   sql.NullInt64
+		)
+		if err := rows.Scan(&summary.ServiceName, &summary.Used, &limit); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if limit.Valid {
+			monthlyLimit, remaining := int(limit.Int64), max(int(limit.Int64)-summary.Used, 0)
+			summary.MonthlyLimit, summary.Remaining = &monthlyLimit, &remaining
+		}
+		summaries = append(summaries, &summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return summaries, nil
+}
+
+// Reads the group's uses of each service per calendar month, for the given number of months up to and including
+// the current one. Every series has an entry for each month, months without uses count 0, and the given services
+// have a series even if they weren't used at all.
+func (repository *CoreRepositoryImpl) ReadMonthlyUsageWithTx(tx *sql.Tx, groupId string, months int, serviceNames []string) (map[string][]*types.MonthlyUsage, error) {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	since := currentMonthStart().AddDate(0, 1-months, 0)
+	rows, err := c.Query("SELECT s.name, DATE_FORMAT(us.usedAt, '%Y-%m'), COUNT(*) FROM used_service us INNER JOIN service s ON us.serviceId = s.id "+
+		"WHERE us.organisationId = ? AND us.usedAt >= ? GROUP BY s.name, DATE_FORMAT(us.usedAt, '%Y-%m')", groupId, since)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	counts := make(map[string]map[string]int)
+	for _, name := range serviceNames {
+		counts[name] = make(map[string]int)
+	}
+	for rows.Next() {
+		var (
+			name, month string
+			count       int
+		)
+		if err := rows.Scan(&name, &month, &count); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if counts[name] == nil {
+			counts[name] = make(map[string]int)
+		}
+		counts[name][month] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	series := make(map[string][]*types.MonthlyUsage, len(counts))
+	for name, byMonth := range counts {
+		history := make([]*types.MonthlyUsage, months)
+		for i := range history {
+			month := since.AddDate(0, i, 0).Format("2006-01")
+			history[i] = &types.MonthlyUsage{Month: month, Count: byMonth[month]}
+		}
+		series[name] = history
+	}
+	return series, nil
+}
+
+// Whether the user is flagged as a platform operator, false for unknown users.
+func (repository *CoreRepositoryImpl) IsPlatformAdmin(ctx context.Context, userId string) (bool, error) {
+	var admin bool
+	err := repository.client.QueryRowContext(ctx, "SELECT platformAdmin FROM user WHERE id = ?", userId).Scan(&admin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return admin, nil
+}
+
+// Finds users whose email starts with the query, for support requests.
+func (repository *CoreRepositoryImpl) SearchUsersByEmail(ctx context.Context, query string, limit int) ([]*types.AdminUser, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(types.NormalizeEmail(query)) + "%"
+	rows, err := repository.reads.reader("SearchUsersByEmail").QueryContext(ctx,
+		"SELECT id, email, verified, lastLogin, platformAdmin FROM user WHERE email LIKE ? ORDER BY email LIMIT ?", pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	users := make([]*types.AdminUser, 0)
+	for rows.Next() {
+		var user types.AdminUser
+		if err := rows.Scan(&user.Id, &user.Email, &user.Verified, &user.LastLogin, &user.PlatformAdmin); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return users, nil
+}
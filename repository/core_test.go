@@ -0,0 +1,606 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"user.service.altiore.io/types"
+)
+
+// A core repository answering UserExists for the given users.
+func newFakeUserRepository(t testing.TB, userIds ...string) (*fakeDatabase, *CoreRepositoryImpl) {
+	users := make(map[string]bool)
+	for _, userId := range userIds {
+		users[userId] = true
+	}
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if statement.is("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)") {
+			return fakeValue(users[statement.arg(0)]), nil
+		}
+		return nil, fmt.Errorf("unexpected statement: %s", statement.Query)
+	})
+	return fake, &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+}
+
+// Runs on every authenticated request, so it must be a single round trip.
+func TestUserExistsRunsASingleStatement(t *testing.T) {
+	fake, core := newFakeUserRepository(t, "user")
+
+	if err := core.UserExists("user"); err != nil {
+		t.Errorf("an existing user: %v", err)
+	}
+	if err := core.UserExists("unknown"); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("an unknown user: got %v, want ErrNotFound", err)
+	}
+	if statements := fake.executed(); len(statements) != 2 || fake.prepared() != 0 {
+		t.Errorf("ran %d statements and prepared %d for two checks, want two unprepared ones", len(statements), fake.prepared())
+	}
+}
+
+func BenchmarkUserExists(b *testing.B) {
+	_, core := newFakeUserRepository(b, "user")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := core.UserExists("user"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteInReadTransactionFails(t *testing.T) {
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if statement.is("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)") {
+			return fakeValue(true), nil
+		}
+		return fakeAffected(1), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	err := core.WithReadTransaction(context.Background(), func(tx *sql.Tx) error {
+		var exists bool
+		if err := txExecer(tx).QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE id = ?)", "user").Scan(&exists); err != nil {
+			t.Errorf("reading in a read-only transaction: %v", err)
+		}
+		_, err := txExecer(tx).Exec("UPDATE user SET verified = TRUE WHERE id = ?", "user")
+		return err
+	})
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1792 {
+		t.Fatalf("writing in a read-only transaction: got %v, want MySQL error 1792", err)
+	}
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Errorf("got %d commits and %d rollbacks, want the transaction rolled back", fake.commits, fake.rollbacks)
+	}
+
+	// the same write in a read-write transaction goes through
+	err = core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+		_, err := txExecer(tx).Exec("UPDATE user SET verified = TRUE WHERE id = ?", "user")
+		return err
+	})
+	if err != nil || fake.commits != 1 {
+		t.Errorf("writing in a read-write transaction: %v, %d commits", err, fake.commits)
+	}
+}
+
+func TestTransactionRollsBackOnPanic(t *testing.T) {
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		return fakeAffected(1), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 3}
+
+	var panicked *sql.Tx
+	func() {
+		defer func() {
+			if r := recover(); r != "callback failed" {
+				t.Errorf("recovered %v, want the callback's panic passed on", r)
+			}
+		}()
+		core.WithTransactionOpts(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted}, func(tx *sql.Tx) error {
+			panicked = tx
+			if _, err := txExecer(tx).Exec("DELETE FROM session WHERE userId = ?", "user"); err != nil {
+				t.Fatal(err)
+			}
+			panic("callback failed")
+		})
+	}()
+
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Errorf("got %d commits and %d rollbacks, want a single rollback", fake.commits, fake.rollbacks)
+	}
+	if _, exists := txContexts.Load(panicked); exists {
+		t.Error("the context of the panicked transaction is still recorded")
+	}
+	if err := panicked.Commit(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("committing the panicked transaction: got %v, want ErrTxDone", err)
+	}
+	// the connection went back to the pool in a usable state
+	if err := core.WithTransaction(context.Background(), func(tx *sql.Tx) error { return nil }); err != nil || fake.commits != 1 {
+		t.Errorf("a transaction after the panic: %v, %d commits", err, fake.commits)
+	}
+}
+
+// Once the request is cancelled, none of a transaction's statements run, the user lock the WithTx methods take
+// included, whichever way the transaction was begun.
+func TestCancelledTransactionRunsNoStatements(t *testing.T) {
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		return fakeRows([]string{"id"}, []driver.Value{"user"}), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := core.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := lockUser(tx, "user"); err == nil {
+		t.Error("the user was locked after the request was cancelled")
+	}
+	if statements := fake.executed(); len(statements) != 0 {
+		t.Errorf("ran %v after the request was cancelled", statements)
+	}
+	core.RollbackTransaction(tx)
+	if _, exists := txContexts.Load(tx); exists {
+		t.Error("the context of the rolled back transaction is still recorded")
+	}
+}
+
+func TestImplementationGroups(t *testing.T) {
+	services := map[string][]int64{"scanner": {1, 2, 3}, "backup": {2}}
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if !statement.is("SELECT implementationGroup FROM service WHERE name = ? AND implementationGroup IS NOT NULL ORDER BY implementationGroup") {
+			return nil, fmt.Errorf("unexpected statement: %s", statement.Query)
+		}
+		if statement.arg(0) == "broken" {
+			return nil, errors.New("connection reset")
+		}
+		result := fakeRows([]string{"implementationGroup"})
+		for _, group := range services[statement.arg(0)] {
+			result.rows = append(result.rows, []driver.Value{group})
+		}
+		return result, nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	for name, expected := range map[string]string{"scanner": "[1 2 3]", "backup": "[2]", "unknown": "[]"} {
+		groups, err := core.ImplementationGroups(name)
+		if err != nil || groups == nil || fmt.Sprint(groups) != expected {
+			t.Errorf("%s: got %v, %v, want %s", name, groups, err, expected)
+		}
+	}
+	if _, err := core.ImplementationGroups("broken"); !errors.Is(err, types.ErrGenericSQL) {
+		t.Errorf("a failing query: got %v, want ErrGenericSQL", err)
+	}
+}
+
+// A user removed from their last two groups at once ends up with exactly one default group. Without the lock on the
+// user, each removal would still see the group the other one is removing and neither would create the default.
+func TestConcurrentRemovalsCreateOneDefaultGroup(t *testing.T) {
+	type writes struct {
+		removed map[string]bool
+		added   []string
+	}
+	var (
+		groups      = map[string]bool{"a": true, "b": true} // of the user, as committed
+		pending     = make(map[*fakeTx]*writes)
+		defaults    int
+		counts      int
+		bothCounted = make(chan struct{})
+	)
+	of := func(tx *fakeTx) *writes {
+		if pending[tx] == nil {
+			pending[tx] = &writes{removed: make(map[string]bool)}
+		}
+		return pending[tx]
+	}
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		switch {
+		case statement.is("SELECT id FROM user WHERE id = ? FOR UPDATE"):
+			return fakeValue(statement.arg(0)), nil
+		case statement.has("DELETE FROM organisation_user"):
+			groupId := statement.arg(1)
+			if !groups[groupId] || of(statement.Tx).removed[groupId] {
+				return fakeAffected(0), nil
+			}
+			of(statement.Tx).removed[groupId] = true
+			return fakeAffected(1), nil
+		case statement.has("SELECT COUNT(*) FROM organisation_user"):
+			if counts++; counts == 2 {
+				close(bothCounted)
+			}
+			own := of(statement.Tx)
+			count := len(own.added)
+			for groupId := range groups {
+				if !own.removed[groupId] {
+					count++
+				}
+			}
+			return fakeValue(int64(count)), nil
+		case statement.has("INSERT INTO organisation_user"):
+			of(statement.Tx).added = append(of(statement.Tx).added, statement.arg(1))
+			return fakeAffected(1), nil
+		case isWrite(statement.Query):
+			return fakeAffected(1), nil
+		}
+		return fakeRows([]string{"value"}), nil
+	})
+	fake.ended = func(tx *fakeTx, committed bool) {
+		if own := pending[tx]; committed && own != nil {
+			for groupId := range own.removed {
+				delete(groups, groupId)
+			}
+			for _, groupId := range own.added {
+				groups[groupId] = true
+				defaults++
+			}
+		}
+		delete(pending, tx)
+	}
+	// lets the removals overlap as far as they can, neither commits before both counted unless one is held back
+	fake.before = func(statement *fakeStatement) {
+		if statement.is("COMMIT") {
+			select {
+			case <-bothCounted:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	role := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, role: role, txAttempts: 1}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, groupId := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+				return core.RemoveUserFromOrganisationWithTx(tx, "user", groupId)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("a removal failed: %v", err)
+		}
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if defaults != 1 || len(groups) != 1 {
+		t.Errorf("created %d default groups and the user is in %d groups, want one of each", defaults, len(groups))
+	}
+}
+
+// A deleted group is hidden until it's restored, after which its members, roles and invitations work as before.
+// Past the restore window it stays deleted.
+func TestRestoredGroupIsFullyFunctional(t *testing.T) {
+	var (
+		now       = time.Now()
+		deletedAt *time.Time
+	)
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		// rows of the deleted group are only hidden from statements that leave deleted groups out
+		visible := deletedAt == nil || !statement.has("deletedAt IS NULL")
+		switch {
+		case statement.is("SELECT id FROM user WHERE id = ? FOR UPDATE"):
+			return fakeValue(statement.arg(0)), nil
+		case statement.has("UPDATE organisation SET deletedAt = NOW()"):
+			if deletedAt != nil {
+				return fakeAffected(0), nil
+			}
+			deleted := now
+			deletedAt = &deleted
+			return fakeAffected(1), nil
+		case statement.has("SELECT COUNT(*) FROM organisation_user ou"):
+			// the user has a group of their own besides
+			return fakeValue(int64(1)), nil
+		case statement.is("SELECT deletedAt FROM organisation WHERE id = ? FOR UPDATE"):
+			if deletedAt == nil {
+				return fakeValue(nil), nil
+			}
+			return fakeValue(*deletedAt), nil
+		case statement.has("UPDATE organisation SET deletedAt = NULL"):
+			if deletedAt == nil || now.Sub(*deletedAt) >= types.GROUP_RESTORE_WINDOW_DAYS*24*time.Hour {
+				return fakeAffected(0), nil
+			}
+			deletedAt = nil
+			return fakeAffected(1), nil
+		case statement.is(readGroupQuery):
+			if !visible {
+				return fakeRows([]string{"id"}), nil
+			}
+			return fakeRows([]string{"id", "name", "slug", "version", "createdBy", "email", "createdAt"},
+				[]driver.Value{"group", "Group", "group", int64(1), "user", "user@example.com", now}), nil
+		case statement.is(isMemberQuery), statement.has("FROM user_role ur"):
+			return fakeValue(visible), nil
+		case statement.has("FROM invitation WHERE tokenHash = ?"):
+			return fakeRows([]string{"id", "userId", "email", "organisationId", "invitedBy"},
+				[]driver.Value{"invitation", "", "invitee@example.com", "group", "user"}), nil
+		}
+		return nil, fmt.Errorf("unexpected statement: %s", statement.Query)
+	})
+	role := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, role: role, txAttempts: 1}
+	ctx := context.Background()
+	functional := func() error {
+		if _, err := core.ReadGroup(ctx, "group"); err != nil {
+			return err
+		}
+		if isMember, err := core.IsMember(ctx, "user", "group"); err != nil || !isMember {
+			return fmt.Errorf("not a member: %v", err)
+		}
+		if err := role.HasPermission(nil, "user", "group", types.INVITE_MEMBER); err != nil {
+			return err
+		}
+		if _, err := core.LookupInvitation("token"); err != nil {
+			return err
+		}
+		return nil
+	}
+	restore := func() error {
+		return core.WithTransaction(ctx, func(tx *sql.Tx) error { return core.RestoreGroupWithTx(tx, "group") })
+	}
+
+	if err := core.WithTransaction(ctx, func(tx *sql.Tx) error { return core.DeleteGroupWithTx(tx, "user", "group") }); err != nil {
+		t.Fatalf("deleting: %v", err)
+	}
+	if _, err := core.ReadGroup(ctx, "group"); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("reading the deleted group: got %v, want ErrNotFound", err)
+	}
+	if isMember, _ := core.IsMember(ctx, "user", "group"); isMember {
+		t.Error("still a member of the deleted group")
+	}
+	if err := role.HasPermission(nil, "user", "group", types.INVITE_MEMBER); !errors.Is(err, types.ErrForbiddenOperation) {
+		t.Errorf("a permission in the deleted group: got %v, want ErrForbiddenOperation", err)
+	}
+
+	if err := restore(); err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if err := functional(); err != nil {
+		t.Errorf("the restored group: %v", err)
+	}
+	if err := restore(); err != nil {
+		t.Errorf("restoring a group that isn't deleted: %v", err)
+	}
+
+	if err := core.WithTransaction(ctx, func(tx *sql.Tx) error { return core.DeleteGroupWithTx(tx, "user", "group") }); err != nil {
+		t.Fatalf("deleting again: %v", err)
+	}
+	now = now.Add((types.GROUP_RESTORE_WINDOW_DAYS + 1) * 24 * time.Hour)
+	if err := restore(); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("restoring past the window: got %v, want ErrNotFound", err)
+	}
+	if _, err := core.ReadGroup(ctx, "group"); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("reading a group deleted past the window: got %v, want ErrNotFound", err)
+	}
+}
+
+// The created group is returned as it was written, with the id its membership and owner role were created for.
+func TestCreatedGroupIsReturned(t *testing.T) {
+	var inserted, mapped, owned string
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		switch {
+		case statement.has("SELECT slug FROM organisation"):
+			return fakeRows([]string{"slug"}, []driver.Value{"acme"}), nil
+		case statement.has("INSERT INTO organisation ("):
+			inserted = statement.arg(0)
+		case statement.has("INSERT INTO organisation_user"):
+			mapped = statement.arg(1)
+		case statement.has("INSERT INTO role"):
+			owned = statement.arg(2)
+		}
+		return fakeAffected(1), nil
+	})
+	role := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, role: role, txAttempts: 1}
+
+	var group *types.Organisation
+	err := core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		group, err = core.CreateOrganisationWithTx(tx, "Acme", "user")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Id == "" || group.Id != inserted || group.Id != mapped || group.Id != owned {
+		t.Errorf("returned group %q, inserted %q, mapped the user to %q and created the owner role in %q", group.Id, inserted, mapped, owned)
+	}
+	if group.Name != "Acme" || group.Slug != "acme-2" || group.MemberCount != 1 {
+		t.Errorf("returned %+v, want Acme with slug acme-2 and one member", group)
+	}
+	if group.CreatedBy == nil || group.CreatedBy.UserId != "user" || group.CreatedAt == nil {
+		t.Errorf("returned creator %+v at %v, want user", group.CreatedBy, group.CreatedAt)
+	}
+	if fake.commits != 1 {
+		t.Errorf("committed %d times, want once", fake.commits)
+	}
+}
+
+// An address already invited to the group isn't invited again, whoever invites it.
+func TestPendingInvitationIsNotRepeated(t *testing.T) {
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if statement.has("SELECT EXISTS(SELECT 1 FROM invitation") {
+			return fakeValue(true), nil
+		}
+		return fakeAffected(1), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	_, _, err := core.CreateInvitationWithTx(nil, "", "invitee@example.com", "group", "other-member")
+	if !errors.Is(err, types.ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+	for _, statement := range fake.executed() {
+		if strings.Contains(statement, "INSERT INTO invitation") {
+			t.Errorf("a second invitation was inserted: %s", statement)
+		}
+	}
+}
+
+// Deleting an invitation that's gone, e.g. already used, is reported rather than passing as done.
+func TestDeletingAMissingInvitationIsNotFound(t *testing.T) {
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		return fakeAffected(0), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+	if err := core.DeleteInvitation("used"); !errors.Is(err, types.ErrInvitationNotFound) {
+		t.Errorf("got %v, want ErrInvitationNotFound", err)
+	}
+}
+
+// Uses are registered up to the group's monthly quota and refused beyond it, except for retries of a registered use.
+func TestServiceQuotaIsEnforced(t *testing.T) {
+	const limit = 2
+	var used int64
+	limited := true
+	fake, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		switch {
+		case statement.has("SELECT id FROM service"):
+			return fakeValue("service"), nil
+		case statement.has("FROM used_service WHERE idempotencyKey = ?"):
+			if statement.arg(0) == "registered" {
+				return fakeValue(int64(1)), nil
+			}
+			return fakeValue(int64(0)), nil
+		case statement.has("SELECT monthlyLimit FROM service_quota"):
+			if !limited {
+				return fakeRows([]string{"monthlyLimit"}), nil
+			}
+			if !statement.has("FOR UPDATE") {
+				t.Error("the quota isn't locked while counting")
+			}
+			return fakeValue(int64(limit)), nil
+		case statement.has("SELECT COUNT(*) FROM used_service"):
+			return fakeValue(used), nil
+		case statement.has("INSERT INTO used_service"):
+			used++
+			return fakeAffected(1), nil
+		}
+		return nil, fmt.Errorf("unexpected statement %s", statement.Query)
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	for i := 0; i < limit; i++ {
+		if err := core.RegisterUsedService("scanner", nil, "group", "user", ""); err != nil {
+			t.Fatalf("use %d within the quota: %v", i+1, err)
+		}
+	}
+	if err := core.RegisterUsedService("scanner", nil, "group", "user", ""); !errors.Is(err, types.ErrQuotaExceeded) {
+		t.Errorf("a use beyond the quota got %v, want ErrQuotaExceeded", err)
+	}
+	if err := core.RegisterUsedService("scanner", nil, "group", "user", "registered"); err != nil {
+		t.Errorf("a retried use was refused: %v", err)
+	}
+	if used != limit {
+		t.Errorf("registered %d uses, want %d (ran %v)", used, limit, fake.executed())
+	}
+
+	limited = false
+	if err := core.RegisterUsedService("scanner", nil, "group", "user", ""); err != nil || used != limit+1 {
+		t.Errorf("a use of an unlimited service got %v", err)
+	}
+}
+
+// Every series of the monthly usage covers each month up to the current one, counting months without uses as 0.
+func TestMonthlyUsageIsZeroFilled(t *testing.T) {
+	thisMonth := currentMonthStart().Format("2006-01")
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		return fakeRows([]string{"name", "month", "count"}, []driver.Value{"scanner", thisMonth, int64(4)}), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	series, err := core.ReadMonthlyUsageWithTx(nil, "group", 3, []string{"backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"scanner", "backup"} {
+		history := series[name]
+		if len(history) != 3 || history[2].Month != thisMonth {
+			t.Fatalf("%s got %d months ending %v, want 3 ending with %s", name, len(history), history, thisMonth)
+		}
+		for i, month := range history {
+			want := 0
+			if name == "scanner" && i == 2 {
+				want = 4
+			}
+			if month.Count != want {
+				t.Errorf("%s counted %d uses in %s, want %d", name, month.Count, month.Month, want)
+			}
+		}
+	}
+}
+
+// An update naming the version the group is at moves it on, one naming an older version is a conflict.
+func TestStaleGroupVersionIsAConflict(t *testing.T) {
+	var version int64 = 3
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		switch {
+		case statement.has("UPDATE organisation SET version = version + 1"):
+			if len(statement.Args) == 2 && statement.Args[1] != version {
+				return fakeAffected(0), nil
+			}
+			version++
+			return fakeAffected(1), nil
+		case statement.has("SELECT version FROM organisation"):
+			return fakeValue(version), nil
+		}
+		return nil, fmt.Errorf("unexpected statement: %s", statement.Query)
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+	update := func(expected *int) (current int, err error) {
+		err = core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+			current, err = core.UpdateGroupVersionWithTx(tx, "group", expected)
+			return err
+		})
+		return current, err
+	}
+
+	read := 3
+	if current, err := update(&read); err != nil || current != 4 {
+		t.Fatalf("updating the current version got %d, %v, want version 4", current, err)
+	}
+	if current, err := update(&read); !errors.Is(err, types.ErrConflict) || current != 4 {
+		t.Errorf("updating a stale version got %d, %v, want ErrConflict at version 4", current, err)
+	}
+	if current, err := update(nil); err != nil || current != 5 {
+		t.Errorf("updating without a version got %d, %v, want version 5", current, err)
+	}
+}
+
+// Only a missing user is ErrNotFound, a failing database isn't taken for one, e.g. by bootstrapping a user anew.
+func TestReadUserByEmailTellsMissingFromFailing(t *testing.T) {
+	failing := false
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if failing {
+			return nil, errors.New("connection reset")
+		}
+		if statement.arg(0) == "user@example.com" {
+			return fakeRows([]string{"id", "email", "locale"}, []driver.Value{"user", "user@example.com", "en"}), nil
+		}
+		return fakeRows([]string{"id", "email", "locale"}), nil
+	})
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, txAttempts: 1}
+
+	if user, err := core.ReadUserByEmail(" User@Example.com"); err != nil || user.Id != "user" {
+		t.Errorf("an existing user: got %+v, %v", user, err)
+	}
+	if _, err := core.ReadUserByEmail("nobody@example.com"); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("a missing user: got %v, want ErrNotFound", err)
+	}
+	failing = true
+	if _, err := core.ReadUserByEmail("user@example.com"); errors.Is(err, types.ErrNotFound) || !errors.Is(err, types.ErrGenericSQL) {
+		t.Errorf("a failing database: got %v, want ErrGenericSQL", err)
+	}
+}
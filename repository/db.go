@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/go-sql-driver/mysql"
+	"user.service.altiore.io/singleton"
+)
+
+// Defaults for connecting at startup, DB_CONNECT_ATTEMPTS and DB_CONNECT_INTERVAL override them.
+// The interval doubles after every failed attempt.
+const (
+	dbConnectAttempts = 5
+	dbConnectInterval = time.Second * 2
+)
+
+// The Cloud SQL dialer is shared by every repository, it's registered with the driver once per instance.
+var (
+	cloudSQLDialer     *cloudsqlconn.Dialer
+	cloudSQLDialerErr  error
+	cloudSQLDialerOnce sync.Once
+	cloudSQLNetworks   = make(map[string]bool)
+	cloudSQLMu         sync.Mutex
+)
+
+// Where a pool connects to, read from the environment with the given prefix, e.g. DB_BUSINESS_REPLICA_.
+type dbTarget struct {
+	name               string
+	host               string
+	port               string
+	instance_conn_name string
+}
+
+func readTarget(name string, prefix string) *dbTarget {
+	return &dbTarget{
+		name:               name,
+		host:               os.Getenv(prefix + "HOST"),
+		port:               os.Getenv(prefix + "PORT"),
+		instance_conn_name: os.Getenv(prefix + "INSTANCE_CONN_NAME"),
+	}
+}
+
+// Pools of the business database and the read routers over them, shared by every repository.
+var (
+	pools   = singleton.NewRegistry[*sql.DB]("database pool", 1)
+	routers = singleton.NewRegistry[*readRouter]("read router", 1)
+)
+
+// Default size of the shared pool, DB_MAX_OPEN_CONNS overrides it. As many connections as the core, role and
+// log repositories had when each opened a pool of its own.
+const dbMaxOpenConns = 30
+
+// Returns the pool of the business database, shared by every repository. The first call opens it and pings it,
+// retrying with exponential backoff so a cold start of the database or a network blip doesn't fail the deploy.
+// Locally the first failure is returned, so misconfiguration shows.
+func openDatabase() (*sql.DB, error) {
+	return pools.Get("primary", connectDatabase)
+}
+
+func connectDatabase() (*sql.DB, error) {
+	attempts, interval := dbConnectAttempts, dbConnectInterval
+	if os.Getenv("ENV") == "LOCAL" {
+		attempts = 1
+	} else {
+		if value, err := strconv.Atoi(os.Getenv("DB_CONNECT_ATTEMPTS")); err == nil && value > 0 {
+			attempts = value
+		}
+		if value, err := time.ParseDuration(os.Getenv("DB_CONNECT_INTERVAL")); err == nil && value > 0 {
+			interval = value
+		}
+	}
+	db, err := openPool(readTarget("primary", "DB_BUSINESS_"))
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		err = db.Ping()
+		if err == nil {
+			break
+		}
+		log.Printf("error connecting to database (attempt %d of %d): %+v\n", attempt, attempts, err)
+		if attempt >= attempts {
+			db.Close()
+			return nil, fmt.Errorf("error connecting to database after %d attempts: %w", attempts, err)
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+	return db, nil
+}
+
+// Opens a pool without connecting, the replica may be down at startup.
+func openPool(target *dbTarget) (*sql.DB, error) {
+	var (
+		uri  = ""
+		user = os.Getenv("DB_BUSINESS_USER")
+		pass = os.Getenv("DB_BUSINESS_PASS")
+	)
+
+	// interpolateParams has the driver inline query arguments, so a query with arguments is a single round trip
+	// instead of an implicit prepare, execute and close.
+	switch os.Getenv("ENV") {
+
+	case "LOCAL":
+		log.Printf("loading connection info for local mysql server (%s)\n", target.name)
+		uri = fmt.Sprintf("%s:%s@tcp(%s:%s)/core?parseTime=true&interpolateParams=true", user, pass, target.host, target.port)
+
+	default:
+		log.Printf("loading connection info for google cloud mysql server (%s)...\n", target.name)
+		network, err := registerCloudSQL(target.instance_conn_name)
+		if err != nil {
+			return nil, err
+		}
+		uri = fmt.Sprintf("%s:%s@%s(localhost:%s)/core?parseTime=true&interpolateParams=true", user, pass, network, target.port)
+	}
+	config, err := mysql.ParseDSN(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	db := sql.OpenDB(&timedConnector{Connector: connector, threshold: slowQueryThreshold()})
+	maxOpenConns := dbMaxOpenConns
+	if value, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS")); err == nil && value > 0 {
+		maxOpenConns = value
+	}
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	return db, nil
+}
+
+// Registers a network dialing the Cloud SQL instance with the driver, returning its name for the DSN.
+func registerCloudSQL(instance_conn_name string) (string, error) {
+	cloudSQLDialerOnce.Do(func() {
+		cloudSQLDialer, cloudSQLDialerErr = cloudsqlconn.NewDialer(context.Background())
+	})
+	if cloudSQLDialerErr != nil {
+		return "", fmt.Errorf("error creating cloud sql dialer: %w", cloudSQLDialerErr)
+	}
+	network := "cloudsqlconn-" + instance_conn_name
+	cloudSQLMu.Lock()
+	defer cloudSQLMu.Unlock()
+	if !cloudSQLNetworks[network] {
+		mysql.RegisterDialContext(network, func(ctx context.Context, addr string) (net.Conn, error) {
+			return cloudSQLDialer.Dial(ctx, instance_conn_name, []cloudsqlconn.DialOption{}...)
+		})
+		cloudSQLNetworks[network] = true
+	}
+	return network, nil
+}
+
+// How often the replica is pinged, reads go to the primary while it doesn't answer.
+const (
+	replicaCheckInterval = time.Second * 5
+	replicaCheckTimeout  = time.Second * 2
+)
+
+// Routes reads that can do with slightly stale data to the read replica, when one is configured
+// (DB_BUSINESS_REPLICA_HOST or DB_BUSINESS_REPLICA_INSTANCE_CONN_NAME) and reachable. Reads within a
+// transaction always use the transaction, so they never go through here.
+// With DB_DEBUG_ROUTING=true every routing decision is logged.
+type readRouter struct {
+	primary *sql.DB
+	replica *sql.DB
+	healthy atomic.Bool
+	debug   bool
+}
+
+// Returns the router over the primary pool, shared like the pool so the replica is opened and checked once.
+func newReadRouter(primary *sql.DB) *readRouter {
+	router, _ := routers.Get("primary", func() (*readRouter, error) {
+		return openReadRouter(primary), nil
+	})
+	return router
+}
+
+func openReadRouter(primary *sql.DB) *readRouter {
+	router := &readRouter{primary: primary, debug: os.Getenv("DB_DEBUG_ROUTING") == "true"}
+	target := readTarget("replica", "DB_BUSINESS_REPLICA_")
+	if target.host == "" && target.instance_conn_name == "" {
+		return router
+	}
+	if target.port == "" {
+		target.port = os.Getenv("DB_BUSINESS_PORT")
+	}
+	replica, err := openPool(target)
+	if err != nil {
+		log.Printf("error opening read replica, reading from the primary: %+v\n", err)
+		return router
+	}
+	router.replica = replica
+	if router.check(); !router.healthy.Load() {
+		log.Println("read replica is unreachable, reading from the primary until it answers")
+	}
+	go router.healthWorker()
+	return router
+}
+
+// Pool for a read by the named method.
+func (router *readRouter) reader(method string) *sql.DB {
+	if router.replica != nil && router.healthy.Load() {
+		if router.debug {
+			log.Printf("db routing: %s -> replica\n", method)
+		}
+		return router.replica
+	}
+	if router.debug {
+		log.Printf("db routing: %s -> primary\n", method)
+	}
+	return router.primary
+}
+
+// Pings the replica, logging when it goes down or comes back.
+func (router *readRouter) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+	err := router.replica.PingContext(ctx)
+	if healthy := err == nil; router.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Println("read replica is reachable, routing reads to it")
+		} else {
+			log.Printf("read replica is unreachable, routing reads to the primary: %+v\n", err)
+		}
+	}
+}
+
+func (router *readRouter) healthWorker() {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		router.check()
+	}
+}
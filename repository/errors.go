@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"user.service.altiore.io/types"
+)
+
+// MySQL error numbers.
+const (
+	mysqlErrDuplicateEntry  = 1062
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// Wraps an error from executing a statement: duplicate key violations become types.ErrDuplicate naming the violated key,
+// anything else types.ErrGenericSQL.
+func wrapSQLError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return fmt.Errorf("%w: key %s: %w", types.ErrDuplicate, duplicateKeyName(mysqlErr.Message), err)
+	}
+	return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+}
+
+// Extracts the key name from a duplicate entry message, e.g. "Duplicate entry 'x' for key 'user.PRIMARY'".
+func duplicateKeyName(message string) string {
+	_, key, found := strings.Cut(message, "for key ")
+	if !found {
+		return "unknown"
+	}
+	return strings.Trim(key, "'")
+}
+
+// Whether a transaction failed on a deadlock or lock wait timeout, in which case running it again may succeed.
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+}
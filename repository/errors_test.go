@@ -0,0 +1,236 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"user.service.altiore.io/types"
+)
+
+func TestWrapSQLError(t *testing.T) {
+	duplicate := wrapSQLError(fakeDuplicateEntry("user.email"))
+	if !errors.Is(duplicate, types.ErrDuplicate) || errors.Is(duplicate, types.ErrGenericSQL) {
+		t.Errorf("a duplicate entry wrapped to %v", duplicate)
+	}
+	if !strings.Contains(duplicate.Error(), "key user.email") {
+		t.Errorf("the error doesn't name the key: %v", duplicate)
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(duplicate, &mysqlErr) {
+		t.Error("the MySQL error was lost in wrapping")
+	}
+
+	for _, err := range []error{&mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}, errors.New("connection reset")} {
+		if wrapped := wrapSQLError(err); !errors.Is(wrapped, types.ErrGenericSQL) || errors.Is(wrapped, types.ErrDuplicate) {
+			t.Errorf("%v wrapped to %v", err, wrapped)
+		}
+	}
+	if key := duplicateKeyName("Duplicate entry 'x'"); key != "unknown" {
+		t.Errorf("a message without a key named key %s", key)
+	}
+}
+
+// Answers the lookups of the write paths as if none of the rows existed yet, except for lookups containing a key of
+// found, which are answered with its value. Fails the write containing fragment on a duplicate key.
+func duplicateOn(fragment string, key string, found map[string]driver.Value) func(statement *fakeStatement) (*fakeResult, error) {
+	existing := &types.Role{Id: "existing", Name: "Existing", GroupId: "group"}
+	return func(statement *fakeStatement) (*fakeResult, error) {
+		switch {
+		case isWrite(statement.Query) && statement.has(fragment):
+			return nil, fakeDuplicateEntry(key)
+		case isWrite(statement.Query):
+			return fakeAffected(1), nil
+		}
+		for lookup, value := range found {
+			if statement.has(lookup) {
+				return fakeValue(value), nil
+			}
+		}
+		switch {
+		case statement.has("SELECT EXISTS"):
+			return fakeValue(false), nil
+		case statement.has("SELECT COUNT(*)"):
+			return fakeValue(int64(0)), nil
+		case statement.has("SELECT id FROM service WHERE name = ?"):
+			return fakeValue("service"), nil
+		case statement.is("SELECT " + roleColumns("") + " FROM role WHERE organisationId = ? ORDER BY name, id"):
+			return fakeRows(strings.Split(roleColumns(""), ", "), roleRow(existing)), nil
+		}
+		// e.g. the slugs taken, the user locked or the group of an unknown role, none of which exist
+		return fakeRows([]string{"value"}), nil
+	}
+}
+
+// Every write path maps a duplicate key to types.ErrDuplicate, or to the error it documents for it.
+func TestDuplicateEntriesAreErrDuplicate(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment string // of the statement failing on the duplicate key
+		key      string
+		found    map[string]driver.Value
+		call     func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error
+		expected error // nil if the duplicate is expected to be absorbed
+	}{
+		{
+			name: "CreateUserWithTx", fragment: "INSERT INTO user", key: "user.PRIMARY", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.CreateUserWithTx(tx, "user", "user@example.com", "password", types.DEFAULT_LOCALE)
+			},
+		},
+		{
+			name: "UpdateGroupSlugWithTx", fragment: "UPDATE organisation SET slug", key: "organisation.slug", expected: types.ErrSlugTaken,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.UpdateGroupSlugWithTx(tx, "group", "taken")
+			},
+		},
+		{
+			name: "CreateServiceWithTx", fragment: "INSERT INTO service", key: "service.name_implementationGroup", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.CreateServiceWithTx(tx, &types.Service{Name: "service"})
+			},
+		},
+		{
+			name: "UpdateServiceWithTx", fragment: "UPDATE service", key: "service.name_implementationGroup", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.UpdateServiceWithTx(tx, &types.Service{Id: "service", Name: "service"})
+			},
+		},
+		{
+			name: "RegisterUsedServiceWithTx", fragment: "INSERT INTO used_service", key: "used_service.PRIMARY", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.RegisterUsedServiceWithTx(tx, "service", nil, "group", "user", "")
+			},
+		},
+		{
+			// the idempotency key is the only other unique column, so the use was registered already
+			name: "RegisterUsedServiceWithTx with an idempotency key", fragment: "INSERT INTO used_service", key: "used_service.idempotencyKey",
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.RegisterUsedServiceWithTx(tx, "service", nil, "group", "user", "key")
+			},
+		},
+		{
+			name: "CreateInvitationWithTx", fragment: "INSERT INTO invitation", key: "invitation.organisationId_email", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, _, err := core.CreateInvitationWithTx(tx, "", "invitee@example.com", "group", "user")
+				return err
+			},
+		},
+		{
+			name: "AddUserToOrganisationWithTx", fragment: "INSERT INTO organisation_user", key: "organisation_user.userId_organisationId", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.AddUserToOrganisationWithTx(tx, "user", "group")
+			},
+		},
+		{
+			// every attempt at a slug collides, the random suffix included
+			name: "CreateOrganisationWithTx", fragment: "INSERT INTO organisation (", key: "organisation.slug", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, err := core.CreateOrganisationWithTx(tx, "Group", "user")
+				return err
+			},
+		},
+		{
+			name: "CreateOrganisationWithTx membership", fragment: "INSERT INTO organisation_user", key: "organisation_user.userId_organisationId", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, err := core.CreateOrganisationWithTx(tx, "Group", "user")
+				return err
+			},
+		},
+		{
+			name: "UpdateNotificationPreferences", fragment: "INSERT INTO notification_preferences", key: "notification_preferences.PRIMARY", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.UpdateNotificationPreferences(context.Background(), "user", &types.NotificationPreferences{})
+			},
+		},
+		{
+			name: "CreateSession", fragment: "INSERT INTO session", key: "session.PRIMARY", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, err := core.CreateSession(context.Background(), "user")
+				return err
+			},
+		},
+		{
+			name: "SetServiceQuota", fragment: "INSERT INTO service_quota", key: "service_quota.PRIMARY", expected: types.ErrDuplicate,
+			found: map[string]driver.Value{"SELECT COUNT(*) FROM service WHERE name = ?": int64(1)},
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return core.SetServiceQuota(context.Background(), "group", "service", 10)
+			},
+		},
+		{
+			name: "AddMemberRole", fragment: "INSERT INTO user_role", key: "user_role.userId_roleId", expected: types.ErrDuplicate,
+			found: map[string]driver.Value{"FROM role WHERE id = ? AND organisationId = ?": true, "FROM organisation_user WHERE": true},
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return role.AddMemberRole(tx, "group", "user", "role")
+			},
+		},
+		{
+			name: "CreateGroupOwnerRole", fragment: "INSERT INTO role", key: "role.organisationId_name", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return role.CreateGroupOwnerRole(tx, "group", "user")
+			},
+		},
+		{
+			name: "CreateGroupOwnerRole assignment", fragment: "INSERT INTO user_role", key: "user_role.userId_roleId", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				return role.CreateGroupOwnerRole(tx, "group", "user")
+			},
+		},
+		{
+			name: "UpdateRoles insert", fragment: "INSERT INTO role", key: "role.organisationId_name", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, err := role.UpdateRolesWithTx(tx, []*types.Role{
+					{Id: "existing", Name: "Existing", GroupId: "group"}, {Id: "new", Name: "New", GroupId: "group"},
+				}, "group")
+				return err
+			},
+		},
+		{
+			name: "UpdateRoles update", fragment: "UPDATE role", key: "role.organisationId_name", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, err := role.UpdateRolesWithTx(tx, []*types.Role{{Id: "existing", Name: "Renamed", GroupId: "group"}}, "group")
+				return err
+			},
+		},
+		{
+			name: "CreateRolesWithTx", fragment: "INSERT INTO role", key: "role.organisationId_name", expected: types.ErrDuplicate,
+			call: func(core *CoreRepositoryImpl, role *RoleRepositoryImpl, tx *sql.Tx) error {
+				_, _, err := role.CreateRolesWithTx(tx, "group", []*types.RoleConfig{{Name: "New"}})
+				return err
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, db := newFakeDatabase(t, duplicateOn(test.fragment, test.key, test.found))
+			role := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+			core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, role: role, txAttempts: 1}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			err = test.call(core, role, tx)
+			if test.expected == nil {
+				if err != nil {
+					t.Fatalf("the duplicate wasn't absorbed: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("got %v, want %v (ran %v)", err, test.expected, fake.executed())
+			}
+			if errors.Is(err, types.ErrGenericSQL) {
+				t.Errorf("a duplicate is reported as a generic SQL error: %v", err)
+			}
+			if test.expected == types.ErrDuplicate && !strings.Contains(err.Error(), test.key) {
+				t.Errorf("the error doesn't name the key %s: %v", test.key, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// An in-memory stand-in for MySQL. Every statement is answered by the handler the test provides, which keeps its
+// tables in plain Go values and recognises statements by their text. Statements run in a read-only transaction
+// that would write are refused like MySQL refuses them. Like the MySQL driver with interpolateParams, statements run
+// without being prepared first, unless the repository prepares them itself. A locking read (FOR UPDATE) in a
+// transaction holds its row until the transaction ends, later ones for the same row wait for it.
+type fakeDatabase struct {
+	mu      sync.Mutex
+	handler func(statement *fakeStatement) (*fakeResult, error)
+	// Optional, called before each statement, COMMIT and ROLLBACK included, without holding the database,
+	// e.g. to hold it back for a while.
+	before func(statement *fakeStatement)
+	// Optional, called as a transaction commits or rolls back, e.g. to apply or drop its writes.
+	ended func(tx *fakeTx, committed bool)
+
+	locks    map[string]*fakeTx // by statement and arguments
+	released *sync.Cond
+
+	statements []string
+	prepares   int
+	commits    int
+	rollbacks  int
+}
+
+// A statement as received by the handler, with its arguments as the driver got them.
+type fakeStatement struct {
+	Query string
+	Args  []driver.Value
+	Tx    *fakeTx // nil outside a transaction
+}
+
+// Rows returned by a query, or the rows affected by an update.
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// Whether the statement is the query, ignoring differences in whitespace.
+func (statement *fakeStatement) is(query string) bool {
+	return strings.Join(strings.Fields(statement.Query), " ") == strings.Join(strings.Fields(query), " ")
+}
+
+func (statement *fakeStatement) has(fragment string) bool {
+	return strings.Contains(statement.Query, fragment)
+}
+
+func (statement *fakeStatement) arg(i int) string {
+	value, _ := statement.Args[i].(string)
+	return value
+}
+
+// Rows answering a query, each row holding a value per column.
+func fakeRows(columns []string, rows ...[]driver.Value) *fakeResult {
+	return &fakeResult{columns: columns, rows: rows}
+}
+
+// A single value answering e.g. a COUNT or EXISTS query.
+func fakeValue(value driver.Value) *fakeResult {
+	return fakeRows([]string{"value"}, []driver.Value{value})
+}
+
+func fakeAffected(rows int64) *fakeResult {
+	return &fakeResult{affected: rows}
+}
+
+// A duplicate key violation, as returned by MySQL.
+func fakeDuplicateEntry(key string) error {
+	return &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry 'x' for key '" + key + "'"}
+}
+
+// Opens a pool over a fake database answering statements with the handler.
+func newFakeDatabase(t testing.TB, handler func(statement *fakeStatement) (*fakeResult, error)) (*fakeDatabase, *sql.DB) {
+	t.Helper()
+	fake := &fakeDatabase{handler: handler, locks: make(map[string]*fakeTx)}
+	fake.released = sync.NewCond(&fake.mu)
+	db := sql.OpenDB(&fakeConnector{db: fake})
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+// Statements run so far, in order.
+func (fake *fakeDatabase) executed() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string(nil), fake.statements...)
+}
+
+// Number of statements prepared so far, each a round trip of its own against MySQL.
+func (fake *fakeDatabase) prepared() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.prepares
+}
+
+// Whether any statement run so far contains the fragment.
+func (fake *fakeDatabase) ran(fragment string) bool {
+	for _, statement := range fake.executed() {
+		if strings.Contains(statement, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fake *fakeDatabase) run(query string, args []driver.Value, tx *fakeTx) (*fakeResult, error) {
+	statement := &fakeStatement{Query: query, Args: args, Tx: tx}
+	if fake.before != nil {
+		fake.before(statement)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.statements = append(fake.statements, query)
+	if tx != nil && tx.readOnly && isWrite(query) {
+		return nil, &mysql.MySQLError{Number: 1792, Message: "Cannot execute statement in a READ ONLY transaction."}
+	}
+	if tx != nil && strings.Contains(query, "FOR UPDATE") {
+		row := fmt.Sprint(query, args)
+		for fake.locks[row] != nil && fake.locks[row] != tx {
+			fake.released.Wait()
+		}
+		fake.locks[row] = tx
+	}
+	result, err := fake.handler(statement)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &fakeResult{}
+	}
+	return result, nil
+}
+
+func isWrite(query string) bool {
+	verb, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	switch strings.ToUpper(verb) {
+	case "INSERT", "UPDATE", "DELETE", "REPLACE":
+		return true
+	}
+	return false
+}
+
+type fakeConnector struct {
+	db *fakeDatabase
+}
+
+func (connector *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{db: connector.db}, nil
+}
+
+func (connector *fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeConn struct {
+	db *fakeDatabase
+	tx *fakeTx
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	conn.db.mu.Lock()
+	conn.db.prepares++
+	conn.db.mu.Unlock()
+	return &fakeStmt{conn: conn, query: query}, nil
+}
+
+func (conn *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return (&fakeStmt{conn: conn, query: query}).Exec(fakeValues(args))
+}
+
+func (conn *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return (&fakeStmt{conn: conn, query: query}).Query(fakeValues(args))
+}
+
+func fakeValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	return conn.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (conn *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	conn.tx = &fakeTx{conn: conn, readOnly: opts.ReadOnly}
+	return conn.tx, nil
+}
+
+type fakeTx struct {
+	conn     *fakeConn
+	readOnly bool
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.end(true)
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.end(false)
+	return nil
+}
+
+// Releases the rows the transaction locked.
+func (tx *fakeTx) end(committed bool) {
+	fake := tx.conn.db
+	if fake.before != nil {
+		fake.before(&fakeStatement{Query: map[bool]string{true: "COMMIT", false: "ROLLBACK"}[committed], Tx: tx})
+	}
+	fake.mu.Lock()
+	if committed {
+		fake.commits++
+	} else {
+		fake.rollbacks++
+	}
+	if fake.ended != nil {
+		fake.ended(tx, committed)
+	}
+	for row, owner := range fake.locks {
+		if owner == tx {
+			delete(fake.locks, row)
+		}
+	}
+	fake.released.Broadcast()
+	fake.mu.Unlock()
+	tx.conn.tx = nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (stmt *fakeStmt) Close() error {
+	return nil
+}
+
+func (stmt *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := stmt.conn.db.run(stmt.query, args, stmt.conn.tx)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (stmt *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, err := stmt.conn.db.run(stmt.query, args, stmt.conn.tx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRowsCursor{result: result}, nil
+}
+
+type fakeRowsCursor struct {
+	result *fakeResult
+	next   int
+}
+
+func (rows *fakeRowsCursor) Columns() []string {
+	return rows.result.columns
+}
+
+func (rows *fakeRowsCursor) Close() error {
+	return nil
+}
+
+func (rows *fakeRowsCursor) Next(dest []driver.Value) error {
+	if rows.next >= len(rows.result.rows) {
+		return io.EOF
+	}
+	copy(dest, rows.result.rows[rows.next])
+	rows.next++
+	return nil
+}
@@ -0,0 +1,26 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Generates the token emailed in an invitation link, 32 random bytes, with the hash that is stored in its place.
+func newInvitationToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("error generating invitation token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, invitationTokenHash(token), nil
+}
+
+// Invitations are looked up by the hash of their token, so a leaked table doesn't leak usable links, and the
+// time a lookup takes says nothing about how close a guessed token came to a real one.
+func invitationTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
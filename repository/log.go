@@ -3,88 +3,102 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/cloudsqlconn"
-	"github.com/go-sql-driver/mysql"
+	"user.service.altiore.io/singleton"
 	"user.service.altiore.io/types"
 )
 
 type LogRepository interface {
 	NewEntry(entry *types.LogEntry)
 	ReadByGroupId(ctx context.Context, groupId string) (any, error)
+	CountByGroupId(ctx context.Context, groupId string) (int64, error)
+	// Counts the group's entries written in [from, to) per action and status, most frequent first.
+	Summarize(ctx context.Context, groupId string, from time.Time, to time.Time) ([]*types.LogSummary, error)
+	// Entries of every group written in [from, to), oldest first, without alerts and the platform log.
+	ReadEntriesBetween(ctx context.Context, from time.Time, to time.Time) ([]*types.LogEntry, error)
+	// The group's alert entries, newest first, those written before since left out if it isn't zero.
+	ReadAlerts(ctx context.Context, groupId string, since time.Time) ([]*types.LogEntry, error)
+	// Claims the stretch of the log from where the named scan got to until the given time.
+	// Returns where the stretch starts, and false if another instance claimed it first.
+	ClaimScan(ctx context.Context, name string, until time.Time) (time.Time, bool, error)
+	// Delivers the group's entries as they're written, until the returned function is called.
+	// The channel is closed early if the subscriber falls behind.
+	// Returns types.ErrTooManyStreams if the group has LOG_STREAMS_PER_GROUP subscribers already.
+	Subscribe(groupId string) (<-chan *types.LogEntry, func(), error)
+	// Deletes entries older than their group's retention period, returning how many were deleted.
+	// Returns types.ErrSweepRunning if a sweep is already running.
+	SweepExpired(ctx context.Context) (int64, error)
 }
 
 type LogRepositoryImpl struct {
 	client    *sql.DB
+	reads     *readRouter
 	entryChan chan *types.LogEntry
+	broadcast *logBroadcast
+
+	// default retention, groups may override it with organisation.logRetentionMonths
+	retentionMonths int
+	sweepMu         sync.Mutex
 }
 
+const (
+	// Our DPA allows keeping action logs for at most 24 months.
+	defaultLogRetentionMonths = 24
+	logRetentionInterval      = time.Hour * 24
+	// Rows deleted per statement, so a sweep doesn't hold locks on the log for long.
+	logRetentionBatchSize = 1000
+	// Live views of a group's log open at once, unless LOG_STREAMS_PER_GROUP says otherwise.
+	defaultLogStreamsPerGroup = 10
+)
+
 type LogRepositoryOpts struct {
 	Key string
 }
 
-var (
-	log_repository_instance_map = make(map[string]*LogRepositoryImpl)
-	log_mu                      sync.Mutex
-)
+var logRepositories = singleton.NewRegistry[*LogRepositoryImpl]("log repository", 1)
 
-func NewLogRepository(opts *LogRepositoryOpts) *LogRepositoryImpl {
-	log_mu.Lock()
-	defer log_mu.Unlock()
-	if instance, exists := log_repository_instance_map[opts.Key]; exists {
-		return instance
-	}
-	var (
-		uri                = ""
-		user               = os.Getenv("DB_BUSINESS_USER")
-		pass               = os.Getenv("DB_BUSINESS_PASS")
-		host               = os.Getenv("DB_BUSINESS_HOST")
-		port               = os.Getenv("DB_BUSINESS_PORT")
-		instance_conn_name = os.Getenv("DB_BUSINESS_INSTANCE_CONN_NAME")
-	)
-	switch os.Getenv("ENV") {
-
-	case "LOCAL":
-		log.Println("loading connection info for local mysql server")
-		uri = fmt.Sprintf("%s:%s@tcp(%s:%s)/core?parseTime=true", user, pass, host, port)
-
-	default:
-		log.Println("loading connection info for google cloud mysql server...")
-		d, err := cloudsqlconn.NewDialer(context.Background())
+func NewLogRepository(opts *LogRepositoryOpts) (*LogRepositoryImpl, error) {
+	return logRepositories.Get(opts.Key, func() (*LogRepositoryImpl, error) {
+		db, err := openDatabase()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		mysql.RegisterDialContext("cloudsqlconn", func(ctx context.Context, addr string) (net.Conn, error) {
-			return d.Dial(ctx, instance_conn_name, []cloudsqlconn.DialOption{}...)
-		})
-		uri = fmt.Sprintf("%s:%s@cloudsqlconn(localhost:%s)/core?parseTime=true", user, pass, port)
-	}
-	db, err := sql.Open("mysql", uri)
-	if err != nil {
-		panic(err)
-	}
-	if err := db.Ping(); err != nil {
-		panic(err)
-	}
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
 
-	log_repository_instance_map[opts.Key] = &LogRepositoryImpl{
-		client:    db,
-		entryChan: make(chan *types.LogEntry), // set a buffer on this when going to prod, reduces the log load (but not too high, in case of errors and lost entries)
-	}
-	for i := 0; i < 5; i++ {
-		go log_repository_instance_map[opts.Key].write_worker()
-	}
-	log.Println("initialized log repository")
-	return log_repository_instance_map[opts.Key]
+		retentionMonths := defaultLogRetentionMonths
+		if value := os.Getenv("LOG_RETENTION_MONTHS"); value != "" {
+			months, err := strconv.Atoi(value)
+			if err != nil || months < 1 {
+				log.Fatalf("LOG_RETENTION_MONTHS must be a positive number, got %q", value)
+			}
+			retentionMonths = months
+		}
+		streamsPerGroup := defaultLogStreamsPerGroup
+		if streams, err := strconv.Atoi(os.Getenv("LOG_STREAMS_PER_GROUP")); err == nil && streams > 0 {
+			streamsPerGroup = streams
+		}
+
+		repository := &LogRepositoryImpl{
+			client:          db,
+			reads:           newReadRouter(db),
+			entryChan:       make(chan *types.LogEntry), // set a buffer on this when going to prod, reduces the log load (but not too high, in case of errors and lost entries)
+			broadcast:       newLogBroadcast(streamsPerGroup),
+			retentionMonths: retentionMonths,
+		}
+		for i := 0; i < 5; i++ {
+			go repository.write_worker()
+		}
+		go repository.retention_worker()
+		log.Println("initialized log repository")
+		return repository, nil
+	})
 }
 
 // Sends a new log entry to the queue, which is then stored in a database.
@@ -95,24 +109,31 @@ func (repository *LogRepositoryImpl) NewEntry(entry *types.LogEntry) {
 // Worker responsible for handling entries pushed to the queue.
 func (repository *LogRepositoryImpl) write_worker() {
 	defer log.Println("log write worker stopped!")
-	stmt, err := repository.client.Prepare("INSERT INTO log VALUES (?, ?, ?, ?, ?, ?)")
+	stmt, err := repository.client.Prepare("INSERT INTO log VALUES (?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		log.Printf("write worker error: %+v\n", err)
 	}
 	defer stmt.Close()
 	for entry := range repository.entryChan {
-		if _, err := stmt.Exec(entry.GroupId, entry.Action, entry.Status, entry.UserId, entry.Email, entry.Timestamp); err != nil {
+		detail := sql.NullString{String: string(entry.Detail), Valid: len(entry.Detail) > 0}
+		if _, err := stmt.Exec(entry.GroupId, entry.Action, entry.Status, entry.UserId, entry.Email, entry.Timestamp, detail); err != nil {
 			log.Printf("error writing log entry: %+v\n", err)
+			continue
 		}
+		repository.broadcast.publish(entry)
 	}
 }
 
+func (repository *LogRepositoryImpl) Subscribe(groupId string) (<-chan *types.LogEntry, func(), error) {
+	return repository.broadcast.subscribe(groupId)
+}
+
 // Get logs by group id.
 func (repository *LogRepositoryImpl) ReadByGroupId(ctx context.Context, groupId string) (any, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	stmt, err := repository.client.PrepareContext(ctx, "SELECT action, status, email, timestamp FROM log WHERE organisationId = ?")
+	stmt, err := repository.reads.reader("ReadByGroupId").PrepareContext(ctx, "SELECT action, status, email, timestamp, detail FROM log WHERE organisationId = ?")
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
@@ -120,15 +141,203 @@ func (repository *LogRepositoryImpl) ReadByGroupId(ctx context.Context, groupId
 	var log []*types.LogEntry
 	rows, err := stmt.QueryContext(ctx, groupId)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var entry types.LogEntry
-		if err := rows.Scan(&entry.Action, &entry.Status, &entry.Email, &entry.Timestamp); err != nil {
+		var (
+			entry  types.LogEntry
+			detail sql.NullString
+		)
+		if err := rows.Scan(&entry.Action, &entry.Status, &entry.Email, &entry.Timestamp, &detail); err != nil {
 			return nil, err
 		}
+		if detail.Valid {
+			entry.Detail = json.RawMessage(detail.String)
+		}
 		log = append(log, &entry)
 	}
 	return log, nil
 }
+
+// Number of entries in the group's log, without reading them.
+func (repository *LogRepositoryImpl) CountByGroupId(ctx context.Context, groupId string) (int64, error) {
+	var count int64
+	if err := repository.reads.reader("CountByGroupId").QueryRowContext(ctx, "SELECT COUNT(*) FROM log WHERE organisationId = ?", groupId).Scan(&count); err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return count, nil
+}
+
+func (repository *LogRepositoryImpl) Summarize(ctx context.Context, groupId string, from time.Time, to time.Time) ([]*types.LogSummary, error) {
+	// formatted the way entries are written, so they compare as strings
+	rows, err := repository.reads.reader("Summarize").QueryContext(ctx, "SELECT action, status, COUNT(*) AS count FROM log "+
+		"WHERE organisationId = ? AND timestamp >= ? AND timestamp < ? GROUP BY action, status ORDER BY count DESC, action, status",
+		groupId, from.Local().Format(time.RFC3339), to.Local().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	summary := make([]*types.LogSummary, 0)
+	for rows.Next() {
+		var entry types.LogSummary
+		if err := rows.Scan(&entry.Action, &entry.Status, &entry.Count); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		summary = append(summary, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return summary, nil
+}
+
+func (repository *LogRepositoryImpl) ReadEntriesBetween(ctx context.Context, from time.Time, to time.Time) ([]*types.LogEntry, error) {
+	return repository.readEntries(ctx, "ReadEntriesBetween", "SELECT organisationId, action, status, userId, email, timestamp, detail FROM log "+
+		"WHERE timestamp >= ? AND timestamp < ? AND status <> ? AND organisationId <> ? ORDER BY timestamp",
+		from.Local().Format(time.RFC3339), to.Local().Format(time.RFC3339), types.LOG_STATUS_ALERT, types.PLATFORM_LOG_ID)
+}
+
+func (repository *LogRepositoryImpl) ReadAlerts(ctx context.Context, groupId string, since time.Time) ([]*types.LogEntry, error) {
+	return repository.readEntries(ctx, "ReadAlerts", "SELECT organisationId, action, status, userId, email, timestamp, detail FROM log "+
+		"WHERE organisationId = ? AND status = ? AND timestamp >= ? ORDER BY timestamp DESC",
+		groupId, types.LOG_STATUS_ALERT, since.Local().Format(time.RFC3339))
+}
+
+// Reads entries with the given query, which selects every column but the detail as JSON.
+func (repository *LogRepositoryImpl) readEntries(ctx context.Context, name string, query string, args ...any) ([]*types.LogEntry, error) {
+	rows, err := repository.reads.reader(name).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	entries := make([]*types.LogEntry, 0)
+	for rows.Next() {
+		var (
+			entry  types.LogEntry
+			detail sql.NullString
+		)
+		if err := rows.Scan(&entry.GroupId, &entry.Action, &entry.Status, &entry.UserId, &entry.Email, &entry.Timestamp, &detail); err != nil {
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		if detail.Valid {
+			entry.Detail = json.RawMessage(detail.String)
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return entries, nil
+}
+
+func (repository *LogRepositoryImpl) ClaimScan(ctx context.Context, name string, until time.Time) (time.Time, bool, error) {
+	// whole seconds, so the value read back compares equal to the one written
+	until = until.UTC().Truncate(time.Second)
+	var from time.Time
+	err := repository.client.QueryRowContext(ctx, "SELECT scannedUntil FROM log_scan WHERE name = ?", name).Scan(&from)
+	if errors.Is(err, sql.ErrNoRows) {
+		// a scan that never ran starts now rather than at the beginning of the log
+		if _, err := repository.client.ExecContext(ctx, "INSERT IGNORE INTO log_scan (name, scannedUntil) VALUES (?, ?)", name, until); err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		return until, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !from.Before(until) {
+		return from, false, nil
+	}
+	result, err := repository.client.ExecContext(ctx, "UPDATE log_scan SET scannedUntil = ? WHERE name = ? AND scannedUntil = ?", until, name, from)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return from, count == 1, nil
+}
+
+// Worker sweeping expired entries once a day.
+func (repository *LogRepositoryImpl) retention_worker() {
+	ticker := time.NewTicker(logRetentionInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if _, err := repository.SweepExpired(context.Background()); err != nil {
+			log.Printf("error sweeping expired log entries: %+v\n", err)
+		}
+	}
+}
+
+func (repository *LogRepositoryImpl) SweepExpired(ctx context.Context) (int64, error) {
+	if !repository.sweepMu.TryLock() {
+		return 0, types.ErrSweepRunning
+	}
+	defer repository.sweepMu.Unlock()
+
+	// groups with a retention period of their own
+	overrides := make(map[string]int)
+	rows, err := repository.client.QueryContext(ctx, "SELECT id, logRetentionMonths FROM organisation WHERE logRetentionMonths IS NOT NULL")
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			groupId string
+			months  int
+		)
+		if err := rows.Scan(&groupId, &months); err != nil {
+			return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		overrides[groupId] = months
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	var removed int64
+	for groupId, months := range overrides {
+		count, err := repository.deleteInBatches(ctx, "DELETE FROM log WHERE organisationId = ? AND timestamp < ? LIMIT ?", groupId, retentionCutoff(months))
+		removed += count
+		if err != nil {
+			return removed, err
+		}
+	}
+	count, err := repository.deleteInBatches(ctx, "DELETE FROM log WHERE timestamp < ? "+
+		"AND organisationId NOT IN (SELECT id FROM organisation WHERE logRetentionMonths IS NOT NULL) LIMIT ?", retentionCutoff(repository.retentionMonths))
+	removed += count
+	if err != nil {
+		return removed, err
+	}
+	log.Printf("log retention sweep removed %d entries\n", removed)
+	return removed, nil
+}
+
+// Entries from before this are expired, formatted the way entries are written.
+func retentionCutoff(months int) string {
+	return time.Now().AddDate(0, -months, 0).Format(time.RFC3339)
+}
+
+// Runs the delete statement until it deletes less than a batch, the batch size being its last argument.
+func (repository *LogRepositoryImpl) deleteInBatches(ctx context.Context, query string, args ...any) (int64, error) {
+	args = append(args, logRetentionBatchSize)
+	var removed int64
+	for {
+		result, err := repository.client.ExecContext(ctx, query, args...)
+		if err != nil {
+			return removed, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return removed, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		removed += count
+		if count < logRetentionBatchSize {
+			return removed, nil
+		}
+	}
+}
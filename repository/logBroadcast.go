@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"log"
+	"sync"
+
+	"user.service.altiore.io/types"
+)
+
+// Entries buffered per subscriber, one that falls further behind is dropped rather than holding up writes.
+const logSubscriberBuffer = 64
+
+// Fans written log entries out to the subscribers of their group, e.g. live audit views.
+// Publishing never blocks, with or without subscribers.
+type logBroadcast struct {
+	maxPerGroup int
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan *types.LogEntry]struct{}
+}
+
+func newLogBroadcast(maxPerGroup int) *logBroadcast {
+	return &logBroadcast{
+		maxPerGroup: maxPerGroup,
+		subscribers: make(map[string]map[chan *types.LogEntry]struct{}),
+	}
+}
+
+// Subscribes to the group's new entries until the returned function is called.
+// The channel is closed when unsubscribing, or early if the subscriber falls behind.
+// Returns types.ErrTooManyStreams if the group has maxPerGroup subscribers already.
+func (b *logBroadcast) subscribe(groupId string) (<-chan *types.LogEntry, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group := b.subscribers[groupId]
+	if len(group) >= b.maxPerGroup {
+		return nil, nil, types.ErrTooManyStreams
+	}
+	if group == nil {
+		group = make(map[chan *types.LogEntry]struct{})
+		b.subscribers[groupId] = group
+	}
+	entries := make(chan *types.LogEntry, logSubscriberBuffer)
+	group[entries] = struct{}{}
+	return entries, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(groupId, entries)
+	}, nil
+}
+
+// Must be called with mu held, does nothing if the subscriber is gone already.
+func (b *logBroadcast) remove(groupId string, entries chan *types.LogEntry) {
+	group := b.subscribers[groupId]
+	if _, exists := group[entries]; !exists {
+		return
+	}
+	delete(group, entries)
+	close(entries)
+	if len(group) == 0 {
+		delete(b.subscribers, groupId)
+	}
+}
+
+func (b *logBroadcast) publish(entry *types.LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for entries := range b.subscribers[entry.GroupId] {
+		select {
+		case entries <- entry:
+		default:
+			// closing tells the subscriber it missed entries, it can reconnect and read the log again
+			log.Printf("log stream of group %s fell behind, closing it\n", entry.GroupId)
+			b.remove(entry.GroupId, entries)
+		}
+	}
+}
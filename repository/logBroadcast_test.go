@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"user.service.altiore.io/types"
+)
+
+// Entries reach the subscribers of their own group only, and a group's streams are capped until one unsubscribes.
+func TestLogBroadcastDeliversToTheGroup(t *testing.T) {
+	broadcast := newLogBroadcast(2)
+	first, unsubscribe, err := broadcast.subscribe("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := broadcast.subscribe("group"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := broadcast.subscribe("group"); !errors.Is(err, types.ErrTooManyStreams) {
+		t.Fatalf("a third stream got %v, want ErrTooManyStreams", err)
+	}
+	other, _, err := broadcast.subscribe("other-group")
+	if err != nil {
+		t.Fatalf("another group's stream was refused: %v", err)
+	}
+
+	broadcast.publish(&types.LogEntry{GroupId: "group", Action: types.INVITE_MEMBER})
+	if entry := <-first; entry.Action != types.INVITE_MEMBER {
+		t.Errorf("got %+v, want the published entry", entry)
+	}
+	select {
+	case entry := <-other:
+		t.Errorf("another group's stream got %+v", entry)
+	default:
+	}
+
+	unsubscribe()
+	if _, open := <-first; open {
+		t.Error("the stream wasn't closed when unsubscribing")
+	}
+	unsubscribe()
+	if _, _, err := broadcast.subscribe("group"); err != nil {
+		t.Errorf("the freed stream wasn't given out again: %v", err)
+	}
+}
+
+// A subscriber that falls behind has its stream closed, rather than holding up the writers.
+func TestLogBroadcastDropsSubscribersFallingBehind(t *testing.T) {
+	broadcast := newLogBroadcast(1)
+	entries, _, err := broadcast.subscribe("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= logSubscriberBuffer; i++ {
+		broadcast.publish(&types.LogEntry{GroupId: "group"})
+	}
+	received := 0
+	for range entries {
+		received++
+	}
+	if received != logSubscriberBuffer {
+		t.Errorf("received %d entries before the stream closed, want %d", received, logSubscriberBuffer)
+	}
+	if _, _, err := broadcast.subscribe("group"); err != nil {
+		t.Errorf("the dropped subscriber still counts against the group: %v", err)
+	}
+}
@@ -1,37 +1,37 @@
 package repository
 
 import (
-	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"net"
-	"os"
-	"sync"
-	"time"
+	"strings"
 
-	"cloud.google.com/go/cloudsqlconn"
-	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"user.service.altiore.io/singleton"
 	"user.service.altiore.io/types"
 )
 
 type RoleRepository interface {
 	ReadRoles(groupId string) ([]*types.Role, error)
 
-	UpdateRoles(roles []*types.Role, groupId string) error
-	UpdateRolesWithTx(tx *sql.Tx, roles []*types.Role, groupId string) error
+	UpdateRoles(roles []*types.Role, groupId string) (*types.RoleUpdateSummary, error)
+	UpdateRolesWithTx(tx *sql.Tx, roles []*types.Role, groupId string) (*types.RoleUpdateSummary, error)
 
 	CreateGroupOwnerRole(tx *sql.Tx, groupId string, userId string) error
+	CreateRolesWithTx(tx *sql.Tx, groupId string, roles []*types.RoleConfig) ([]string, []string, error)
+	ReassignGroupOwnerWithTx(tx *sql.Tx, groupId string, userId string) ([]string, error)
 
 	GetMembersWithRoles(groupId string) ([]*types.MemberRole, error)
 	GetMembersWithRolesWithTx(tx *sql.Tx, groupId string) ([]*types.MemberRole, error)
 
-	DeleteRole(roleId string) error
-	DeleteRoleWithTx(tx *sql.Tx, roleId string) error
+	DeleteRole(groupId string, roleId string) error
+	DeleteRoleWithTx(tx *sql.Tx, groupId string, roleId string) error
 
-	AddMemberRole(tx *sql.Tx, userId string, roleId string) error
-	RemoveMemberRole(tx *sql.Tx, userId string, roleId string) error
+	AddMemberRole(tx *sql.Tx, groupId string, userId string, roleId string) error
+	RemoveMemberRole(tx *sql.Tx, groupId string, userId string, roleId string) error
+
+	HasPermission(tx *sql.Tx, userId string, groupId string, permission string) error
 
 	ReadMemberRoles(userId string, groupId string) ([]*types.Role, error)
 	ReadMemberRolesWithTx(tx *sql.Tx, userId string, groupId string) ([]*types.Role, error)
@@ -41,66 +41,90 @@ type RoleRepositoryOpts struct {
 	Key string
 }
 
-var (
-	role_repository_instance_map = make(map[string]*RoleRepositoryImpl)
-	role_mu                      sync.Mutex
-)
+var roleRepositories = singleton.NewRegistry[*RoleRepositoryImpl]("role repository", 1)
 
 type RoleRepositoryImpl struct {
 	client *sql.DB
+	reads  *readRouter
 }
 
-func NewRoleRepository(opts *RoleRepositoryOpts) *RoleRepositoryImpl {
-	role_mu.Lock()
-	defer role_mu.Unlock()
-	if instance, exists := role_repository_instance_map[opts.Key]; exists {
-		return instance
-	}
-	var (
-		uri                = ""
-		user               = os.Getenv("DB_BUSINESS_USER")
-		pass               = os.Getenv("DB_BUSINESS_PASS")
-		host               = os.Getenv("DB_BUSINESS_HOST")
-		port               = os.Getenv("DB_BUSINESS_PORT")
-		instance_conn_name = os.Getenv("DB_BUSINESS_INSTANCE_CONN_NAME")
-	)
-	switch os.Getenv("ENV") {
-
-	case "LOCAL":
-		log.Println("loading connection info for local mysql server")
-		uri = fmt.Sprintf("%s:%s@tcp(%s:%s)/core?parseTime=true", user, pass, host, port)
-
-	default:
-		log.Println("loading connection info for google cloud mysql server...")
-		d, err := cloudsqlconn.NewDialer(context.Background())
+func NewRoleRepository(opts *RoleRepositoryOpts) (*RoleRepositoryImpl, error) {
+	return roleRepositories.Get(opts.Key, func() (*RoleRepositoryImpl, error) {
+		db, err := openDatabase()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		mysql.RegisterDialContext("cloudsqlconn", func(ctx context.Context, addr string) (net.Conn, error) {
-			return d.Dial(ctx, instance_conn_name, []cloudsqlconn.DialOption{}...)
-		})
-		uri = fmt.Sprintf("%s:%s@cloudsqlconn(localhost:%s)/core?parseTime=true", user, pass, port)
+		log.Println("initialized role repository")
+		return &RoleRepositoryImpl{
+			client: db,
+			reads:  newReadRouter(db),
+		}, nil
+	})
+}
+
+// Permission columns of the role table, in the order of types.PermissionCatalogue.
+// Every query touching role permissions is built from this list, so reads and writes can't drift apart.
+var rolePermissionColumns = func() []string {
+	columns := make([]string, len(types.PermissionCatalogue))
+	for i, permission := range types.PermissionCatalogue {
+		columns[i] = permission.Column
 	}
-	db, err := sql.Open("mysql", uri)
-	if err != nil {
-		panic(err)
+	return columns
+}()
+
+// Column list for selecting a full role, optionally prefixed with a table alias.
+func roleColumns(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
 	}
-	if err := db.Ping(); err != nil {
-		panic(err)
+	columns := []string{prefix + "id", prefix + "name", prefix + "organisationId"}
+	for _, column := range rolePermissionColumns {
+		columns = append(columns, prefix+column)
 	}
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+	return strings.Join(columns, ", ")
+}
 
-	role_repository_instance_map[opts.Key] = &RoleRepositoryImpl{
-		client: db,
+// Pointers to the permission fields, in column order, for scanning.
+func permissionFields(p *types.Permissions) []any {
+	fields := make([]any, len(types.PermissionCatalogue))
+	for i, permission := range types.PermissionCatalogue {
+		fields[i] = permission.Field(p)
 	}
-	log.Println("initialized role repository")
-	return role_repository_instance_map[opts.Key]
+	return fields
+}
+
+// Values of the permission fields, in column order, for inserts and updates.
+func permissionValues(p *types.Permissions) []any {
+	fields := permissionFields(p)
+	values := make([]any, len(fields))
+	for i, field := range fields {
+		values[i] = *field.(*bool)
+	}
+	return values
+}
+
+// Scans a row selected with roleColumns into a role.
+func scanRole(row interface{ Scan(dest ...any) error }, role *types.Role) error {
+	return row.Scan(append([]any{&role.Id, &role.Name, &role.GroupId}, permissionFields(&role.Permissions)...)...)
+}
+
+// Placeholders for inserting a full role.
+func roleInsertPlaceholders() string {
+	return strings.TrimSuffix(strings.Repeat("?, ", len(rolePermissionColumns)+3), ", ")
+}
+
+// Assignments for updating a role's name and permissions.
+func roleUpdateAssignments() string {
+	assignments := []string{"name = ?"}
+	for _, column := range rolePermissionColumns {
+		assignments = append(assignments, column+" = ?")
+	}
+	return strings.Join(assignments, ", ")
 }
 
 func (repository *RoleRepositoryImpl) ReadMemberRoles(userId string, groupId string) ([]*types.Role, error) {
-	return repository.readMemberRoles(repository.client, userId, groupId)
+	return repository.readMemberRoles(repository.reads.reader("ReadMemberRoles"), userId, groupId)
 }
 
 func (repository *RoleRepositoryImpl) ReadMemberRolesWithTx(tx *sql.Tx, userId string, groupId string) ([]*types.Role, error) {
@@ -109,13 +133,11 @@ func (repository *RoleRepositoryImpl) ReadMemberRolesWithTx(tx *sql.Tx, userId s
 
 // Reads a user's roles within a group.
 func (repository *RoleRepositoryImpl) readMemberRoles(exe types.Execer, userId string, groupId string) ([]*types.Role, error) {
-	rows, err := exe.Query("SELECT r.id, r.name, r.organisationId, "+
-		"r.rename_organisation, r.delete_organisation, r.invite_member, r.remove_member, "+
-		"r.create_case, r.update_case_metadata, r.delete_case, r.export_case, "+
-		"r.view_logs, r.export_logs "+
+	rows, err := exe.Query("SELECT "+roleColumns("r")+" "+
 		"FROM user_role ur "+
 		"INNER JOIN role r ON ur.roleId = r.id "+
-		"INNER JOIN organisation_user ou ON ur.userId = ou.userId "+
+		"INNER JOIN organisation_user ou ON ur.userId = ou.userId AND r.organisationId = ou.organisationId "+
+		"INNER JOIN organisation o ON ou.organisationId = o.id AND o.deletedAt IS NULL "+
 		"WHERE ur.userId = ? AND ou.organisationId = ?", userId, groupId)
 	if err != nil {
 		return nil, err
@@ -124,11 +146,7 @@ func (repository *RoleRepositoryImpl) readMemberRoles(exe types.Execer, userId s
 	var roles []*types.Role
 	for rows.Next() {
 		var role types.Role
-		if err := rows.Scan(
-			&role.Id, &role.Name, &role.GroupId,
-			&role.RenameGroup, &role.DeleteGroup, &role.InviteMember, &role.RemoveMember,
-			&role.CreateCase, &role.UpdateCaseMetadata, &role.DeleteCase, &role.ExportCase,
-			&role.ViewLogs, &role.ExportLogs); err != nil {
+		if err := scanRole(rows, &role); err != nil {
 			return nil, err
 		}
 		roles = append(roles, &role)
@@ -136,65 +154,115 @@ func (repository *RoleRepositoryImpl) readMemberRoles(exe types.Execer, userId s
 	return roles, nil
 }
 
-// Checks if the user has permission to an action.
-func (repository *RoleRepositoryImpl) HasPermission(tx *sql.Tx, userId string, groupId string) error {
-
+// Checks if the user has a permission within the group, through any of their roles in it.
+// Returns nil when allowed and types.ErrForbiddenOperation when denied.
+func (repository *RoleRepositoryImpl) HasPermission(tx *sql.Tx, userId string, groupId string, permission string) error {
+	var c types.Execer = repository.client
+	if tx != nil {
+		c = txExecer(tx)
+	}
+	info, exists := types.LookupPermission(permission)
+	if !exists {
+		return fmt.Errorf("%w: %s", types.ErrUnknownPermission, permission)
+	}
+	var allowed bool
+	err := c.QueryRow("SELECT EXISTS(SELECT 1 FROM user_role ur "+
+		"INNER JOIN role r ON ur.roleId = r.id "+
+		"INNER JOIN organisation_user ou ON ur.userId = ou.userId AND r.organisationId = ou.organisationId "+
+		"INNER JOIN organisation o ON ou.organisationId = o.id AND o.deletedAt IS NULL "+
+		"WHERE ur.userId = ? AND ou.organisationId = ? AND r."+info.Column+" = true)", userId, groupId).Scan(&allowed)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !allowed {
+		return fmt.Errorf("%w: missing permission %s", types.ErrForbiddenOperation, permission)
+	}
 	return nil
 }
 
 // Remove a role from the specified user, by deleting the user_role mapping.
-func (repository *RoleRepositoryImpl) RemoveMemberRole(tx *sql.Tx, userId string, roleId string) error {
+// The role must be defined within the group, otherwise ErrNotFound is returned.
+func (repository *RoleRepositoryImpl) RemoveMemberRole(tx *sql.Tx, groupId string, userId string, roleId string) error {
 
-	// check if the role being removed is "Group Owner"
-	checkRoleStmt, err := tx.Prepare("SELECT name FROM role WHERE id = ?")
+	// check the role belongs to the group, and if it is "Group Owner"
+	checkRoleStmt, err := txExecer(tx).Prepare("SELECT name FROM role WHERE id = ? AND organisationId = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer checkRoleStmt.Close()
 	var roleName string
-	if err := checkRoleStmt.QueryRow(roleId).Scan(&roleName); err != nil {
+	if err := checkRoleStmt.QueryRow(roleId, groupId).Scan(&roleName); err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("%w:, role with id %s not found", types.ErrNotFound, roleId)
+			return fmt.Errorf("%w: role with id %s not found in group", types.ErrNotFound, roleId)
 		}
 		return fmt.Errorf("%w: failed to execute query: %v", types.ErrGenericSQL, err)
 	}
 
 	if roleName == "Group Owner" {
 		// check how many users have the "Group Owner" role
-		checkMembersStmt, err := tx.Prepare("SELECT COUNT(*) FROM user_role WHERE roleId = ?")
+		checkMembersStmt, err := txExecer(tx).Prepare("SELECT COUNT(*) FROM user_role WHERE roleId = ?")
 		if err != nil {
 			return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 		}
 		defer checkMembersStmt.Close()
 		var count int
 		if err := checkMembersStmt.QueryRow(roleId).Scan(&count); err != nil {
-			return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+			return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 		}
 		if count <= 1 {
 			return fmt.Errorf("%w: cannot remove the last Group Owner role from the group", types.ErrForbiddenOperation)
 		}
 	}
 
-	stmt, err := tx.Prepare("DELETE FROM user_role WHERE userId = ? AND roleId = ?")
+	stmt, err := txExecer(tx).Prepare("DELETE FROM user_role WHERE userId = ? AND roleId = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
 	if _, err := stmt.Exec(userId, roleId); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return nil
 }
 
 // Add a role to the specified user, by mapping role to user.
-func (repository *RoleRepositoryImpl) AddMemberRole(tx *sql.Tx, userId string, roleId string) error {
-	stmt, err := tx.Prepare("INSERT INTO user_role VALUES (?, ? ,?)")
+// The role must be defined within the group, the user must be a member of it, and the mapping must not already exist.
+func (repository *RoleRepositoryImpl) AddMemberRole(tx *sql.Tx, groupId string, userId string, roleId string) error {
+
+	// check the role belongs to the group
+	var roleExists bool
+	if err := txExecer(tx).QueryRow("SELECT EXISTS(SELECT 1 FROM role WHERE id = ? AND organisationId = ?)", roleId, groupId).Scan(&roleExists); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !roleExists {
+		return fmt.Errorf("%w: role with id %s not found in group", types.ErrNotFound, roleId)
+	}
+
+	// check the user is a member of the group
+	var isMember bool
+	if err := txExecer(tx).QueryRow("SELECT EXISTS(SELECT 1 FROM organisation_user WHERE userId = ? AND organisationId = ?)", userId, groupId).Scan(&isMember); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if !isMember {
+		return fmt.Errorf("%w: user is not a member of the group", types.ErrForbiddenOperation)
+	}
+
+	// check the role isn't already assigned
+	var isAssigned bool
+	if err := txExecer(tx).QueryRow("SELECT EXISTS(SELECT 1 FROM user_role WHERE userId = ? AND roleId = ?)", userId, roleId).Scan(&isAssigned); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if isAssigned {
+		return types.ErrAlreadyAssigned
+	}
+
+	stmt, err := txExecer(tx).Prepare("INSERT INTO user_role VALUES (?, ? ,?)")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
 	if _, err := stmt.Exec(uuid.NewString(), userId, roleId); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return wrapSQLError(err)
 	}
 	return nil
 }
@@ -207,21 +275,25 @@ func (repository *RoleRepositoryImpl) GetMembersWithRoles(groupId string) ([]*ty
 	return repository.getMembersWithRoles(repository.client, groupId)
 }
 
+// Reads all members of a group along with their roles in it, members without roles are included with no roles.
+// Members are ordered by email and their roles by name.
 func (repository *RoleRepositoryImpl) getMembersWithRoles(exe types.Execer, groupId string) ([]*types.MemberRole, error) {
 	query := "SELECT u.id AS user_id, u.email AS user_name, r.id AS role_id, r.name AS role_name " +
 		"FROM user u " +
 		"INNER JOIN organisation_user ou ON u.id = ou.userId " +
-		"INNER JOIN user_role ur ON u.id = ur.userId " +
-		"INNER JOIN role r ON ur.roleId = r.id " +
-		"WHERE ou.organisationId = ?"
+		"LEFT JOIN (user_role ur INNER JOIN role r ON ur.roleId = r.id) ON u.id = ur.userId AND r.organisationId = ou.organisationId " +
+		"WHERE ou.organisationId = ? " +
+		"ORDER BY u.email, u.id, r.name"
 	rows, err := exe.Query(query, groupId)
 	if err != nil {
 		return nil, fmt.Errorf("%w: failed to execute query: %v", types.ErrGenericSQL, err)
 	}
 	defer rows.Close()
+	memberRoles := make([]*types.MemberRole, 0)
 	memberRolesMap := make(map[string]*types.MemberRole)
 	for rows.Next() {
-		var userId, userName, roleId, roleName string
+		var userId, userName string
+		var roleId, roleName sql.NullString
 		if err := rows.Scan(&userId, &userName, &roleId, &roleName); err != nil {
 			return nil, fmt.Errorf("%w: failed to scan row: %v", types.ErrGenericSQL, err)
 		}
@@ -229,41 +301,45 @@ func (repository *RoleRepositoryImpl) getMembersWithRoles(exe types.Execer, grou
 			memberRolesMap[userId] = &types.MemberRole{
 				Id:     userId,
 				Member: userName,
+				Email:  userName,
 				Roles:  []*types.Role{},
 			}
+			memberRoles = append(memberRoles, memberRolesMap[userId])
+		}
+		if roleId.Valid {
+			memberRolesMap[userId].Roles = append(memberRolesMap[userId].Roles, &types.Role{
+				Id:   roleId.String,
+				Name: roleName.String,
+			})
 		}
-		memberRolesMap[userId].Roles = append(memberRolesMap[userId].Roles, &types.Role{
-			Id:   roleId,
-			Name: roleName,
-		})
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("%w: rows iteration error: %v", types.ErrGenericSQL, err)
 	}
-	var memberRoles []*types.MemberRole
-	for _, mr := range memberRolesMap {
-		memberRoles = append(memberRoles, mr)
-	}
 	return memberRoles, nil
 }
 
 func (repository *RoleRepositoryImpl) CreateGroupOwnerRole(tx *sql.Tx, groupId string, userId string) error {
 
 	// create role
-	createRoleStmt, err := tx.Prepare("INSERT INTO role VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	createRoleStmt, err := txExecer(tx).Prepare("INSERT INTO role (" + roleColumns("") + ") VALUES (" + roleInsertPlaceholders() + ")")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer createRoleStmt.Close()
 	roleId := uuid.NewString()
-	_, err = createRoleStmt.Exec(roleId, "Group Owner", groupId, true, true, true, true, true, true, true, true, true, true)
+	owner := make([]any, len(rolePermissionColumns))
+	for i := range owner {
+		owner[i] = true
+	}
+	_, err = createRoleStmt.Exec(append([]any{roleId, "Group Owner", groupId}, owner...)...)
 	if err != nil {
 		log.Printf("error creating group owner role: %+v\n", err)
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return wrapSQLError(err)
 	}
 
 	// map role to user
-	mapRoleStmt, err := tx.Prepare("INSERT INTO user_role VALUES (?, ?, ?)")
+	mapRoleStmt, err := txExecer(tx).Prepare("INSERT INTO user_role VALUES (?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
@@ -271,13 +347,18 @@ func (repository *RoleRepositoryImpl) CreateGroupOwnerRole(tx *sql.Tx, groupId s
 	user_role_id := uuid.NewString()
 	_, err = mapRoleStmt.Exec(user_role_id, userId, roleId)
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+		return wrapSQLError(err)
 	}
 	return nil
 }
 
 func (repository *RoleRepositoryImpl) ReadRoles(groupId string) ([]*types.Role, error) {
-	stmt, err := repository.client.Prepare("SELECT * FROM role WHERE organisationId = ?")
+	return repository.readRoles(repository.reads.reader("ReadRoles"), groupId)
+}
+
+// Reads all roles defined within a group.
+func (repository *RoleRepositoryImpl) readRoles(exe types.Execer, groupId string) ([]*types.Role, error) {
+	stmt, err := exe.Prepare("SELECT " + roleColumns("") + " FROM role WHERE organisationId = ? ORDER BY name, id")
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
@@ -292,7 +373,7 @@ func (repository *RoleRepositoryImpl) ReadRoles(groupId string) ([]*types.Role,
 	var roles []*types.Role
 	for rows.Next() {
 		var role types.Role
-		if err := rows.Scan(&role.Id, &role.Name, &role.GroupId, &role.RenameGroup, &role.DeleteGroup, &role.InviteMember, &role.RemoveMember, &role.CreateCase, &role.UpdateCaseMetadata, &role.DeleteCase, &role.ExportCase, &role.ViewLogs, &role.ExportLogs); err != nil {
+		if err := scanRole(rows, &role); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %v", err)
 		}
 		roles = append(roles, &role)
@@ -305,106 +386,284 @@ func (repository *RoleRepositoryImpl) ReadRoles(groupId string) ([]*types.Role,
 	return roles, nil
 }
 
-func (repository *RoleRepositoryImpl) DeleteRoleWithTx(tx *sql.Tx, roleId string) error {
-	return repository.deleteRole(tx, roleId)
+func (repository *RoleRepositoryImpl) DeleteRoleWithTx(tx *sql.Tx, groupId string, roleId string) error {
+	return repository.deleteRole(txExecer(tx), groupId, roleId)
 }
 
-func (repository *RoleRepositoryImpl) DeleteRole(roleId string) error {
-	return repository.deleteRole(repository.client, roleId)
+func (repository *RoleRepositoryImpl) DeleteRole(groupId string, roleId string) error {
+	return repository.deleteRole(repository.client, groupId, roleId)
 }
 
-func (repository *RoleRepositoryImpl) deleteRole(exe types.Execer, roleId string) error {
+// Deletes one of the group's roles along with its user mappings. Returns ErrNotFound if the role isn't defined
+// within the group, and ErrForbiddenOperation for the "Group Owner" role, which would lock owners out of the group.
+func (repository *RoleRepositoryImpl) deleteRole(exe types.Execer, groupId string, roleId string) error {
+	var roleName string
+	err := exe.QueryRow("SELECT name FROM role WHERE id = ? AND organisationId = ?", roleId, groupId).Scan(&roleName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: role with id %s not found in group", types.ErrNotFound, roleId)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	if roleName == "Group Owner" {
+		return fmt.Errorf("%w: the Group Owner role cannot be deleted", types.ErrForbiddenOperation)
+	}
+
 	// delete all user_role mappings
-	user_role_stmt, err := exe.Prepare("DELETE FROM user_role WHERE roleId = ?")
+	user_role_stmt, err := exe.Prepare("DELETE ur FROM user_role ur " +
+		"INNER JOIN role r ON ur.roleId = r.id " +
+		"WHERE ur.roleId = ? AND r.organisationId = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer user_role_stmt.Close()
-	if _, err := user_role_stmt.Exec(roleId); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+	if _, err := user_role_stmt.Exec(roleId, groupId); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	// delete role
-	stmt, err := exe.Prepare("DELETE FROM role WHERE id = ?")
+	stmt, err := exe.Prepare("DELETE FROM role WHERE id = ? AND organisationId = ?")
 	if err != nil {
 		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(roleId); err != nil {
-		return fmt.Errorf("%w: %v", types.ErrGenericSQL, err)
+	if _, err := stmt.Exec(roleId, groupId); err != nil {
+		return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
 	}
 	return nil
 }
 
-func (repository *RoleRepositoryImpl) UpdateRoles(roles []*types.Role, groupId string) error {
+func (repository *RoleRepositoryImpl) UpdateRoles(roles []*types.Role, groupId string) (*types.RoleUpdateSummary, error) {
 	return repository.updateRoles(repository.client, roles, groupId)
 }
 
-func (repository *RoleRepositoryImpl) UpdateRolesWithTx(tx *sql.Tx, roles []*types.Role, groupId string) error {
+func (repository *RoleRepositoryImpl) UpdateRolesWithTx(tx *sql.Tx, roles []*types.Role, groupId string) (*types.RoleUpdateSummary, error) {
 	return repository.updateRoles(tx, roles, groupId)
 }
 
-func (repository *RoleRepositoryImpl) updateRoles(exe types.Execer, roles []*types.Role, groupId string) error {
+// Replaces the group's roles with the submitted set: new roles are created, existing roles updated,
+// and roles missing from the set are deleted. The "Group Owner" role is never modified or deleted.
+func (repository *RoleRepositoryImpl) updateRoles(exe types.Execer, roles []*types.Role, groupId string) (*types.RoleUpdateSummary, error) {
 
-	// check
-	checkStmt, err := exe.Prepare("SELECT id FROM role WHERE id = ?")
+	// current roles of the group
+	existing, err := repository.readRoles(exe, groupId)
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return nil, err
+	}
+	existingMap := make(map[string]*types.Role)
+	for _, role := range existing {
+		existingMap[role.Id] = role
+	}
+
+	// role names must be unique within the group, including after renames
+	if err := checkDuplicateRoleNames(existing, roles); err != nil {
+		return nil, err
+	}
+
+	// a submitted id unknown to the group must be new, not the id of another group's role
+	if err := checkForeignRoles(exe, existingMap, roles); err != nil {
+		return nil, err
 	}
-	defer checkStmt.Close()
 
 	// update (existing roles)
-	updateStmt, err := exe.Prepare("UPDATE role SET name = ?, rename_organisation = ?, delete_organisation = ?, invite_member = ?, remove_member = ?, create_case = ?, update_case_metadata = ?, delete_case = ?, export_case = ?, view_logs = ?, export_logs = ? WHERE id = ?")
+	updateStmt, err := exe.Prepare("UPDATE role SET " + roleUpdateAssignments() + " WHERE id = ? AND organisationId = ?")
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer updateStmt.Close()
 
 	// insert (new roles)
-	insertStmt, err := exe.Prepare("INSERT INTO role VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	insertStmt, err := exe.Prepare("INSERT INTO role (" + roleColumns("") + ") VALUES (" + roleInsertPlaceholders() + ")")
 	if err != nil {
-		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+		return nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
 	}
 	defer insertStmt.Close()
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(roles))
-	var _err error
+	// roles are handled one at a time, as the statements are shared and the list is small.
+	// failures are collected, so the caller learns about every role that failed.
+	summary := &types.RoleUpdateSummary{}
+	submitted := make(map[string]bool)
+	var errs []error
 	for _, role := range roles {
-		go func(role *types.Role) {
-			defer wg.Done()
+		submitted[role.Id] = true
 
-			// dont do anything to the "Group Owner" role, as this prevents lock-outs of user's own groups.
-			if role.Name == "Group Owner" {
-				return
-			}
+		// dont do anything to the "Group Owner" role, as this prevents lock-outs of user's own groups.
+		if role.Name == "Group Owner" {
+			continue
+		}
+		current, exists := existingMap[role.Id]
+		if exists && current.Name == "Group Owner" {
+			continue
+		}
 
-			// check if exists
-			var id string
-			err := checkStmt.QueryRow(role.Id).Scan(&id)
-			if err != nil && err != sql.ErrNoRows {
-				log.Printf("error reading role: %+v\n", err)
-				_err = err
-				return
+		if !exists {
+			// if not exists, insert
+			_, err = insertStmt.Exec(append([]any{role.Id, role.Name, groupId}, permissionValues(&role.Permissions)...)...)
+			if err != nil {
+				log.Printf("error creating role: %+v\n", err)
+				errs = append(errs, fmt.Errorf("role %s (%s): %w", role.Id, role.Name, wrapSQLError(err)))
+				continue
 			}
-			if err == sql.ErrNoRows {
-				// if not exists, insert
-				_, err = insertStmt.Exec(role.Id, role.Name, groupId, role.RenameGroup, role.DeleteGroup, role.InviteMember, role.RemoveMember, role.CreateCase, role.UpdateCaseMetadata, role.DeleteCase, role.ExportCase, role.ViewLogs, role.ExportLogs)
-				if err != nil {
-					log.Printf("error creating role: %+v\n", err)
-					_err = err
-					return
-				}
-			} else {
-				// if exists, update
-				_, err = updateStmt.Exec(role.Name, role.RenameGroup, role.DeleteGroup, role.InviteMember, role.RemoveMember, role.CreateCase, role.UpdateCaseMetadata, role.DeleteCase, role.ExportCase, role.ViewLogs, role.ExportLogs, role.Id)
-				if err != nil {
-					log.Printf("error updating role: %+v\n", err)
-					_err = err
-					return
-				}
+			summary.Created++
+		} else {
+			// if exists, update
+			args := append([]any{role.Name}, permissionValues(&role.Permissions)...)
+			_, err = updateStmt.Exec(append(args, role.Id, groupId)...)
+			if err != nil {
+				log.Printf("error updating role: %+v\n", err)
+				errs = append(errs, fmt.Errorf("role %s (%s): %w", role.Id, role.Name, wrapSQLError(err)))
+				continue
 			}
-		}(role)
+			summary.Updated++
+		}
+	}
+
+	// delete roles omitted from the submitted set, along with their user mappings
+	for _, role := range existing {
+		if submitted[role.Id] || role.Name == "Group Owner" {
+			continue
+		}
+		if err := repository.deleteRole(exe, groupId, role.Id); err != nil {
+			log.Printf("error deleting role: %+v\n", err)
+			errs = append(errs, fmt.Errorf("role %s (%s): %w", role.Id, role.Name, err))
+			continue
+		}
+		summary.Deleted++
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// Returns ErrNotFound naming the submitted roles that aren't the group's, but exist within another group.
+func checkForeignRoles(exe types.Execer, existing map[string]*types.Role, roles []*types.Role) error {
+	stmt, err := exe.Prepare("SELECT organisationId FROM role WHERE id = ?")
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+	}
+	defer stmt.Close()
+	foreign := make([]string, 0)
+	for _, role := range roles {
+		if _, exists := existing[role.Id]; exists {
+			continue
+		}
+		var groupId string
+		err := stmt.QueryRow(role.Id).Scan(&groupId)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		foreign = append(foreign, role.Id)
+	}
+	if len(foreign) > 0 {
+		return fmt.Errorf("%w: roles %s not found in group", types.ErrNotFound, strings.Join(foreign, ", "))
+	}
+	return nil
+}
+
+// Ensures no two roles in the group end up sharing a name (case-insensitive), once the submitted roles are applied.
+func checkDuplicateRoleNames(existing []*types.Role, roles []*types.Role) error {
+
+	// role id -> name, as it will be after the update
+	names := make(map[string]string)
+	for _, role := range existing {
+		if role.Name == "Group Owner" {
+			names[role.Id] = role.Name
+		}
+	}
+	for _, role := range roles {
+		if role.Name == "Group Owner" {
+			continue
+		}
+		if _, protected := names[role.Id]; protected {
+			continue
+		}
+		names[role.Id] = role.Name
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if seen[key] {
+			return fmt.Errorf("%w: %s", types.ErrDuplicateRoleName, name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// Makes the member the group's only "Group Owner", returning who held the role before.
+// Returns ErrNotFound if the group has no owner role, and ErrForbiddenOperation if the user isn't a member.
+func (repository *RoleRepositoryImpl) ReassignGroupOwnerWithTx(tx *sql.Tx, groupId string, userId string) ([]string, error) {
+	var roleId string
+	err := txExecer(tx).QueryRow("SELECT id FROM role WHERE organisationId = ? AND name = 'Group Owner' FOR UPDATE", groupId).Scan(&roleId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no Group Owner role in group %s", types.ErrNotFound, groupId)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	rows, err := txExecer(tx).Query("SELECT userId FROM user_role WHERE roleId = ? AND userId <> ?", roleId, userId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	previous := make([]string, 0)
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+		}
+		previous = append(previous, owner)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+
+	if err := repository.AddMemberRole(tx, groupId, userId, roleId); err != nil && !errors.Is(err, types.ErrAlreadyAssigned) {
+		return nil, err
+	}
+	if _, err := txExecer(tx).Exec("DELETE FROM user_role WHERE roleId = ? AND userId <> ?", roleId, userId); err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrGenericSQL, err)
+	}
+	return previous, nil
+}
+
+// Creates the roles in the group, skipping those whose name the group already has, ignoring case, like a repeated
+// name within roles. Returns the names of the created and the skipped roles.
+func (repository *RoleRepositoryImpl) CreateRolesWithTx(tx *sql.Tx, groupId string, roles []*types.RoleConfig) ([]string, []string, error) {
+	existing, err := repository.readRoles(txExecer(tx), groupId)
+	if err != nil {
+		return nil, nil, err
+	}
+	taken := make(map[string]bool)
+	for _, role := range existing {
+		taken[strings.ToLower(strings.TrimSpace(role.Name))] = true
+	}
+
+	insertStmt, err := txExecer(tx).Prepare("INSERT INTO role (" + roleColumns("") + ") VALUES (" + roleInsertPlaceholders() + ")")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", types.ErrPrepareStatement, err)
+	}
+	defer insertStmt.Close()
+
+	created, skipped := make([]string, 0), make([]string, 0)
+	for _, role := range roles {
+		key := strings.ToLower(strings.TrimSpace(role.Name))
+		if taken[key] {
+			skipped = append(skipped, role.Name)
+			continue
+		}
+		taken[key] = true
+		if _, err := insertStmt.Exec(append([]any{uuid.NewString(), role.Name, groupId}, permissionValues(&role.Permissions)...)...); err != nil {
+			return nil, nil, fmt.Errorf("role %s: %w", role.Name, wrapSQLError(err))
+		}
+		created = append(created, role.Name)
 	}
-	wg.Wait()
-	return _err
+	return created, skipped, nil
 }
@@ -0,0 +1,533 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"user.service.altiore.io/types"
+)
+
+// The role and user_role tables, answering the statements of the role repository.
+type fakeRoleTables struct {
+	roles     map[string]*types.Role
+	userRoles map[string][]string // role id -> user ids
+	members   map[string][]string // group id -> user ids, of organisation_user
+	emails    map[string]string   // user id -> email, of the user table
+}
+
+func newFakeRoleTables(roles ...*types.Role) *fakeRoleTables {
+	tables := &fakeRoleTables{roles: make(map[string]*types.Role), userRoles: make(map[string][]string),
+		members: make(map[string][]string), emails: make(map[string]string)}
+	for _, role := range roles {
+		tables.roles[role.Id] = role
+	}
+	return tables
+}
+
+func (tables *fakeRoleTables) assign(roleId string, userIds ...string) {
+	tables.userRoles[roleId] = append(tables.userRoles[roleId], userIds...)
+}
+
+func (tables *fakeRoleTables) join(groupId string, userId string, email string) {
+	tables.members[groupId] = append(tables.members[groupId], userId)
+	tables.emails[userId] = email
+}
+
+// Role as stored, nil if there is none in the group.
+func (tables *fakeRoleTables) role(id string, groupId string) *types.Role {
+	role, exists := tables.roles[id]
+	if !exists || role.GroupId != groupId {
+		return nil
+	}
+	return role
+}
+
+func roleRow(role *types.Role) []driver.Value {
+	row := []driver.Value{role.Id, role.Name, role.GroupId}
+	for _, value := range permissionValues(&role.Permissions) {
+		row = append(row, value)
+	}
+	return row
+}
+
+// Sets a role's name and permissions from statement arguments, starting at the name.
+func setRole(role *types.Role, args []driver.Value) {
+	role.Name = args[0].(string)
+	for i, field := range permissionFields(&role.Permissions) {
+		*field.(*bool) = args[i+1].(bool)
+	}
+}
+
+// The role names must be unique within a group, like the role table's unique key.
+func (tables *fakeRoleTables) nameTaken(groupId string, name string, except string) bool {
+	for _, role := range tables.roles {
+		if role.GroupId == groupId && role.Id != except && strings.EqualFold(role.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tables *fakeRoleTables) handle(statement *fakeStatement) (*fakeResult, error) {
+	switch {
+	case statement.is("SELECT " + roleColumns("") + " FROM role WHERE organisationId = ? ORDER BY name, id"):
+		var roles []*types.Role
+		for _, role := range tables.roles {
+			if role.GroupId == statement.arg(0) {
+				roles = append(roles, role)
+			}
+		}
+		sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+		result := fakeRows(strings.Split(roleColumns(""), ", "))
+		for _, role := range roles {
+			result.rows = append(result.rows, roleRow(role))
+		}
+		return result, nil
+
+	case statement.has("FROM user_role ur INNER JOIN role r") && statement.has("WHERE ur.userId = ? AND ou.organisationId = ?"):
+		result := fakeRows(strings.Split(roleColumns("r"), ", "))
+		for roleId, userIds := range tables.userRoles {
+			role := tables.role(roleId, statement.arg(1))
+			if role != nil && contains(userIds, statement.arg(0)) {
+				result.rows = append(result.rows, roleRow(role))
+			}
+		}
+		return result, nil
+
+	case statement.has("LEFT JOIN (user_role ur INNER JOIN role r ON ur.roleId = r.id)"):
+		// a row per role of each member in the group, and a row of NULL role columns for a member without any
+		userIds := append([]string(nil), tables.members[statement.arg(0)]...)
+		sort.Slice(userIds, func(i, j int) bool { return tables.emails[userIds[i]] < tables.emails[userIds[j]] })
+		result := fakeRows([]string{"user_id", "user_name", "role_id", "role_name"})
+		for _, userId := range userIds {
+			var roles []*types.Role
+			for roleId, holders := range tables.userRoles {
+				if role := tables.role(roleId, statement.arg(0)); role != nil && contains(holders, userId) {
+					roles = append(roles, role)
+				}
+			}
+			sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+			if len(roles) == 0 {
+				result.rows = append(result.rows, []driver.Value{userId, tables.emails[userId], nil, nil})
+			}
+			for _, role := range roles {
+				result.rows = append(result.rows, []driver.Value{userId, tables.emails[userId], role.Id, role.Name})
+			}
+		}
+		return result, nil
+
+	case statement.is("SELECT organisationId FROM role WHERE id = ?"):
+		role, exists := tables.roles[statement.arg(0)]
+		if !exists {
+			return fakeRows([]string{"organisationId"}), nil
+		}
+		return fakeValue(role.GroupId), nil
+
+	case statement.is("SELECT name FROM role WHERE id = ? AND organisationId = ?"):
+		role := tables.role(statement.arg(0), statement.arg(1))
+		if role == nil {
+			return fakeRows([]string{"name"}), nil
+		}
+		return fakeValue(role.Name), nil
+
+	case statement.is("SELECT COUNT(*) FROM user_role WHERE roleId = ?"):
+		return fakeValue(int64(len(tables.userRoles[statement.arg(0)]))), nil
+
+	case statement.is("INSERT INTO role (" + roleColumns("") + ") VALUES (" + roleInsertPlaceholders() + ")"):
+		id, groupId := statement.arg(0), statement.arg(2)
+		if _, exists := tables.roles[id]; exists {
+			return nil, fakeDuplicateEntry("role.PRIMARY")
+		}
+		role := &types.Role{Id: id, GroupId: groupId}
+		setRole(role, append([]driver.Value{statement.Args[1]}, statement.Args[3:]...))
+		if tables.nameTaken(groupId, role.Name, id) {
+			return nil, fakeDuplicateEntry("role.organisationId_name")
+		}
+		tables.roles[id] = role
+		return fakeAffected(1), nil
+
+	case statement.is("UPDATE role SET " + roleUpdateAssignments() + " WHERE id = ? AND organisationId = ?"):
+		n := len(statement.Args)
+		role := tables.role(statement.arg(n-2), statement.arg(n-1))
+		if role == nil {
+			return fakeAffected(0), nil
+		}
+		if tables.nameTaken(role.GroupId, statement.arg(0), role.Id) {
+			return nil, fakeDuplicateEntry("role.organisationId_name")
+		}
+		setRole(role, statement.Args[:n-2])
+		return fakeAffected(1), nil
+
+	case statement.is("DELETE ur FROM user_role ur INNER JOIN role r ON ur.roleId = r.id WHERE ur.roleId = ? AND r.organisationId = ?"):
+		if tables.role(statement.arg(0), statement.arg(1)) == nil {
+			return fakeAffected(0), nil
+		}
+		affected := int64(len(tables.userRoles[statement.arg(0)]))
+		delete(tables.userRoles, statement.arg(0))
+		return fakeAffected(affected), nil
+
+	case statement.is("DELETE FROM role WHERE id = ? AND organisationId = ?"):
+		if tables.role(statement.arg(0), statement.arg(1)) == nil {
+			return fakeAffected(0), nil
+		}
+		delete(tables.roles, statement.arg(0))
+		return fakeAffected(1), nil
+
+	case statement.is("DELETE FROM user_role WHERE userId = ? AND roleId = ?"):
+		userIds := tables.userRoles[statement.arg(1)]
+		for i, userId := range userIds {
+			if userId == statement.arg(0) {
+				tables.userRoles[statement.arg(1)] = append(userIds[:i], userIds[i+1:]...)
+				return fakeAffected(1), nil
+			}
+		}
+		return fakeAffected(0), nil
+	}
+	return nil, fmt.Errorf("unexpected statement: %s", statement.Query)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// A role repository and a core repository, for transactions, over the fake tables.
+func newFakeRoleRepository(t testing.TB, tables *fakeRoleTables) (*fakeDatabase, *RoleRepositoryImpl, *CoreRepositoryImpl) {
+	fake, db := newFakeDatabase(t, tables.handle)
+	role := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+	core := &CoreRepositoryImpl{client: db, reads: &readRouter{primary: db}, role: role, txAttempts: 1}
+	return fake, role, core
+}
+
+func TestDeleteRoleOfAnotherGroup(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "owner-b", Name: "Group Owner", GroupId: "group-b"},
+		&types.Role{Id: "editor-b", Name: "Editor", GroupId: "group-b"},
+	)
+	tables.assign("owner-b", "victim")
+	tables.assign("editor-b", "victim")
+	fake, roles, _ := newFakeRoleRepository(t, tables)
+
+	for _, roleId := range []string{"owner-b", "editor-b"} {
+		if err := roles.DeleteRole("group-a", roleId); !errors.Is(err, types.ErrNotFound) {
+			t.Errorf("deleting %s through another group: got %v, want ErrNotFound", roleId, err)
+		}
+	}
+	if fake.ran("DELETE") {
+		t.Errorf("a role of another group was deleted: %v", fake.executed())
+	}
+	if len(tables.roles) != 2 || len(tables.userRoles["owner-b"]) != 1 || len(tables.userRoles["editor-b"]) != 1 {
+		t.Errorf("the other group's roles changed: %+v %+v", tables.roles, tables.userRoles)
+	}
+}
+
+func TestDeleteRoleRefusesGroupOwner(t *testing.T) {
+	tables := newFakeRoleTables(&types.Role{Id: "owner", Name: "Group Owner", GroupId: "group"})
+	tables.assign("owner", "user")
+	fake, roles, _ := newFakeRoleRepository(t, tables)
+
+	if err := roles.DeleteRole("group", "owner"); !errors.Is(err, types.ErrForbiddenOperation) {
+		t.Errorf("deleting the Group Owner role: got %v, want ErrForbiddenOperation", err)
+	}
+	if fake.ran("DELETE") {
+		t.Errorf("the Group Owner role was deleted: %v", fake.executed())
+	}
+}
+
+func TestDeleteRoleOfTheGroup(t *testing.T) {
+	tables := newFakeRoleTables(&types.Role{Id: "editor", Name: "Editor", GroupId: "group"})
+	tables.assign("editor", "a", "b")
+	_, roles, _ := newFakeRoleRepository(t, tables)
+
+	if err := roles.DeleteRole("group", "editor"); err != nil {
+		t.Fatalf("deleting a role of the group: %v", err)
+	}
+	if len(tables.roles) != 0 || len(tables.userRoles["editor"]) != 0 {
+		t.Errorf("the role or its mappings survived: %+v %+v", tables.roles, tables.userRoles)
+	}
+}
+
+func TestRemoveMemberRoleOfAnotherGroup(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "owner-b", Name: "Group Owner", GroupId: "group-b"},
+		&types.Role{Id: "editor-b", Name: "Editor", GroupId: "group-b"},
+	)
+	tables.assign("owner-b", "victim", "other")
+	tables.assign("editor-b", "victim")
+	fake, _, core := newFakeRoleRepository(t, tables)
+
+	for _, roleId := range []string{"owner-b", "editor-b"} {
+		err := core.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+			return core.role.RemoveMemberRole(tx, "group-a", "victim", roleId)
+		})
+		if !errors.Is(err, types.ErrNotFound) {
+			t.Errorf("removing %s through another group: got %v, want ErrNotFound", roleId, err)
+		}
+	}
+	if fake.ran("DELETE") {
+		t.Errorf("a role of another group was removed: %v", fake.executed())
+	}
+}
+
+// Run with -race: the roles of a request share the update and insert statements, and requests for several
+// groups run at once.
+func TestUpdateTwentyRoles(t *testing.T) {
+	tables := newFakeRoleTables()
+	groups := []string{"group-a", "group-b", "group-c"}
+	for _, groupId := range groups {
+		tables.roles["owner-"+groupId] = &types.Role{Id: "owner-" + groupId, Name: "Group Owner", GroupId: groupId}
+		for i := 0; i < 10; i++ {
+			id := fmt.Sprintf("%s-existing-%d", groupId, i)
+			tables.roles[id] = &types.Role{Id: id, Name: fmt.Sprintf("Existing %d", i), GroupId: groupId}
+		}
+	}
+	_, roles, _ := newFakeRoleRepository(t, tables)
+
+	var wg sync.WaitGroup
+	summaries := make([]*types.RoleUpdateSummary, len(groups))
+	errs := make([]error, len(groups))
+	for g, groupId := range groups {
+		submitted := []*types.Role{{Id: "owner-" + groupId, Name: "Group Owner", GroupId: groupId}}
+		for i := 0; i < 20; i++ {
+			id := fmt.Sprintf("%s-existing-%d", groupId, i)
+			if i >= 10 {
+				id = fmt.Sprintf("%s-new-%d", groupId, i)
+			}
+			role := &types.Role{Id: id, Name: fmt.Sprintf("Role %d", i), GroupId: groupId}
+			role.ViewLogs = i%2 == 0
+			submitted = append(submitted, role)
+		}
+		wg.Add(1)
+		go func(g int, groupId string) {
+			defer wg.Done()
+			summaries[g], errs[g] = roles.UpdateRoles(submitted, groupId)
+		}(g, groupId)
+	}
+	wg.Wait()
+
+	for g, groupId := range groups {
+		if errs[g] != nil {
+			t.Fatalf("updating the roles of %s: %v", groupId, errs[g])
+		}
+		if want := (types.RoleUpdateSummary{Created: 10, Updated: 10}); *summaries[g] != want {
+			t.Errorf("updating the roles of %s: got %+v, want %+v", groupId, *summaries[g], want)
+		}
+		stored, err := roles.ReadRoles(groupId)
+		if err != nil {
+			t.Fatalf("reading the roles of %s: %v", groupId, err)
+		}
+		if len(stored) != 21 {
+			t.Errorf("%s has %d roles, want 21", groupId, len(stored))
+		}
+		for _, role := range stored {
+			var i int
+			if _, err := fmt.Sscanf(role.Name, "Role %d", &i); err == nil && role.ViewLogs != (i%2 == 0) {
+				t.Errorf("%s of %s has ViewLogs=%v", role.Name, groupId, role.ViewLogs)
+			}
+		}
+	}
+}
+
+func TestUpdateRolesReportsEveryFailedRole(t *testing.T) {
+	tables := newFakeRoleTables()
+	_, db := newFakeDatabase(t, func(statement *fakeStatement) (*fakeResult, error) {
+		if statement.has("INSERT INTO role") && strings.HasPrefix(statement.arg(1), "Broken") {
+			return nil, errors.New("connection reset")
+		}
+		return tables.handle(statement)
+	})
+	roles := &RoleRepositoryImpl{client: db, reads: &readRouter{primary: db}}
+
+	_, err := roles.UpdateRoles([]*types.Role{
+		{Id: "one", Name: "Broken one", GroupId: "group"},
+		{Id: "two", Name: "Fine", GroupId: "group"},
+		{Id: "three", Name: "Broken three", GroupId: "group"},
+	}, "group")
+	if err == nil {
+		t.Fatal("updating roles with failing inserts succeeded")
+	}
+	for _, id := range []string{"one", "three"} {
+		if !strings.Contains(err.Error(), "role "+id+" ") {
+			t.Errorf("the error doesn't name role %s: %v", id, err)
+		}
+	}
+	if strings.Contains(err.Error(), "role two ") {
+		t.Errorf("the error names a role that was created: %v", err)
+	}
+}
+
+func TestRolesRoundTrip(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "owner", Name: "Group Owner", GroupId: "group"},
+		&types.Role{Id: "editor", Name: "Editor", GroupId: "group"},
+		&types.Role{Id: "auditor", Name: "Auditor", GroupId: "group"},
+	)
+	*types.PermissionCatalogue[0].Field(&tables.roles["owner"].Permissions) = true
+	_, roles, _ := newFakeRoleRepository(t, tables)
+
+	read, err := roles.ReadRoles("group")
+	if err != nil {
+		t.Fatalf("reading roles: %v", err)
+	}
+	var submitted []*types.Role
+	for _, role := range read {
+		switch role.Name {
+		case "Editor":
+			role.Name = "Writer"
+			for _, permission := range types.PermissionCatalogue {
+				*permission.Field(&role.Permissions) = true
+			}
+		case "Auditor":
+			continue
+		}
+		submitted = append(submitted, role)
+	}
+	created := &types.Role{Id: "viewer", Name: "Viewer", GroupId: "group"}
+	created.ViewLogs = true
+	submitted = append(submitted, created)
+
+	summary, err := roles.UpdateRoles(submitted, "group")
+	if err != nil {
+		t.Fatalf("updating roles: %v", err)
+	}
+	if want := (types.RoleUpdateSummary{Created: 1, Updated: 1, Deleted: 1}); *summary != want {
+		t.Errorf("got summary %+v, want %+v", *summary, want)
+	}
+
+	reread, err := roles.ReadRoles("group")
+	if err != nil {
+		t.Fatalf("reading roles again: %v", err)
+	}
+	byName := make(map[string]*types.Role)
+	for _, role := range reread {
+		byName[role.Name] = role
+	}
+	if len(reread) != 3 || byName["Group Owner"] == nil || byName["Writer"] == nil || byName["Viewer"] == nil {
+		t.Fatalf("got roles %v, want Group Owner, Writer and Viewer", byName)
+	}
+	if byName["Writer"].Id != "editor" {
+		t.Errorf("the renamed role has id %s, want editor", byName["Writer"].Id)
+	}
+	for _, permission := range types.PermissionCatalogue {
+		if !permission.Granted(&byName["Writer"].Permissions) {
+			t.Errorf("the renamed role lost %s", permission.Key)
+		}
+		if granted := permission.Granted(&byName["Viewer"].Permissions); granted != (permission.Key == types.VIEW_LOGS) {
+			t.Errorf("the created role has %s=%v", permission.Key, granted)
+		}
+	}
+	if *byName["Group Owner"] != *tables.roles["owner"] || !types.PermissionCatalogue[0].Granted(&byName["Group Owner"].Permissions) {
+		t.Errorf("the Group Owner role changed: %+v", byName["Group Owner"])
+	}
+}
+
+func TestUpdateRolesWithAnotherGroupsRole(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "editor", Name: "Editor", GroupId: "group"},
+		&types.Role{Id: "foreign", Name: "Foreign", GroupId: "other"},
+	)
+	fake, roles, _ := newFakeRoleRepository(t, tables)
+
+	_, err := roles.UpdateRoles([]*types.Role{
+		{Id: "editor", Name: "Editor", GroupId: "group"},
+		{Id: "foreign", Name: "Stolen", GroupId: "group"},
+	}, "group")
+	if !errors.Is(err, types.ErrNotFound) || errors.Is(err, types.ErrDuplicate) {
+		t.Fatalf("submitting another group's role: got %v, want ErrNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "foreign") {
+		t.Errorf("the error doesn't name the role: %v", err)
+	}
+	if fake.ran("INSERT") || fake.ran("UPDATE") || fake.ran("DELETE") {
+		t.Errorf("roles were written: %v", fake.executed())
+	}
+	if tables.roles["foreign"].Name != "Foreign" || tables.roles["foreign"].GroupId != "other" {
+		t.Errorf("the other group's role changed: %+v", tables.roles["foreign"])
+	}
+}
+
+// Read on every permission check the cache misses, so it must be a single round trip.
+func TestReadMemberRolesRunsASingleStatement(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "editor", Name: "Editor", GroupId: "group"},
+		&types.Role{Id: "viewer", Name: "Viewer", GroupId: "group"},
+		&types.Role{Id: "other", Name: "Editor", GroupId: "other"},
+	)
+	tables.assign("editor", "user")
+	tables.assign("other", "user")
+	fake, roles, _ := newFakeRoleRepository(t, tables)
+
+	memberRoles, err := roles.ReadMemberRoles("user", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberRoles) != 1 || memberRoles[0].Id != "editor" {
+		t.Errorf("got roles %+v, want only editor", memberRoles)
+	}
+	if statements := fake.executed(); len(statements) != 1 || fake.prepared() != 0 {
+		t.Errorf("ran %d statements and prepared %d, want a single unprepared one", len(statements), fake.prepared())
+	}
+}
+
+func BenchmarkReadMemberRoles(b *testing.B) {
+	tables := newFakeRoleTables()
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprint("role-", i)
+		tables.roles[id] = &types.Role{Id: id, Name: id, GroupId: "group"}
+		tables.assign(id, "user")
+	}
+	_, roles, _ := newFakeRoleRepository(b, tables)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := roles.ReadMemberRoles("user", "group"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Members without a role in the group are listed all the same, with no roles rather than null.
+func TestMembersWithoutRolesAreListed(t *testing.T) {
+	tables := newFakeRoleTables(
+		&types.Role{Id: "viewer", Name: "Viewer", GroupId: "group"},
+		&types.Role{Id: "editor", Name: "Editor", GroupId: "group"},
+		&types.Role{Id: "other", Name: "Editor", GroupId: "other"},
+	)
+	tables.join("group", "a", "a@example.com")
+	tables.join("group", "b", "b@example.com")
+	tables.join("group", "c", "c@example.com")
+	tables.assign("viewer", "a")
+	tables.assign("editor", "a")
+	tables.assign("other", "c")
+	_, roles, _ := newFakeRoleRepository(t, tables)
+
+	members, err := roles.GetMembersWithRoles("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("got %d members, want 3", len(members))
+	}
+	if a := members[0]; a.Id != "a" || len(a.Roles) != 2 || a.Roles[0].Name != "Editor" || a.Roles[1].Name != "Viewer" {
+		t.Errorf("got %+v for the member with roles", a)
+	}
+	for _, member := range members[1:] {
+		if member.Roles == nil || len(member.Roles) != 0 {
+			t.Errorf("got roles %v for %s, who has none in the group", member.Roles, member.Id)
+		}
+		if raw, _ := json.Marshal(member); !strings.Contains(string(raw), `"roles":[]`) {
+			t.Errorf("%s is serialised as %s", member.Id, raw)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Queries taking longer than this are logged, DB_SLOW_QUERY_THRESHOLD overrides it.
+const defaultSlowQueryThreshold = time.Millisecond * 250
+
+// A query that took longer than the threshold, logged as JSON.
+type slowQuery struct {
+	Query      string `json:"query"`
+	DurationMs int64  `json:"durationMs"`
+	Rows       int64  `json:"rows"`
+}
+
+func slowQueryThreshold() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("DB_SLOW_QUERY_THRESHOLD")); err == nil && value > 0 {
+		return value
+	}
+	return defaultSlowQueryThreshold
+}
+
+// Wraps the driver's connections to time every statement, whether it's run directly, prepared or within a
+// transaction. A query's duration runs until its rows are closed, so reading the rows is included.
+type timedConnector struct {
+	driver.Connector
+	threshold time.Duration
+}
+
+func (connector *timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn: conn, threshold: connector.threshold}, nil
+}
+
+// Records a statement's duration, the place to feed metrics from. Only slow ones are logged.
+func observeQuery(threshold time.Duration, query string, duration time.Duration, rows int64) {
+	if duration < threshold {
+		return
+	}
+	entry, _ := json.Marshal(&slowQuery{Query: queryName(query), DurationMs: duration.Milliseconds(), Rows: rows})
+	log.Printf("slow query: %s\n", entry)
+}
+
+// The query on one line and cut short, the statements are built from constants so it identifies the query.
+func queryName(query string) string {
+	name := strings.Join(strings.Fields(query), " ")
+	if len(name) > 200 {
+		name = name[:200] + "..."
+	}
+	return name
+}
+
+// The driver's connection supports all of these, the wrapper has to as well or database/sql falls back
+// to slower paths.
+type timedConn struct {
+	conn      driver.Conn
+	threshold time.Duration
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt: stmt, query: query, threshold: c.threshold}, nil
+}
+
+func (c *timedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *timedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		// driver.ErrSkip has database/sql prepare the statement instead, which is timed there
+		return nil, err
+	}
+	return &timedRows{rows: rows, query: query, start: start, threshold: c.threshold}, nil
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	observeResult(c.threshold, query, time.Since(start), result)
+	return result, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	return c.conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *timedConn) IsValid() bool {
+	return c.conn.(driver.Validator).IsValid()
+}
+
+func (c *timedConn) CheckNamedValue(value *driver.NamedValue) error {
+	return c.conn.(driver.NamedValueChecker).CheckNamedValue(value)
+}
+
+func observeResult(threshold time.Duration, query string, duration time.Duration, result driver.Result) {
+	affected, _ := result.RowsAffected()
+	observeQuery(threshold, query, duration, affected)
+}
+
+type timedStmt struct {
+	stmt      driver.Stmt
+	query     string
+	threshold time.Duration
+}
+
+func (s *timedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *timedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *timedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *timedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	observeResult(s.threshold, s.query, time.Since(start), result)
+	return result, nil
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &timedRows{rows: rows, query: s.query, start: start, threshold: s.threshold}, nil
+}
+
+func (s *timedStmt) CheckNamedValue(value *driver.NamedValue) error {
+	return s.stmt.(driver.NamedValueChecker).CheckNamedValue(value)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// Counts the rows read, observing the query once they're closed.
+type timedRows struct {
+	rows      driver.Rows
+	query     string
+	start     time.Time
+	count     int64
+	threshold time.Duration
+}
+
+func (r *timedRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *timedRows) Close() error {
+	err := r.rows.Close()
+	observeQuery(r.threshold, r.query, time.Since(r.start), r.count)
+	return err
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	err := r.rows.Next(dest)
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+// Stored procedures answer with more than one result set.
+func (r *timedRows) HasNextResultSet() bool {
+	rows, ok := r.rows.(driver.RowsNextResultSet)
+	return ok && rows.HasNextResultSet()
+}
+
+func (r *timedRows) NextResultSet() error {
+	rows, ok := r.rows.(driver.RowsNextResultSet)
+	if !ok {
+		return io.EOF
+	}
+	return rows.NextResultSet()
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"user.service.altiore.io/types"
+)
+
+// Context of every transaction begun by the repository, keyed by the *sql.Tx, until it's committed or rolled back.
+// The WithTx methods only receive the transaction, this is how their statements are run with the caller's context
+// regardless.
+var txContexts sync.Map
+
+// Runs the transaction's statements with the context it was started with, so a cancelled request aborts the
+// statement in flight rather than only the ones after it. Statements prepared through it are prepared with the
+// context but executed without, they fail once database/sql has rolled the cancelled transaction back.
+// Transactions the repository didn't begin are returned as they are.
+func txExecer(tx *sql.Tx) types.Execer {
+	ctx, exists := txContexts.Load(tx)
+	if !exists {
+		return tx
+	}
+	return &contextExecer{ctx: ctx.(context.Context), tx: tx}
+}
+
+type contextExecer struct {
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+func (exe *contextExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return exe.tx.ExecContext(exe.ctx, query, args...)
+}
+
+func (exe *contextExecer) Prepare(query string) (*sql.Stmt, error) {
+	return exe.tx.PrepareContext(exe.ctx, query)
+}
+
+func (exe *contextExecer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return exe.tx.QueryContext(exe.ctx, query, args...)
+}
+
+func (exe *contextExecer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return exe.tx.QueryRowContext(exe.ctx, query, args...)
+}
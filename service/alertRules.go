@@ -0,0 +1,233 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// Looks for suspicious activity in a group's log. Rules only see the entries they're given, so they can be
+// evaluated against any stream of entries, not just the stored log.
+type AlertRule interface {
+	// Action of the log entries the rule's alerts are written as.
+	Name() string
+	// How far back entries must reach for Evaluate to see everything that counts towards an alert.
+	Lookback() time.Duration
+	// Returns an alert for every entry that raised one, entries being of a single group and oldest first.
+	Evaluate(entries []*types.LogEntry) []*types.Alert
+}
+
+const (
+	ALERT_REPEATED_FORBIDDEN = "RepeatedForbidden"
+	ALERT_OFF_HOURS_REMOVAL  = "OffHoursRemoval"
+	ALERT_INVITE_BURST       = "InviteBurst"
+)
+
+// Alerts when a user is refused Threshold times within Window, once per burst.
+type RepeatedForbiddenRule struct {
+	Threshold int
+	Window    time.Duration
+}
+
+func (rule *RepeatedForbiddenRule) Name() string            { return ALERT_REPEATED_FORBIDDEN }
+func (rule *RepeatedForbiddenRule) Lookback() time.Duration { return rule.Window }
+
+func (rule *RepeatedForbiddenRule) Evaluate(entries []*types.LogEntry) []*types.Alert {
+	alerts := make([]*types.Alert, 0)
+	refused := make(map[string][]time.Time)
+	for _, entry := range entries {
+		at, ok := entryTime(entry)
+		if !ok || entry.Status != types.LOG_STATUS_FORBIDDEN {
+			continue
+		}
+		times := withinWindow(append(refused[entry.UserId], at), at, rule.Window)
+		refused[entry.UserId] = times
+		// only the refusal reaching the threshold alerts, not every one after it
+		if len(times) == rule.Threshold {
+			alerts = append(alerts, &types.Alert{GroupId: entry.GroupId, Rule: rule.Name(), UserId: entry.UserId, Email: entry.Email,
+				At: at, Count: len(times), Window: rule.Window})
+		}
+	}
+	return alerts
+}
+
+// Alerts on every member removal outside business hours, from Start to End o'clock on weekdays in Location.
+type OffHoursRemovalRule struct {
+	Start    int
+	End      int
+	Location *time.Location
+}
+
+func (rule *OffHoursRemovalRule) Name() string            { return ALERT_OFF_HOURS_REMOVAL }
+func (rule *OffHoursRemovalRule) Lookback() time.Duration { return 0 }
+
+func (rule *OffHoursRemovalRule) Evaluate(entries []*types.LogEntry) []*types.Alert {
+	alerts := make([]*types.Alert, 0)
+	for _, entry := range entries {
+		at, ok := entryTime(entry)
+		if !ok || entry.Action != types.REMOVE_MEMBER || entry.Status != "OK" {
+			continue
+		}
+		local := at.In(rule.Location)
+		weekend := local.Weekday() == time.Saturday || local.Weekday() == time.Sunday
+		if weekend || local.Hour() < rule.Start || local.Hour() >= rule.End {
+			alerts = append(alerts, &types.Alert{GroupId: entry.GroupId, Rule: rule.Name(), UserId: entry.UserId, Email: entry.Email, At: at})
+		}
+	}
+	return alerts
+}
+
+// Alerts when more than Threshold invitations are sent within Window, once per burst. A batch counts
+// every address it invited.
+type InviteBurstRule struct {
+	Threshold int
+	Window    time.Duration
+}
+
+func (rule *InviteBurstRule) Name() string            { return ALERT_INVITE_BURST }
+func (rule *InviteBurstRule) Lookback() time.Duration { return rule.Window }
+
+func (rule *InviteBurstRule) Evaluate(entries []*types.LogEntry) []*types.Alert {
+	alerts := make([]*types.Alert, 0)
+	var invites []time.Time
+	for _, entry := range entries {
+		at, ok := entryTime(entry)
+		if !ok || entry.Action != types.INVITE_MEMBER || entry.Status != "OK" {
+			continue
+		}
+		before := len(withinWindow(invites, at, rule.Window))
+		for i := 0; i < invitedAddresses(entry); i++ {
+			invites = append(invites, at)
+		}
+		invites = withinWindow(invites, at, rule.Window)
+		if before <= rule.Threshold && len(invites) > rule.Threshold {
+			alerts = append(alerts, &types.Alert{GroupId: entry.GroupId, Rule: rule.Name(), At: at, Count: len(invites), Window: rule.Window})
+		}
+	}
+	return alerts
+}
+
+// Number of addresses an invite entry is for, batches list theirs in the detail.
+func invitedAddresses(entry *types.LogEntry) int {
+	var detail struct {
+		Emails []string `json:"emails"`
+	}
+	if len(entry.Detail) > 0 && json.Unmarshal(entry.Detail, &detail) == nil && len(detail.Emails) > 0 {
+		return len(detail.Emails)
+	}
+	return 1
+}
+
+// Drops the times more than window before now, times being oldest first.
+func withinWindow(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	return times[i:]
+}
+
+// When the entry was written, entries with a malformed timestamp are skipped by every rule.
+func entryTime(entry *types.LogEntry) (time.Time, bool) {
+	at, err := time.Parse(time.RFC3339, entry.Timestamp)
+	return at, err == nil
+}
+
+// Runs every rule on the entries of each group, returning the alerts raised by entries written at or after from.
+// Entries before from only count towards those, their own alerts were raised by an earlier evaluation.
+func EvaluateAlertRules(rules []AlertRule, entries []*types.LogEntry, from time.Time) []*types.Alert {
+	byGroup := make(map[string][]*types.LogEntry)
+	for _, entry := range entries {
+		byGroup[entry.GroupId] = append(byGroup[entry.GroupId], entry)
+	}
+	alerts := make([]*types.Alert, 0)
+	for _, groupEntries := range byGroup {
+		sort.SliceStable(groupEntries, func(i, j int) bool {
+			a, _ := entryTime(groupEntries[i])
+			b, _ := entryTime(groupEntries[j])
+			return a.Before(b)
+		})
+		for _, rule := range rules {
+			for _, alert := range rule.Evaluate(groupEntries) {
+				if !alert.At.Before(from) {
+					alerts = append(alerts, alert)
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+// Longest lookback of the rules.
+func AlertLookback(rules []AlertRule) time.Duration {
+	var lookback time.Duration
+	for _, rule := range rules {
+		lookback = max(lookback, rule.Lookback())
+	}
+	return lookback
+}
+
+// The rules with their thresholds from the environment:
+// ALERT_FORBIDDEN_THRESHOLD and ALERT_FORBIDDEN_WINDOW (5 within 10m),
+// ALERT_BUSINESS_HOURS and ALERT_TIMEZONE ("8-18" in UTC),
+// ALERT_INVITE_THRESHOLD and ALERT_INVITE_WINDOW (more than 20 within 1h).
+func NewAlertRules() []AlertRule {
+	location := time.UTC
+	if value := os.Getenv("ALERT_TIMEZONE"); value != "" {
+		var err error
+		if location, err = time.LoadLocation(value); err != nil {
+			log.Fatalf("ALERT_TIMEZONE must be a time zone, got %q", value)
+		}
+	}
+	start, end := 8, 18
+	if value := os.Getenv("ALERT_BUSINESS_HOURS"); value != "" {
+		from, to, found := strings.Cut(value, "-")
+		var errFrom, errTo error
+		start, errFrom = strconv.Atoi(from)
+		end, errTo = strconv.Atoi(to)
+		if !found || errFrom != nil || errTo != nil || start < 0 || end > 24 || start >= end {
+			log.Fatalf("ALERT_BUSINESS_HOURS must be hours like \"8-18\", got %q", value)
+		}
+	}
+	return []AlertRule{
+		&RepeatedForbiddenRule{
+			Threshold: alertThreshold("ALERT_FORBIDDEN_THRESHOLD", 5),
+			Window:    alertWindow("ALERT_FORBIDDEN_WINDOW", time.Minute*10),
+		},
+		&OffHoursRemovalRule{Start: start, End: end, Location: location},
+		&InviteBurstRule{
+			Threshold: alertThreshold("ALERT_INVITE_THRESHOLD", 20),
+			Window:    alertWindow("ALERT_INVITE_WINDOW", time.Hour),
+		},
+	}
+}
+
+func alertThreshold(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 1 {
+		log.Fatalf("%s must be a positive number, got %q", key, value)
+	}
+	return threshold
+}
+
+func alertWindow(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		log.Fatalf("%s must be a positive duration, got %q", key, value)
+	}
+	return window
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// Monday 2026-03-02 09:00 UTC, within business hours.
+var alertBase = time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+
+func alertEntry(offset time.Duration, action string, status string, userId string) *types.LogEntry {
+	return &types.LogEntry{
+		GroupId:   "group",
+		Action:    action,
+		Status:    status,
+		UserId:    userId,
+		Email:     userId + "@example.com",
+		Timestamp: alertBase.Add(offset).Format(time.RFC3339),
+	}
+}
+
+func forbidden(offset time.Duration, userId string) *types.LogEntry {
+	return alertEntry(offset, types.VIEW_LOGS, types.LOG_STATUS_FORBIDDEN, userId)
+}
+
+func TestRepeatedForbiddenRule(t *testing.T) {
+	rule := &RepeatedForbiddenRule{Threshold: 3, Window: time.Minute * 10}
+	tests := []struct {
+		name    string
+		entries []*types.LogEntry
+		alerts  []string // user ids alerted on, in order
+	}{
+		{
+			name:    "below the threshold",
+			entries: []*types.LogEntry{forbidden(0, "a"), forbidden(time.Minute, "a")},
+		},
+		{
+			name:    "at the threshold",
+			entries: []*types.LogEntry{forbidden(0, "a"), forbidden(time.Minute, "a"), forbidden(time.Minute*2, "a")},
+			alerts:  []string{"a"},
+		},
+		{
+			name: "once per burst",
+			entries: []*types.LogEntry{
+				forbidden(0, "a"), forbidden(time.Minute, "a"), forbidden(time.Minute*2, "a"),
+				forbidden(time.Minute*3, "a"), forbidden(time.Minute*4, "a"),
+			},
+			alerts: []string{"a"},
+		},
+		{
+			name:    "spread beyond the window",
+			entries: []*types.LogEntry{forbidden(0, "a"), forbidden(time.Minute*6, "a"), forbidden(time.Minute*12, "a")},
+		},
+		{
+			name:    "counted per user",
+			entries: []*types.LogEntry{forbidden(0, "a"), forbidden(time.Minute, "b"), forbidden(time.Minute*2, "a")},
+		},
+		{
+			name: "other statuses don't count",
+			entries: []*types.LogEntry{
+				forbidden(0, "a"), alertEntry(time.Minute, types.VIEW_LOGS, "OK", "a"), forbidden(time.Minute*2, "a"),
+			},
+		},
+		{
+			name: "malformed timestamps are skipped",
+			entries: []*types.LogEntry{
+				forbidden(0, "a"), {GroupId: "group", Status: types.LOG_STATUS_FORBIDDEN, UserId: "a", Timestamp: "yesterday"},
+				forbidden(time.Minute, "a"),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerts := rule.Evaluate(test.entries)
+			if len(alerts) != len(test.alerts) {
+				t.Fatalf("got %d alerts, want %d: %+v", len(alerts), len(test.alerts), alerts)
+			}
+			for i, alert := range alerts {
+				if alert.UserId != test.alerts[i] || alert.Rule != ALERT_REPEATED_FORBIDDEN || alert.Count != rule.Threshold {
+					t.Errorf("alert %d: got %+v, want one about %s", i, alert, test.alerts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOffHoursRemovalRule(t *testing.T) {
+	copenhagen, err := time.LoadLocation("Europe/Copenhagen")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	rule := &OffHoursRemovalRule{Start: 8, End: 18, Location: copenhagen}
+	removal := func(at time.Time, status string) *types.LogEntry {
+		return &types.LogEntry{GroupId: "group", Action: types.REMOVE_MEMBER, Status: status, UserId: "owner", Timestamp: at.Format(time.RFC3339)}
+	}
+	tests := []struct {
+		name  string
+		entry *types.LogEntry
+		alert bool
+	}{
+		// Copenhagen is UTC+1 in March
+		{"within business hours", removal(time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC), "OK"), false},
+		{"before business hours", removal(time.Date(2026, 3, 2, 6, 30, 0, 0, time.UTC), "OK"), true},
+		{"at the end of business hours", removal(time.Date(2026, 3, 2, 17, 0, 0, 0, time.UTC), "OK"), true},
+		{"just before the end", removal(time.Date(2026, 3, 2, 16, 59, 0, 0, time.UTC), "OK"), false},
+		{"on a saturday", removal(time.Date(2026, 3, 7, 11, 0, 0, 0, time.UTC), "OK"), true},
+		{"a refused removal", removal(time.Date(2026, 3, 2, 2, 0, 0, 0, time.UTC), types.LOG_STATUS_FORBIDDEN), false},
+		{"another action", &types.LogEntry{GroupId: "group", Action: types.INVITE_MEMBER, Status: "OK",
+			Timestamp: time.Date(2026, 3, 2, 2, 0, 0, 0, time.UTC).Format(time.RFC3339)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerts := rule.Evaluate([]*types.LogEntry{test.entry})
+			if alerted := len(alerts) == 1; alerted != test.alert || len(alerts) > 1 {
+				t.Fatalf("got %d alerts, want alert=%v", len(alerts), test.alert)
+			}
+			if test.alert && (alerts[0].Rule != ALERT_OFF_HOURS_REMOVAL || alerts[0].UserId != "owner") {
+				t.Errorf("got %+v", alerts[0])
+			}
+		})
+	}
+}
+
+func TestInviteBurstRule(t *testing.T) {
+	rule := &InviteBurstRule{Threshold: 3, Window: time.Hour}
+	invite := func(offset time.Duration) *types.LogEntry {
+		return alertEntry(offset, types.INVITE_MEMBER, "OK", "owner")
+	}
+	batch := func(offset time.Duration, emails ...string) *types.LogEntry {
+		entry := invite(offset)
+		entry.Detail, _ = json.Marshal(map[string]any{"emails": emails})
+		return entry
+	}
+	tests := []struct {
+		name    string
+		entries []*types.LogEntry
+		counts  []int // of the alerts raised, in order
+	}{
+		{"at the threshold", []*types.LogEntry{invite(0), invite(time.Minute), invite(time.Minute * 2)}, nil},
+		{"over the threshold", []*types.LogEntry{invite(0), invite(time.Minute), invite(time.Minute * 2), invite(time.Minute * 3)}, []int{4}},
+		{"once per burst", []*types.LogEntry{
+			invite(0), invite(time.Minute), invite(time.Minute * 2), invite(time.Minute * 3), invite(time.Minute * 4),
+		}, []int{4}},
+		{"a batch counts every address", []*types.LogEntry{invite(0), batch(time.Minute, "a@x.io", "b@x.io", "c@x.io")}, []int{4}},
+		{"spread beyond the window", []*types.LogEntry{
+			invite(0), invite(time.Minute * 20), invite(time.Minute * 40), invite(time.Minute * 61),
+		}, nil},
+		{"again after the window", []*types.LogEntry{
+			batch(0, "a@x.io", "b@x.io", "c@x.io", "d@x.io"), batch(time.Hour*2, "e@x.io", "f@x.io", "g@x.io", "h@x.io"),
+		}, []int{4, 4}},
+		{"failed invitations don't count", []*types.LogEntry{
+			invite(0), invite(time.Minute), invite(time.Minute * 2), alertEntry(time.Minute*3, types.INVITE_MEMBER, "Error", "owner"),
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerts := rule.Evaluate(test.entries)
+			if len(alerts) != len(test.counts) {
+				t.Fatalf("got %d alerts, want %d: %+v", len(alerts), len(test.counts), alerts)
+			}
+			for i, alert := range alerts {
+				if alert.Count != test.counts[i] || alert.Rule != ALERT_INVITE_BURST {
+					t.Errorf("alert %d: got %+v, want a count of %d", i, alert, test.counts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateAlertRulesOnlyAlertsFromTheScannedStretch(t *testing.T) {
+	rules := []AlertRule{&RepeatedForbiddenRule{Threshold: 3, Window: time.Minute * 10}}
+	other := forbidden(time.Minute*2, "a")
+	other.GroupId = "other"
+	// out of order, each group's entries are sorted before the rules see them
+	entries := []*types.LogEntry{
+		forbidden(time.Minute*2, "a"), forbidden(0, "a"), forbidden(time.Minute, "a"),
+		forbidden(time.Minute*7, "b"), forbidden(time.Minute*8, "b"), forbidden(time.Minute*9, "b"),
+		other,
+	}
+	// the burst of a was alerted on by the scan before, only entries from minute 5 on are new
+	alerts := EvaluateAlertRules(rules, entries, alertBase.Add(time.Minute*5))
+	if len(alerts) != 1 || alerts[0].UserId != "b" || alerts[0].GroupId != "group" {
+		t.Fatalf("got %+v, want a single alert about b", alerts)
+	}
+	if lookback := AlertLookback(NewAlertRules()); lookback != time.Hour {
+		t.Errorf("the default rules look back %s, want 1h", lookback)
+	}
+}
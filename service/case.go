@@ -1,18 +1,115 @@
 package service
 
-import "os"
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
 
-type CaseService struct {
-	domain string
+type CaseService interface {
+	GetPermissions() (any, error)
+	DeleteCasesForGroup(ctx context.Context, groupId string) error
 }
 
-func NewCaseService() *CaseService {
-	return &CaseService{
-		domain: os.Getenv("CASE_SERVICE_DOMAIN"),
+type CaseServiceOpts struct {
+	Token TokenService
+}
+
+type CaseServiceImpl struct {
+	domain    string
+	token     TokenService
+	client    *http.Client
+	retryChan chan *caseRetry
+}
+
+type caseRetry struct {
+	groupId string
+	attempt int
+}
+
+const (
+	caseRetryAttempts = 5
+	caseRetryDelay    = time.Second * 30
+)
+
+func NewCaseService(opts *CaseServiceOpts) *CaseServiceImpl {
+	s := &CaseServiceImpl{
+		domain:    os.Getenv("CASE_SERVICE_DOMAIN"),
+		token:     opts.Token,
+		client:    &http.Client{Timeout: time.Second * 10},
+		retryChan: make(chan *caseRetry, 100),
+	}
+	if s.domain == "" {
+		log.Println("CASE_SERVICE_DOMAIN not set, case service calls will be skipped (dry-run).")
 	}
+	go s.retryWorker()
+	return s
 }
 
-func (service *CaseService) GetPermissions() (any, error) {
+func (service *CaseServiceImpl) GetPermissions() (any, error) {
 
 	return nil, nil
 }
+
+// Asks the case service to delete all cases owned by the group.
+// On failure the call is queued for retry in the background, and the error is returned for logging.
+func (service *CaseServiceImpl) DeleteCasesForGroup(ctx context.Context, groupId string) error {
+	if service.domain == "" {
+		log.Printf("(dry-run) skipping case cleanup for group %s\n", groupId)
+		return nil
+	}
+	if err := service.deleteCasesForGroup(ctx, groupId); err != nil {
+		service.enqueueRetry(&caseRetry{groupId: groupId, attempt: 1})
+		return err
+	}
+	return nil
+}
+
+func (service *CaseServiceImpl) deleteCasesForGroup(ctx context.Context, groupId string) error {
+	token, err := service.token.NewToken(service.domain)
+	if err != nil {
+		return fmt.Errorf("error creating internal token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/api/internal/group/%s/cases", service.domain, groupId), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Token", token)
+	res, err := service.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling case service: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("case service responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Queues a retry, dropping it if the queue is full rather than blocking the caller.
+func (service *CaseServiceImpl) enqueueRetry(retry *caseRetry) {
+	select {
+	case service.retryChan <- retry:
+	default:
+		log.Printf("case cleanup retry queue full, dropping cleanup for group %s\n", retry.groupId)
+	}
+}
+
+// Retries failed case cleanups, waiting between attempts and giving up after a fixed number of attempts.
+func (service *CaseServiceImpl) retryWorker() {
+	for retry := range service.retryChan {
+		time.Sleep(caseRetryDelay)
+		if err := service.deleteCasesForGroup(context.Background(), retry.groupId); err != nil {
+			log.Printf("case cleanup for group %s failed (attempt %d): %+v\n", retry.groupId, retry.attempt+1, err)
+			if retry.attempt+1 < caseRetryAttempts {
+				retry.attempt++
+				service.enqueueRetry(retry)
+			} else {
+				log.Printf("giving up on case cleanup for group %s\n", retry.groupId)
+			}
+		}
+	}
+}
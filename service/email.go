@@ -1,75 +1,398 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net/smtp"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+
+	"user.service.altiore.io/singleton"
+	"user.service.altiore.io/types"
 )
 
+//go:embed templates
+var emailTemplateFS embed.FS
+
+// Templates of a single locale. Every mail has a HTML and a plain text template, e.g. invitation.html and invitation.txt,
+// and a subject defined in subjects.txt, e.g. invitation.subject.
+type emailTemplates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// Loaded per locale from templates/<locale>.
+var emailTemplatesByLocale = make(map[string]*emailTemplates)
+
+// Sample data per mail, used to render every template at startup.
+var emailTemplateSamples = map[string]any{
+	"invitation":         &types.InvitationMailData{Group: "group", Link: "link"},
+	"signup_invitation":  &types.InvitationMailData{Group: "group", Link: "link"},
+	"verification":       &types.VerificationMailData{Link: "link"},
+	"reset_password":     &types.ResetPasswordMailData{Link: "link"},
+	"removed_from_group": &types.RemovedFromGroupMailData{Group: "group"},
+	"security_alert":     &types.AlertMailData{Group: "group", Rule: ALERT_REPEATED_FORBIDDEN, Email: "email", At: "2024-01-01 00:00", Count: 5, Window: "10m0s", Link: "link"},
+	"audit_digest": &types.AuditDigestMailData{Group: "group", From: "2024-01-01", To: "2024-01-07", Total: 1, Link: "link",
+		Summary: []*types.LogSummary{{Action: "action", Status: "OK", Count: 1}}},
+}
+
+// Parses the templates of every supported locale, and renders every mail in every locale,
+// so a missing or broken translation stops the service from starting rather than failing a send.
+func init() {
+	for _, locale := range types.SupportedLocales {
+		emailTemplatesByLocale[locale] = &emailTemplates{
+			html: htmltemplate.Must(htmltemplate.New("").Funcs(htmltemplate.FuncMap{
+				"button": func(link string, label string) map[string]string {
+					return map[string]string{"Link": link, "Label": label}
+				},
+			}).ParseFS(emailTemplateFS, "templates/"+locale+"/*.html")),
+			text: texttemplate.Must(texttemplate.New("").ParseFS(emailTemplateFS, "templates/"+locale+"/*.txt")),
+		}
+		for name, data := range emailTemplateSamples {
+			if _, err := renderEmail(locale, name, data); err != nil {
+				panic(fmt.Sprintf("email template %s is broken for locale %s: %v", name, locale, err))
+			}
+		}
+	}
+}
+
+// Picks the first supported locale from an Accept-Language header or a stored preference, e.g. "da-DK,da;q=0.9,en;q=0.8".
+// Falls back to the default locale.
+func MatchLocale(value string) string {
+	for _, tag := range strings.Split(value, ",") {
+		tag, _, _ = strings.Cut(tag, ";")
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), "-")
+		tag = strings.ToLower(tag)
+		for _, locale := range types.SupportedLocales {
+			if tag == locale {
+				return locale
+			}
+		}
+	}
+	return types.DEFAULT_LOCALE
+}
+
 type EmailService interface {
-	Send(to []string, message string) error
-	CreateInvitationMail(to string, group string, link string) string
-	CreateSignupAndInvitationMail(to string, group string, link string) string
-	CreateSignupVerification(to string, link string) string
-	CreateResetPassword(to string, link string) string
-	CreateRemovedFromGroup(to string, group string) string
+	Send(message *types.EmailMessage) error
+	Enqueue(message *types.EmailMessage)
+	DeadLetters() int64
+	// Connects and authenticates against the provider without sending, for readiness and startup checks.
+	Verify(ctx context.Context) error
+	CreateInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error)
+	CreateSignupAndInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error)
+	CreateSignupVerification(to string, locale string, data *types.VerificationMailData) (*types.EmailMessage, error)
+	CreateResetPassword(to string, locale string, data *types.ResetPasswordMailData) (*types.EmailMessage, error)
+	CreateRemovedFromGroup(to string, locale string, data *types.RemovedFromGroupMailData) (*types.EmailMessage, error)
+	CreateAuditDigest(to string, locale string, data *types.AuditDigestMailData) (*types.EmailMessage, error)
+	CreateSecurityAlert(to string, locale string, data *types.AlertMailData) (*types.EmailMessage, error)
 }
 
-type EmailServiceOpts struct{}
+type EmailServiceOpts struct {
+	// Optional, selected from EMAIL_PROVIDER when nil.
+	Provider EmailProvider
+}
 
 type EmailServiceImpl struct {
-	email    string
-	password string
+	email       string
+	provider    EmailProvider
+	sendChan    chan *types.EmailMessage
+	deadLetters atomic.Int64
+}
+
+const (
+	emailAttempts     = 5
+	emailWorkers      = 3
+	emailInitialDelay = time.Second * 2
+)
+
+var emailServices = singleton.NewRegistry[*EmailServiceImpl]("email service", 1)
+
+// Sender address of the noop provider when EMAIL_SERVICE_EMAIL isn't set, so local development needs no mail configuration.
+const noopEmailSender = "noreply@localhost"
+
+// Creates the email service, shared by every caller so a single send queue and set of workers exist.
+// Returns types.ErrEmailConfig if the provider or the sender address EMAIL_SERVICE_EMAIL is misconfigured.
+func NewEmailService(opts *EmailServiceOpts) (*EmailServiceImpl, error) {
+	return emailServices.Get("default", func() (*EmailServiceImpl, error) {
+		provider := opts.Provider
+		if provider == nil {
+			var err error
+			if provider, err = NewEmailProvider(); err != nil {
+				return nil, err
+			}
+		}
+		sender := os.Getenv("EMAIL_SERVICE_EMAIL")
+		if _, noop := provider.(*NoopEmailProvider); noop && sender == "" {
+			sender = noopEmailSender
+		}
+		if address, err := mail.ParseAddress(sender); err != nil || address.Address != sender {
+			return nil, fmt.Errorf("%w: EMAIL_SERVICE_EMAIL %q is not an email address", types.ErrEmailConfig, sender)
+		}
+		service := &EmailServiceImpl{
+			email:    sender,
+			provider: provider,
+			sendChan: make(chan *types.EmailMessage, 100),
+		}
+		for i := 0; i < emailWorkers; i++ {
+			go service.send_worker()
+		}
+		log.Println("initialized email service")
+		return service, nil
+	})
+}
+
+// Sends a mail through the configured provider, blocking until it is delivered or fails.
+func (service *EmailServiceImpl) Send(message *types.EmailMessage) error {
+	return service.provider.Send(message)
 }
 
-func NewEmailService() *EmailServiceImpl {
-	return &EmailServiceImpl{
-		email:    os.Getenv("EMAIL_SERVICE_EMAIL"),
-		password: os.Getenv("EMAIL_SERVICE_PASSWORD"),
+// Queues a mail for sending in the background, never blocks the caller.
+// Mails that can't be queued or delivered end up in the dead-letter log.
+func (service *EmailServiceImpl) Enqueue(message *types.EmailMessage) {
+	select {
+	case service.sendChan <- message:
+	default:
+		service.deadLetter(message, 0, errors.New("send queue full"))
 	}
 }
 
-// Sends a mail.
-func (service *EmailServiceImpl) Send(to []string, message string) error {
-	auth := smtp.PlainAuth("", service.email, service.password, "smtp.gmail.com")
-	addr := fmt.Sprintf("%s:%d", "smtp.gmail.com", 587)
-	if err := smtp.SendMail(addr, auth, service.email, to, []byte(message)); err != nil {
-		return err
+// Number of mails that were given up on.
+func (service *EmailServiceImpl) DeadLetters() int64 {
+	return service.deadLetters.Load()
+}
+
+// Worker responsible for sending queued mails, retrying with exponential backoff.
+func (service *EmailServiceImpl) send_worker() {
+	defer log.Println("email send worker stopped!")
+	for message := range service.sendChan {
+		delay := emailInitialDelay
+		for attempt := 1; attempt <= emailAttempts; attempt++ {
+			err := service.Send(message)
+			if err == nil {
+				break
+			}
+			log.Printf("error sending %q to %v (attempt %d): %+v\n", message.Subject, message.To, attempt, err)
+			if attempt == emailAttempts {
+				service.deadLetter(message, attempt, err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
 	}
-	return nil
+}
+
+// Records a mail that won't be sent as a single structured log line, so support can find and follow up on it.
+func (service *EmailServiceImpl) deadLetter(message *types.EmailMessage, attempts int, err error) {
+	service.deadLetters.Add(1)
+	entry, _ := json.Marshal(map[string]any{
+		"to":        message.To,
+		"subject":   message.Subject,
+		"attempts":  attempts,
+		"error":     err.Error(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+	log.Printf("email dead-letter: %s\n", entry)
+}
+
+// Checks the configured provider is able to send mail, for use by readiness and startup checks.
+func (service *EmailServiceImpl) Verify(ctx context.Context) error {
+	return service.provider.Verify(ctx)
 }
 
 // Create a default group invitation mail notification.
-func (service *EmailServiceImpl) CreateInvitationMail(to string, group string, link string) string {
-	mailHeader := fmt.Sprintf("From:%s\nTo:%s\nSubject: Invitation Link\n\n", service.email, to)
-	mailBody := fmt.Sprintf("Hello\nYou have been invited to the group %s.\nFollow this link to accept the invite: %s", group, link)
-	return mailHeader + mailBody
+func (service *EmailServiceImpl) CreateInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "invitation", data)
 }
 
-// Create a group signup invitation flow  mail.
-func (service *EmailServiceImpl) CreateSignupAndInvitationMail(to string, group string, link string) string {
-	mailHeader := fmt.Sprintf("From:%s\nTo:%s\nSubject: Invitation Link\n\n", service.email, to)
-	mailBody := fmt.Sprintf("Hello\nYou have been invited to the group %s, but you are not a user yet!\nFollow this link to sign up and accept the invite: %s", group, link)
-	return mailHeader + mailBody
+// Create a group signup invitation flow mail.
+func (service *EmailServiceImpl) CreateSignupAndInvitationMail(to string, locale string, data *types.InvitationMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "signup_invitation", data)
 }
 
 // Create signup verification email.
-func (service *EmailServiceImpl) CreateSignupVerification(to string, link string) string {
-	mailHeader := fmt.Sprintf("From:%s\nTo:%s\nSubject: Verification Link\n\n", service.email, to)
-	mailBody := fmt.Sprintf("Hello\nClick here to verify your account: %s", link)
-	return mailHeader + mailBody
+func (service *EmailServiceImpl) CreateSignupVerification(to string, locale string, data *types.VerificationMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "verification", data)
 }
 
 // Create a reset password link.
-func (service *EmailServiceImpl) CreateResetPassword(to string, link string) string {
-	mailHeader := fmt.Sprintf("From:%s\nTo:%s\nSubject: Reset password link \n\n", service.email, to)
-	mailBody := fmt.Sprintf("Hello\nfollow this link to reset your password.\n\n%s", link)
-	return mailHeader + mailBody
+func (service *EmailServiceImpl) CreateResetPassword(to string, locale string, data *types.ResetPasswordMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "reset_password", data)
 }
 
 // Create a removed from group email notification.
-func (service *EmailServiceImpl) CreateRemovedFromGroup(to string, group string) string {
-	mailHeader := fmt.Sprintf("From:%s\nTo:%s\nSubject: Removed from group\n\n", service.email, to)
-	mailBody := fmt.Sprintf("Hello\n\n, This is a message to notify you, that you've been removed from the group\t%s\n\n", group)
-	return mailHeader + mailBody
+func (service *EmailServiceImpl) CreateRemovedFromGroup(to string, locale string, data *types.RemovedFromGroupMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "removed_from_group", data)
+}
+
+// Create a weekly summary of a group's log.
+func (service *EmailServiceImpl) CreateAuditDigest(to string, locale string, data *types.AuditDigestMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "audit_digest", data)
+}
+
+// Create a notification of suspicious activity in a group.
+func (service *EmailServiceImpl) CreateSecurityAlert(to string, locale string, data *types.AlertMailData) (*types.EmailMessage, error) {
+	return service.render(to, locale, "security_alert", data)
+}
+
+// Renders the named mail in the given locale into a message, unsupported locales fall back to the default locale.
+func (service *EmailServiceImpl) render(to string, locale string, name string, data any) (*types.EmailMessage, error) {
+	message, err := renderEmail(MatchLocale(locale), name, data)
+	if err != nil {
+		return nil, err
+	}
+	message.From = service.email
+	message.To = []string{to}
+	return message, nil
+}
+
+// Renders the subject and both alternatives of the named mail.
+func renderEmail(locale string, name string, data any) (*types.EmailMessage, error) {
+	templates := emailTemplatesByLocale[locale]
+	var subject, html, text bytes.Buffer
+	if err := templates.text.ExecuteTemplate(&subject, name+".subject", data); err != nil {
+		return nil, fmt.Errorf("error rendering %s subject: %w", name, err)
+	}
+	if err := templates.html.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return nil, fmt.Errorf("error rendering %s html template: %w", name, err)
+	}
+	if err := templates.text.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return nil, fmt.Errorf("error rendering %s text template: %w", name, err)
+	}
+	return &types.EmailMessage{
+		Subject: subject.String(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// Encodes a message as multipart/alternative MIME, with the plain text part first so clients prefer the HTML part.
+// With attachments the alternatives are wrapped in multipart/mixed, followed by a base64 part per attachment.
+func composeMIME(message *types.EmailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	to := make([]string, len(message.To))
+	for i, recipient := range message.To {
+		to[i] = (&mail.Address{Address: recipient}).String()
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", (&mail.Address{Address: message.From}).String())
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if len(message.Attachments) == 0 {
+		fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", w.Boundary())
+		if err := writeAlternatives(w, message); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", w.Boundary())
+	alternatives := multipart.NewWriter(nil)
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alternatives.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// a writer only picks its own boundary when created, so it's moved onto the part afterwards
+	nested := multipart.NewWriter(pw)
+	if err := nested.SetBoundary(alternatives.Boundary()); err != nil {
+		return nil, err
+	}
+	if err := writeAlternatives(nested, message); err != nil {
+		return nil, err
+	}
+	if err := nested.Close(); err != nil {
+		return nil, err
+	}
+	for _, attachment := range message.Attachments {
+		if err := writeAttachment(w, attachment); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the plain text and HTML alternatives as quoted-printable parts.
+func writeAlternatives(w *multipart.Writer, message *types.EmailMessage) error {
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes an attachment as a base64 part, wrapped at 76 characters per line as RFC 2045 requires.
+// The filename is parameter encoded, so non-ASCII names survive.
+func writeAttachment(w *multipart.Writer, attachment types.EmailAttachment) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {attachmentContentType(attachment)},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(pw, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(pw, "%s\r\n", encoded)
+	return err
+}
+
+// The attachment's content type, guessed from the filename when not given.
+func attachmentContentType(attachment types.EmailAttachment) string {
+	if attachment.ContentType != "" {
+		return attachment.ContentType
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(attachment.Filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
 }
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// Delivers rendered messages, implemented per email provider.
+type EmailProvider interface {
+	Send(message *types.EmailMessage) error
+	// Connects and authenticates without sending anything.
+	Verify(ctx context.Context) error
+}
+
+const (
+	smtpDialTimeout = time.Second * 10
+	// Bounds a whole SMTP session when the context has no deadline of its own, net/smtp sets none.
+	smtpSessionTimeout = time.Second * 30
+)
+
+// Selects the email provider from EMAIL_PROVIDER (smtp, sendgrid or noop).
+// Defaults to noop when ENV=LOCAL, and smtp otherwise.
+// Returns types.ErrEmailConfig if the selected provider is missing configuration.
+func NewEmailProvider() (EmailProvider, error) {
+	provider := strings.ToLower(os.Getenv("EMAIL_PROVIDER"))
+	if provider == "" {
+		provider = "smtp"
+		if os.Getenv("ENV") == "LOCAL" {
+			provider = "noop"
+		}
+	}
+	switch provider {
+	case "sendgrid":
+		log.Println("using sendgrid email provider")
+		return NewSendGridEmailProvider()
+	case "noop":
+		log.Println("using noop email provider, emails will only be logged")
+		return &NoopEmailProvider{}, nil
+	case "smtp":
+		log.Println("using smtp email provider")
+		return NewSMTPEmailProvider()
+	default:
+		return nil, fmt.Errorf("%w: unknown EMAIL_PROVIDER %q", types.ErrEmailConfig, provider)
+	}
+}
+
+// Sends email through an SMTP server.
+type SMTPEmailProvider struct {
+	host     string
+	port     string
+	tls      string
+	username string
+	password string
+}
+
+// Creates an SMTP provider, configured by EMAIL_SMTP_HOST, EMAIL_SMTP_PORT and EMAIL_SMTP_TLS (starttls, tls or none).
+// Authenticates as EMAIL_SERVICE_EMAIL with EMAIL_SERVICE_PASSWORD, both are required.
+func NewSMTPEmailProvider() (*SMTPEmailProvider, error) {
+	p := &SMTPEmailProvider{
+		host:     os.Getenv("EMAIL_SMTP_HOST"),
+		port:     os.Getenv("EMAIL_SMTP_PORT"),
+		tls:      strings.ToLower(os.Getenv("EMAIL_SMTP_TLS")),
+		username: os.Getenv("EMAIL_SERVICE_EMAIL"),
+		password: os.Getenv("EMAIL_SERVICE_PASSWORD"),
+	}
+	if p.host == "" {
+		p.host = "smtp.gmail.com"
+	}
+	if p.port == "" {
+		p.port = "587"
+	}
+	if p.tls == "" {
+		p.tls = "starttls"
+	}
+	switch {
+	case p.username == "" || p.password == "":
+		return nil, fmt.Errorf("%w: EMAIL_SERVICE_EMAIL and EMAIL_SERVICE_PASSWORD must be set for smtp", types.ErrEmailConfig)
+	case p.tls != "starttls" && p.tls != "tls" && p.tls != "none":
+		return nil, fmt.Errorf("%w: EMAIL_SMTP_TLS must be starttls, tls or none, got %q", types.ErrEmailConfig, p.tls)
+	}
+	if port, err := strconv.Atoi(p.port); err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("%w: EMAIL_SMTP_PORT %q is not a port", types.ErrEmailConfig, p.port)
+	}
+	return p, nil
+}
+
+// Connects and authenticates against the SMTP server.
+// The session is bounded by the context deadline, or by smtpSessionTimeout when it has none.
+func (provider *SMTPEmailProvider) connect(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(provider.host, provider.port)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var conn net.Conn
+	var err error
+	if provider.tls == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: provider.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", types.ErrEmailConnection, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpSessionTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", types.ErrEmailConnection, err)
+	}
+	client, err := smtp.NewClient(conn, provider.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", types.ErrEmailConnection, err)
+	}
+	if provider.tls == "starttls" {
+		if err := client.StartTLS(&tls.Config{ServerName: provider.host}); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("%w: %v", types.ErrEmailConnection, err)
+		}
+	}
+	if provider.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", provider.username, provider.password, provider.host)); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("%w: %v", types.ErrEmailAuth, err)
+		}
+	}
+	return client, nil
+}
+
+func (provider *SMTPEmailProvider) Send(message *types.EmailMessage) error {
+	data, err := composeMIME(message)
+	if err != nil {
+		return fmt.Errorf("%w: error composing message: %v", types.ErrEmailSend, err)
+	}
+	client, err := provider.connect(context.Background())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Mail(message.From); err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	for _, recipient := range message.To {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	return client.Quit()
+}
+
+// Checks the SMTP server is reachable and accepts our credentials.
+func (provider *SMTPEmailProvider) Verify(ctx context.Context) error {
+	client, err := provider.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+// Sends email through the SendGrid v3 API.
+type SendGridEmailProvider struct {
+	apiKey string
+	url    string
+	client *http.Client
+}
+
+// Creates a SendGrid provider, authenticated by SENDGRID_API_KEY, which is required.
+func NewSendGridEmailProvider() (*SendGridEmailProvider, error) {
+	apiKey := os.Getenv("SENDGRID_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("%w: SENDGRID_API_KEY must be set for sendgrid", types.ErrEmailConfig)
+	}
+	return &SendGridEmailProvider{
+		apiKey: apiKey,
+		url:    "https://api.sendgrid.com/v3",
+		client: &http.Client{Timeout: time.Second * 10},
+	}, nil
+}
+
+func (provider *SendGridEmailProvider) Send(message *types.EmailMessage) error {
+	recipients := make([]map[string]string, len(message.To))
+	for i, recipient := range message.To {
+		recipients[i] = map[string]string{"email": recipient}
+	}
+
+	// the api expects the plain text alternative before the html one
+	payload := map[string]any{
+		"personalizations": []map[string]any{{"to": recipients}},
+		"from":             map[string]string{"email": message.From},
+		"subject":          message.Subject,
+		"content": []map[string]string{
+			{"type": "text/plain", "value": message.Text},
+			{"type": "text/html", "value": message.HTML},
+		},
+	}
+	// an empty list is rejected, so the field is left out when there's nothing to attach
+	if len(message.Attachments) > 0 {
+		payload["attachments"] = sendGridAttachments(message.Attachments)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	return provider.do(context.Background(), http.MethodPost, "/mail/send", body)
+}
+
+// Attachments in the shape the api expects, base64 encoded.
+func sendGridAttachments(attachments []types.EmailAttachment) []map[string]string {
+	encoded := make([]map[string]string, len(attachments))
+	for i, attachment := range attachments {
+		encoded[i] = map[string]string{
+			"content":     base64.StdEncoding.EncodeToString(attachment.Data),
+			"filename":    attachment.Filename,
+			"type":        attachmentContentType(attachment),
+			"disposition": "attachment",
+		}
+	}
+	return encoded
+}
+
+// Checks the API is reachable and the key is accepted.
+func (provider *SendGridEmailProvider) Verify(ctx context.Context) error {
+	return provider.do(ctx, http.MethodGet, "/scopes", nil)
+}
+
+func (provider *SendGridEmailProvider) do(ctx context.Context, method string, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, provider.url+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailSend, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+provider.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", types.ErrEmailConnection, err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: sendgrid responded with status %d", types.ErrEmailAuth, res.StatusCode)
+	case res.StatusCode >= 300:
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%w: sendgrid responded with status %d: %s", types.ErrEmailSend, res.StatusCode, detail)
+	}
+	return nil
+}
+
+// Logs messages instead of sending them, for local development.
+type NoopEmailProvider struct{}
+
+func (provider *NoopEmailProvider) Send(message *types.EmailMessage) error {
+	log.Printf("(noop email) from %s to %v, subject %q, %d attachment(s):\n%s\n", message.From, message.To, message.Subject, len(message.Attachments), message.Text)
+	return nil
+}
+
+func (provider *NoopEmailProvider) Verify(ctx context.Context) error {
+	return nil
+}
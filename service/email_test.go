@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"user.service.altiore.io/types"
+)
+
+func TestEveryMailRendersInEveryLocale(t *testing.T) {
+	for _, locale := range types.SupportedLocales {
+		for name, data := range emailTemplateSamples {
+			t.Run(locale+"/"+name, func(t *testing.T) {
+				message, err := renderEmail(locale, name, data)
+				if err != nil {
+					t.Fatalf("rendering: %v", err)
+				}
+				if strings.TrimSpace(message.Subject) == "" || strings.TrimSpace(message.Text) == "" || strings.TrimSpace(message.HTML) == "" {
+					t.Fatalf("got an empty part: %+v", message)
+				}
+				for part, content := range map[string]string{"subject": message.Subject, "text": message.Text, "html": message.HTML} {
+					if strings.Contains(content, "<no value>") {
+						t.Errorf("the %s refers to a field the data doesn't have:\n%s", part, content)
+					}
+				}
+				if strings.Contains(message.Subject, "\n") {
+					t.Errorf("the subject spans lines: %q", message.Subject)
+				}
+			})
+		}
+	}
+}
+
+// Every mail in the templates has a sample, and every locale has the same set of templates,
+// so a mail added in one locale alone or without a sample is caught here rather than at send time.
+func TestEveryLocaleHasEveryTemplate(t *testing.T) {
+	expected := make(map[string]bool)
+	for name := range emailTemplateSamples {
+		expected[name+".html"] = true
+		expected[name+".txt"] = true
+	}
+	for _, locale := range types.SupportedLocales {
+		files, err := fs.Glob(emailTemplateFS, "templates/"+locale+"/*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]bool)
+		for _, file := range files {
+			name := path.Base(file)
+			if name == "layout.html" || name == "subjects.txt" {
+				continue
+			}
+			found[name] = true
+			if !expected[name] {
+				t.Errorf("%s has %s, which has no sample to render", locale, name)
+			}
+		}
+		for name := range expected {
+			if !found[name] {
+				t.Errorf("%s is missing %s", locale, name)
+			}
+		}
+	}
+}
+
+func TestUnsupportedLocalesFallBackToTheDefault(t *testing.T) {
+	tests := []struct {
+		value  string
+		locale string
+	}{
+		{"", types.DEFAULT_LOCALE},
+		{"da", types.LOCALE_DA},
+		{"da-DK,da;q=0.9,en;q=0.8", types.LOCALE_DA},
+		{"DA-dk", types.LOCALE_DA},
+		{"fr-FR,fr;q=0.9", types.DEFAULT_LOCALE},
+		{"fr-FR, da;q=0.5", types.LOCALE_DA},
+	}
+	for _, test := range tests {
+		if locale := MatchLocale(test.value); locale != test.locale {
+			t.Errorf("MatchLocale(%q) = %s, want %s", test.value, locale, test.locale)
+		}
+	}
+}
+
+// Every caller shares one email service, and with it a single send queue and set of workers.
+func TestConcurrentEmailServicesAreShared(t *testing.T) {
+	services := make([]*EmailServiceImpl, 50)
+	var wg sync.WaitGroup
+	for i := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service, err := NewEmailService(&EmailServiceOpts{Provider: &NoopEmailProvider{}})
+			if err != nil {
+				t.Error(err)
+			}
+			services[i] = service
+		}()
+	}
+	wg.Wait()
+	for _, service := range services {
+		if service == nil || service != services[0] {
+			t.Fatal("callers got different email services")
+		}
+	}
+	if n := emailServices.Len(); n != 1 {
+		t.Errorf("%d email services exist, want 1", n)
+	}
+}
+
+// A misconfigured provider is refused as it's created, rather than as the first mail fails.
+func TestMisconfiguredProvidersAreRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"unknown provider", map[string]string{"EMAIL_PROVIDER": "carrier-pigeon"}},
+		{"smtp without credentials", map[string]string{"EMAIL_PROVIDER": "smtp", "EMAIL_SERVICE_EMAIL": "", "EMAIL_SERVICE_PASSWORD": ""}},
+		{"smtp with an invalid port", map[string]string{"EMAIL_PROVIDER": "smtp", "EMAIL_SERVICE_EMAIL": "mail@example.com", "EMAIL_SERVICE_PASSWORD": "secret", "EMAIL_SMTP_PORT": "70000"}},
+		{"smtp with an invalid tls mode", map[string]string{"EMAIL_PROVIDER": "smtp", "EMAIL_SERVICE_EMAIL": "mail@example.com", "EMAIL_SERVICE_PASSWORD": "secret", "EMAIL_SMTP_TLS": "maybe"}},
+		{"sendgrid without a key", map[string]string{"EMAIL_PROVIDER": "sendgrid", "SENDGRID_API_KEY": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			if _, err := NewEmailProvider(); !errors.Is(err, types.ErrEmailConfig) {
+				t.Errorf("got %v, want ErrEmailConfig", err)
+			}
+		})
+	}
+}
+
+// A composed message reads back through net/mail and mime/multipart as what went in, non-ASCII text included.
+func TestComposedMessagesParse(t *testing.T) {
+	rendered, err := renderEmail(types.LOCALE_DA, "invitation", emailTemplateSamples["invitation"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := types.EmailAttachment{Filename: "logs for Årstiderne.csv", Data: bytes.Repeat([]byte("id,action,ø\r\n"), 40)}
+	for _, attachments := range [][]types.EmailAttachment{nil, {attachment}} {
+		message := &types.EmailMessage{
+			From:        "noreply@example.com",
+			To:          []string{"a@example.com", "b@example.com"},
+			Subject:     "Invitation til Årstiderne — ændringer",
+			Text:        rendered.Text,
+			HTML:        rendered.HTML,
+			Attachments: attachments,
+		}
+		raw, err := composeMIME(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 998 {
+				t.Fatalf("a line is %d characters long, over the limit of RFC 5322", len(line))
+			}
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("parsing the message: %v", err)
+		}
+
+		var decoder mime.WordDecoder
+		if subject, err := decoder.DecodeHeader(parsed.Header.Get("Subject")); err != nil || subject != message.Subject {
+			t.Errorf("got subject %q (%v), want %q", subject, err, message.Subject)
+		}
+		if to, err := parsed.Header.AddressList("To"); err != nil || len(to) != 2 || to[1].Address != "b@example.com" {
+			t.Errorf("got recipients %v (%v)", to, err)
+		}
+		if from, err := mail.ParseAddress(parsed.Header.Get("From")); err != nil || from.Address != message.From {
+			t.Errorf("got sender %v (%v)", from, err)
+		}
+		if _, err := parsed.Header.Date(); err != nil {
+			t.Errorf("the date doesn't parse: %v", err)
+		}
+
+		parts := readParts(t, parsed.Header.Get("Content-Type"), parsed.Body)
+		// quoted-printable text has canonical CRLF line breaks
+		lf := strings.NewReplacer("\r\n", "\n")
+		if lf.Replace(parts["text/plain"]) != message.Text || lf.Replace(parts["text/html"]) != message.HTML {
+			t.Errorf("the alternatives didn't survive encoding: %q", parts)
+		}
+		if len(attachments) > 0 && parts[attachment.Filename] != string(attachment.Data) {
+			t.Errorf("the attachment didn't survive encoding: %q", parts[attachment.Filename])
+		}
+	}
+}
+
+// The decoded parts of a multipart body, nested ones included, by media type or by the filename of attachments.
+func readParts(t *testing.T, contentType string, body io.Reader) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		t.Fatalf("got content type %q (%v), want a multipart one", contentType, err)
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("reading a part: %v", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if strings.HasPrefix(partType, "multipart/") {
+			for name, content := range readParts(t, part.Header.Get("Content-Type"), part) {
+				parts[name] = content
+			}
+			continue
+		}
+		var content io.Reader = part // quoted-printable parts are decoded by the reader
+		name := partType
+		if part.FileName() != "" {
+			name = part.FileName()
+			content = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		decoded, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatalf("decoding the %s part: %v", name, err)
+		}
+		parts[name] = string(decoded)
+	}
+}
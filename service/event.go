@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"user.service.altiore.io/types"
+)
+
+type EventPublisher interface {
+	PublishUserEvent(event string, userId string)
+}
+
+type EventPublisherOpts struct{}
+
+type EventPublisherImpl struct {
+	topic *pubsub.Topic
+}
+
+// Creates the user lifecycle event publisher, using the topic in PUBSUB_TOPIC within the project in PUBSUB_PROJECT_ID.
+// If no topic is configured, publishing is a no-op.
+func NewEventPublisher(opts *EventPublisherOpts) *EventPublisherImpl {
+	topicId := os.Getenv("PUBSUB_TOPIC")
+	if topicId == "" {
+		log.Println("PUBSUB_TOPIC not set, user events will not be published.")
+		return &EventPublisherImpl{}
+	}
+	client, err := pubsub.NewClient(context.Background(), os.Getenv("PUBSUB_PROJECT_ID"))
+	if err != nil {
+		log.Printf("error creating pubsub client, user events will not be published: %+v\n", err)
+		return &EventPublisherImpl{}
+	}
+	return &EventPublisherImpl{
+		topic: client.Topic(topicId),
+	}
+}
+
+// Publishes a user lifecycle event in the background, failures are only logged.
+func (service *EventPublisherImpl) PublishUserEvent(event string, userId string) {
+	if service.topic == nil {
+		return
+	}
+	data, err := json.Marshal(&types.UserEvent{
+		Event:     event,
+		UserId:    userId,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("error encoding user event: %+v\n", err)
+		return
+	}
+	result := service.topic.Publish(context.Background(), &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{"event": event},
+	})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+		if _, err := result.Get(ctx); err != nil {
+			log.Printf("error publishing %s event for user %s: %+v\n", event, userId, err)
+		}
+	}()
+}
@@ -3,21 +3,26 @@ package service
 import (
 	"context"
 	"fmt"
-	"sync"
+	"os"
+	"strconv"
 
-	firebase "firebase.google.com/go"
-	"firebase.google.com/go/auth"
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
 
 	"google.golang.org/api/option"
+	"user.service.altiore.io/singleton"
+	"user.service.altiore.io/types"
 )
 
 type FirebaseService interface {
 	VerifyToken(token string) (*auth.Token, error)
+	VerifyTokenStrict(token string) (*auth.Token, error)
 	SetNewPassword(uid string, password string) error
 	ResetPassword(email string) (string, error)
 	RevokeToken(uid string) error
 	UserExists(email string) error
 	GetUserIdByEmail(email string) (string, error)
+	GetUsers(ctx context.Context, uids []string) (map[string]*types.FirebaseUser, error)
 	InviteMember(organisationId string, email string) error
 	CreateUser(email string, password string, name string) (string, error)
 	DeleteUser(userId string) error
@@ -27,55 +32,82 @@ type FirebaseServiceOpts struct {
 	Email EmailService
 }
 
-var (
-	firebase_service_instance_map = make(map[string]*FirebaseServiceImpl)
-	mu                            sync.Mutex
-)
+var firebaseServices = singleton.NewRegistry[*FirebaseServiceImpl]("firebase service", 1)
 
 type FirebaseServiceImpl struct {
-	auth  *auth.Client
-	email EmailService
+	auth   *auth.Client
+	email  EmailService
+	tokens *firebaseTokenCache
 }
 
 func NewFirebaseService(opts *FirebaseServiceOpts, key string) *FirebaseServiceImpl {
+	instance, _ := firebaseServices.Get(key, func() (*FirebaseServiceImpl, error) {
+		mode, config, clientOpts := firebaseCredentials()
+		app, err := firebase.NewApp(context.Background(), config, clientOpts...)
+		if err != nil {
+			panic(fmt.Errorf("error initializing firebase app using %s: %+v", mode, err))
+		}
+
+		auth, err := app.Auth(context.Background())
+		if err != nil {
+			panic(fmt.Errorf("error instantiating firebase auth using %s: %+v", mode, err))
+		}
+
+		cacheSize := 10000
+		if size, err := strconv.Atoi(os.Getenv("FIREBASE_TOKEN_CACHE_SIZE")); err == nil {
+			cacheSize = size
+		}
+
+		return &FirebaseServiceImpl{
+			auth:   auth,
+			email:  opts.Email,
+			tokens: newFirebaseTokenCache(cacheSize),
+		}, nil
+	})
+	return instance
+}
 
-	mu.Lock()
-	defer mu.Unlock()
-
-	if instance, exists := firebase_service_instance_map[key]; exists {
-		return instance
-	}
-
-	//option.WithCredentialsJSON()
-	opt := option.WithCredentialsFile("./cloud-421916-firebase-adminsdk-r2o16-4f7e7089fe.json")
-	app, err := firebase.NewApp(context.Background(), nil, opt)
-	if err != nil {
-		panic(fmt.Errorf("error initializing app: %+v", err))
+// Picks the credentials mode from the environment: the auth emulator when FIREBASE_AUTH_EMULATOR_HOST is set,
+// raw JSON from FIREBASE_CREDENTIALS_JSON, a key file from FIREBASE_CREDENTIALS_FILE,
+// or Application Default Credentials when none are set. Returns a description of the mode for error messages.
+func firebaseCredentials() (string, *firebase.Config, []option.ClientOption) {
+	if host := os.Getenv("FIREBASE_AUTH_EMULATOR_HOST"); host != "" {
+		// the auth client talks to the emulator by itself when the variable is set, it only needs a project id to check tokens against
+		projectId := os.Getenv("GCLOUD_PROJECT")
+		if projectId == "" {
+			projectId = "demo-user-service"
+		}
+		return fmt.Sprintf("auth emulator (%s, project %s)", host, projectId), &firebase.Config{ProjectID: projectId}, []option.ClientOption{option.WithoutAuthentication()}
 	}
-
-	auth, err := app.Auth(context.Background())
-	if err != nil {
-		panic(fmt.Errorf("error instantiating app: %+v", err))
+	if credentials := os.Getenv("FIREBASE_CREDENTIALS_JSON"); credentials != "" {
+		return "FIREBASE_CREDENTIALS_JSON", nil, []option.ClientOption{option.WithCredentialsJSON([]byte(credentials))}
 	}
-
-	firebase_service_instance_map[key] = &FirebaseServiceImpl{
-		auth:  auth,
-		email: opts.Email,
+	if path := os.Getenv("FIREBASE_CREDENTIALS_FILE"); path != "" {
+		return fmt.Sprintf("FIREBASE_CREDENTIALS_FILE (%s)", path), nil, []option.ClientOption{option.WithCredentialsFile(path)}
 	}
-
-	return firebase_service_instance_map[key]
+	return "application default credentials", nil, nil
 }
 
 // Verifies a token through Firebase, returns the decoded token if valid.
+// Verified tokens are cached for a few minutes (FIREBASE_TOKEN_CACHE_SIZE entries, 0 disables the cache),
+// so a revoked token may be accepted until its cache entry runs out, unless it was revoked through RevokeToken.
 func (service *FirebaseServiceImpl) VerifyToken(token string) (*auth.Token, error) {
-	// this doesnt check if token has been revoked, but no use case requires this so far
-	decodedToken, err := service.auth.VerifyIDToken(context.Background(), token)
+	if decodedToken, ok := service.tokens.get(token); ok {
+		return decodedToken, nil
+	}
+	decodedToken, err := service.VerifyTokenStrict(token)
 	if err != nil {
 		return nil, err
 	}
+	service.tokens.put(token, decodedToken)
 	return decodedToken, nil
 }
 
+// Verifies a token through Firebase, bypassing the cache and checking it hasn't been revoked.
+func (service *FirebaseServiceImpl) VerifyTokenStrict(token string) (*auth.Token, error) {
+	return service.auth.VerifyIDTokenAndCheckRevoked(context.Background(), token)
+}
+
 // Set a user's password.
 func (service *FirebaseServiceImpl) SetNewPassword(uid string, password string) error {
 	changes := &auth.UserToUpdate{}
@@ -86,29 +118,61 @@ func (service *FirebaseServiceImpl) SetNewPassword(uid string, password string)
 
 // Allow the user to reset their password through firebase.
 func (service *FirebaseServiceImpl) ResetPassword(email string) (string, error) {
-	return service.auth.PasswordResetLink(context.Background(), email)
+	return service.auth.PasswordResetLink(context.Background(), types.NormalizeEmail(email))
 }
 
 // Revokes a user's refresh token.
 func (service *FirebaseServiceImpl) RevokeToken(uid string) error {
+	service.tokens.invalidate(uid)
 	return service.auth.RevokeRefreshTokens(context.Background(), uid)
 }
 
 // Check if a user exists by email
 func (service *FirebaseServiceImpl) UserExists(email string) error {
-	_, err := service.auth.GetUserByEmail(context.Background(), email)
+	_, err := service.auth.GetUserByEmail(context.Background(), types.NormalizeEmail(email))
 	return err
 }
 
-// Get userId by email.
+// Get userId by email, types.ErrNotFound if there's no account with it.
 func (service *FirebaseServiceImpl) GetUserIdByEmail(email string) (string, error) {
-	user, err := service.auth.GetUserByEmail(context.Background(), email)
+	user, err := service.auth.GetUserByEmail(context.Background(), types.NormalizeEmail(email))
 	if err != nil {
-		return "", err
+		if auth.IsUserNotFound(err) {
+			return "", fmt.Errorf("%w: %v", types.ErrNotFound, err)
+		}
+		return "", fmt.Errorf("%w: %v", types.ErrFirebaseError, err)
 	}
 	return user.UID, nil
 }
 
+// The Admin SDK accepts at most this many identifiers per GetUsers call.
+const firebaseGetUsersBatchSize = 100
+
+// Get the Firebase profiles of many users, in batches. Uids without an account are left out of the result rather than failing.
+func (service *FirebaseServiceImpl) GetUsers(ctx context.Context, uids []string) (map[string]*types.FirebaseUser, error) {
+	users := make(map[string]*types.FirebaseUser, len(uids))
+	for start := 0; start < len(uids); start += firebaseGetUsersBatchSize {
+		end := min(start+firebaseGetUsersBatchSize, len(uids))
+		identifiers := make([]auth.UserIdentifier, 0, end-start)
+		for _, uid := range uids[start:end] {
+			identifiers = append(identifiers, auth.UIDIdentifier{UID: uid})
+		}
+		result, err := service.auth.GetUsers(ctx, identifiers)
+		if err != nil {
+			return nil, fmt.Errorf("error getting firebase users: %w", err)
+		}
+		for _, user := range result.Users {
+			users[user.UID] = &types.FirebaseUser{
+				UID:         user.UID,
+				Email:       user.Email,
+				DisplayName: user.DisplayName,
+				Disabled:    user.Disabled,
+			}
+		}
+	}
+	return users, nil
+}
+
 func (service *FirebaseServiceImpl) InviteMember(organisationId string, email string) error {
 
 	// generate link
@@ -120,19 +184,23 @@ func (service *FirebaseServiceImpl) InviteMember(organisationId string, email st
 	}
 
 	// generate template and send mail
-	message := service.email.CreateInvitationMail(email, link, "")
-	if err := service.email.Send([]string{email}, message); err != nil {
+	message, err := service.email.CreateInvitationMail(email, types.DEFAULT_LOCALE, &types.InvitationMailData{Link: link})
+	if err != nil {
 		return err
 	}
+	service.email.Enqueue(message)
 
 	return nil
 }
 
 // Create a user in firebase.
 func (service *FirebaseServiceImpl) CreateUser(email string, password string, name string) (string, error) {
-	params := (&auth.UserToCreate{}).Email(email).Password(password).DisplayName(name)
+	params := (&auth.UserToCreate{}).Email(types.NormalizeEmail(email)).Password(password).DisplayName(name)
 	user, err := service.auth.CreateUser(context.Background(), params)
 	if err != nil {
+		if auth.IsEmailAlreadyExists(err) {
+			return "", fmt.Errorf("%w: %w", types.ErrUserAlreadyExists, err)
+		}
 		return "", err
 	}
 	return user.UID, nil
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Verified tokens are reused for at most this long, so revocations are picked up within this window,
+// even though a token is valid until its own expiry.
+const FirebaseTokenCacheTTL = time.Minute * 5
+
+// Caches verified tokens, keyed by a hash of the token so raw tokens aren't kept in memory.
+type firebaseTokenCache struct {
+	entries map[string]*firebaseTokenCacheEntry
+	maxSize int
+	mu      sync.Mutex
+}
+
+type firebaseTokenCacheEntry struct {
+	token   *auth.Token
+	expires time.Time
+}
+
+func newFirebaseTokenCache(maxSize int) *firebaseTokenCache {
+	return &firebaseTokenCache{
+		entries: make(map[string]*firebaseTokenCacheEntry),
+		maxSize: maxSize,
+	}
+}
+
+func firebaseTokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the decoded token if it was verified recently and hasn't expired.
+func (cache *firebaseTokenCache) get(token string) (*auth.Token, bool) {
+	key := firebaseTokenCacheKey(token)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, exists := cache.entries[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+	return entry.token, true
+}
+
+// Stores a verified token until the earlier of its expiry and the cache TTL.
+// When full, expired entries are dropped first, then arbitrary ones.
+func (cache *firebaseTokenCache) put(token string, decoded *auth.Token) {
+	if cache.maxSize <= 0 {
+		return
+	}
+	expires := time.Now().Add(FirebaseTokenCacheTTL)
+	if exp := time.Unix(decoded.Expires, 0); decoded.Expires != 0 && exp.Before(expires) {
+		expires = exp
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) >= cache.maxSize {
+		now := time.Now()
+		for key, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+		for key := range cache.entries {
+			if len(cache.entries) < cache.maxSize {
+				break
+			}
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[firebaseTokenCacheKey(token)] = &firebaseTokenCacheEntry{token: decoded, expires: expires}
+}
+
+// Drops every cached token belonging to the user.
+func (cache *firebaseTokenCache) invalidate(uid string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key, entry := range cache.entries {
+		if entry.token.UID == uid {
+			delete(cache.entries, key)
+		}
+	}
+}
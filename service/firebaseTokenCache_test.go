@@ -0,0 +1,105 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+func TestFirebaseTokenCacheExpiresWithTheToken(t *testing.T) {
+	cache := newFirebaseTokenCache(10)
+	cache.put("fresh", &auth.Token{UID: "a", Expires: time.Now().Add(time.Hour).Unix()})
+	cache.put("expired", &auth.Token{UID: "a", Expires: time.Now().Add(-time.Second).Unix()})
+
+	if _, ok := cache.get("fresh"); !ok {
+		t.Error("a verified token wasn't cached")
+	}
+	if _, ok := cache.get("expired"); ok {
+		t.Error("an expired token was served from the cache")
+	}
+}
+
+func TestFirebaseTokenCacheInvalidatesTheUser(t *testing.T) {
+	cache := newFirebaseTokenCache(10)
+	expires := time.Now().Add(time.Hour).Unix()
+	cache.put("a1", &auth.Token{UID: "a", Expires: expires})
+	cache.put("a2", &auth.Token{UID: "a", Expires: expires})
+	cache.put("b1", &auth.Token{UID: "b", Expires: expires})
+
+	cache.invalidate("a")
+	for _, token := range []string{"a1", "a2"} {
+		if _, ok := cache.get(token); ok {
+			t.Errorf("token %s of the invalidated user is still cached", token)
+		}
+	}
+	if _, ok := cache.get("b1"); !ok {
+		t.Error("invalidating a user dropped another user's token")
+	}
+}
+
+func TestFirebaseTokenCacheStaysWithinItsSize(t *testing.T) {
+	cache := newFirebaseTokenCache(3)
+	for i := 0; i < 10; i++ {
+		cache.put(fmt.Sprint(i), &auth.Token{UID: "a", Expires: time.Now().Add(time.Hour).Unix()})
+	}
+	if size := len(cache.entries); size != 3 {
+		t.Errorf("got %d entries, want 3", size)
+	}
+	disabled := newFirebaseTokenCache(0)
+	disabled.put("a", &auth.Token{UID: "a"})
+	if _, ok := disabled.get("a"); ok {
+		t.Error("a cache of size 0 cached a token")
+	}
+}
+
+// Tokens as sent by clients, long enough that hashing them costs what it does in production.
+func benchmarkTokens(n int) []string {
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("eyJhbGciOiJSUzI1NiIsImtpZCI6IjEifQ.%0900d.signature", i)
+	}
+	return tokens
+}
+
+func BenchmarkFirebaseTokenCacheHit(b *testing.B) {
+	cache := newFirebaseTokenCache(10000)
+	tokens := benchmarkTokens(1000)
+	for i, token := range tokens {
+		cache.put(token, &auth.Token{UID: fmt.Sprint(i), Expires: time.Now().Add(time.Hour).Unix()})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.get(tokens[i%len(tokens)]); !ok {
+			b.Fatal("cache miss")
+		}
+	}
+}
+
+func BenchmarkFirebaseTokenCacheHitParallel(b *testing.B) {
+	cache := newFirebaseTokenCache(10000)
+	tokens := benchmarkTokens(1000)
+	for i, token := range tokens {
+		cache.put(token, &auth.Token{UID: fmt.Sprint(i), Expires: time.Now().Add(time.Hour).Unix()})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.get(tokens[i%len(tokens)])
+			i++
+		}
+	})
+}
+
+// Every put into a full cache evicts, the worst case of a burst of new sessions.
+func BenchmarkFirebaseTokenCachePutWhenFull(b *testing.B) {
+	cache := newFirebaseTokenCache(1000)
+	tokens := benchmarkTokens(2000)
+	decoded := &auth.Token{UID: "a", Expires: time.Now().Add(time.Hour).Unix()}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.put(tokens[i%len(tokens)], decoded)
+	}
+}
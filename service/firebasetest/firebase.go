@@ -0,0 +1,170 @@
+// Package firebasetest provides an in-memory FirebaseService, for running the service locally without Firebase and for handler tests.
+package firebasetest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/google/uuid"
+	"user.service.altiore.io/service"
+	"user.service.altiore.io/types"
+)
+
+// A user known to the fake.
+type User struct {
+	UID      string
+	Email    string
+	Password string
+	Name     string
+}
+
+// Implements service.FirebaseService with users kept in memory.
+// There are no signatures to check, so a token is simply the uid of the user it belongs to.
+type FakeFirebaseService struct {
+	email service.EmailService
+	users map[string]*User
+	mu    sync.Mutex
+}
+
+var _ service.FirebaseService = (*FakeFirebaseService)(nil)
+
+// Creates an empty fake, opts.Email is optional and only used to send invitations.
+func NewFakeFirebaseService(opts *service.FirebaseServiceOpts) *FakeFirebaseService {
+	fake := &FakeFirebaseService{users: make(map[string]*User)}
+	if opts != nil {
+		fake.email = opts.Email
+	}
+	return fake
+}
+
+// Adds a user directly, e.g. to seed a test.
+func (fake *FakeFirebaseService) AddUser(user *User) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.users[user.UID] = user
+}
+
+// Returns a copy of a user, or nil if it doesn't exist.
+func (fake *FakeFirebaseService) User(uid string) *User {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if user, exists := fake.users[uid]; exists {
+		copy := *user
+		return &copy
+	}
+	return nil
+}
+
+// Accepts any non-empty token as the uid of the caller, the uid doesn't need to be known, as signups
+// carry a uid created by the client.
+func (fake *FakeFirebaseService) VerifyToken(token string) (*auth.Token, error) {
+	if token == "" {
+		return nil, fmt.Errorf("empty token")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	claims := map[string]interface{}{}
+	if user, exists := fake.users[token]; exists {
+		claims["email"] = user.Email
+	}
+	return &auth.Token{UID: token, Subject: token, Claims: claims}, nil
+}
+
+// Same as VerifyToken, the fake has no cache to bypass.
+func (fake *FakeFirebaseService) VerifyTokenStrict(token string) (*auth.Token, error) {
+	return fake.VerifyToken(token)
+}
+
+func (fake *FakeFirebaseService) SetNewPassword(uid string, password string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	user, exists := fake.users[uid]
+	if !exists {
+		return fmt.Errorf("%w: no user with uid %s", types.ErrNotFound, uid)
+	}
+	user.Password = password
+	return nil
+}
+
+func (fake *FakeFirebaseService) ResetPassword(email string) (string, error) {
+	if _, err := fake.GetUserIdByEmail(email); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://localhost/reset_password?email=%s", email), nil
+}
+
+// Tokens can't be revoked, as they never expire in the fake.
+func (fake *FakeFirebaseService) RevokeToken(uid string) error {
+	return nil
+}
+
+func (fake *FakeFirebaseService) UserExists(email string) error {
+	_, err := fake.GetUserIdByEmail(email)
+	return err
+}
+
+func (fake *FakeFirebaseService) GetUserIdByEmail(email string) (string, error) {
+	email = types.NormalizeEmail(email)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, user := range fake.users {
+		if user.Email == email {
+			return user.UID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no user with email %s", types.ErrNotFound, email)
+}
+
+func (fake *FakeFirebaseService) GetUsers(ctx context.Context, uids []string) (map[string]*types.FirebaseUser, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	users := make(map[string]*types.FirebaseUser, len(uids))
+	for _, uid := range uids {
+		if user, exists := fake.users[uid]; exists {
+			users[uid] = &types.FirebaseUser{UID: user.UID, Email: user.Email, DisplayName: user.Name}
+		}
+	}
+	return users, nil
+}
+
+// Sends the invitation through the email service when one is given, otherwise only logs it.
+func (fake *FakeFirebaseService) InviteMember(organisationId string, email string) error {
+	link := fmt.Sprintf("http://localhost:2000/signup?o=%s", organisationId)
+	if fake.email == nil {
+		log.Printf("(fake firebase) invitation for %s: %s\n", email, link)
+		return nil
+	}
+	message, err := fake.email.CreateInvitationMail(email, types.DEFAULT_LOCALE, &types.InvitationMailData{Link: link})
+	if err != nil {
+		return err
+	}
+	fake.email.Enqueue(message)
+	return nil
+}
+
+func (fake *FakeFirebaseService) CreateUser(email string, password string, name string) (string, error) {
+	email = types.NormalizeEmail(email)
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, user := range fake.users {
+		if user.Email == email {
+			return "", fmt.Errorf("%w: %s", types.ErrUserAlreadyExists, email)
+		}
+	}
+	uid := uuid.NewString()
+	fake.users[uid] = &User{UID: uid, Email: email, Password: password, Name: name}
+	return uid, nil
+}
+
+func (fake *FakeFirebaseService) DeleteUser(userId string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, exists := fake.users[userId]; !exists {
+		return fmt.Errorf("%w: no user with uid %s", types.ErrNotFound, userId)
+	}
+	delete(fake.users, userId)
+	return nil
+}
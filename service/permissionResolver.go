@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"user.service.altiore.io/types"
+)
+
+// Resolves which permission a request needs, and who made it, for the middleware and the internal check endpoints.
+type PermissionResolver interface {
+	// Permission needed for a route, e.g. ("PATCH", "/api/group/:id/update"), false if it needs none.
+	ForRoute(method string, path string) (string, bool)
+	// Permission needed for an action another service asks about, e.g. "/api/case/cis18/create".
+	ForAction(action string) (string, bool)
+	// Email of a user for log entries, cached for a while.
+	UserEmail(userId string) string
+	// A user as stored by us, without their password, cached for a while. ErrNotFound if there is no such user.
+	User(userId string) (*types.User, error)
+
+	// Whether the user is a member of the group, confirmed memberships are cached for permissionCacheTTL.
+	IsMember(ctx context.Context, userId string, groupId string) (bool, error)
+	// A member's permissions in a group, aggregated over their roles and cached for permissionCacheTTL.
+	MemberPermissions(userId string, groupId string) (*types.Permissions, error)
+	// Drops the cached membership and permissions of a member, after their roles or membership changed.
+	InvalidateMember(userId string, groupId string)
+	// Drops the cached memberships and permissions of every member of a group, after its roles changed or it was deleted.
+	InvalidateGroup(groupId string)
+	PermissionCacheStats() *types.PermissionCacheStats
+}
+
+// Reads users, implemented by the core repository.
+type UserReader interface {
+	ReadUserById(userId string) (*types.User, error)
+}
+
+// Reads a member's roles, implemented by the role repository.
+type MemberRoleReader interface {
+	ReadMemberRoles(userId string, groupId string) ([]*types.Role, error)
+}
+
+// Checks memberships, implemented by the core repository.
+type MembershipReader interface {
+	IsMember(ctx context.Context, userId string, groupId string) (bool, error)
+}
+
+type PermissionResolverOpts struct {
+	Users   UserReader
+	Roles   MemberRoleReader
+	Members MembershipReader
+}
+
+type PermissionResolverImpl struct {
+	users   UserReader
+	roles   MemberRoleReader
+	members MembershipReader
+
+	// keyed by "METHOD /route" for routes of this service, and by the action name for other services
+	permissions map[string]string
+
+	cache map[string]*types.User
+	mu    sync.Mutex
+
+	decisions map[memberKey]*permissionCacheEntry
+	// confirmed memberships, non-memberships are never cached so joining takes effect at once
+	memberships map[memberKey]time.Time
+	decisionsMu sync.Mutex
+	// bumped by every invalidation, so a read that started before one doesn't cache what it read
+	generation uint64
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+type memberKey struct {
+	userId  string
+	groupId string
+}
+
+type permissionCacheEntry struct {
+	permissions types.Permissions
+	expires     time.Time
+}
+
+// How long a member's aggregated permissions are cached for. Changes made through this instance invalidate them
+// right away, changes made through another instance show up once they expire.
+const permissionCacheTTL = time.Second * 30
+
+// How long users stay cached, so changes show up in the log and the check endpoints eventually.
+const userCacheTTL = time.Minute * 30
+
+func NewPermissionResolver(opts *PermissionResolverOpts) *PermissionResolverImpl {
+	resolver := &PermissionResolverImpl{
+		users:   opts.Users,
+		roles:   opts.Roles,
+		members: opts.Members,
+		permissions: map[string]string{
+
+			"PATCH /api/group/:id/update":  "RenameGroup",
+			"DELETE /api/group/:id/delete": "DeleteGroup",
+
+			"POST /api/group/:id/member/invite_batch":        "InviteMember",
+			"GET /api/group/:id/invitations":                 "InviteMember",
+			"GET /api/group/:id/invitation/:invitationId":    "InviteMember",
+			"DELETE /api/group/:id/invitation/:invitationId": "InviteMember",
+
+			"POST /api/group/:id/role/update":        "ManageRoles",
+			"POST /api/group/:id/role/delete":        "ManageRoles",
+			"POST /api/group/:id/member/add_role":    "ManageRoles",
+			"POST /api/group/:id/member/remove_role": "ManageRoles",
+			"GET /api/group/:id/export_config":       "ManageRoles",
+			"POST /api/group/:id/import_config":      "ManageRoles",
+
+			"GET /api/group/:id/logs":        "ViewLogs",
+			"GET /api/group/:id/logs/count":  "ViewLogs",
+			"GET /api/group/:id/logs/stream": "ViewLogs",
+			"GET /api/group/:id/alerts":      "ViewLogs",
+
+			// case service
+			"/api/case/cis18/create": "CreateCase",
+			"/api/case/nis2/create":  "CreateCase",
+
+			"/api/case/updateMetadata": "UpdateCaseMetadata",
+			"/api/case/delete":         "DeleteCase",
+		},
+		cache:       make(map[string]*types.User),
+		decisions:   make(map[memberKey]*permissionCacheEntry),
+		memberships: make(map[memberKey]time.Time),
+	}
+	mustKnowPermissions(resolver.permissions)
+	go resolver.cacheFlushWorker()
+	return resolver
+}
+
+// Panics if the map refers to a permission missing from the catalogue, so typos surface at startup.
+func mustKnowPermissions(permissions map[string]string) {
+	for key, permission := range permissions {
+		if _, exists := types.LookupPermission(permission); !exists {
+			panic(fmt.Errorf("unknown permission %q required by %s", permission, key))
+		}
+	}
+}
+
+// Flushes the user cache periodically, and the memberships and permissions that have expired since.
+func (resolver *PermissionResolverImpl) cacheFlushWorker() {
+	log.Println("permission resolver cache flush worker started.")
+	ticker := time.NewTicker(userCacheTTL)
+	defer func() {
+		ticker.Stop()
+		log.Println("permission resolver cache flush worker stopped.")
+	}()
+	for {
+		<-ticker.C
+		resolver.mu.Lock()
+		resolver.cache = make(map[string]*types.User)
+		resolver.mu.Unlock()
+
+		now := time.Now()
+		resolver.decisionsMu.Lock()
+		for key, entry := range resolver.decisions {
+			if now.After(entry.expires) {
+				delete(resolver.decisions, key)
+			}
+		}
+		for key, expires := range resolver.memberships {
+			if now.After(expires) {
+				delete(resolver.memberships, key)
+			}
+		}
+		resolver.decisionsMu.Unlock()
+	}
+}
+
+func (resolver *PermissionResolverImpl) ForRoute(method string, path string) (string, bool) {
+	permission, exists := resolver.permissions[fmt.Sprintf("%s %s", method, path)]
+	return permission, exists
+}
+
+func (resolver *PermissionResolverImpl) ForAction(action string) (string, bool) {
+	permission, exists := resolver.permissions[action]
+	return permission, exists
+}
+
+// Returns a placeholder rather than an error if the user can't be read, as it's only used for logging.
+func (resolver *PermissionResolverImpl) UserEmail(userId string) string {
+	user, err := resolver.User(userId)
+	if err != nil {
+		log.Printf("error reading user by id to get mail for logging: %+v\n", err)
+		return "Error reading email"
+	}
+	return user.Email
+}
+
+func (resolver *PermissionResolverImpl) User(userId string) (*types.User, error) {
+	resolver.mu.Lock()
+	cached, exists := resolver.cache[userId]
+	resolver.mu.Unlock()
+	if exists {
+		user := *cached
+		return &user, nil
+	}
+	user, err := resolver.users.ReadUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = ""
+	cached = &types.User{}
+	*cached = *user
+	resolver.mu.Lock()
+	resolver.cache[userId] = cached
+	resolver.mu.Unlock()
+	return user, nil
+}
+
+func (resolver *PermissionResolverImpl) IsMember(ctx context.Context, userId string, groupId string) (bool, error) {
+	key := memberKey{userId: userId, groupId: groupId}
+	resolver.decisionsMu.Lock()
+	expires, exists := resolver.memberships[key]
+	generation := resolver.generation
+	resolver.decisionsMu.Unlock()
+	if exists && time.Now().Before(expires) {
+		return true, nil
+	}
+
+	isMember, err := resolver.members.IsMember(ctx, userId, groupId)
+	if err != nil || !isMember {
+		return isMember, err
+	}
+
+	resolver.decisionsMu.Lock()
+	if resolver.generation == generation {
+		resolver.memberships[key] = time.Now().Add(permissionCacheTTL)
+	}
+	resolver.decisionsMu.Unlock()
+	return true, nil
+}
+
+func (resolver *PermissionResolverImpl) MemberPermissions(userId string, groupId string) (*types.Permissions, error) {
+	key := memberKey{userId: userId, groupId: groupId}
+	resolver.decisionsMu.Lock()
+	entry, exists := resolver.decisions[key]
+	generation := resolver.generation
+	resolver.decisionsMu.Unlock()
+	if exists && time.Now().Before(entry.expires) {
+		resolver.hits.Add(1)
+		permissions := entry.permissions
+		return &permissions, nil
+	}
+	resolver.misses.Add(1)
+
+	roles, err := resolver.roles.ReadMemberRoles(userId, groupId)
+	if err != nil {
+		return nil, err
+	}
+	permissions := AggregatePermissions(roles)
+
+	resolver.decisionsMu.Lock()
+	if resolver.generation == generation {
+		resolver.decisions[key] = &permissionCacheEntry{
+			permissions: *permissions,
+			expires:     time.Now().Add(permissionCacheTTL),
+		}
+	}
+	resolver.decisionsMu.Unlock()
+	return permissions, nil
+}
+
+func (resolver *PermissionResolverImpl) InvalidateMember(userId string, groupId string) {
+	resolver.decisionsMu.Lock()
+	defer resolver.decisionsMu.Unlock()
+	resolver.generation++
+	delete(resolver.decisions, memberKey{userId: userId, groupId: groupId})
+	delete(resolver.memberships, memberKey{userId: userId, groupId: groupId})
+}
+
+func (resolver *PermissionResolverImpl) InvalidateGroup(groupId string) {
+	resolver.decisionsMu.Lock()
+	defer resolver.decisionsMu.Unlock()
+	resolver.generation++
+	for key := range resolver.decisions {
+		if key.groupId == groupId {
+			delete(resolver.decisions, key)
+		}
+	}
+	for key := range resolver.memberships {
+		if key.groupId == groupId {
+			delete(resolver.memberships, key)
+		}
+	}
+}
+
+func (resolver *PermissionResolverImpl) PermissionCacheStats() *types.PermissionCacheStats {
+	resolver.decisionsMu.Lock()
+	entries := len(resolver.decisions)
+	resolver.decisionsMu.Unlock()
+	return &types.PermissionCacheStats{
+		Hits:    resolver.hits.Load(),
+		Misses:  resolver.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// Combines the permissions of all the given roles, a permission is granted if any role grants it.
+func AggregatePermissions(roles []*types.Role) *types.Permissions {
+	var p types.Permissions
+	for _, role := range roles {
+		for _, permission := range types.PermissionCatalogue {
+			if permission.Granted(&role.Permissions) {
+				*permission.Field(&p) = true
+			}
+		}
+	}
+	return &p
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"user.service.altiore.io/types"
+)
+
+func TestAggregatePermissionsGrantsWhatAnyRoleGrants(t *testing.T) {
+	for _, permission := range types.PermissionCatalogue {
+		granting := &types.Role{Name: "granting"}
+		*permission.Field(&granting.Permissions) = true
+		aggregated := AggregatePermissions([]*types.Role{{Name: "empty"}, granting})
+		for _, other := range types.PermissionCatalogue {
+			if granted := other.Granted(aggregated); granted != (other == permission) {
+				t.Errorf("a role granting %s aggregated to %s=%v", permission.Key, other.Key, granted)
+			}
+		}
+	}
+}
+
+func TestAggregatePermissionsWithoutRoles(t *testing.T) {
+	if aggregated := AggregatePermissions(nil); *aggregated != (types.Permissions{}) {
+		t.Errorf("no roles aggregated to %+v", aggregated)
+	}
+}
+
+// Roles and memberships as stored, changed by the tests behind the resolver's back.
+type fakeRoleStore struct {
+	mu      sync.Mutex
+	roles   map[string][]*types.Role // "userId groupId"
+	members map[string]bool
+}
+
+func newFakeRoleStore() *fakeRoleStore {
+	return &fakeRoleStore{roles: make(map[string][]*types.Role), members: make(map[string]bool)}
+}
+
+func (store *fakeRoleStore) grant(userId string, groupId string, permission string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	role := &types.Role{Name: permission, GroupId: groupId}
+	info, _ := types.LookupPermission(permission)
+	*info.Field(&role.Permissions) = true
+	store.roles[userId+" "+groupId] = []*types.Role{role}
+	store.members[userId+" "+groupId] = true
+}
+
+func (store *fakeRoleStore) revoke(userId string, groupId string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.roles, userId+" "+groupId)
+}
+
+func (store *fakeRoleStore) ReadMemberRoles(userId string, groupId string) ([]*types.Role, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.roles[userId+" "+groupId], nil
+}
+
+func (store *fakeRoleStore) IsMember(ctx context.Context, userId string, groupId string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.members[userId+" "+groupId], nil
+}
+
+func (store *fakeRoleStore) ReadUserById(userId string) (*types.User, error) {
+	return &types.User{Id: userId}, nil
+}
+
+func newTestResolver(store *fakeRoleStore) *PermissionResolverImpl {
+	return NewPermissionResolver(&PermissionResolverOpts{Users: store, Roles: store, Members: store})
+}
+
+func mustManageRoles(t *testing.T, resolver *PermissionResolverImpl, userId string, groupId string) bool {
+	t.Helper()
+	permissions, err := resolver.MemberPermissions(userId, groupId)
+	if err != nil {
+		t.Fatalf("reading permissions: %v", err)
+	}
+	return permissions.ManageRoles
+}
+
+func TestRoleRevocationTakesEffectImmediately(t *testing.T) {
+	store := newFakeRoleStore()
+	store.grant("user", "group", types.MANAGE_ROLES)
+	resolver := newTestResolver(store)
+
+	if !mustManageRoles(t, resolver, "user", "group") {
+		t.Fatal("the granted permission is missing")
+	}
+	store.revoke("user", "group")
+	// still cached, changes made without invalidating only show once the entry expires
+	if !mustManageRoles(t, resolver, "user", "group") {
+		t.Fatal("the permission wasn't cached")
+	}
+	resolver.InvalidateMember("user", "group")
+	if mustManageRoles(t, resolver, "user", "group") {
+		t.Error("the revoked permission is still granted after invalidating the member")
+	}
+}
+
+func TestGroupInvalidationRevokesEveryMember(t *testing.T) {
+	store := newFakeRoleStore()
+	store.grant("a", "group", types.MANAGE_ROLES)
+	store.grant("b", "group", types.MANAGE_ROLES)
+	store.grant("a", "other", types.MANAGE_ROLES)
+	resolver := newTestResolver(store)
+	for _, key := range [][2]string{{"a", "group"}, {"b", "group"}, {"a", "other"}} {
+		mustManageRoles(t, resolver, key[0], key[1])
+	}
+
+	store.revoke("a", "group")
+	store.revoke("b", "group")
+	store.revoke("a", "other")
+	resolver.InvalidateGroup("group")
+	if mustManageRoles(t, resolver, "a", "group") || mustManageRoles(t, resolver, "b", "group") {
+		t.Error("a revoked permission is still granted after invalidating the group")
+	}
+	if !mustManageRoles(t, resolver, "a", "other") {
+		t.Error("invalidating a group dropped the permissions cached for another")
+	}
+}
+
+func TestMembershipRevocationTakesEffectImmediately(t *testing.T) {
+	store := newFakeRoleStore()
+	store.grant("user", "group", types.VIEW_LOGS)
+	resolver := newTestResolver(store)
+
+	if isMember, _ := resolver.IsMember(context.Background(), "user", "group"); !isMember {
+		t.Fatal("the member isn't a member")
+	}
+	store.mu.Lock()
+	store.members["user group"] = false
+	store.mu.Unlock()
+	resolver.InvalidateMember("user", "group")
+	if isMember, _ := resolver.IsMember(context.Background(), "user", "group"); isMember {
+		t.Error("the removed member is still a member after invalidating them")
+	}
+}
+
+func TestPermissionCacheCountsHitsAndMisses(t *testing.T) {
+	store := newFakeRoleStore()
+	store.grant("user", "group", types.VIEW_LOGS)
+	resolver := newTestResolver(store)
+
+	mustManageRoles(t, resolver, "user", "group")
+	mustManageRoles(t, resolver, "user", "group")
+	mustManageRoles(t, resolver, "user", "group")
+	stats := resolver.PermissionCacheStats()
+	if stats.Misses != 1 || stats.Hits != 2 || stats.Entries != 1 {
+		t.Errorf("got %+v, want 1 miss, 2 hits and 1 entry", stats)
+	}
+}
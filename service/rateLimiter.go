@@ -0,0 +1,149 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits how often something may happen per key, e.g. mails sent to an address.
+// The in-memory implementation is per instance, a shared backend such as Redis can implement the same interface.
+type RateLimiter interface {
+	// Takes a token from the key's bucket for the policy, returning how long to wait if there is none left.
+	Allow(policy string, key string) (bool, time.Duration)
+	// Number of requests the policy turned away, for monitoring.
+	Throttled(policy string) int64
+}
+
+// Rate limiting policies, each configurable as RATE_LIMIT_<POLICY>, e.g. RATE_LIMIT_INVITE_PER_ADDRESS=3/1h.
+const (
+	RATE_LIMIT_INVITE_PER_CALLER  = "INVITE_PER_CALLER"
+	RATE_LIMIT_INVITE_PER_ADDRESS = "INVITE_PER_ADDRESS"
+	RATE_LIMIT_RESET_PER_CALLER   = "RESET_PER_CALLER"
+	RATE_LIMIT_RESET_PER_ADDRESS  = "RESET_PER_ADDRESS"
+)
+
+// Allows Burst requests at once, refilling the whole bucket over Per.
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+var defaultRateLimits = map[string]RateLimit{
+	RATE_LIMIT_INVITE_PER_CALLER:  {Burst: 30, Per: time.Hour},
+	RATE_LIMIT_INVITE_PER_ADDRESS: {Burst: 3, Per: time.Hour},
+	RATE_LIMIT_RESET_PER_CALLER:   {Burst: 10, Per: time.Hour},
+	RATE_LIMIT_RESET_PER_ADDRESS:  {Burst: 3, Per: time.Hour},
+}
+
+type RateLimiterOpts struct{}
+
+type RateLimiterImpl struct {
+	limits    map[string]RateLimit
+	throttled map[string]*atomic.Int64
+
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// How often buckets that have filled up again are dropped.
+const rateLimiterCleanupInterval = time.Minute * 10
+
+func NewRateLimiter(opts *RateLimiterOpts) *RateLimiterImpl {
+	limiter := &RateLimiterImpl{
+		limits:    make(map[string]RateLimit),
+		throttled: make(map[string]*atomic.Int64),
+		buckets:   make(map[string]*bucket),
+	}
+	for policy, limit := range defaultRateLimits {
+		if value := os.Getenv("RATE_LIMIT_" + policy); value != "" {
+			parsed, err := parseRateLimit(value)
+			if err != nil {
+				log.Fatalf("RATE_LIMIT_%s is invalid: %v", policy, err)
+			}
+			limit = parsed
+		}
+		limiter.limits[policy] = limit
+		limiter.throttled[policy] = new(atomic.Int64)
+	}
+	go limiter.cleanupWorker()
+	return limiter
+}
+
+// Parses "<burst>/<duration>", e.g. "3/1h".
+func parseRateLimit(value string) (RateLimit, error) {
+	burst, per, found := strings.Cut(value, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("expected <burst>/<duration>, got %q", value)
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 1 {
+		return RateLimit{}, fmt.Errorf("burst must be a positive number, got %q", burst)
+	}
+	p, err := time.ParseDuration(per)
+	if err != nil || p <= 0 {
+		return RateLimit{}, fmt.Errorf("duration must be positive, got %q", per)
+	}
+	return RateLimit{Burst: b, Per: p}, nil
+}
+
+func (limiter *RateLimiterImpl) Allow(policy string, key string) (bool, time.Duration) {
+	limit, exists := limiter.limits[policy]
+	if !exists {
+		panic(fmt.Errorf("unknown rate limit policy %q", policy))
+	}
+	refill := float64(limit.Burst) / float64(limit.Per)
+	now := time.Now()
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	b, exists := limiter.buckets[policy+":"+key]
+	if !exists {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		limiter.buckets[policy+":"+key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(now.Sub(b.updated))*refill)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	limiter.throttled[policy].Add(1)
+	log.Printf("rate limited by %s\n", policy)
+	return false, time.Duration((1 - b.tokens) / refill)
+}
+
+func (limiter *RateLimiterImpl) Throttled(policy string) int64 {
+	if counter, exists := limiter.throttled[policy]; exists {
+		return counter.Load()
+	}
+	return 0
+}
+
+// Drops buckets that have been idle long enough to be full again, they'd start out full anyway.
+func (limiter *RateLimiterImpl) cleanupWorker() {
+	ticker := time.NewTicker(rateLimiterCleanupInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		limiter.mu.Lock()
+		for key, b := range limiter.buckets {
+			policy, _, _ := strings.Cut(key, ":")
+			if time.Since(b.updated) > limiter.limits[policy].Per {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.mu.Unlock()
+	}
+}
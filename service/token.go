@@ -12,21 +12,61 @@ import (
 type TokenService interface {
 	NewToken(audience string) (string, error)
 	CheckToken(token string) error
+	// Reports a token's claims and the outcome of every check, never the secret.
+	Inspect(token string) *types.TokenInspection
+
+	// Whether session tokens are handed out and accepted, SESSION_TOKENS=true.
+	SessionsEnabled() bool
+	SessionTTL() time.Duration
+	NewSessionToken(session *types.Session) (*types.SessionToken, error)
+	// Checks a session token locally, an expired token still returns its claims along with ErrSessionExpired.
+	CheckSessionToken(token string) (*types.SessionClaims, error)
+	// Whether a session may be extended with a new session token.
+	CheckSessionRefresh(session *types.Session) error
 }
 
 type TokenServiceImpl struct {
 	service_token_secret string
 	issuer               string
+	// optional, the audience Inspect advises tokens to carry, CheckToken doesn't check it
+	audience string
 	//internalList         []string
+
+	// session tokens are signed with their own secret, so a session token can never pass as a service token
+	sessions      bool
+	sessionSecret string
+	sessionTTL    time.Duration
+	// how long after signing in a session can be refreshed, before the user has to go through firebase again
+	sessionMaxAge time.Duration
 }
 
+const (
+	defaultSessionTTL    = time.Minute * 15
+	defaultSessionMaxAge = time.Hour * 24 * 7
+
+	// the audience of session tokens, tokens for anything else are rejected as session tokens
+	sessionAudience = "session"
+)
+
 type TokenServiceOpts struct{}
 
 func NewTokenService(opts *TokenServiceOpts) TokenService {
-	return &TokenServiceImpl{
+	service := &TokenServiceImpl{
 		service_token_secret: os.Getenv("SERVICE_TOKEN_SECRET"),
 		issuer:               os.Getenv("SERVICE_TOKEN_ISSUER"),
+		audience:             os.Getenv("SERVICE_TOKEN_AUDIENCE"),
+		sessions:             os.Getenv("SESSION_TOKENS") == "true",
+		sessionSecret:        os.Getenv("SESSION_TOKEN_SECRET"),
+		sessionTTL:           defaultSessionTTL,
+		sessionMaxAge:        defaultSessionMaxAge,
+	}
+	if value, err := time.ParseDuration(os.Getenv("SESSION_TOKEN_TTL")); err == nil && value > 0 {
+		service.sessionTTL = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("SESSION_MAX_AGE")); err == nil && value > 0 {
+		service.sessionMaxAge = value
 	}
+	return service
 }
 
 // Generates a new JWT for the specified audience.
@@ -44,12 +84,7 @@ func (service *TokenServiceImpl) NewToken(audience string) (string, error) {
 }
 
 func (service *TokenServiceImpl) CheckToken(token string) error {
-	_token, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %+v", t.Header["alg"])
-		}
-		return []byte(service.service_token_secret), nil
-	})
+	_token, err := jwt.Parse(token, service.serviceTokenKey)
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
 			return fmt.Errorf("invalid token signature")
@@ -67,3 +102,135 @@ func (service *TokenServiceImpl) CheckToken(token string) error {
 
 	return nil
 }
+
+// The key internal tokens are signed with, refusing tokens signed any other way than with HMAC.
+func (service *TokenServiceImpl) serviceTokenKey(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %+v", t.Header["alg"])
+	}
+	return []byte(service.service_token_secret), nil
+}
+
+// Parses the token without trusting it and runs every check on its own, so a rejected token shows which check failed,
+// e.g. an expiry in the past on a clock running behind, or a signature made with another secret.
+// Valid is exactly what CheckToken accepts and Reason names the check it failed. The issuer, the audience and a
+// required expiry are advisory only, as CheckToken doesn't check them.
+func (service *TokenServiceImpl) Inspect(token string) *types.TokenInspection {
+	now := time.Now()
+	inspection := &types.TokenInspection{
+		ServerTime:       now.UTC().Format(time.RFC3339),
+		ExpectedIssuer:   service.issuer,
+		ExpectedAudience: service.audience,
+	}
+	claims := jwt.MapClaims{}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		inspection.Reason = fmt.Sprintf("malformed token: %v", err)
+		return inspection
+	}
+	inspection.Header = parsed.Header
+	inspection.Claims = claims
+
+	_, signatureErr := jwt.NewParser(jwt.WithoutClaimsValidation()).Parse(token, service.serviceTokenKey)
+	// the same validation the parser runs in CheckToken
+	timesErr := claims.Valid()
+	inspection.Checks = types.TokenChecks{
+		Signature: signatureErr == nil,
+		Times:     timesErr == nil,
+	}
+	inspection.Advisory = types.TokenAdvisoryChecks{
+		Issuer:   claims.VerifyIssuer(service.issuer, true),
+		Audience: service.audience == "" || claims.VerifyAudience(service.audience, true),
+		Expiry:   claims.VerifyExpiresAt(now.Unix(), true),
+	}
+
+	// decided by CheckToken itself, the checks above only explain its answer
+	err = service.CheckToken(token)
+	inspection.Valid = err == nil
+	switch {
+	case inspection.Valid:
+	case signatureErr != nil:
+		inspection.Reason = fmt.Sprintf("signature: %v", signatureErr)
+	case timesErr != nil:
+		inspection.Reason = fmt.Sprintf("times: %v, compare with serverTime", timesErr)
+	default:
+		inspection.Reason = err.Error()
+	}
+	return inspection
+}
+
+func (service *TokenServiceImpl) SessionsEnabled() bool {
+	return service.sessions
+}
+
+func (service *TokenServiceImpl) SessionTTL() time.Duration {
+	return service.sessionTTL
+}
+
+// Mints a short-lived session token for the session, carrying the user and session id.
+func (service *TokenServiceImpl) NewSessionToken(session *types.Session) (*types.SessionToken, error) {
+	now := time.Now()
+	expiresAt := now.Add(service.sessionTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": service.issuer,
+		"aud": sessionAudience,
+		"sub": session.UserId,
+		"sid": session.Id,
+		"iat": now.Unix(),
+		"exp": expiresAt.Unix(),
+	})
+	signedToken, err := token.SignedString([]byte(service.sessionSecret))
+	if err != nil {
+		return nil, fmt.Errorf("error signing session token: %w", err)
+	}
+	return &types.SessionToken{
+		Token:     signedToken,
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// Verifies a session token without leaving the service. The expiry is checked apart from the rest, so refreshing
+// can tell an expired token from a forged one.
+func (service *TokenServiceImpl) CheckSessionToken(token string) (*types.SessionClaims, error) {
+	if !service.sessions {
+		return nil, types.ErrInvalidToken
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(jwt.WithoutClaimsValidation()).ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %+v", t.Header["alg"])
+		}
+		return []byte(service.sessionSecret), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", types.ErrInvalidToken, err)
+	}
+	if !claims.VerifyIssuer(service.issuer, true) || !claims.VerifyAudience(sessionAudience, true) {
+		return nil, fmt.Errorf("%w: not a session token", types.ErrInvalidToken)
+	}
+	userId, _ := claims["sub"].(string)
+	sessionId, _ := claims["sid"].(string)
+	exp, ok := claims["exp"].(float64)
+	if userId == "" || sessionId == "" || !ok {
+		return nil, fmt.Errorf("%w: session claims missing", types.ErrInvalidToken)
+	}
+	sessionClaims := &types.SessionClaims{
+		UserId:    userId,
+		SessionId: sessionId,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}
+	if !time.Now().Before(sessionClaims.ExpiresAt) {
+		return sessionClaims, types.ErrSessionExpired
+	}
+	return sessionClaims, nil
+}
+
+func (service *TokenServiceImpl) CheckSessionRefresh(session *types.Session) error {
+	if session.RevokedAt != nil {
+		return types.ErrSessionRevoked
+	}
+	if time.Since(session.CreatedAt) > service.sessionMaxAge {
+		return fmt.Errorf("%w: signed in more than %s ago", types.ErrSessionExpired, service.sessionMaxAge)
+	}
+	return nil
+}
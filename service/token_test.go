@@ -0,0 +1,105 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"user.service.altiore.io/types"
+)
+
+// A session token checks out as the session it was minted for, and not at all with another secret or as a
+// service token.
+func TestSessionTokensRoundTrip(t *testing.T) {
+	t.Setenv("SESSION_TOKENS", "true")
+	t.Setenv("SESSION_TOKEN_SECRET", "session-secret")
+	t.Setenv("SERVICE_TOKEN_SECRET", "service-secret")
+	t.Setenv("SERVICE_TOKEN_ISSUER", "user-service")
+	tokens := NewTokenService(nil)
+	session, err := tokens.NewSessionToken(&types.Session{Id: "session", UserId: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.CheckSessionToken(session.Token)
+	if err != nil || claims.UserId != "user" || claims.SessionId != "session" {
+		t.Fatalf("got %+v, %v, want the session's claims", claims, err)
+	}
+	if err := tokens.CheckToken(session.Token); err == nil {
+		t.Error("a session token passed as a service token")
+	}
+
+	t.Setenv("SESSION_TOKEN_SECRET", "another-secret")
+	if _, err := NewTokenService(nil).CheckSessionToken(session.Token); !errors.Is(err, types.ErrInvalidToken) {
+		t.Errorf("checking with another secret got %v, want ErrInvalidToken", err)
+	}
+}
+
+// Revoked sessions and sessions signed in to too long ago can't be refreshed.
+func TestSessionRefresh(t *testing.T) {
+	t.Setenv("SESSION_MAX_AGE", "1h")
+	tokens := NewTokenService(nil)
+	revokedAt := time.Now()
+	for _, tc := range []struct {
+		name    string
+		session *types.Session
+		want    error
+	}{
+		{"recent", &types.Session{CreatedAt: time.Now().Add(-time.Minute)}, nil},
+		{"revoked", &types.Session{CreatedAt: time.Now(), RevokedAt: &revokedAt}, types.ErrSessionRevoked},
+		{"too old", &types.Session{CreatedAt: time.Now().Add(-time.Hour * 2)}, types.ErrSessionExpired},
+	} {
+		if err := tokens.CheckSessionRefresh(tc.session); !errors.Is(err, tc.want) {
+			t.Errorf("refreshing a %s session got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+// An inspection is valid exactly when CheckToken accepts the token, the issuer, the audience and a missing expiry
+// are only advised on.
+func TestInspectAgreesWithCheckToken(t *testing.T) {
+	t.Setenv("SERVICE_TOKEN_SECRET", "service-secret")
+	t.Setenv("SERVICE_TOKEN_ISSUER", "user-service")
+	t.Setenv("SERVICE_TOKEN_AUDIENCE", "case-service")
+	tokens := NewTokenService(nil)
+	sign := func(secret string, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	inFuture, inPast := time.Now().Add(time.Minute).Unix(), time.Now().Add(-time.Minute).Unix()
+
+	for _, tc := range []struct {
+		name     string
+		token    string
+		valid    bool
+		reason   string
+		advisory types.TokenAdvisoryChecks
+	}{
+		{"expected", sign("service-secret", jwt.MapClaims{"iss": "user-service", "aud": "case-service", "exp": inFuture}),
+			true, "", types.TokenAdvisoryChecks{Issuer: true, Audience: true, Expiry: true}},
+		{"another issuer and audience", sign("service-secret", jwt.MapClaims{"iss": "elsewhere", "aud": "elsewhere", "exp": inFuture}),
+			true, "", types.TokenAdvisoryChecks{Expiry: true}},
+		{"without exp", sign("service-secret", jwt.MapClaims{"iss": "user-service", "aud": "case-service"}),
+			true, "", types.TokenAdvisoryChecks{Issuer: true, Audience: true}},
+		{"expired", sign("service-secret", jwt.MapClaims{"iss": "user-service", "aud": "case-service", "exp": inPast}),
+			false, "times", types.TokenAdvisoryChecks{Issuer: true, Audience: true}},
+		{"signed with another secret", sign("another-secret", jwt.MapClaims{"iss": "user-service", "aud": "case-service", "exp": inFuture}),
+			false, "signature", types.TokenAdvisoryChecks{Issuer: true, Audience: true, Expiry: true}},
+		{"malformed", "not-a-token", false, "malformed", types.TokenAdvisoryChecks{}},
+	} {
+		inspection := tokens.Inspect(tc.token)
+		if checked := tokens.CheckToken(tc.token) == nil; inspection.Valid != checked || inspection.Valid != tc.valid {
+			t.Errorf("%s: inspected valid=%t, CheckToken accepted=%t, want %t", tc.name, inspection.Valid, checked, tc.valid)
+		}
+		if !strings.HasPrefix(inspection.Reason, tc.reason) || (tc.reason == "") != (inspection.Reason == "") {
+			t.Errorf("%s: got reason %q, want one starting with %q", tc.name, inspection.Reason, tc.reason)
+		}
+		if inspection.Advisory != tc.advisory {
+			t.Errorf("%s: got advisory checks %+v, want %+v", tc.name, inspection.Advisory, tc.advisory)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"user.service.altiore.io/types"
+)
+
+type WebhookService interface {
+	Emit(event string, data any)
+	Failures() int64
+}
+
+type WebhookServiceOpts struct{}
+
+type WebhookServiceImpl struct {
+	targets   []string
+	secret    string
+	client    *http.Client
+	eventChan chan *types.WebhookEvent
+	failures  atomic.Int64
+}
+
+const (
+	webhookAttempts = 5
+	webhookWorkers  = 2
+)
+
+// Creates the webhook dispatcher, targets are read from WEBHOOK_URLS (comma separated) and signed with WEBHOOK_SECRET.
+func NewWebhookService(opts *WebhookServiceOpts) *WebhookServiceImpl {
+	s := &WebhookServiceImpl{
+		secret:    os.Getenv("WEBHOOK_SECRET"),
+		client:    &http.Client{Timeout: time.Second * 10},
+		eventChan: make(chan *types.WebhookEvent, 100),
+	}
+	for _, target := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			s.targets = append(s.targets, target)
+		}
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go s.deliveryWorker()
+	}
+	return s
+}
+
+// Queues an event for delivery to every target, never blocks the caller.
+func (service *WebhookServiceImpl) Emit(event string, data any) {
+	if len(service.targets) == 0 {
+		return
+	}
+	e := &types.WebhookEvent{
+		Id:        uuid.NewString(),
+		Event:     event,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Data:      data,
+	}
+	select {
+	case service.eventChan <- e:
+	default:
+		service.failures.Add(1)
+		log.Printf("webhook queue full, dropping %s event %s\n", e.Event, e.Id)
+	}
+}
+
+// Number of deliveries that failed after all attempts, or were dropped.
+func (service *WebhookServiceImpl) Failures() int64 {
+	return service.failures.Load()
+}
+
+// Worker responsible for delivering queued events.
+func (service *WebhookServiceImpl) deliveryWorker() {
+	for e := range service.eventChan {
+		body, err := json.Marshal(e)
+		if err != nil {
+			service.failures.Add(1)
+			log.Printf("error encoding webhook event: %+v\n", err)
+			continue
+		}
+		for _, target := range service.targets {
+			service.deliver(target, e, body)
+		}
+	}
+}
+
+// Delivers an event to a single target, retrying with exponential backoff.
+func (service *WebhookServiceImpl) deliver(target string, e *types.WebhookEvent, body []byte) {
+	delay := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err := service.post(target, body)
+		if err == nil {
+			return
+		}
+		log.Printf("webhook delivery of %s event %s to %s failed (attempt %d): %+v\n", e.Event, e.Id, target, attempt, err)
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	service.failures.Add(1)
+}
+
+func (service *WebhookServiceImpl) post(target string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", "sha256="+service.sign(body))
+	res, err := service.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("target responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// HMAC-SHA256 of the body using the webhook secret, hex encoded.
+func (service *WebhookServiceImpl) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(service.secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,108 @@
+// Package singleton keeps the one instance per key of services and repositories that hold resources, such as
+// database pools and background workers, so constructing one twice hands back the first.
+package singleton
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Instances of T by key, built on first use. A build runs with the registry locked, so concurrent callers for
+// a key wait for it and all get the same instance. A failed build isn't kept, the next call tries again.
+type Registry[T any] struct {
+	name      string
+	warnAbove int
+	instances map[string]T
+	mu        sync.Mutex
+}
+
+// Every registry, for Counts.
+var (
+	registries   []counter
+	registriesMu sync.Mutex
+)
+
+type counter interface {
+	label() string
+	Len() int
+}
+
+// Creates a registry, name describing its instances in logs, e.g. "database pool". A warning is logged
+// whenever a build leaves more than warnAbove instances, as a second one usually means a mistyped key.
+// Zero never warns.
+func NewRegistry[T any](name string, warnAbove int) *Registry[T] {
+	registry := &Registry[T]{name: name, warnAbove: warnAbove, instances: make(map[string]T)}
+	registriesMu.Lock()
+	registries = append(registries, registry)
+	registriesMu.Unlock()
+	return registry
+}
+
+// Returns the instance for the key, building it if there is none yet.
+func (registry *Registry[T]) Get(key string, build func() (T, error)) (T, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if instance, exists := registry.instances[key]; exists {
+		return instance, nil
+	}
+	instance, err := build()
+	if err != nil {
+		return instance, err
+	}
+	registry.instances[key] = instance
+	if registry.warnAbove > 0 && len(registry.instances) > registry.warnAbove {
+		log.Printf("warning: %d %s instances exist (keys %v), each holds its own resources\n", len(registry.instances), registry.name, registry.keys())
+	}
+	return instance, nil
+}
+
+// Number of instances built so far.
+func (registry *Registry[T]) Len() int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return len(registry.instances)
+}
+
+func (registry *Registry[T]) label() string {
+	return registry.name
+}
+
+func (registry *Registry[T]) keys() []string {
+	keys := make([]string, 0, len(registry.instances))
+	for key := range registry.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Number of instances of every registry by name, for monitoring.
+func Counts() map[string]int {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	counts := make(map[string]int, len(registries))
+	for _, registry := range registries {
+		counts[registry.label()] += registry.Len()
+	}
+	return counts
+}
+
+// Counts formatted for a log line, e.g. "database pool=1 email service=1".
+func Summary() string {
+	counts := Counts()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	summary := ""
+	for i, name := range names {
+		if i > 0 {
+			summary += " "
+		}
+		summary += fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return summary
+}
@@ -0,0 +1,60 @@
+package singleton
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentGetsBuildOnce(t *testing.T) {
+	registry := NewRegistry[*int]("test instance", 1)
+	var builds atomic.Int32
+	instances := make([]*int, 50)
+	var wg sync.WaitGroup
+	for i := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance, err := registry.Get("key", func() (*int, error) {
+				builds.Add(1)
+				return new(int), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			instances[i] = instance
+		}()
+	}
+	wg.Wait()
+
+	if n := builds.Load(); n != 1 {
+		t.Errorf("built %d instances, want 1", n)
+	}
+	for _, instance := range instances {
+		if instance == nil || instance != instances[0] {
+			t.Fatal("callers got different instances")
+		}
+	}
+	if n := registry.Len(); n != 1 {
+		t.Errorf("the registry holds %d instances, want 1", n)
+	}
+}
+
+func TestFailedBuildIsRetried(t *testing.T) {
+	registry := NewRegistry[*int]("retried instance", 1)
+	failure := errors.New("unavailable")
+	if _, err := registry.Get("key", func() (*int, error) { return nil, failure }); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the build's error", err)
+	}
+	if n := registry.Len(); n != 0 {
+		t.Fatalf("a failed build was kept")
+	}
+	instance, err := registry.Get("key", func() (*int, error) { return new(int), nil })
+	if err != nil || instance == nil {
+		t.Fatalf("the next call didn't build: %v", err)
+	}
+	if counts := Counts(); counts["retried instance"] != 1 {
+		t.Errorf("got counts %v", counts)
+	}
+}
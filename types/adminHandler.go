@@ -0,0 +1,15 @@
+package types
+
+// A user as operators see them, never with their password.
+type AdminUser struct {
+	Id            string `json:"id"`
+	Email         string `json:"email"`
+	Verified      bool   `json:"verified"`
+	LastLogin     string `json:"lastLogin"`
+	PlatformAdmin bool   `json:"platformAdmin"`
+}
+
+// The member to make the group's only owner.
+type ReassignOwnerBody struct {
+	UserId string `json:"userId" binding:"required"`
+}
@@ -3,5 +3,65 @@ package types
 import "github.com/gin-gonic/gin"
 
 type Handler interface {
-	RegisterRoutes(*gin.Engine)
+	RegisterRoutes(*gin.RouterGroup)
 }
+
+// Body of every error response, wrapped as {"error": APIError}.
+// Code is stable for clients to switch on, Message is for humans and may change.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// Error codes returned by the API.
+const (
+	CODE_INTERNAL           = "INTERNAL"
+	CODE_INVALID_REQUEST    = "INVALID_REQUEST"
+	CODE_METHOD_NOT_ALLOWED = "METHOD_NOT_ALLOWED"
+
+	// authentication and authorisation
+	CODE_AUTH_HEADER_MISSING   = "AUTH_HEADER_MISSING"
+	CODE_AUTH_HEADER_MALFORMED = "AUTH_HEADER_MALFORMED"
+	CODE_TOKEN_INVALID         = "TOKEN_INVALID"
+	CODE_USER_UNKNOWN          = "USER_UNKNOWN" // the token is valid, but its user has no account here
+	CODE_INVALID_CREDENTIALS   = "INVALID_CREDENTIALS"
+	CODE_WEAK_PASSWORD         = "WEAK_PASSWORD"
+	CODE_USER_NOT_VERIFIED     = "USER_NOT_VERIFIED"
+	CODE_MISSING_PERMISSION    = "MISSING_PERMISSION"
+	CODE_INTERNAL_ONLY         = "INTERNAL_ONLY"
+	CODE_NOT_A_MEMBER          = "NOT_A_MEMBER"
+	CODE_SESSION_EXPIRED       = "SESSION_EXPIRED" // the session can't be refreshed, sign in through firebase again
+
+	// missing resources, NOT_FOUND when it's ambiguous which one is missing
+	CODE_NOT_FOUND            = "NOT_FOUND"
+	CODE_USER_NOT_FOUND       = "USER_NOT_FOUND"
+	CODE_GROUP_NOT_FOUND      = "GROUP_NOT_FOUND"
+	CODE_ROLE_NOT_FOUND       = "ROLE_NOT_FOUND"
+	CODE_INVITATION_NOT_FOUND = "INVITATION_NOT_FOUND"
+	CODE_INVITATION_EXPIRED   = "INVITATION_EXPIRED"
+	CODE_SERVICE_NOT_FOUND    = "SERVICE_NOT_FOUND"
+	CODE_SIGNUP_REQUIRED      = "SIGNUP_REQUIRED"
+
+	// conflicts
+	CODE_USER_EXISTS           = "USER_EXISTS"
+	CODE_ALREADY_MEMBER        = "ALREADY_MEMBER"
+	CODE_GROUP_EXISTS          = "GROUP_EXISTS"
+	CODE_INVITATION_EXISTS     = "INVITATION_EXISTS"
+	CODE_ROLE_ALREADY_ASSIGNED = "ROLE_ALREADY_ASSIGNED"
+	CODE_DUPLICATE_ROLE_NAME   = "DUPLICATE_ROLE_NAME"
+	CODE_LAST_GROUP_OWNER      = "LAST_GROUP_OWNER"
+	CODE_OWNER_ROLE_PROTECTED  = "OWNER_ROLE_PROTECTED"
+	CODE_SERVICE_EXISTS        = "SERVICE_EXISTS"
+	CODE_SERVICE_IN_USE        = "SERVICE_IN_USE"
+	CODE_ALREADY_RUNNING       = "ALREADY_RUNNING"
+	CODE_SLUG_TAKEN            = "SLUG_TAKEN"
+	CODE_VERSION_CONFLICT      = "VERSION_CONFLICT"
+
+	// availability
+	CODE_RATE_LIMITED     = "RATE_LIMITED"
+	CODE_MAINTENANCE      = "MAINTENANCE"
+	CODE_TOO_MANY_STREAMS = "TOO_MANY_STREAMS"
+	CODE_QUOTA_EXCEEDED   = "QUOTA_EXCEEDED"
+	CODE_GROUP_LIMIT      = "GROUP_LIMIT_REACHED"
+)
@@ -2,25 +2,145 @@ package types
 
 import (
 	"database/sql"
+	"time"
 )
 
+// Name of the group every user gets when they'd otherwise have none, on signup or after leaving their last group.
+const DEFAULT_GROUP_NAME = "My Group"
+
+// Days a deleted group can be restored for, before it's cleaned up for good.
+const GROUP_RESTORE_WINDOW_DAYS = 30
+
 type Service struct {
 	Id                  string `json:"id"`
 	Name                string `json:"name"`
 	ImplementationGroup *int   `json:"implementationGroup"`
 	Description         string `json:"description"`
+	Retired             bool   `json:"retired"`
+}
+
+// How often a service was used within a group, Uses is only set for detailed reports.
+type ServiceUsage struct {
+	ServiceId           string        `json:"serviceId"`
+	Name                string        `json:"name"`
+	ImplementationGroup *int          `json:"implementationGroup"`
+	Count               int           `json:"count"`
+	Uses                []*ServiceUse `json:"uses,omitempty"`
+}
+
+// A single use of a service, UsedAt is nil for uses recorded before timestamps were kept.
+type ServiceUse struct {
+	ServiceId string     `json:"-"`
+	UserId    string     `json:"userId"`
+	Email     string     `json:"email"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// A group's use of a service within the current calendar month (UTC), against the group's monthly limit.
+type QuotaUsage struct {
+	ServiceName  string `json:"serviceName"`
+	MonthlyLimit int    `json:"monthlyLimit"`
+	Used         int    `json:"used"`
+	Remaining    int    `json:"remaining"`
+	ResetsAt     string `json:"resetsAt"`
+}
+
+// A group's month-to-date use of a service, MonthlyLimit and Remaining are nil while its use is unlimited.
+// History is only set when asked for, oldest month first, ending with the current one.
+type ServiceUsageSummary struct {
+	ServiceName  string          `json:"serviceName"`
+	Used         int             `json:"used"`
+	MonthlyLimit *int            `json:"monthlyLimit"`
+	Remaining    *int            `json:"remaining"`
+	History      []*MonthlyUsage `json:"history,omitempty"`
+}
+
+// Uses of a service within a calendar month, e.g. "2026-05".
+type MonthlyUsage struct {
+	Month string `json:"month"`
+	Count int    `json:"count"`
+}
+
+type GroupUsage struct {
+	ResetsAt string                 `json:"resetsAt"`
+	Services []*ServiceUsageSummary `json:"services"`
 }
 
 type Organisation struct {
-	Id              string `json:"id"`
-	Name            string `json:"name"`
-	CasePermissions []any  `json:"casePermissions"`
-	Members         []any  `json:"members"`
+	Id          string       `json:"id"`
+	Name        string       `json:"name"`
+	Slug        string       `json:"slug,omitempty"`
+	MemberCount int          `json:"memberCount,omitempty"`
+	Permissions *Permissions `json:"permissions,omitempty"`
+	// Incremented by every metadata update, which may require it to match, see UpdateGroupBody.
+	Version int `json:"version,omitempty"`
+	// Unknown for groups created before it was recorded, the creator of older ones is their owner if they had one.
+	CreatedBy *GroupCreator `json:"createdBy,omitempty"`
+	CreatedAt *time.Time    `json:"createdAt,omitempty"`
+}
+
+// The user who created a group, the email is missing once they've deleted their account.
+type GroupCreator struct {
+	UserId      string `json:"userId"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// A group as other services see it, deleted groups included until they're purged.
+type GroupInfo struct {
+	Id          string     `json:"id"`
+	Name        string     `json:"name"`
+	MemberCount int        `json:"memberCount"`
+	Deleted     bool       `json:"deleted"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+
+	CreatedBy *GroupCreator `json:"createdBy,omitempty"`
+	CreatedAt *time.Time    `json:"createdAt,omitempty"`
 }
 
 type OrganisationMember struct {
-	Id    string `json:"id"`
-	Email string `json:"email"`
+	Id          string         `json:"id"`
+	Email       string         `json:"email"`
+	DisplayName string         `json:"displayName,omitempty"`
+	Disabled    bool           `json:"disabled"`
+	LastLogin   string         `json:"lastLogin"`
+	Roles       []*RoleSummary `json:"roles"`
+}
+
+// One page of a group's members, ordered by email. NextCursor is empty on the last page.
+type MemberPage struct {
+	Members    []*OrganisationMember `json:"members"`
+	NextCursor string                `json:"nextCursor,omitempty"`
+	Total      int                   `json:"total"`
+	// the last member of the page if there are more, encoded into NextCursor by the handler
+	Next *MemberCursor `json:"-"`
+}
+
+// Position after a member in the listing, members sort by email and then id.
+type MemberCursor struct {
+	Email string `json:"e"`
+	Id    string `json:"i"`
+}
+
+// An invitation to a group, UserId is the invitee's if they had an account when invited.
+// InvitedBy is the inviting user's id, nil if unknown. The inviter's email and name are only set by listings.
+// Expired invitations were sent before invitation links carried a token, their links no longer work.
+type Invitation struct {
+	Id             string  `json:"id"`
+	UserId         string  `json:"-"`
+	Email          string  `json:"email"`
+	GroupId        string  `json:"groupId"`
+	InvitedBy      *string `json:"invitedBy"`
+	InvitedByEmail string  `json:"invitedByEmail,omitempty"`
+	InvitedByName  string  `json:"invitedByName,omitempty"`
+	Expired        bool    `json:"expired,omitempty"`
+}
+
+// Lightweight role reference, used when listing roles alongside other data.
+type RoleSummary struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 // Interface allowing for dynamic methods differing between client and transaction use.
@@ -28,6 +148,7 @@ type Execer interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Prepare(query string) (*sql.Stmt, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type User struct {
@@ -36,4 +157,5 @@ type User struct {
 	Password  string `json:"password"`
 	LastLogin string `json:"lastLogin"`
 	Verified  bool   `json:"verified"`
+	Locale    string `json:"locale"`
 }
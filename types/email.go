@@ -0,0 +1,32 @@
+package types
+
+import "strings"
+
+// Brings an email address to the one form it's stored and compared in, trimmed and lowercased.
+// RFC 5321 allows a case-sensitive local part, but no provider our users sign up with treats it that way,
+// and "Alice@Example.com" failing to match "alice@example.com" is the far likelier mistake, so the whole
+// address is lowercased rather than just the domain.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Template data for the weekly audit digest mail, From and To are the dates the week starts and ends on.
+type AuditDigestMailData struct {
+	Group   string
+	From    string
+	To      string
+	Total   int
+	Summary []*LogSummary
+	Link    string
+}
+
+// Template data for the security alert mail, Count and Window as for the alert.
+type AlertMailData struct {
+	Group  string
+	Rule   string
+	Email  string
+	At     string
+	Count  int
+	Window string
+	Link   string
+}
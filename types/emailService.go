@@ -0,0 +1,49 @@
+package types
+
+// Locales emails can be sent in, a user's locale is one of these.
+var (
+	LOCALE_EN = "en"
+	LOCALE_DA = "da"
+
+	DEFAULT_LOCALE   = LOCALE_EN
+	SupportedLocales = []string{LOCALE_EN, LOCALE_DA}
+)
+
+// A rendered email, with a plain text and a HTML alternative, and optionally attachments.
+type EmailMessage struct {
+	From        string
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []EmailAttachment
+}
+
+// A file attached to an email, e.g. a log export.
+type EmailAttachment struct {
+	Filename string
+	// Optional, guessed from the filename extension when empty.
+	ContentType string
+	Data        []byte
+}
+
+// Template data for the invitation and signup invitation mails.
+type InvitationMailData struct {
+	Group string
+	Link  string
+}
+
+// Template data for the signup verification mail.
+type VerificationMailData struct {
+	Link string
+}
+
+// Template data for the reset password mail.
+type ResetPasswordMailData struct {
+	Link string
+}
+
+// Template data for the removed from group mail.
+type RemovedFromGroupMailData struct {
+	Group string
+}
@@ -26,7 +26,27 @@ var (
 	ErrTxCancelled = errors.New("transaction was cancelled")
 
 	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrInvitationExpired  = errors.New("invitation link has expired")
 	ErrGenericSQL         = errors.New("generic sql error")
+	ErrDuplicate          = errors.New("duplicate entry")
+	ErrServiceInUse       = errors.New("service is in use")
+	ErrQuotaExceeded      = errors.New("monthly quota exceeded")
+	ErrSlugTaken          = errors.New("slug is taken by another group")
+	ErrGroupLimitReached  = errors.New("daily group creation limit reached")
+	ErrConflict           = errors.New("changed since it was read")
+)
+
+// role repository
+var (
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrAlreadyAssigned   = errors.New("role is already assigned to the user")
+)
+
+// log repository
+var (
+	ErrSweepRunning   = errors.New("log retention sweep is already running")
+	ErrTooManyStreams = errors.New("too many log streams open for the group")
 )
 
 // firebase service
@@ -34,7 +54,20 @@ var (
 	ErrFirebaseError = errors.New("firebase error")
 )
 
+// email service
+var (
+	ErrEmailConnection = errors.New("unable to connect to email provider")
+	ErrEmailAuth       = errors.New("email provider rejected credentials")
+	ErrEmailSend       = errors.New("error sending email")
+	ErrEmailConfig     = errors.New("invalid email configuration")
+)
+
 // token service
 var (
 	ErrInvalidToken = errors.New("invalid token")
+
+	// session tokens
+	ErrSessionExpired  = errors.New("session expired")
+	ErrSessionRevoked  = errors.New("session revoked")
+	ErrSessionNotFound = errors.New("session not found")
 )
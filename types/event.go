@@ -0,0 +1,15 @@
+package types
+
+// User lifecycle event names.
+var (
+	EVENT_USER_SIGNED_UP = "user.signed_up"
+	EVENT_USER_VERIFIED  = "user.verified"
+	EVENT_USER_DELETED   = "user.deleted"
+)
+
+// Published message for user lifecycle events, deliberately carrying no PII beyond the user id.
+type UserEvent struct {
+	Event     string `json:"event"`
+	UserId    string `json:"userId"`
+	Timestamp string `json:"timestamp"`
+}
@@ -1,3 +1,9 @@
 package types
 
-var ()
+// Basic profile of a Firebase account.
+type FirebaseUser struct {
+	UID         string `json:"uid"`
+	Email       string `json:"email"`
+	DisplayName string `json:"displayName"`
+	Disabled    bool   `json:"disabled"`
+}
@@ -0,0 +1,86 @@
+package types
+
+// Used both to add and to remove a role from a member.
+type MemberRoleBody struct {
+	UserId string `json:"userId" binding:"required"`
+	RoleId string `json:"roleId" binding:"required"`
+}
+
+type DeleteRoleBody struct {
+	RoleId string `json:"roleId" binding:"required"`
+}
+
+// Only the given fields are changed.
+type UpdateGroupBody struct {
+	// The version the changes were made on, as read from the group. Updates of a group changed since are refused.
+	// Only required with GROUP_VERSION_REQUIRED=true while clients move over.
+	Version *int `json:"version"`
+
+	Name *string `json:"name"`
+	// An empty slug removes it, renaming the group leaves it as it is.
+	Slug *string `json:"slug"`
+	// Weekly summary of the log mailed to members with ViewLogs.
+	AuditDigest *bool `json:"auditDigest"`
+}
+
+// A group named like one the user already owns is refused, e.g. after a double click, unless AllowDuplicateName is set.
+type CreateGroupBody struct {
+	Name               string `json:"name" binding:"required"`
+	AllowDuplicateName bool   `json:"allowDuplicateName"`
+}
+
+// Deprecated: Name is accepted but ignored, the invitation mail shows the group's own name.
+type InviteMemberBody struct {
+	Email   string `json:"email" binding:"required"`
+	GroupId string `json:"groupId" binding:"required"`
+	Name    string `json:"name,omitempty"`
+}
+
+// Deprecated: Name is accepted but ignored, the notification mail shows the group's own name.
+type RemoveMemberBody struct {
+	UserId  string `json:"userId" binding:"required"`
+	GroupId string `json:"groupId" binding:"required"`
+	Name    string `json:"name,omitempty"`
+}
+
+// Addresses are validated one by one, so a bad one doesn't fail the batch.
+type InviteBatchBody struct {
+	Emails []string `json:"emails" binding:"required,min=1,max=50"`
+}
+
+// A role by name and permissions, without ids, so it can be set up in another group.
+type RoleConfig struct {
+	Name string `json:"name" binding:"required,max=255"`
+
+	Permissions
+}
+
+// A group's roles, apart from "Group Owner" which every group has, and optionally its members' addresses.
+type GroupConfig struct {
+	Roles   []*RoleConfig `json:"roles" binding:"required,max=100,dive"`
+	Members []string      `json:"members,omitempty" binding:"max=50"`
+	// Who created the exported group, ignored on import.
+	CreatedBy *GroupCreator `json:"createdBy,omitempty"`
+}
+
+// Roles are created unless the group has one of the same name, members are invited, never added.
+type ImportConfigResult struct {
+	Created     []string            `json:"created"`
+	Skipped     []string            `json:"skipped"`
+	Invitations []*InvitationResult `json:"invitations,omitempty"`
+}
+
+// Outcome of inviting a single address of a batch.
+type InvitationResult struct {
+	Email        string `json:"email"`
+	Status       string `json:"status"`
+	InvitationId string `json:"invitationId,omitempty"`
+}
+
+const (
+	INVITATION_INVITED         = "invited"
+	INVITATION_ALREADY_MEMBER  = "already-member"
+	INVITATION_ALREADY_INVITED = "already-invited"
+	INVITATION_INVALID         = "invalid"
+	INVITATION_RATE_LIMITED    = "rate-limited"
+)
@@ -0,0 +1,103 @@
+package types
+
+type CheckUserBody struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// Counters of the permission cache since startup, and how many members it holds now.
+type PermissionCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+// Who a checked token belongs to, returned by the check endpoints with ?detail=true.
+type UserIdentity struct {
+	UserId   string `json:"userId"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+}
+
+// Action is the endpoint of the calling service the user wants to use, e.g. "/api/case/cis18/create".
+type StrictCheckUserBody struct {
+	Token   string `json:"token" binding:"required"`
+	GroupId string `json:"groupId" binding:"required"`
+	Action  string `json:"action" binding:"required"`
+}
+
+type LookupUsersBody struct {
+	UIDs []string `json:"uids" binding:"required,max=1000"`
+}
+
+type CreateServiceBody struct {
+	Name                string `json:"name" binding:"required,max=255"`
+	ImplementationGroup *int   `json:"implementationGroup" binding:"omitempty,min=1"`
+	Description         string `json:"description"`
+}
+
+// Limits the uses of a service, across its implementation groups, per calendar month.
+type SetQuotaBody struct {
+	MonthlyLimit *int `json:"monthlyLimit" binding:"required,min=0"`
+}
+
+// Either a number of groups per day, or no limit at all.
+type SetGroupCreationLimitBody struct {
+	DailyLimit *int `json:"dailyLimit" binding:"omitempty,min=1"`
+	Unlimited  bool `json:"unlimited"`
+}
+
+// How many groups a user may create per day, the default unless Overridden.
+type GroupCreationLimit struct {
+	UserId     string `json:"userId"`
+	DailyLimit *int   `json:"dailyLimit,omitempty"`
+	Unlimited  bool   `json:"unlimited"`
+	Overridden bool   `json:"overridden"`
+}
+
+// Only the given fields are changed, an implementationGroup of 0 removes it.
+type UpdateServiceBody struct {
+	Name                *string `json:"name" binding:"omitempty,min=1,max=255"`
+	ImplementationGroup *int    `json:"implementationGroup" binding:"omitempty,min=0"`
+	Description         *string `json:"description"`
+	Retired             *bool   `json:"retired"`
+}
+
+type MaintenanceBody struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+type InspectTokenBody struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// The outcome of each check an internal token goes through. Times covers exp, nbf and iat, each only checked when
+// the token has it.
+type TokenChecks struct {
+	Signature bool `json:"signature"`
+	Times     bool `json:"times"`
+}
+
+// Checks internal tokens don't go through (yet), for a service to see whether its tokens would pass them. Audience
+// passes when SERVICE_TOKEN_AUDIENCE isn't set, Expiry only when the token has an exp in the future.
+type TokenAdvisoryChecks struct {
+	Issuer   bool `json:"issuer"`
+	Audience bool `json:"audience"`
+	Expiry   bool `json:"expiry"`
+}
+
+// What a token carries and why it is or isn't accepted, for debugging tokens between services. Valid is exactly
+// whether the token is accepted, the advisory checks don't count towards it.
+// Claims are read without trusting them, so they're shown even when the signature is wrong.
+type TokenInspection struct {
+	Valid    bool                `json:"valid"`
+	Reason   string              `json:"reason,omitempty"`
+	Checks   TokenChecks         `json:"checks"`
+	Advisory TokenAdvisoryChecks `json:"advisory"`
+	Header   map[string]any      `json:"header,omitempty"`
+	Claims   map[string]any      `json:"claims,omitempty"`
+	// this service's clock and expectations, to spot clock skew or configuration differing between services
+	ServerTime       string `json:"serverTime"`
+	ExpectedIssuer   string `json:"expectedIssuer"`
+	ExpectedAudience string `json:"expectedAudience,omitempty"`
+}
@@ -1,5 +1,10 @@
 package types
 
+import (
+	"encoding/json"
+	"time"
+)
+
 /*
 	what was done
 	did it go through?
@@ -7,11 +12,43 @@ package types
 	when did it happen
 */
 
+// The log admin actions are written to, next to the log of the group they concern if any.
+const PLATFORM_LOG_ID = "platform"
+
+// Statuses of log entries the alert rules look at, or write.
+const (
+	LOG_STATUS_FORBIDDEN = "Forbidden"
+	// Written by the alert scan, the action being the rule that raised it.
+	LOG_STATUS_ALERT = "Alert"
+)
+
 type LogEntry struct {
-	GroupId   string `json:"groupId"`
-	Action    string `json:"action"`
-	Status    string `json:"status"` // did the action go well? transform status code to OK or smthing else
-	UserId    string `json:"-"`
-	Email     string `json:"email"`
-	Timestamp string `json:"timestamp"`
+	GroupId   string          `json:"groupId"`
+	Action    string          `json:"action"`
+	Status    string          `json:"status"` // did the action go well? transform status code to OK or smthing else
+	UserId    string          `json:"-"`
+	Email     string          `json:"email"`
+	Timestamp string          `json:"timestamp"`
+	Detail    json.RawMessage `json:"detail,omitempty"` // a JSON object, e.g. what a group was renamed from and to
+}
+
+// How often an action ended with a status, e.g. in the weekly audit digest.
+type LogSummary struct {
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Count  int    `json:"count"`
+}
+
+// Suspicious activity an alert rule found in a group's log.
+type Alert struct {
+	GroupId string
+	Rule    string
+	// who the alert is about, empty if it's about the group as a whole
+	UserId string
+	Email  string
+	// when the entry that raised it was written
+	At time.Time
+	// entries counted within Window, for the rules that count
+	Count  int
+	Window time.Duration
 }
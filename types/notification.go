@@ -0,0 +1,32 @@
+package types
+
+// Mail categories a user can opt out of. Transactional mail, like verification and password reset, has no category and is always sent.
+var (
+	NOTIFICATION_REMOVED_FROM_GROUP  = "removedFromGroup"
+	NOTIFICATION_INVITATION_ACCEPTED = "invitationAccepted"
+)
+
+// Which mail categories a user wants to receive.
+type NotificationPreferences struct {
+	RemovedFromGroup   bool `json:"removedFromGroup"`
+	InvitationAccepted bool `json:"invitationAccepted"`
+}
+
+// Default preferences, for users who haven't changed them.
+func DefaultNotificationPreferences() *NotificationPreferences {
+	return &NotificationPreferences{
+		RemovedFromGroup:   true,
+		InvitationAccepted: true,
+	}
+}
+
+// Whether the given category is enabled, unknown categories are treated as enabled.
+func (preferences *NotificationPreferences) Enabled(category string) bool {
+	switch category {
+	case NOTIFICATION_REMOVED_FROM_GROUP:
+		return preferences.RemovedFromGroup
+	case NOTIFICATION_INVITATION_ACCEPTED:
+		return preferences.InvitationAccepted
+	}
+	return true
+}
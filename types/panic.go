@@ -0,0 +1,12 @@
+package types
+
+// A panic recovered while serving a request, as handed to an error reporter.
+type PanicReport struct {
+	RequestId string `json:"requestId"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	ClientIP  string `json:"clientIP"`
+	Panic     string `json:"panic"`
+	Stack     string `json:"stack"`
+	Timestamp string `json:"timestamp"`
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of the password policy, enforced for passwords we set in Firebase ourselves.
+const (
+	PASSWORD_MIN_LENGTH = 10
+	PASSWORD_MAX_LENGTH = 128
+)
+
+// Checks a password against the policy: between PASSWORD_MIN_LENGTH and PASSWORD_MAX_LENGTH characters, with at
+// least one letter and one digit. The error describes what's missing, so it's safe to show to the user.
+func ValidatePassword(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < PASSWORD_MIN_LENGTH {
+		return fmt.Errorf("password must be at least %d characters", PASSWORD_MIN_LENGTH)
+	}
+	if length > PASSWORD_MAX_LENGTH {
+		return fmt.Errorf("password must be at most %d characters", PASSWORD_MAX_LENGTH)
+	}
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	if !letter || !digit {
+		return errors.New("password must contain a letter and a digit")
+	}
+	return nil
+}
@@ -1,11 +1,17 @@
 package types
 
+import (
+	"fmt"
+	"reflect"
+)
+
 var (
 	RENAME_GROUP = "RenameGroup"
 	DELETE_GROUP = "DeleteGroup"
 
 	INVITE_MEMBER = "InviteMember"
 	REMOVE_MEMBER = "RemoveMember"
+	MANAGE_ROLES  = "ManageRoles"
 
 	CREATE_CASE          = "CreateCase"
 	UPDATE_CASE_METADATA = "UpdateCaseMetadata"
@@ -16,17 +22,134 @@ var (
 	EXPORT_LOGS = "ExportLogs"
 )
 
+// Permission categories, used to group permissions in the role editor.
+var (
+	CATEGORY_GROUP   = "Group"
+	CATEGORY_MEMBERS = "Members"
+	CATEGORY_CASE    = "Case"
+	CATEGORY_LOGS    = "Logs"
+)
+
+// Describes a single permission. The key is also the name of the Permissions field holding it.
+type PermissionInfo struct {
+	Key         string `json:"key"`
+	DisplayName string `json:"displayName"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	// column of the role table holding the permission
+	Column string `json:"-"`
+
+	// index of the Permissions field holding the permission, resolved from the key at init
+	field int
+}
+
+// Reports whether the permission set grants this permission.
+func (permission *PermissionInfo) Granted(p *Permissions) bool {
+	return *permission.Field(p)
+}
+
+// The field of the permission set holding this permission.
+func (permission *PermissionInfo) Field(p *Permissions) *bool {
+	return reflect.ValueOf(p).Elem().Field(permission.field).Addr().Interface().(*bool)
+}
+
+// The catalogue of all known permissions, this is the single source of truth for permission keys,
+// and for the role table columns they are stored in.
+var PermissionCatalogue = []*PermissionInfo{
+	{Key: RENAME_GROUP, DisplayName: "Rename group", Category: CATEGORY_GROUP, Description: "Change the name of the group.",
+		Column: "rename_organisation"},
+	{Key: DELETE_GROUP, DisplayName: "Delete group", Category: CATEGORY_GROUP, Description: "Delete the group and all of its data.",
+		Column: "delete_organisation"},
+
+	{Key: INVITE_MEMBER, DisplayName: "Invite member", Category: CATEGORY_MEMBERS, Description: "Invite new members to the group.",
+		Column: "invite_member"},
+	{Key: REMOVE_MEMBER, DisplayName: "Remove member", Category: CATEGORY_MEMBERS, Description: "Remove members from the group.",
+		Column: "remove_member"},
+	{Key: MANAGE_ROLES, DisplayName: "Manage roles", Category: CATEGORY_MEMBERS, Description: "Define the group's roles and assign them to members.",
+		Column: "manage_roles"},
+
+	{Key: CREATE_CASE, DisplayName: "Create case", Category: CATEGORY_CASE, Description: "Create new cases within the group.",
+		Column: "create_case"},
+	{Key: UPDATE_CASE_METADATA, DisplayName: "Update case metadata", Category: CATEGORY_CASE, Description: "Change the metadata of existing cases.",
+		Column: "update_case_metadata"},
+	{Key: DELETE_CASE, DisplayName: "Delete case", Category: CATEGORY_CASE, Description: "Delete cases within the group.",
+		Column: "delete_case"},
+	{Key: EXPORT_CASE, DisplayName: "Export case", Category: CATEGORY_CASE, Description: "Export cases within the group.",
+		Column: "export_case"},
+
+	{Key: VIEW_LOGS, DisplayName: "View logs", Category: CATEGORY_LOGS, Description: "View the group's audit log.",
+		Column: "view_logs"},
+	{Key: EXPORT_LOGS, DisplayName: "Export logs", Category: CATEGORY_LOGS, Description: "Export the group's audit log.",
+		Column: "export_logs"},
+}
+
+var permissionIndex = make(map[string]*PermissionInfo)
+
+// Indexes the catalogue, and ensures it and the fields of Permissions describe the same permissions,
+// so adding a field without a catalogue entry, or the other way around, fails at startup.
+func init() {
+	fields := make(map[string]int)
+	permissionsType := reflect.TypeOf(Permissions{})
+	for i := 0; i < permissionsType.NumField(); i++ {
+		field := permissionsType.Field(i)
+		if field.Type.Kind() != reflect.Bool {
+			panic(fmt.Errorf("permission field %s is not a bool", field.Name))
+		}
+		fields[field.Name] = i
+	}
+	for _, permission := range PermissionCatalogue {
+		index, exists := fields[permission.Key]
+		if !exists {
+			panic(fmt.Errorf("permission %q has no field in Permissions", permission.Key))
+		}
+		if permission.Column == "" {
+			panic(fmt.Errorf("permission %q has no column", permission.Key))
+		}
+		if _, exists := permissionIndex[permission.Key]; exists {
+			panic(fmt.Errorf("permission %q is in the catalogue twice", permission.Key))
+		}
+		permission.field = index
+		permissionIndex[permission.Key] = permission
+	}
+	for name := range fields {
+		if _, exists := permissionIndex[name]; !exists {
+			panic(fmt.Errorf("permission field %s is missing from the catalogue", name))
+		}
+	}
+}
+
+// Looks up a permission in the catalogue by its key.
+func LookupPermission(key string) (*PermissionInfo, bool) {
+	permission, exists := permissionIndex[key]
+	return permission, exists
+}
+
+// Counts of the changes made when replacing a group's roles.
+type RoleUpdateSummary struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+}
+
 type MemberRole struct {
 	Id     string  `json:"id" binding:"required"`
 	Member string  `json:"member" binding:"required"`
+	Email  string  `json:"email"`
 	Roles  []*Role `json:"roles" binding:"required"`
 }
 
+// A role defined within a group. The owning group is always serialised as "groupId",
+// matching the name used for groups throughout the API (the database column is organisationId).
 type Role struct {
 	Id      string `json:"id" binding:"required"`
 	Name    string `json:"name" binding:"required"`
 	GroupId string `json:"groupId" binding:"required"`
 
+	Permissions
+}
+
+// The set of permissions a role grants, also used for a member's aggregated permissions within a group.
+type Permissions struct {
 	// Group
 	RenameGroup bool `json:"renameGroup"`
 	DeleteGroup bool `json:"deleteGroup"`
@@ -34,6 +157,7 @@ type Role struct {
 	// Members
 	InviteMember bool `json:"inviteMember"`
 	RemoveMember bool `json:"removeMember"`
+	ManageRoles  bool `json:"manageRoles"`
 
 	// Case
 	CreateCase         bool `json:"createCase"`
@@ -0,0 +1,84 @@
+package types
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Reads the permission constants declared in roleRepository.go, keyed by constant name.
+func permissionConstants(t *testing.T) map[string]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "roleRepository.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing roleRepository.go: %v", err)
+	}
+	constants := make(map[string]string)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			for i, name := range value.Names {
+				if strings.HasPrefix(name.Name, "CATEGORY_") || i >= len(value.Values) {
+					continue
+				}
+				literal, ok := value.Values[i].(*ast.BasicLit)
+				if !ok || literal.Kind != token.STRING {
+					continue
+				}
+				key, err := strconv.Unquote(literal.Value)
+				if err != nil {
+					t.Fatalf("unquoting %s: %v", name.Name, err)
+				}
+				constants[name.Name] = key
+			}
+		}
+	}
+	return constants
+}
+
+func TestEveryPermissionConstantHasAnAccessor(t *testing.T) {
+	constants := permissionConstants(t)
+	if len(constants) != len(PermissionCatalogue) {
+		t.Errorf("found %d permission constants, the catalogue has %d permissions", len(constants), len(PermissionCatalogue))
+	}
+	for name, key := range constants {
+		permission, exists := LookupPermission(key)
+		if !exists {
+			t.Errorf("%s (%q) is missing from the catalogue", name, key)
+			continue
+		}
+		var p Permissions
+		if permission.Granted(&p) {
+			t.Errorf("%s is granted by an empty permission set", name)
+		}
+		*permission.Field(&p) = true
+		if !permission.Granted(&p) {
+			t.Errorf("%s isn't granted after setting its field", name)
+		}
+	}
+}
+
+func TestPermissionAccessorsReadTheirOwnField(t *testing.T) {
+	for _, permission := range PermissionCatalogue {
+		var p Permissions
+		*permission.Field(&p) = true
+		for _, other := range PermissionCatalogue {
+			if granted := other.Granted(&p); granted != (other == permission) {
+				t.Errorf("setting %s made %s granted=%v", permission.Key, other.Key, granted)
+			}
+		}
+	}
+}
+
+func TestUnknownPermissionLookup(t *testing.T) {
+	if _, exists := LookupPermission("RenameGroups"); exists {
+		t.Error("a misspelled permission was found in the catalogue")
+	}
+}
@@ -0,0 +1,24 @@
+package types
+
+import "time"
+
+// A session we issued after the user signed in through firebase, the session token handed to the client carries its id.
+type Session struct {
+	Id        string
+	UserId    string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+// The claims of a session token whose signature checked out.
+type SessionClaims struct {
+	UserId    string
+	SessionId string
+	ExpiresAt time.Time
+}
+
+// Handed out by login, token verification and refresh while session tokens are enabled.
+type SessionToken struct {
+	Token     string `json:"sessionToken"`
+	ExpiresAt string `json:"expiresAt"`
+}
@@ -0,0 +1,73 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MinSlugLength = 3
+	MaxSlugLength = 63
+)
+
+// Lowercase letters and digits, in words joined by single hyphens.
+var slugPattern = regexp.MustCompile("^[a-z0-9]+(-[a-z0-9]+)*$")
+
+// Slugs a group can't take, as they'd be mistaken for a path, e.g. /api/group/list.
+var ReservedSlugs = map[string]bool{
+	"api": true, "internal": true, "admin": true,
+	"create": true, "list": true, "permissions": true, "member": true, "join": true, "reject": true,
+}
+
+// Checks the slug is fit for a URL and can't be mistaken for a group id or a path.
+func ValidateSlug(slug string) error {
+	switch {
+	case len(slug) < MinSlugLength || len(slug) > MaxSlugLength:
+		return fmt.Errorf("slug must be %d to %d characters", MinSlugLength, MaxSlugLength)
+	case !slugPattern.MatchString(slug):
+		return errors.New("slug must be lowercase letters and digits, separated by single hyphens")
+	case ReservedSlugs[slug]:
+		return fmt.Errorf("slug %q is reserved", slug)
+	case IsGroupId(slug):
+		return errors.New("slug must not be a group id")
+	}
+	return nil
+}
+
+// Whether the value is a group id rather than a slug.
+func IsGroupId(value string) bool {
+	_, err := uuid.Parse(value)
+	return err == nil
+}
+
+// Danish letters are spelled out, other letters outside a-z are dropped.
+var slugReplacer = strings.NewReplacer("æ", "ae", "ø", "oe", "å", "aa")
+
+// Derives a slug from a group name, e.g. "Acme Finance" becomes "acme-finance". Falls back to "group"
+// for names that leave no valid slug.
+func Slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range slugReplacer.Replace(strings.ToLower(name)) {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '_' || r == '.' || r == '/' || r == '&':
+			hyphen = true
+		}
+	}
+	// room for a suffix making it unique
+	slug := strings.TrimRight(b.String()[:min(b.Len(), MaxSlugLength-8)], "-")
+	if ValidateSlug(slug) != nil {
+		return "group"
+	}
+	return slug
+}
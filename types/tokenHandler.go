@@ -0,0 +1,9 @@
+package types
+
+type VerifyTokenBody struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type RefreshSessionBody struct {
+	Token string `json:"sessionToken" binding:"required"`
+}
@@ -6,6 +6,7 @@ type RegisterUserBody struct {
 }
 
 type LoginBody struct {
+	UID      string `json:"uid" binding:"required"`
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
@@ -15,4 +16,46 @@ type RegisterServiceUsedBody struct {
 	OrganisationId      string `json:"organisationId" binding:"required"`
 	ServiceName         string `json:"serviceName" binding:"required"`
 	ImplementationGroup *int   `json:"implementationGroup" binding:"required"`
+	// Optional, e.g. the id of the created case. Registering the same key twice only counts once.
+	IdempotencyKey string `json:"idempotencyKey" binding:"max=128"`
+}
+
+type StartPasswordResetBody struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordBody struct {
+	UID         string `json:"uid" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+// Signup where we create the Firebase account. Locale is optional, falling back to the request's Accept-Language.
+type SignupFullBody struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+	Name     string `json:"name" binding:"required,max=255"`
+	Locale   string `json:"locale"`
+}
+
+// Locale is optional, falling back to the request's Accept-Language.
+// InvitationId is the token of the invitation link the user signed up from, if any, which they join right away.
+type SignupEmailPasswordBody struct {
+	UID          string  `json:"uid" binding:"required"`
+	Email        string  `json:"email" binding:"required"`
+	Password     string  `json:"password" binding:"required"`
+	InvitationId *string `json:"invitationId"`
+	Locale       string  `json:"locale"`
+}
+
+// Locale is optional, falling back to the request's Accept-Language.
+type SignupProviderBody struct {
+	UID    string `json:"uid" binding:"required"`
+	Email  string `json:"email" binding:"required"`
+	Locale string `json:"locale"`
+}
+
+// Only the given categories are changed.
+type UpdateNotificationPreferencesBody struct {
+	RemovedFromGroup   *bool `json:"removedFromGroup"`
+	InvitationAccepted *bool `json:"invitationAccepted"`
 }
@@ -0,0 +1,18 @@
+package types
+
+// Webhook event names.
+var (
+	WEBHOOK_MEMBER_ADDED       = "member.added"
+	WEBHOOK_MEMBER_REMOVED     = "member.removed"
+	WEBHOOK_GROUP_DELETED      = "group.deleted"
+	WEBHOOK_GROUP_RESTORED     = "group.restored"
+	WEBHOOK_INVITATION_CREATED = "invitation.created"
+)
+
+// Body of a webhook delivery.
+type WebhookEvent struct {
+	Id        string `json:"id"`
+	Event     string `json:"event"`
+	Timestamp string `json:"timestamp"`
+	Data      any    `json:"data"`
+}